@@ -0,0 +1,201 @@
+package shadowsocks
+
+import (
+	"net/netip"
+	"strings"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+var ErrDestinationDenied = E.New("destination denied")
+
+// ACLService is implemented by services that check destinations against an ACL before calling the handler.
+// SetACL must be called before the service starts serving. A nil ACL allows all destinations.
+type ACLService interface {
+	SetACL(acl *ACL)
+}
+
+type ACLAction uint8
+
+const (
+	ACLAllow ACLAction = iota
+	ACLDeny
+)
+
+type PortRange struct {
+	Start uint16
+	End   uint16
+}
+
+// ACLRule matches destinations by all of its non-empty fields.
+// Prefixes only match IP destinations and DomainSuffixes only domain ones, a destination
+// matches if it matches either.
+type ACLRule struct {
+	Action ACLAction
+	// Network is N.NetworkTCP or N.NetworkUDP, empty matches both.
+	Network string
+	// Prefixes match IP destinations, IPv4-mapped addresses are matched as IPv4, NAT64 (64:ff9b::/96)
+	// and 6to4 (2002::/16) addresses both as themselves and as the IPv4 address they embed.
+	Prefixes []netip.Prefix
+	// DomainSuffixes match a domain and its subdomains.
+	DomainSuffixes []string
+	Ports          []PortRange
+	// Users and Groups restrict the rule to some users, it applies to all users if both are empty.
+	Users  []any
+	Groups []string
+}
+
+// PrivatePrefixes are the "this network", loopback, private, shared, benchmarking, link-local,
+// multicast and broadcast networks.
+var PrivatePrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("255.255.255.255/32"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+var (
+	nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+	sixToFour   = netip.MustParsePrefix("2002::/16")
+)
+
+// BlockPrivate returns a rule denying PrivatePrefixes and localhost to all users.
+// Domains resolving to private addresses are resolved by the handler, which should check them with ACL.Allow.
+func BlockPrivate() ACLRule {
+	return ACLRule{
+		Action:         ACLDeny,
+		Prefixes:       PrivatePrefixes,
+		DomainSuffixes: []string{"localhost"},
+	}
+}
+
+// ACL is an ordered list of rules, the first matching rule decides.
+type ACL struct {
+	rules         []aclRule
+	defaultAction ACLAction
+}
+
+type aclRule struct {
+	ACLRule
+	users map[any]struct{}
+}
+
+// NewACL creates an ACL from rules. groups maps the group names used by rules to their users,
+// destinations matching no rule get defaultAction.
+func NewACL(rules []ACLRule, groups map[string][]any, defaultAction ACLAction) *ACL {
+	acl := &ACL{
+		rules:         make([]aclRule, 0, len(rules)),
+		defaultAction: defaultAction,
+	}
+	for _, rule := range rules {
+		compiled := aclRule{ACLRule: rule}
+		if len(rule.Users) > 0 || len(rule.Groups) > 0 {
+			compiled.users = make(map[any]struct{})
+			for _, user := range rule.Users {
+				compiled.users[user] = struct{}{}
+			}
+			for _, group := range rule.Groups {
+				for _, user := range groups[group] {
+					compiled.users[user] = struct{}{}
+				}
+			}
+		}
+		compiled.DomainSuffixes = make([]string, len(rule.DomainSuffixes))
+		for i, suffix := range rule.DomainSuffixes {
+			compiled.DomainSuffixes[i] = strings.ToLower(strings.Trim(suffix, "."))
+		}
+		acl.rules = append(acl.rules, compiled)
+	}
+	return acl
+}
+
+// Allow reports whether user may reach destination over network. user is nil for services without users.
+// A nil ACL allows everything.
+func (a *ACL) Allow(network string, user any, destination M.Socksaddr) bool {
+	if a == nil {
+		return true
+	}
+	for i := range a.rules {
+		if a.rules[i].match(network, user, destination) {
+			return a.rules[i].Action == ACLAllow
+		}
+	}
+	return a.defaultAction == ACLAllow
+}
+
+func (r *aclRule) match(network string, user any, destination M.Socksaddr) bool {
+	if r.Network != "" && r.Network != network {
+		return false
+	}
+	if r.users != nil {
+		if _, loaded := r.users[user]; !loaded {
+			return false
+		}
+	}
+	if len(r.Ports) > 0 {
+		var portMatched bool
+		for _, portRange := range r.Ports {
+			if destination.Port >= portRange.Start && destination.Port <= portRange.End {
+				portMatched = true
+				break
+			}
+		}
+		if !portMatched {
+			return false
+		}
+	}
+	if len(r.Prefixes) == 0 && len(r.DomainSuffixes) == 0 {
+		return true
+	}
+	if destination.IsIP() {
+		addr := destination.Addr.Unmap()
+		if r.matchAddr(addr) {
+			return true
+		}
+		if embedded, loaded := embeddedIPv4(addr); loaded && r.matchAddr(embedded) {
+			return true
+		}
+	} else if destination.IsFqdn() {
+		domain := strings.ToLower(strings.TrimSuffix(destination.Fqdn, "."))
+		for _, suffix := range r.DomainSuffixes {
+			if domain == suffix || strings.HasSuffix(domain, suffix) && domain[len(domain)-len(suffix)-1] == '.' {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *aclRule) matchAddr(addr netip.Addr) bool {
+	for _, prefix := range r.Prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// embeddedIPv4 returns the IPv4 address embedded in a NAT64 or 6to4 address.
+func embeddedIPv4(addr netip.Addr) (netip.Addr, bool) {
+	ip := addr.As16()
+	switch {
+	case nat64Prefix.Contains(addr):
+		return netip.AddrFrom4([4]byte{ip[12], ip[13], ip[14], ip[15]}), true
+	case sixToFour.Contains(addr):
+		return netip.AddrFrom4([4]byte{ip[2], ip[3], ip[4], ip[5]}), true
+	default:
+		return netip.Addr{}, false
+	}
+}
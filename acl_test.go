@@ -0,0 +1,72 @@
+package shadowsocks_test
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/sagernet/sing-shadowsocks"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestACL(t *testing.T) {
+	t.Parallel()
+	acl := shadowsocks.NewACL([]shadowsocks.ACLRule{
+		shadowsocks.BlockPrivate(),
+		{
+			Action: shadowsocks.ACLAllow,
+			Groups: []string{"admin"},
+		},
+		{
+			Action:  shadowsocks.ACLDeny,
+			Network: N.NetworkUDP,
+			Ports:   []shadowsocks.PortRange{{Start: 6881, End: 6889}},
+		},
+		{
+			Action:         shadowsocks.ACLDeny,
+			Users:          []any{"bob"},
+			DomainSuffixes: []string{".Example.COM"},
+			Prefixes:       []netip.Prefix{netip.MustParsePrefix("8.8.8.0/24")},
+		},
+	}, map[string][]any{"admin": {"alice"}}, shadowsocks.ACLAllow)
+	denyACL := shadowsocks.NewACL(nil, nil, shadowsocks.ACLDeny)
+	for _, test := range []struct {
+		network     string
+		user        any
+		destination string
+		allow       bool
+	}{
+		{N.NetworkTCP, "alice", "127.0.0.1:80", false},
+		{N.NetworkTCP, nil, "[::ffff:192.168.1.1]:80", false},
+		{N.NetworkTCP, nil, "[fe80::1]:80", false},
+		{N.NetworkTCP, nil, "0.1.2.3:80", false},
+		{N.NetworkTCP, nil, "198.19.0.1:80", false},
+		{N.NetworkUDP, nil, "239.255.255.250:1900", false},
+		{N.NetworkUDP, nil, "[ff02::fb]:5353", false},
+		{N.NetworkTCP, nil, "[64:ff9b::10.0.0.1]:80", false},
+		{N.NetworkTCP, nil, "[64:ff9b::1.1.1.1]:80", true},
+		{N.NetworkTCP, nil, "[2002:c0a8:101::1]:80", false},
+		{N.NetworkTCP, nil, "[2002:101:101::1]:80", true},
+		{N.NetworkTCP, nil, "localhost:80", false},
+		{N.NetworkTCP, nil, "api.localhost.:80", false},
+		{N.NetworkUDP, "alice", "1.1.1.1:6881", true},
+		{N.NetworkUDP, "bob", "1.1.1.1:6881", false},
+		{N.NetworkTCP, "bob", "1.1.1.1:6881", true},
+		{N.NetworkTCP, "bob", "www.example.com:443", false},
+		{N.NetworkTCP, "bob", "example.com:443", false},
+		{N.NetworkTCP, "bob", "notexample.com:443", true},
+		{N.NetworkTCP, "bob", "8.8.8.8:53", false},
+		{N.NetworkTCP, "carol", "www.example.com:443", true},
+	} {
+		if denyACL.Allow(test.network, test.user, M.ParseSocksaddr(test.destination)) {
+			t.Fatal("default action ignored")
+		}
+		if acl.Allow(test.network, test.user, M.ParseSocksaddr(test.destination)) != test.allow {
+			t.Error("bad result for ", test.network, " ", test.user, " ", test.destination)
+		}
+	}
+	var nilACL *shadowsocks.ACL
+	if !nilACL.Allow(N.NetworkTCP, nil, M.ParseSocksaddr("127.0.0.1:80")) {
+		t.Fatal("nil ACL denied")
+	}
+}
@@ -0,0 +1,66 @@
+package shadowsocks
+
+import (
+	"context"
+
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// PacketBatchHandler is implemented by services that can process several packets with one call.
+// Packets that fail are released and reported to the service's error handler.
+type PacketBatchHandler interface {
+	NewPackets(ctx context.Context, conn N.PacketConn, buffers []*buf.Buffer, metadata []M.Metadata)
+}
+
+// PacketBatchReader reads up to len(buffers) packets with one call, returning the number read.
+type PacketBatchReader interface {
+	ReadPackets(buffers []*buf.Buffer, sources []M.Socksaddr) (n int, err error)
+}
+
+// PacketBatchWriter writes packets with one call. All buffers are released.
+type PacketBatchWriter interface {
+	WritePackets(buffers []*buf.Buffer, destinations []M.Socksaddr) error
+}
+
+// WritePackets writes buffers with one call if writer is a PacketBatchWriter,
+// or one at a time otherwise. All buffers are released.
+func WritePackets(writer N.PacketWriter, buffers []*buf.Buffer, destinations []M.Socksaddr) error {
+	if batchWriter, ok := writer.(PacketBatchWriter); ok {
+		return batchWriter.WritePackets(buffers, destinations)
+	}
+	for i, buffer := range buffers {
+		err := writer.WritePacket(buffer, destinations[i])
+		if err != nil {
+			buf.ReleaseMulti(buffers[i+1:])
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	_ N.NetPacketConn   = (*BatchPacketConn)(nil)
+	_ PacketBatchReader = (*BatchPacketConn)(nil)
+	_ PacketBatchWriter = (*BatchPacketConn)(nil)
+)
+
+func (c *BatchPacketConn) ReadPacket(buffer *buf.Buffer) (M.Socksaddr, error) {
+	n, source, err := c.ReadFromUDPAddrPort(buffer.FreeBytes())
+	if err != nil {
+		return M.Socksaddr{}, err
+	}
+	buffer.Extend(n)
+	return M.SocksaddrFromNetIP(source).Unwrap(), nil
+}
+
+func (c *BatchPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	defer buffer.Release()
+	_, err := c.WriteToUDPAddrPort(buffer.Bytes(), destination.AddrPort())
+	return err
+}
+
+func (c *BatchPacketConn) Upstream() any {
+	return c.UDPConn
+}
@@ -0,0 +1,184 @@
+package shadowsocks
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+
+	"golang.org/x/sys/unix"
+)
+
+// BatchPacketConn is a UDP connection reading and writing packets in batches with recvmmsg and sendmmsg.
+type BatchPacketConn struct {
+	*net.UDPConn
+	rawConn syscall.RawConn
+	ipv6    bool
+}
+
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+func NewBatchPacketConn(conn *net.UDPConn) (*BatchPacketConn, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var sockaddr unix.Sockaddr
+	err = rawConn.Control(func(fd uintptr) {
+		sockaddr, err = unix.Getsockname(int(fd))
+	})
+	if err != nil {
+		return nil, E.Cause(err, "getsockname")
+	}
+	_, ipv6 := sockaddr.(*unix.SockaddrInet6)
+	return &BatchPacketConn{conn, rawConn, ipv6}, nil
+}
+
+func (c *BatchPacketConn) ReadPackets(buffers []*buf.Buffer, sources []M.Socksaddr) (int, error) {
+	if len(buffers) == 0 {
+		return 0, nil
+	}
+	msgs := make([]mmsghdr, len(buffers))
+	iovecs := make([]unix.Iovec, len(buffers))
+	names := make([]unix.RawSockaddrInet6, len(buffers))
+	for i, buffer := range buffers {
+		free := buffer.FreeBytes()
+		if len(free) == 0 {
+			return 0, io.ErrShortBuffer
+		}
+		iovecs[i].Base = &free[0]
+		iovecs[i].SetLen(len(free))
+		msgs[i].hdr.Name = (*byte)(unsafe.Pointer(&names[i]))
+		msgs[i].hdr.Namelen = unix.SizeofSockaddrInet6
+		msgs[i].hdr.Iov = &iovecs[i]
+		msgs[i].hdr.SetIovlen(1)
+	}
+	n, err := c.mmsg(unix.SYS_RECVMMSG, msgs, false)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		buffers[i].Extend(int(msgs[i].len))
+		sources[i] = parseSockaddr(&names[i])
+	}
+	return n, nil
+}
+
+func (c *BatchPacketConn) WritePackets(buffers []*buf.Buffer, destinations []M.Socksaddr) error {
+	defer buf.ReleaseMulti(buffers)
+	if len(buffers) == 0 {
+		return nil
+	}
+	msgs := make([]mmsghdr, len(buffers))
+	iovecs := make([]unix.Iovec, len(buffers))
+	names := make([]unix.RawSockaddrInet6, len(buffers))
+	for i, buffer := range buffers {
+		namelen, err := putSockaddr(&names[i], destinations[i].AddrPort(), c.ipv6)
+		if err != nil {
+			return err
+		}
+		data := buffer.Bytes()
+		if len(data) > 0 {
+			iovecs[i].Base = &data[0]
+			iovecs[i].SetLen(len(data))
+		}
+		msgs[i].hdr.Name = (*byte)(unsafe.Pointer(&names[i]))
+		msgs[i].hdr.Namelen = namelen
+		msgs[i].hdr.Iov = &iovecs[i]
+		msgs[i].hdr.SetIovlen(1)
+	}
+	for sent := 0; sent < len(msgs); {
+		n, err := c.mmsg(unix.SYS_SENDMMSG, msgs[sent:], true)
+		if err != nil {
+			return err
+		}
+		sent += n
+	}
+	return nil
+}
+
+// mmsg runs a recvmmsg or sendmmsg call on msgs, waiting through the runtime poller and retrying on EINTR.
+func (c *BatchPacketConn) mmsg(trap uintptr, msgs []mmsghdr, write bool) (int, error) {
+	var (
+		n     uintptr
+		errno syscall.Errno
+	)
+	call := func(fd uintptr) bool {
+		for {
+			n, _, errno = unix.Syscall6(trap, fd, uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(msgs)), 0, 0, 0)
+			if errno != unix.EINTR {
+				break
+			}
+		}
+		return errno != unix.EAGAIN && errno != unix.EWOULDBLOCK
+	}
+	var err error
+	if write {
+		err = c.rawConn.Write(call)
+	} else {
+		err = c.rawConn.Read(call)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		if write {
+			return 0, os.NewSyscallError("sendmmsg", errno)
+		}
+		return 0, os.NewSyscallError("recvmmsg", errno)
+	}
+	return int(n), nil
+}
+
+func parseSockaddr(name *unix.RawSockaddrInet6) M.Socksaddr {
+	switch name.Family {
+	case unix.AF_INET:
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(name))
+		return M.SocksaddrFrom(netip.AddrFrom4(sa.Addr), networkPort(&sa.Port))
+	case unix.AF_INET6:
+		return M.SocksaddrFrom(netip.AddrFrom16(name.Addr), networkPort(&name.Port)).Unwrap()
+	default:
+		return M.Socksaddr{}
+	}
+}
+
+func putSockaddr(name *unix.RawSockaddrInet6, destination netip.AddrPort, ipv6 bool) (uint32, error) {
+	addr := destination.Addr()
+	if !ipv6 {
+		addr = addr.Unmap()
+		if !addr.Is4() {
+			return 0, E.New("bad destination for IPv4 socket: ", destination)
+		}
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(name))
+		sa.Family = unix.AF_INET
+		sa.Addr = addr.As4()
+		putNetworkPort(&sa.Port, destination.Port())
+		return unix.SizeofSockaddrInet4, nil
+	}
+	if !addr.IsValid() {
+		return 0, E.New("bad destination: ", destination)
+	}
+	name.Family = unix.AF_INET6
+	name.Addr = addr.As16()
+	putNetworkPort(&name.Port, destination.Port())
+	return unix.SizeofSockaddrInet6, nil
+}
+
+func networkPort(port *uint16) uint16 {
+	b := (*[2]byte)(unsafe.Pointer(port))
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+func putNetworkPort(port *uint16, value uint16) {
+	b := (*[2]byte)(unsafe.Pointer(port))
+	b[0], b[1] = byte(value>>8), byte(value)
+}
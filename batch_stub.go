@@ -0,0 +1,48 @@
+//go:build !linux
+
+package shadowsocks
+
+import (
+	"io"
+	"net"
+
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// BatchPacketConn is a UDP connection with the batch interfaces, reading and writing one packet at a time
+// on platforms without recvmmsg and sendmmsg.
+type BatchPacketConn struct {
+	*net.UDPConn
+}
+
+func NewBatchPacketConn(conn *net.UDPConn) (*BatchPacketConn, error) {
+	return &BatchPacketConn{conn}, nil
+}
+
+// ReadPackets reads one packet per call.
+func (c *BatchPacketConn) ReadPackets(buffers []*buf.Buffer, sources []M.Socksaddr) (int, error) {
+	if len(buffers) == 0 {
+		return 0, nil
+	}
+	if buffers[0].FreeLen() == 0 {
+		return 0, io.ErrShortBuffer
+	}
+	source, err := c.ReadPacket(buffers[0])
+	if err != nil {
+		return 0, err
+	}
+	sources[0] = source
+	return 1, nil
+}
+
+func (c *BatchPacketConn) WritePackets(buffers []*buf.Buffer, destinations []M.Socksaddr) error {
+	for i, buffer := range buffers {
+		err := c.WritePacket(buffer, destinations[i])
+		if err != nil {
+			buf.ReleaseMulti(buffers[i+1:])
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package shadowsocks_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+func TestBatchPacketConn(t *testing.T) {
+	t.Parallel()
+	const count = 8
+	for _, network := range []string{"udp4", "udp"} {
+		t.Run(network, func(t *testing.T) {
+			server := listenBatch(t, network)
+			defer server.Close()
+			client := listenBatch(t, network)
+			defer client.Close()
+			serverAddr := M.SocksaddrFromNet(server.LocalAddr())
+			clientAddr := M.SocksaddrFromNet(client.LocalAddr())
+
+			buffers := make([]*buf.Buffer, count)
+			destinations := make([]M.Socksaddr, count)
+			for i := range buffers {
+				buffers[i] = buf.As([]byte("packet " + strconv.Itoa(i)))
+				destinations[i] = serverAddr
+			}
+			err := client.WritePackets(buffers, destinations)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			server.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var received int
+			for received < count {
+				buffers = make([]*buf.Buffer, count)
+				for i := range buffers {
+					buffers[i] = buf.NewPacket()
+				}
+				sources := make([]M.Socksaddr, count)
+				n, err := server.ReadPackets(buffers, sources)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := 0; i < n; i++ {
+					if expected := "packet " + strconv.Itoa(received); string(buffers[i].Bytes()) != expected {
+						t.Fatal("expected ", expected, ", got ", string(buffers[i].Bytes()))
+					}
+					if sources[i].Port != clientAddr.Port {
+						t.Fatal("bad source: ", sources[i])
+					}
+					received++
+				}
+				buf.ReleaseMulti(buffers)
+			}
+		})
+	}
+}
+
+func TestBatchPacketConnFullBuffer(t *testing.T) {
+	t.Parallel()
+	conn := listenBatch(t, "udp4")
+	defer conn.Close()
+	buffers := []*buf.Buffer{buf.NewPacket(), buf.As(make([]byte, 0))}
+	defer buf.ReleaseMulti(buffers)
+	_, err := conn.ReadPackets(buffers, make([]M.Socksaddr, len(buffers)))
+	if !errors.Is(err, io.ErrShortBuffer) {
+		t.Fatal("expected short buffer, got ", err)
+	}
+}
+
+func listenBatch(t *testing.T, network string) *shadowsocks.BatchPacketConn {
+	address := "127.0.0.1:0"
+	if network == "udp" {
+		address = "[::1]:0"
+	}
+	udpConn, err := net.ListenUDP(network, M.ParseSocksaddr(address).UDPAddr())
+	if err != nil {
+		t.Skip(err)
+	}
+	conn, err := shadowsocks.NewBatchPacketConn(udpConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
@@ -4,11 +4,13 @@ go 1.18
 
 require (
 	github.com/sagernet/sing v0.2.18
+	github.com/shadowsocks/go-shadowsocks2 v0.1.5
 	golang.org/x/crypto v0.16.0
+	golang.org/x/sys v0.15.0
 	lukechampine.com/blake3 v1.2.1
 )
 
 require (
 	github.com/klauspost/cpuid/v2 v2.0.12 // indirect
-	golang.org/x/sys v0.15.0 // indirect
+	github.com/riobard/go-bloom v0.0.0-20200614022211-cdc8013cb5b3 // indirect
 )
@@ -0,0 +1,203 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	F "github.com/sagernet/sing/common/format"
+)
+
+var ErrHandshakeOverloaded = E.New("too many handshakes in flight")
+
+type HandshakeReason uint8
+
+const (
+	ReasonUnknown HandshakeReason = iota
+	// ReasonReadFailed means the peer closed or failed before a complete header was read.
+	ReasonReadFailed
+	// ReasonBadHeader means the header was truncated or had an unexpected type or length.
+	ReasonBadHeader
+	// ReasonDecryptFailed means an AEAD tag did not authenticate.
+	ReasonDecryptFailed
+	// ReasonReplay means the salt or packet id was already seen.
+	ReasonReplay
+	// ReasonBadTimestamp means the client clock is too far from the server clock.
+	ReasonBadTimestamp
+	// ReasonUnknownUser means no configured user matched the request.
+	ReasonUnknownUser
+	// ReasonBadPadding means the padding was missing or damaged.
+	ReasonBadPadding
+	// ReasonBadAddress means the destination address could not be parsed.
+	ReasonBadAddress
+	// ReasonRateLimited means the user opened connections faster than allowed.
+	ReasonRateLimited
+	// ReasonTimeout means the request was not read within the handshake timeout.
+	ReasonTimeout
+	// ReasonOverloaded means no handshake slot freed up in time.
+	ReasonOverloaded
+	// ReasonDenied means the destination was denied by the ACL.
+	ReasonDenied
+)
+
+func (r HandshakeReason) String() string {
+	switch r {
+	case ReasonReadFailed:
+		return "read failed"
+	case ReasonBadHeader:
+		return "bad header"
+	case ReasonDecryptFailed:
+		return "decrypt failed"
+	case ReasonReplay:
+		return "replay"
+	case ReasonBadTimestamp:
+		return "bad timestamp"
+	case ReasonUnknownUser:
+		return "unknown user"
+	case ReasonBadPadding:
+		return "bad padding"
+	case ReasonBadAddress:
+		return "bad address"
+	case ReasonRateLimited:
+		return "rate limited"
+	case ReasonTimeout:
+		return "timeout"
+	case ReasonOverloaded:
+		return "overloaded"
+	case ReasonDenied:
+		return "denied"
+	default:
+		return "unknown"
+	}
+}
+
+// HandshakeError reports why a request was rejected and how many bytes were read before.
+// errors.Is matches both the wrapped cause and any HandshakeError with the same Reason.
+type HandshakeError struct {
+	Reason   HandshakeReason
+	Consumed int
+	Cause    error
+}
+
+func NewHandshakeError(reason HandshakeReason, consumed int, cause error) error {
+	return &HandshakeError{reason, consumed, cause}
+}
+
+func (e *HandshakeError) Error() string {
+	return F.ToString("handshake: ", e.Reason, " after ", e.Consumed, " bytes: ", e.Cause)
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Cause
+}
+
+func (e *HandshakeError) Is(target error) bool {
+	targetError, isHandshakeError := target.(*HandshakeError)
+	return isHandshakeError && targetError.Reason == e.Reason
+}
+
+// HandshakeReasonOf returns the reason of the first HandshakeError in err's chain.
+func HandshakeReasonOf(err error) HandshakeReason {
+	var handshakeError *HandshakeError
+	if errors.As(err, &handshakeError) {
+		return handshakeError.Reason
+	}
+	return ReasonUnknown
+}
+
+// ReadReason returns ReasonTimeout for deadline errors, ReasonReadFailed for errors caused by the peer
+// going away and fallback otherwise.
+func ReadReason(err error, fallback HandshakeReason) HandshakeReason {
+	var netError interface{ Timeout() bool }
+	if errors.As(err, &netError) && netError.Timeout() {
+		return ReasonTimeout
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.ErrClosedPipe) || netError != nil {
+		return ReasonReadFailed
+	}
+	return fallback
+}
+
+// HandshakeReader counts the bytes read from a connection during the handshake.
+type HandshakeReader struct {
+	io.Reader
+	Consumed int
+}
+
+func (r *HandshakeReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	r.Consumed += n
+	return
+}
+
+// HandshakeService is implemented by services that bound the handshakes of incoming connections.
+// The setters must be called before the service starts serving.
+type HandshakeService interface {
+	// SetHandshakeTimeout bounds the time to read a request up to the end of its padding.
+	// Zero disables the deadline.
+	SetHandshakeTimeout(timeout time.Duration)
+	// SetHandshakeLimit bounds the number of handshakes in flight. A handshake over the limit waits
+	// up to queueTimeout for a slot and is rejected with ReasonOverloaded after. Zero means unbounded.
+	SetHandshakeLimit(limit int, queueTimeout time.Duration)
+}
+
+// HandshakeLimiter applies the handshake timeout and in-flight limit of a service.
+// The zero value applies neither.
+type HandshakeLimiter struct {
+	timeout      time.Duration
+	queueTimeout time.Duration
+	slots        chan struct{}
+}
+
+func (l *HandshakeLimiter) SetHandshakeTimeout(timeout time.Duration) {
+	l.timeout = timeout
+}
+
+func (l *HandshakeLimiter) SetHandshakeLimit(limit int, queueTimeout time.Duration) {
+	if limit > 0 {
+		l.slots = make(chan struct{}, limit)
+	} else {
+		l.slots = nil
+	}
+	l.queueTimeout = queueTimeout
+}
+
+// Start takes a handshake slot and sets the read deadline of conn. A nil error must be followed by Finish.
+func (l *HandshakeLimiter) Start(ctx context.Context, conn net.Conn) error {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			if l.queueTimeout <= 0 {
+				return NewHandshakeError(ReasonOverloaded, 0, ErrHandshakeOverloaded)
+			}
+			timer := time.NewTimer(l.queueTimeout)
+			select {
+			case l.slots <- struct{}{}:
+				timer.Stop()
+			case <-timer.C:
+				return NewHandshakeError(ReasonOverloaded, 0, ErrHandshakeOverloaded)
+			case <-ctx.Done():
+				timer.Stop()
+				return NewHandshakeError(ReasonOverloaded, 0, ctx.Err())
+			}
+		}
+	}
+	if l.timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(l.timeout))
+	}
+	return nil
+}
+
+// Finish clears the read deadline set by Start and frees the slot.
+func (l *HandshakeLimiter) Finish(conn net.Conn) {
+	if l.timeout > 0 {
+		conn.SetReadDeadline(time.Time{})
+	}
+	if l.slots != nil {
+		<-l.slots
+	}
+}
@@ -0,0 +1,131 @@
+// Package vectortest holds the helpers shared by the test vectors of the cipher packages.
+package vectortest
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+var (
+	Request  = []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	Response = []byte("HTTP/1.1 204 No Content\r\n\r\n")
+)
+
+// Check compares actual with the hex encoded expected vector.
+func Check(t *testing.T, name string, expected string, actual []byte) {
+	t.Helper()
+	if expected != hex.EncodeToString(actual) {
+		t.Fatalf("%s: expected %s, got %x", name, expected, actual)
+	}
+}
+
+func DecodeHex(t *testing.T, content string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func HexReader(t *testing.T, content string) io.Reader {
+	t.Helper()
+	return bytes.NewReader(DecodeHex(t, content))
+}
+
+// Handler answers Request to Destination with Response, over TCP or UDP. Done, if not nil,
+// is closed once the packet connection has been answered.
+type Handler struct {
+	T           *testing.T
+	Destination M.Socksaddr
+	Done        chan struct{}
+}
+
+func (h *Handler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	if metadata.Destination != h.Destination {
+		return E.New("bad destination: ", metadata.Destination)
+	}
+	request := make([]byte, len(Request))
+	_, err := io.ReadFull(conn, request)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(request, Request) {
+		return E.New("bad request: ", string(request))
+	}
+	_, err = conn.Write(Response)
+	return err
+}
+
+func (h *Handler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	defer close(h.Done)
+	buffer := buf.NewPacket()
+	defer buffer.Release()
+	destination, err := conn.ReadPacket(buffer)
+	if err != nil {
+		h.T.Error(err)
+		return nil
+	}
+	if destination != h.Destination || !bytes.Equal(buffer.Bytes(), Request) {
+		h.T.Errorf("udp request: decoded %q to %s", buffer.Bytes(), destination)
+		return nil
+	}
+	response := buf.NewPacket()
+	response.Resize(2048, 0)
+	common.Must1(response.Write(Response))
+	err = conn.WritePacket(response, destination)
+	if err != nil {
+		h.T.Error(err)
+	}
+	return nil
+}
+
+func (h *Handler) NewError(ctx context.Context, err error) {
+	h.T.Error(err)
+}
+
+// BufferPacketConn keeps the last packet written to it and reads nothing.
+type BufferPacketConn struct {
+	Packet []byte
+}
+
+func (c *BufferPacketConn) ReadPacket(buffer *buf.Buffer) (M.Socksaddr, error) {
+	return M.Socksaddr{}, io.EOF
+}
+
+func (c *BufferPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	c.Packet = append(c.Packet[:0], buffer.Bytes()...)
+	buffer.Release()
+	return nil
+}
+
+func (c *BufferPacketConn) Close() error {
+	return nil
+}
+
+func (c *BufferPacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{}
+}
+
+func (c *BufferPacketConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *BufferPacketConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *BufferPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
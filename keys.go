@@ -0,0 +1,44 @@
+package shadowsocks
+
+import (
+	"context"
+	"time"
+)
+
+// KeyService is implemented by services that accept several server keys at once, or identity PSKs
+// for multi-user services. Keys are tried in order, so a rotation replaces the primary key
+// and keeps the previous one as a secondary until clients are migrated.
+type KeyService interface {
+	// UpdateKeys replaces the accepted keys, the first one becomes the primary key returned by Password.
+	// It may be called while the service is serving.
+	UpdateKeys(keys []ServerKey) error
+}
+
+// ServerKey is a key accepted by a service, or one of the keys of a user.
+type ServerKey struct {
+	// Key is the raw key. If it is empty, the key is derived from Password as in the constructors.
+	Key      []byte
+	Password string
+	// NotBefore and NotAfter bound when the key is accepted, the zero time leaves its side open.
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// Active reports whether the key is accepted at now.
+func (k ServerKey) Active(now time.Time) bool {
+	return (k.NotBefore.IsZero() || !now.Before(k.NotBefore)) && (k.NotAfter.IsZero() || now.Before(k.NotAfter))
+}
+
+type keyIndexKey struct{}
+
+// ContextWithKeyIndex returns a context carrying the index of the user key a connection or UDP session
+// was authenticated with, 0 being the primary key.
+func ContextWithKeyIndex(ctx context.Context, index int) context.Context {
+	return context.WithValue(ctx, keyIndexKey{}, index)
+}
+
+// KeyIndexFromContext returns the index stored by ContextWithKeyIndex.
+func KeyIndexFromContext(ctx context.Context) (int, bool) {
+	index, loaded := ctx.Value(keyIndexKey{}).(int)
+	return index, loaded
+}
@@ -0,0 +1,102 @@
+package shadowsocks
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/x/list"
+)
+
+var ErrServiceClosed = E.New("service closed")
+
+// ShutdownService is implemented by services that can be torn down.
+type ShutdownService interface {
+	// Close rejects new connections and packets, and closes open connections and UDP sessions.
+	Close() error
+	// Shutdown rejects new connections and packets, waits for open connections to finish until ctx is done,
+	// then closes the remaining ones and all UDP sessions. It returns ctx.Err() if connections were cut.
+	Shutdown(ctx context.Context) (ShutdownStats, error)
+}
+
+// ShutdownStats reports what a shutdown closed.
+type ShutdownStats struct {
+	// Drained counts connections that finished on their own during the shutdown.
+	Drained int
+	// Cut counts connections closed by the service.
+	Cut int
+	// Sessions counts UDP sessions closed by the service.
+	Sessions int
+}
+
+// Lifecycle tracks the open connections of a service and whether it has been shut down.
+type Lifecycle struct {
+	closed  int32
+	access  sync.Mutex
+	conns   list.List[net.Conn]
+	drained chan struct{}
+}
+
+// Acquire registers conn until Release, or fails with ErrServiceClosed after a shutdown started.
+func (l *Lifecycle) Acquire(conn net.Conn) (*list.Element[net.Conn], error) {
+	l.access.Lock()
+	defer l.access.Unlock()
+	if l.closed != 0 {
+		return nil, ErrServiceClosed
+	}
+	return l.conns.PushBack(conn), nil
+}
+
+func (l *Lifecycle) Release(element *list.Element[net.Conn]) {
+	l.access.Lock()
+	defer l.access.Unlock()
+	l.conns.Remove(element)
+	if l.drained != nil && l.conns.Len() == 0 {
+		close(l.drained)
+		l.drained = nil
+	}
+}
+
+// Closed reports whether a shutdown started. It does not lock, packet handlers check it on every packet.
+func (l *Lifecycle) Closed() bool {
+	return atomic.LoadInt32(&l.closed) != 0
+}
+
+// Shutdown waits for registered connections to be released until ctx is done, then closes the remaining ones.
+func (l *Lifecycle) Shutdown(ctx context.Context) (stats ShutdownStats, err error) {
+	l.access.Lock()
+	atomic.StoreInt32(&l.closed, 1)
+	open := l.conns.Len()
+	if open == 0 {
+		l.access.Unlock()
+		return
+	}
+	drained := make(chan struct{})
+	l.drained = drained
+	l.access.Unlock()
+	select {
+	case <-drained:
+		stats.Drained = open
+		return
+	case <-ctx.Done():
+	}
+	stats.Cut = l.Close()
+	stats.Drained = open - stats.Cut
+	if stats.Cut > 0 {
+		err = ctx.Err()
+	}
+	return
+}
+
+// Close closes all registered connections and returns how many there were.
+func (l *Lifecycle) Close() int {
+	l.access.Lock()
+	defer l.access.Unlock()
+	atomic.StoreInt32(&l.closed, 1)
+	for element := l.conns.Front(); element != nil; element = element.Next() {
+		element.Value.Close()
+	}
+	return l.conns.Len()
+}
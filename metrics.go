@@ -0,0 +1,88 @@
+package shadowsocks
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/udpnat"
+)
+
+// Metrics receives protocol events from services.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	HandshakeAccepted(method string)
+	HandshakeRejected(method string, err error)
+	ConnectionOpened(method string)
+	ConnectionClosed(method string)
+	PacketSessionOpened(method string)
+	PacketSessionClosed(method string)
+	ReadBytes(method string, n int64)
+	WriteBytes(method string, n int64)
+	ClockSkew(method string, skew time.Duration)
+	UserLookup(method string, duration time.Duration)
+}
+
+// MetricsService is implemented by services that accept a metrics collector.
+// SetMetrics must be called before the service starts serving.
+type MetricsService interface {
+	SetMetrics(metrics Metrics)
+}
+
+func NewMetricsConn(conn net.Conn, method string, metrics Metrics) net.Conn {
+	metrics.ConnectionOpened(method)
+	return &metricsConn{
+		CounterConn: bufio.NewCounterConn(conn, []N.CountFunc{func(n int64) {
+			metrics.ReadBytes(method, n)
+		}}, []N.CountFunc{func(n int64) {
+			metrics.WriteBytes(method, n)
+		}}),
+		method:  method,
+		metrics: metrics,
+	}
+}
+
+type metricsConn struct {
+	*bufio.CounterConn
+	method    string
+	metrics   Metrics
+	closeOnce sync.Once
+}
+
+func (c *metricsConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.metrics.ConnectionClosed(c.method)
+	})
+	return c.CounterConn.Close()
+}
+
+func (c *metricsConn) Upstream() any {
+	return c.CounterConn
+}
+
+// MetricsUDPHandler wraps the handler of an UDP NAT to track packet sessions.
+type MetricsUDPHandler struct {
+	udpnat.Handler
+	Method  string
+	Metrics Metrics
+}
+
+func NewMetricsUDPHandler(method string, handler udpnat.Handler) *MetricsUDPHandler {
+	return &MetricsUDPHandler{
+		Handler: handler,
+		Method:  method,
+	}
+}
+
+func (h *MetricsUDPHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	if h.Metrics == nil {
+		return h.Handler.NewPacketConnection(ctx, conn, metadata)
+	}
+	h.Metrics.PacketSessionOpened(h.Method)
+	defer h.Metrics.PacketSessionClosed(h.Method)
+	return h.Handler.NewPacketConnection(ctx, conn, metadata)
+}
@@ -4,12 +4,13 @@ import (
 	"context"
 	"net"
 	"net/netip"
+	"time"
 
 	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
-	"github.com/sagernet/sing/common/udpnat"
 )
 
 const MethodNone = "none"
@@ -137,7 +138,7 @@ func (c *nonePacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	if err != nil {
 		return
 	}
-	buffer := buf.With(p[:n])
+	buffer := buf.As(p[:n])
 	destination, err := M.SocksaddrSerializer.ReadAddrPort(buffer)
 	if err != nil {
 		return
@@ -163,6 +164,10 @@ func (c *nonePacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	if err != nil {
 		return
 	}
+	_, err = c.Write(buffer.Bytes())
+	if err != nil {
+		return
+	}
 	return len(p), nil
 }
 
@@ -171,18 +176,45 @@ func (c *nonePacketConn) Headroom() int {
 }
 
 type NoneService struct {
-	handler Handler
-	udpNat  *udpnat.Service[netip.AddrPort]
+	*UDPServer[netip.AddrPort]
+	handler    Handler
+	udpHandler *MetricsUDPHandler
+	udpNat     *UDPNAT[netip.AddrPort]
+	metrics    Metrics
+	handshake  HandshakeLimiter
+	lifecycle  Lifecycle
+	registry   SessionRegistry
+	acl        *ACL
 }
 
 func NewNoneService(udpTimeout int64, handler Handler) Service {
 	s := &NoneService{
-		handler: handler,
+		handler:    handler,
+		udpHandler: NewMetricsUDPHandler(MethodNone, handler),
 	}
-	s.udpNat = udpnat.New[netip.AddrPort](udpTimeout, handler)
+	s.udpNat = NewUDPNAT[netip.AddrPort](udpTimeout, s.udpHandler, HashAddrPort)
+	s.udpNat.SetSessionRegistry(&s.registry)
+	s.UDPServer = NewUDPServer[netip.AddrPort](MethodNone, handler, s.udpNat, &s.lifecycle, &s.metrics)
 	return s
 }
 
+func (s *NoneService) SetHandshakeTimeout(timeout time.Duration) {
+	s.handshake.SetHandshakeTimeout(timeout)
+}
+
+func (s *NoneService) SetHandshakeLimit(limit int, queueTimeout time.Duration) {
+	s.handshake.SetHandshakeLimit(limit, queueTimeout)
+}
+
+func (s *NoneService) SetACL(acl *ACL) {
+	s.acl = acl
+}
+
+func (s *NoneService) SetMetrics(metrics Metrics) {
+	s.metrics = metrics
+	s.udpHandler.Metrics = metrics
+}
+
 func (s *NoneService) Name() string {
 	return MethodNone
 }
@@ -191,38 +223,114 @@ func (s *NoneService) Password() string {
 	return ""
 }
 
+func (s *NoneService) Sessions() []SessionInfo {
+	return s.registry.Sessions()
+}
+
+func (s *NoneService) UserSessions(user any) []SessionInfo {
+	return s.registry.UserSessions(user)
+}
+
+func (s *NoneService) CloseSession(id uint64) bool {
+	return s.registry.CloseSession(id)
+}
+
+func (s *NoneService) CloseUserSessions(user any) int {
+	return s.registry.CloseUserSessions(user)
+}
+
+func (s *NoneService) Close() error {
+	s.lifecycle.Close()
+	s.udpNat.Close()
+	return nil
+}
+
+func (s *NoneService) Shutdown(ctx context.Context) (ShutdownStats, error) {
+	stats, err := s.lifecycle.Shutdown(ctx)
+	stats.Sessions = s.udpNat.Close()
+	return stats, err
+}
+
 func (s *NoneService) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
-	destination, err := M.SocksaddrSerializer.ReadAddrPort(conn)
+	element, err := s.lifecycle.Acquire(conn)
 	if err != nil {
+		return &ServerConnError{Conn: conn, Source: metadata.Source, Cause: err}
+	}
+	defer s.lifecycle.Release(element)
+	destination, err := s.readDestination(ctx, conn)
+	if err != nil {
+		if s.metrics != nil {
+			s.metrics.HandshakeRejected(MethodNone, err)
+		}
 		return err
 	}
 	metadata.Protocol = "shadowsocks"
 	metadata.Destination = destination
-	return s.handler.NewConnection(ctx, conn, metadata)
+	session := s.registry.Register(N.NetworkTCP, nil, metadata, conn)
+	defer session.Unregister()
+	if s.metrics != nil {
+		s.metrics.HandshakeAccepted(MethodNone)
+		conn = NewMetricsConn(conn, MethodNone, s.metrics)
+	}
+	return s.handler.NewConnection(ctx, session.Conn(conn), metadata)
+}
+
+func (s *NoneService) readDestination(ctx context.Context, conn net.Conn) (M.Socksaddr, error) {
+	err := s.handshake.Start(ctx, conn)
+	if err != nil {
+		return M.Socksaddr{}, err
+	}
+	defer s.handshake.Finish(conn)
+	handshakeReader := &HandshakeReader{Reader: conn}
+	destination, err := M.SocksaddrSerializer.ReadAddrPort(handshakeReader)
+	if err != nil {
+		return M.Socksaddr{}, NewHandshakeError(ReadReason(err, ReasonBadAddress), handshakeReader.Consumed, err)
+	}
+	if !s.acl.Allow(N.NetworkTCP, nil, destination) {
+		return M.Socksaddr{}, NewHandshakeError(ReasonDenied, handshakeReader.Consumed, E.Extend(ErrDestinationDenied, destination))
+	}
+	return destination, nil
 }
 
 func (s *NoneService) WriteIsThreadUnsafe() {
 }
 
 func (s *NoneService) NewPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
+	return s.ServePacket(metadata, func() error {
+		return s.newPacket(ctx, conn, buffer, metadata)
+	})
+}
+
+func (s *NoneService) newPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
+	packetLen := buffer.Len()
 	destination, err := M.SocksaddrSerializer.ReadAddrPort(buffer)
 	if err != nil {
-		return err
+		return NewHandshakeError(ReasonBadAddress, packetLen, err)
+	}
+	if !s.acl.Allow(N.NetworkUDP, nil, destination) {
+		return NewHandshakeError(ReasonDenied, packetLen, E.Extend(ErrDestinationDenied, destination))
 	}
 	metadata.Protocol = "shadowsocks"
 	metadata.Destination = destination
+	if s.metrics != nil {
+		s.metrics.ReadBytes(MethodNone, int64(buffer.Len()))
+	}
 	s.udpNat.NewPacket(ctx, metadata.Source.AddrPort(), buffer, metadata, func(natConn N.PacketConn) N.PacketWriter {
-		return &nonePacketWriter{conn, natConn}
+		return &nonePacketWriter{conn, natConn, s.metrics}
 	})
 	return nil
 }
 
 type nonePacketWriter struct {
-	source N.PacketConn
-	nat    N.PacketConn
+	source  N.PacketConn
+	nat     N.PacketConn
+	metrics Metrics
 }
 
 func (w *nonePacketWriter) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	if w.metrics != nil {
+		w.metrics.WriteBytes(MethodNone, int64(buffer.Len()))
+	}
 	header := buf.With(buffer.ExtendHeader(M.SocksaddrSerializer.AddrPortLen(destination)))
 	err := M.SocksaddrSerializer.WriteAddrPort(header, destination)
 	if err != nil {
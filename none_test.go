@@ -0,0 +1,229 @@
+package shadowsocks_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func FuzzNoneServiceNewConnection(f *testing.F) {
+	for _, destination := range []string{"test.com:443", "1.1.1.1:53", "[::1]:80"} {
+		conn := &bufferConn{}
+		_, err := shadowsocks.NewNone().DialConn(conn, M.ParseSocksaddr(destination))
+		if err != nil {
+			f.Fatal(err)
+		}
+		conn.writer.WriteString("hello")
+		f.Add(conn.writer.Bytes())
+	}
+	service := shadowsocks.NewNoneService(60, &discardHandler{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		service.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(data)}, M.Metadata{})
+	})
+}
+
+func FuzzNoneServiceNewPacket(f *testing.F) {
+	for _, destination := range []string{"test.com:443", "1.1.1.1:53", "[::1]:80"} {
+		conn := &bufferConn{}
+		_, err := shadowsocks.NewNone().DialPacketConn(conn).WriteTo([]byte("hello"), M.ParseSocksaddr(destination))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(conn.writer.Bytes())
+	}
+	service := shadowsocks.NewNoneService(60, &discardHandler{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		buffer := buf.NewSize(len(data))
+		buffer.Write(data)
+		service.NewPacket(context.Background(), nil, buffer, M.Metadata{})
+	})
+}
+
+func BenchmarkNoneServiceNewConnection(b *testing.B) {
+	service := shadowsocks.NewNoneService(60, &benchmarkHandler{})
+	conn := &bufferConn{}
+	_, err := shadowsocks.NewNone().DialEarlyConn(conn, M.ParseSocksaddr("test.com:443")).Write([]byte("hello"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	request := conn.writer.Bytes()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = service.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNoneServiceNewPacket(b *testing.B) {
+	service := shadowsocks.NewNoneService(60, &discardHandler{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	packet := nonePacket(b)
+	b.SetBytes(int64(len(packet)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buffer := buf.NewPacket()
+		buffer.Write(packet)
+		err := service.NewPacket(ctx, nil, buffer, M.Metadata{})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNoneServiceWritePacket(b *testing.B) {
+	handler := &benchmarkHandler{conns: make(chan N.PacketConn, 1)}
+	service := shadowsocks.NewNoneService(60, handler)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := service.NewPacket(ctx, &discardPacketConn{}, buf.As(nonePacket(b)), M.Metadata{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn := <-handler.conns
+	destination := M.ParseSocksaddr("test.com:443")
+	payload := make([]byte, 1024)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buffer := buf.NewPacket()
+		buffer.Resize(256, 0)
+		buffer.Write(payload)
+		err = conn.WritePacket(buffer, destination)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func nonePacket(t testing.TB) []byte {
+	conn := &bufferConn{}
+	_, err := shadowsocks.NewNone().DialPacketConn(conn).WriteTo(make([]byte, 1024), M.ParseSocksaddr("test.com:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn.writer.Bytes()
+}
+
+type bufferConn struct {
+	reader io.Reader
+	writer bytes.Buffer
+}
+
+func (c *bufferConn) Read(p []byte) (n int, err error) {
+	if c.reader == nil {
+		return 0, io.EOF
+	}
+	return c.reader.Read(p)
+}
+
+func (c *bufferConn) Write(p []byte) (n int, err error) {
+	return c.writer.Write(p)
+}
+
+func (c *bufferConn) Close() error {
+	return nil
+}
+
+func (c *bufferConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *bufferConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *bufferConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *bufferConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *bufferConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type discardHandler struct{}
+
+func (h *discardHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	_, err := io.Copy(io.Discard, conn)
+	return err
+}
+
+func (h *discardHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	for {
+		buffer := buf.NewPacket()
+		_, err := conn.ReadPacket(buffer)
+		buffer.Release()
+		if errors.Is(err, io.ErrClosedPipe) {
+			return nil
+		}
+	}
+}
+
+func (h *discardHandler) NewError(ctx context.Context, err error) {
+}
+
+// benchmarkHandler returns as soon as the handshake is done, and hands out the first packet connection
+// holding it until the context is done.
+type benchmarkHandler struct {
+	discardHandler
+	conns chan N.PacketConn
+}
+
+func (h *benchmarkHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	return nil
+}
+
+func (h *benchmarkHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	h.conns <- conn
+	<-ctx.Done()
+	return nil
+}
+
+type discardPacketConn struct{}
+
+func (c *discardPacketConn) ReadPacket(buffer *buf.Buffer) (M.Socksaddr, error) {
+	return M.Socksaddr{}, io.EOF
+}
+
+func (c *discardPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	buffer.Release()
+	return nil
+}
+
+func (c *discardPacketConn) Close() error {
+	return nil
+}
+
+func (c *discardPacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{}
+}
+
+func (c *discardPacketConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *discardPacketConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *discardPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
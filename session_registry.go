@@ -0,0 +1,162 @@
+package shadowsocks
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// SessionService is implemented by services that keep a registry of their open TCP connections and UDP sessions.
+type SessionService interface {
+	Sessions() []SessionInfo
+	// UserSessions returns the sessions of user, which must be of the user type of the service.
+	UserSessions(user any) []SessionInfo
+	// CloseSession closes the session with id and reports whether it was open.
+	CloseSession(id uint64) bool
+	// CloseUserSessions closes all sessions of user and returns how many there were.
+	CloseUserSessions(user any) int
+}
+
+// SessionInfo describes an open TCP connection or UDP session.
+type SessionInfo struct {
+	ID          uint64
+	Network     string
+	User        any
+	Source      M.Socksaddr
+	Destination M.Socksaddr
+	Start       time.Time
+	// KeyIndex is the index of the user key the session was authenticated with, 0 being the primary key.
+	KeyIndex int
+	// ReadBytes counts payload bytes received from the client.
+	ReadBytes uint64
+	// WriteBytes counts payload bytes sent to the client.
+	WriteBytes uint64
+}
+
+// SessionRegistry tracks the open sessions of a service. The zero value is ready to use.
+type SessionRegistry struct {
+	lastID   uint64
+	access   sync.RWMutex
+	sessions map[uint64]*RegisteredSession
+}
+
+// RegisteredSession is an entry of a SessionRegistry.
+type RegisteredSession struct {
+	readBytes  uint64
+	writeBytes uint64
+
+	registry *SessionRegistry
+	closer   io.Closer
+	info     SessionInfo
+}
+
+// Register adds a session that CloseSession and CloseUserSessions terminate by closing closer.
+// user is nil for services without users.
+func (r *SessionRegistry) Register(network string, user any, metadata M.Metadata, closer io.Closer) *RegisteredSession {
+	return r.RegisterKey(network, user, 0, metadata, closer)
+}
+
+// RegisterKey is Register for users with several keys, keyIndex is the key the session was authenticated with.
+func (r *SessionRegistry) RegisterKey(network string, user any, keyIndex int, metadata M.Metadata, closer io.Closer) *RegisteredSession {
+	session := &RegisteredSession{
+		registry: r,
+		closer:   closer,
+		info: SessionInfo{
+			ID:          atomic.AddUint64(&r.lastID, 1),
+			Network:     network,
+			User:        user,
+			Source:      metadata.Source,
+			Destination: metadata.Destination,
+			Start:       time.Now(),
+			KeyIndex:    keyIndex,
+		},
+	}
+	r.access.Lock()
+	if r.sessions == nil {
+		r.sessions = make(map[uint64]*RegisteredSession)
+	}
+	r.sessions[session.info.ID] = session
+	r.access.Unlock()
+	return session
+}
+
+func (r *SessionRegistry) Sessions() []SessionInfo {
+	r.access.RLock()
+	defer r.access.RUnlock()
+	sessions := make([]SessionInfo, 0, len(r.sessions))
+	for _, session := range r.sessions {
+		sessions = append(sessions, session.Info())
+	}
+	return sessions
+}
+
+func (r *SessionRegistry) UserSessions(user any) []SessionInfo {
+	r.access.RLock()
+	defer r.access.RUnlock()
+	var sessions []SessionInfo
+	for _, session := range r.sessions {
+		if session.info.User == user {
+			sessions = append(sessions, session.Info())
+		}
+	}
+	return sessions
+}
+
+func (r *SessionRegistry) CloseSession(id uint64) bool {
+	r.access.RLock()
+	session, loaded := r.sessions[id]
+	r.access.RUnlock()
+	if !loaded {
+		return false
+	}
+	session.closer.Close()
+	return true
+}
+
+func (r *SessionRegistry) CloseUserSessions(user any) int {
+	var closers []io.Closer
+	r.access.RLock()
+	for _, session := range r.sessions {
+		if session.info.User == user {
+			closers = append(closers, session.closer)
+		}
+	}
+	r.access.RUnlock()
+	for _, closer := range closers {
+		closer.Close()
+	}
+	return len(closers)
+}
+
+// Unregister removes the session once it is finished.
+func (s *RegisteredSession) Unregister() {
+	s.registry.access.Lock()
+	delete(s.registry.sessions, s.info.ID)
+	s.registry.access.Unlock()
+}
+
+func (s *RegisteredSession) Info() SessionInfo {
+	info := s.info
+	info.ReadBytes = atomic.LoadUint64(&s.readBytes)
+	info.WriteBytes = atomic.LoadUint64(&s.writeBytes)
+	return info
+}
+
+func (s *RegisteredSession) CountRead(n int64) {
+	atomic.AddUint64(&s.readBytes, uint64(n))
+}
+
+func (s *RegisteredSession) CountWrite(n int64) {
+	atomic.AddUint64(&s.writeBytes, uint64(n))
+}
+
+// Conn wraps the protocol conn of the session to count its bytes.
+func (s *RegisteredSession) Conn(conn net.Conn) net.Conn {
+	return bufio.NewCounterConn(conn, []N.CountFunc{s.CountRead}, []N.CountFunc{s.CountWrite})
+}
@@ -0,0 +1,226 @@
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/x/list"
+)
+
+// SessionTable is a map of packet sessions that expire when idle, sharded by key so that packets
+// handled on different cores rarely contend on the same lock.
+// A positive size limit evicts the least recently used session of a full shard.
+type SessionTable[K comparable, V comparable] struct {
+	expired uint64
+	evicted uint64
+
+	shards   []sessionShard[K, V]
+	mask     uint64
+	hash     func(K) uint64
+	maxAge   int64
+	maxShard int
+	onEvict  func(key K, value V)
+}
+
+type sessionShard[K comparable, V comparable] struct {
+	access  sync.Mutex
+	entries map[K]*list.Element[*sessionEntry[K, V]]
+	lru     list.List[*sessionEntry[K, V]]
+	_       [64]byte
+}
+
+type sessionEntry[K comparable, V comparable] struct {
+	key     K
+	value   V
+	expires int64
+}
+
+// NewSessionTable creates a table of sessions that expire after maxAge seconds without use.
+// maxSize bounds the number of sessions, zero means unbounded. onEvict, if not nil, is called
+// with the shard locked for sessions removed by expiry, by the size limit or by Clear, not for deleted ones.
+func NewSessionTable[K comparable, V comparable](hash func(K) uint64, maxAge int64, maxSize int, onEvict func(key K, value V)) *SessionTable[K, V] {
+	shardCount := 1
+	for shardCount < runtime.GOMAXPROCS(0)*4 && shardCount < 256 {
+		shardCount <<= 1
+	}
+	if maxSize > 0 {
+		for shardCount > 1 && shardCount > maxSize {
+			shardCount >>= 1
+		}
+	}
+	t := &SessionTable[K, V]{
+		shards:   make([]sessionShard[K, V], shardCount),
+		mask:     uint64(shardCount - 1),
+		hash:     hash,
+		maxAge:   maxAge,
+		maxShard: maxSize / shardCount,
+		onEvict:  onEvict,
+	}
+	for i := range t.shards {
+		t.shards[i].entries = make(map[K]*list.Element[*sessionEntry[K, V]])
+	}
+	return t
+}
+
+func (t *SessionTable[K, V]) shard(key K) *sessionShard[K, V] {
+	return &t.shards[t.hash(key)&t.mask]
+}
+
+// Load returns the session of key and refreshes its age.
+func (t *SessionTable[K, V]) Load(key K) (V, bool) {
+	shard := t.shard(key)
+	now := time.Now().Unix()
+	shard.access.Lock()
+	defer shard.access.Unlock()
+	t.purge(shard, now)
+	element, loaded := shard.entries[key]
+	if !loaded {
+		return common.DefaultValue[V](), false
+	}
+	t.touch(shard, element, now)
+	return element.Value.value, true
+}
+
+// LoadOrStore returns the session of key, creating it with constructor if there is none.
+// The constructor is called with the shard locked.
+func (t *SessionTable[K, V]) LoadOrStore(key K, constructor func() V) (V, bool) {
+	shard := t.shard(key)
+	now := time.Now().Unix()
+	shard.access.Lock()
+	defer shard.access.Unlock()
+	t.purge(shard, now)
+	element, loaded := shard.entries[key]
+	if loaded {
+		t.touch(shard, element, now)
+		return element.Value.value, true
+	}
+	if t.maxShard > 0 {
+		for shard.lru.Len() >= t.maxShard {
+			t.remove(shard, shard.lru.Front(), &t.evicted)
+		}
+	}
+	value := constructor()
+	shard.entries[key] = shard.lru.PushBack(&sessionEntry[K, V]{key: key, value: value, expires: now + t.maxAge})
+	return value, false
+}
+
+// Delete removes the session of key.
+func (t *SessionTable[K, V]) Delete(key K) {
+	shard := t.shard(key)
+	shard.access.Lock()
+	defer shard.access.Unlock()
+	element, loaded := shard.entries[key]
+	if loaded {
+		shard.lru.Remove(element)
+		delete(shard.entries, key)
+	}
+}
+
+// CompareAndDelete removes the session of key if it is still value.
+func (t *SessionTable[K, V]) CompareAndDelete(key K, value V) bool {
+	shard := t.shard(key)
+	shard.access.Lock()
+	defer shard.access.Unlock()
+	element, loaded := shard.entries[key]
+	if !loaded || element.Value.value != value {
+		return false
+	}
+	shard.lru.Remove(element)
+	delete(shard.entries, key)
+	return true
+}
+
+// Clear removes all sessions and returns how many there were.
+func (t *SessionTable[K, V]) Clear() int {
+	var n int
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.access.Lock()
+		for element := shard.lru.Front(); element != nil; element = shard.lru.Front() {
+			entry := shard.lru.Remove(element)
+			delete(shard.entries, entry.key)
+			if t.onEvict != nil {
+				t.onEvict(entry.key, entry.value)
+			}
+			n++
+		}
+		shard.access.Unlock()
+	}
+	return n
+}
+
+// PurgeExpired removes the expired sessions of all shards, including those no packet reaches anymore.
+func (t *SessionTable[K, V]) PurgeExpired() {
+	if t.maxAge == 0 {
+		return
+	}
+	now := time.Now().Unix()
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.access.Lock()
+		t.purge(shard, now)
+		shard.access.Unlock()
+	}
+}
+
+// Len returns the number of sessions, including expired ones not yet removed.
+func (t *SessionTable[K, V]) Len() int {
+	var n int
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.access.Lock()
+		n += shard.lru.Len()
+		shard.access.Unlock()
+	}
+	return n
+}
+
+// Expired returns the number of sessions removed after being idle for too long.
+func (t *SessionTable[K, V]) Expired() uint64 {
+	return atomic.LoadUint64(&t.expired)
+}
+
+// Evicted returns the number of sessions removed to stay within the size limit.
+func (t *SessionTable[K, V]) Evicted() uint64 {
+	return atomic.LoadUint64(&t.evicted)
+}
+
+// purge removes the expired sessions at the front of shard, which is ordered by expiry.
+func (t *SessionTable[K, V]) purge(shard *sessionShard[K, V], now int64) {
+	if t.maxAge == 0 {
+		return
+	}
+	for front := shard.lru.Front(); front != nil && front.Value.expires <= now; front = shard.lru.Front() {
+		t.remove(shard, front, &t.expired)
+	}
+}
+
+func (t *SessionTable[K, V]) touch(shard *sessionShard[K, V], element *list.Element[*sessionEntry[K, V]], now int64) {
+	shard.lru.MoveToBack(element)
+	element.Value.expires = now + t.maxAge
+}
+
+func (t *SessionTable[K, V]) remove(shard *sessionShard[K, V], element *list.Element[*sessionEntry[K, V]], counter *uint64) {
+	entry := shard.lru.Remove(element)
+	delete(shard.entries, entry.key)
+	atomic.AddUint64(counter, 1)
+	if t.onEvict != nil {
+		t.onEvict(entry.key, entry.value)
+	}
+}
+
+// HashUint64 spreads random or sequential IDs, such as 2022 session IDs, over the shards of a SessionTable.
+func HashUint64(id uint64) uint64 {
+	return id * 0x9e3779b97f4a7c15 >> 32
+}
+
+// HashAddrPort hashes a source address for a SessionTable.
+func HashAddrPort(addrPort netip.AddrPort) uint64 {
+	addr := addrPort.Addr().As16()
+	return HashUint64(binary.BigEndian.Uint64(addr[:8]) ^ binary.BigEndian.Uint64(addr[8:]) ^ uint64(addrPort.Port()))
+}
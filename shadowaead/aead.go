@@ -6,7 +6,9 @@ import (
 	"io"
 	"sync"
 
+	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
 )
 
 // https://shadowsocks.org/en/wiki/AEAD-Ciphers.html
@@ -22,30 +24,42 @@ const (
 	Overhead = 16
 )
 
+var ErrBadChunkLength = E.New("bad chunk length")
+
+// Reader decrypts a stream of AEAD chunks.
+// Chunk buffers are borrowed from a pool only while a chunk is being read or holds unread data,
+// so an idle reader keeps no more than its length chunk.
 type Reader struct {
-	upstream io.Reader
-	cipher   cipher.AEAD
-	buffer   []byte
-	nonce    []byte
-	index    int
-	cached   int
+	upstream     io.Reader
+	cipher       cipher.AEAD
+	buffer       []byte
+	chunk        *chunkBuffer
+	raw          bool
+	maxChunkSize int
+	lengthChunk  [PacketLengthBufferSize + Overhead]byte
+	nonce        []byte
+	index        int
+	cached       int
 }
 
 func NewReader(upstream io.Reader, cipher cipher.AEAD, maxPacketSize int) *Reader {
 	return &Reader{
-		upstream: upstream,
-		cipher:   cipher,
-		buffer:   make([]byte, maxPacketSize+Overhead),
-		nonce:    make([]byte, cipher.NonceSize()),
+		upstream:     upstream,
+		cipher:       cipher,
+		maxChunkSize: maxPacketSize + Overhead,
+		nonce:        make([]byte, cipher.NonceSize()),
 	}
 }
 
+// NewRawReader creates a reader decrypting into buffer, which it keeps for its lifetime.
 func NewRawReader(upstream io.Reader, cipher cipher.AEAD, buffer []byte, nonce []byte) *Reader {
 	return &Reader{
-		upstream: upstream,
-		cipher:   cipher,
-		buffer:   buffer,
-		nonce:    nonce,
+		upstream:     upstream,
+		cipher:       cipher,
+		buffer:       buffer,
+		raw:          true,
+		maxChunkSize: len(buffer),
+		nonce:        nonce,
 	}
 }
 
@@ -53,37 +67,50 @@ func (r *Reader) Upstream() any {
 	return r.upstream
 }
 
+// acquire makes r.buffer large enough for a chunk with a payload of length bytes.
+func (r *Reader) acquire(length int) []byte {
+	if r.raw || r.chunk != nil && len(r.chunk.data) >= length+Overhead {
+		return r.buffer
+	}
+	r.release()
+	r.chunk = getChunkBuffer(length)
+	r.buffer = r.chunk.data
+	return r.buffer
+}
+
+// release returns the chunk buffer once no unread data is left in it.
+func (r *Reader) release() {
+	if r.chunk == nil {
+		return
+	}
+	putChunkBuffer(r.chunk)
+	r.chunk = nil
+	r.buffer = nil
+}
+
 func (r *Reader) WriteTo(writer io.Writer) (n int64, err error) {
 	if r.cached > 0 {
 		writeN, writeErr := writer.Write(r.buffer[r.index : r.index+r.cached])
+		r.cached = 0
+		r.release()
 		if writeErr != nil {
 			return int64(writeN), writeErr
 		}
 		n += int64(writeN)
 	}
 	for {
-		start := PacketLengthBufferSize + Overhead
-		_, err = io.ReadFull(r.upstream, r.buffer[:start])
+		var length int
+		length, err = r.readLength()
 		if err != nil {
 			return
 		}
-		_, err = r.cipher.Open(r.buffer[:0], r.nonce, r.buffer[:start], nil)
+		err = r.readChunk(length)
 		if err != nil {
 			return
 		}
-		increaseNonce(r.nonce)
-		length := int(binary.BigEndian.Uint16(r.buffer[:PacketLengthBufferSize]))
-		end := length + Overhead
-		_, err = io.ReadFull(r.upstream, r.buffer[:end])
-		if err != nil {
-			return
-		}
-		_, err = r.cipher.Open(r.buffer[:0], r.nonce, r.buffer[:end], nil)
-		if err != nil {
-			return
-		}
-		increaseNonce(r.nonce)
 		writeN, writeErr := writer.Write(r.buffer[:length])
+		r.cached = 0
+		r.release()
 		if writeErr != nil {
 			return int64(writeN), writeErr
 		}
@@ -91,25 +118,39 @@ func (r *Reader) WriteTo(writer io.Writer) (n int64, err error) {
 	}
 }
 
-func (r *Reader) readInternal() (err error) {
-	start := PacketLengthBufferSize + Overhead
-	_, err = io.ReadFull(r.upstream, r.buffer[:start])
+// readLength reads and opens the length chunk in place.
+func (r *Reader) readLength() (int, error) {
+	_, err := io.ReadFull(r.upstream, r.lengthChunk[:])
 	if err != nil {
-		return err
+		return 0, err
 	}
-	_, err = r.cipher.Open(r.buffer[:0], r.nonce, r.buffer[:start], nil)
+	return r.openLength(r.lengthChunk[:])
+}
+
+func (r *Reader) openLength(lengthChunk []byte) (int, error) {
+	_, err := r.cipher.Open(r.lengthChunk[:0], r.nonce, lengthChunk, nil)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	increaseNonce(r.nonce)
-	length := int(binary.BigEndian.Uint16(r.buffer[:PacketLengthBufferSize]))
+	length := int(binary.BigEndian.Uint16(r.lengthChunk[:PacketLengthBufferSize]))
+	if length+Overhead > r.maxChunkSize {
+		return 0, ErrBadChunkLength
+	}
+	return length, nil
+}
+
+// readChunk reads and opens a chunk with a payload of length bytes into r.buffer.
+func (r *Reader) readChunk(length int) error {
 	end := length + Overhead
-	_, err = io.ReadFull(r.upstream, r.buffer[:end])
-	if err != nil {
-		return err
+	buffer := r.acquire(length)
+	_, err := io.ReadFull(r.upstream, buffer[:end])
+	if err == nil {
+		_, err = r.cipher.Open(buffer[:0], r.nonce, buffer[:end], nil)
 	}
-	_, err = r.cipher.Open(r.buffer[:0], r.nonce, r.buffer[:end], nil)
 	if err != nil {
+		r.cached = 0
+		r.release()
 		return err
 	}
 	increaseNonce(r.nonce)
@@ -118,17 +159,28 @@ func (r *Reader) readInternal() (err error) {
 	return nil
 }
 
+func (r *Reader) readInternal() error {
+	length, err := r.readLength()
+	if err != nil {
+		return err
+	}
+	return r.readChunk(length)
+}
+
 func (r *Reader) ReadByte() (byte, error) {
-	if r.cached == 0 {
+	for r.cached == 0 {
 		err := r.readInternal()
 		if err != nil {
 			return 0, err
 		}
 	}
-	index := r.index
+	b := r.buffer[r.index]
 	r.index++
 	r.cached--
-	return r.buffer[index], nil
+	if r.cached == 0 {
+		r.release()
+	}
+	return b, nil
 }
 
 func (r *Reader) Read(b []byte) (n int, err error) {
@@ -136,21 +188,16 @@ func (r *Reader) Read(b []byte) (n int, err error) {
 		n = copy(b, r.buffer[r.index:r.index+r.cached])
 		r.cached -= n
 		r.index += n
+		if r.cached == 0 {
+			r.release()
+		}
 		return
 	}
-	start := PacketLengthBufferSize + Overhead
-	_, err = io.ReadFull(r.upstream, r.buffer[:start])
-	if err != nil {
-		return 0, err
-	}
-	_, err = r.cipher.Open(r.buffer[:0], r.nonce, r.buffer[:start], nil)
+	length, err := r.readLength()
 	if err != nil {
 		return 0, err
 	}
-	increaseNonce(r.nonce)
-	length := int(binary.BigEndian.Uint16(r.buffer[:PacketLengthBufferSize]))
 	end := length + Overhead
-
 	if len(b) >= end {
 		data := b[:end]
 		_, err = io.ReadFull(r.upstream, data)
@@ -164,18 +211,16 @@ func (r *Reader) Read(b []byte) (n int, err error) {
 		increaseNonce(r.nonce)
 		return length, nil
 	} else {
-		_, err = io.ReadFull(r.upstream, r.buffer[:end])
-		if err != nil {
-			return 0, err
-		}
-		_, err = r.cipher.Open(r.buffer[:0], r.nonce, r.buffer[:end], nil)
+		err = r.readChunk(length)
 		if err != nil {
 			return 0, err
 		}
-		increaseNonce(r.nonce)
 		n = copy(b, r.buffer[:length])
 		r.cached = length - n
 		r.index = n
+		if r.cached == 0 {
+			r.release()
+		}
 		return
 	}
 }
@@ -185,11 +230,15 @@ func (r *Reader) Discard(n int) error {
 		if r.cached >= n {
 			r.cached -= n
 			r.index += n
+			if r.cached == 0 {
+				r.release()
+			}
 			return nil
 		} else if r.cached > 0 {
 			n -= r.cached
 			r.cached = 0
 			r.index = 0
+			r.release()
 		}
 		err := r.readInternal()
 		if err != nil {
@@ -198,69 +247,66 @@ func (r *Reader) Discard(n int) error {
 	}
 }
 
+// ReadBuffer opens the next chunk straight into the free space of buffer when it fits.
+func (r *Reader) ReadBuffer(buffer *buf.Buffer) error {
+	n, err := r.Read(buffer.FreeBytes())
+	if err != nil {
+		return err
+	}
+	buffer.Extend(n)
+	return nil
+}
+
+// Buffer returns a copy of the unread data, since the chunk buffer goes back to the pool once drained.
 func (r *Reader) Buffer() *buf.Buffer {
-	buffer := buf.With(r.buffer)
-	buffer.Resize(r.index, r.cached)
-	return buffer
+	if r.cached == 0 {
+		return buf.As(nil)
+	}
+	return buf.As(append([]byte(nil), r.buffer[r.index:r.index+r.cached]...))
 }
 
 func (r *Reader) Cached() int {
 	return r.cached
 }
 
+// CachedSlice returns the unread data, valid until the next read.
 func (r *Reader) CachedSlice() []byte {
 	return r.buffer[r.index : r.index+r.cached]
 }
 
 func (r *Reader) ReadWithLengthChunk(lengthChunk []byte) error {
-	_, err := r.cipher.Open(r.buffer[:0], r.nonce, lengthChunk, nil)
+	length, err := r.openLength(lengthChunk)
 	if err != nil {
 		return err
 	}
-	increaseNonce(r.nonce)
-	length := int(binary.BigEndian.Uint16(r.buffer[:PacketLengthBufferSize]))
-	end := length + Overhead
-	_, err = io.ReadFull(r.upstream, r.buffer[:end])
-	if err != nil {
-		return err
-	}
-	_, err = r.cipher.Open(r.buffer[:0], r.nonce, r.buffer[:end], nil)
-	if err != nil {
-		return err
-	}
-	increaseNonce(r.nonce)
-	r.cached = length
-	r.index = 0
-	return nil
+	return r.readChunk(length)
 }
 
 func (r *Reader) ReadWithLength(length uint16) error {
-	end := int(length) + Overhead
-	_, err := io.ReadFull(r.upstream, r.buffer[:end])
-	if err != nil {
-		return err
-	}
-	_, err = r.cipher.Open(r.buffer[:0], r.nonce, r.buffer[:end], nil)
-	if err != nil {
-		return err
+	if int(length)+Overhead > r.maxChunkSize {
+		return ErrBadChunkLength
 	}
-	increaseNonce(r.nonce)
-	r.cached = int(length)
-	r.index = 0
-	return nil
+	return r.readChunk(int(length))
 }
 
 func (r *Reader) ReadExternalChunk(chunk []byte) error {
-	bb, err := r.cipher.Open(r.buffer[:0], r.nonce, chunk, nil)
+	buffer := r.acquire(len(chunk))
+	bb, err := r.cipher.Open(buffer[:0], r.nonce, chunk, nil)
 	if err != nil {
+		r.cached = 0
+		r.release()
 		return err
 	}
 	increaseNonce(r.nonce)
 	r.cached = len(bb)
 	r.index = 0
+	if r.cached == 0 {
+		r.release()
+	}
 	return nil
 }
 
+// ReadChunk opens chunk into the free space of buffer, leaving the chunk buffer of the reader alone.
 func (r *Reader) ReadChunk(buffer *buf.Buffer, chunk []byte) error {
 	bb, err := r.cipher.Open(buffer.Index(buffer.Len()), r.nonce, chunk, nil)
 	if err != nil {
@@ -271,11 +317,16 @@ func (r *Reader) ReadChunk(buffer *buf.Buffer, chunk []byte) error {
 	return nil
 }
 
+// Writer encrypts a stream into AEAD chunks.
+// Chunk buffers are borrowed from a pool for each write and returned when it completes;
+// the header buffer returned by Buffer is held until the BufferedWriter is flushed.
 type Writer struct {
 	upstream      io.Writer
 	cipher        cipher.AEAD
 	maxPacketSize int
 	buffer        []byte
+	chunk         *chunkBuffer
+	raw           bool
 	nonce         []byte
 	access        sync.Mutex
 }
@@ -284,18 +335,19 @@ func NewWriter(upstream io.Writer, cipher cipher.AEAD, maxPacketSize int) *Write
 	return &Writer{
 		upstream:      upstream,
 		cipher:        cipher,
-		buffer:        make([]byte, maxPacketSize+PacketLengthBufferSize+Overhead*2),
 		nonce:         make([]byte, cipher.NonceSize()),
 		maxPacketSize: maxPacketSize,
 	}
 }
 
+// NewRawWriter creates a writer encrypting into buffer, which it keeps for its lifetime.
 func NewRawWriter(upstream io.Writer, cipher cipher.AEAD, maxPacketSize int, buffer []byte, nonce []byte) *Writer {
 	return &Writer{
 		upstream:      upstream,
 		cipher:        cipher,
 		maxPacketSize: maxPacketSize,
 		buffer:        buffer,
+		raw:           true,
 		nonce:         nonce,
 	}
 }
@@ -304,23 +356,58 @@ func (w *Writer) Upstream() any {
 	return w.upstream
 }
 
+// borrow returns a buffer for chunks with payloads of up to payloadLen bytes.
+// The chunk is nil for raw writers, which use their own buffer.
+func (w *Writer) borrow(payloadLen int) (*chunkBuffer, []byte) {
+	if w.raw {
+		return nil, w.buffer
+	}
+	if payloadLen > w.maxPacketSize {
+		payloadLen = w.maxPacketSize
+	}
+	chunk := getChunkBuffer(payloadLen)
+	return chunk, chunk.data
+}
+
+func (w *Writer) giveBack(chunk *chunkBuffer) {
+	if chunk != nil {
+		putChunkBuffer(chunk)
+	}
+}
+
+// ReadFrom borrows a chunk buffer for each read of r. While r looks idle it reads into the smallest
+// chunk class, and it asks for a full chunk only after a read filled the previous one, so a copy
+// blocked on an idle r holds a few hundred bytes.
 func (w *Writer) ReadFrom(r io.Reader) (n int64, err error) {
+	idleSize := 1 << minChunkClass
+	if idleSize > w.maxPacketSize {
+		idleSize = w.maxPacketSize
+	}
+	readSize := idleSize
 	for {
+		chunk, buffer := w.borrow(readSize)
 		offset := Overhead + PacketLengthBufferSize
-		readN, readErr := r.Read(w.buffer[offset : offset+w.maxPacketSize])
+		readN, readErr := r.Read(buffer[offset : offset+readSize])
 		if readErr != nil {
+			w.giveBack(chunk)
 			return 0, readErr
 		}
-		binary.BigEndian.PutUint16(w.buffer[:PacketLengthBufferSize], uint16(readN))
-		w.cipher.Seal(w.buffer[:0], w.nonce, w.buffer[:PacketLengthBufferSize], nil)
+		binary.BigEndian.PutUint16(buffer[:PacketLengthBufferSize], uint16(readN))
+		w.cipher.Seal(buffer[:0], w.nonce, buffer[:PacketLengthBufferSize], nil)
 		increaseNonce(w.nonce)
-		packet := w.cipher.Seal(w.buffer[offset:offset], w.nonce, w.buffer[offset:offset+readN], nil)
+		packet := w.cipher.Seal(buffer[offset:offset], w.nonce, buffer[offset:offset+readN], nil)
 		increaseNonce(w.nonce)
-		_, err = w.upstream.Write(w.buffer[:offset+len(packet)])
+		_, err = w.upstream.Write(buffer[:offset+len(packet)])
+		w.giveBack(chunk)
 		if err != nil {
 			return
 		}
 		n += int64(readN)
+		if readN == readSize {
+			readSize = w.maxPacketSize
+		} else {
+			readSize = idleSize
+		}
 	}
 }
 
@@ -328,6 +415,8 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 	if len(p) == 0 {
 		return
 	}
+	chunk, buffer := w.borrow(len(p))
+	defer w.giveBack(chunk)
 
 	for pLen := len(p); pLen > 0; {
 		var data []byte
@@ -340,14 +429,14 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 			pLen = 0
 		}
 		w.access.Lock()
-		binary.BigEndian.PutUint16(w.buffer[:PacketLengthBufferSize], uint16(len(data)))
-		w.cipher.Seal(w.buffer[:0], w.nonce, w.buffer[:PacketLengthBufferSize], nil)
+		binary.BigEndian.PutUint16(buffer[:PacketLengthBufferSize], uint16(len(data)))
+		w.cipher.Seal(buffer[:0], w.nonce, buffer[:PacketLengthBufferSize], nil)
 		increaseNonce(w.nonce)
 		offset := Overhead + PacketLengthBufferSize
-		packet := w.cipher.Seal(w.buffer[offset:offset], w.nonce, data, nil)
+		packet := w.cipher.Seal(buffer[offset:offset], w.nonce, data, nil)
 		increaseNonce(w.nonce)
 		w.access.Unlock()
-		_, err = w.upstream.Write(w.buffer[:offset+len(packet)])
+		_, err = w.upstream.Write(buffer[:offset+len(packet)])
 		if err != nil {
 			return
 		}
@@ -359,42 +448,102 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 
 func (w *Writer) WriteVectorised(buffers []*buf.Buffer) error {
 	defer buf.ReleaseMulti(buffers)
+	chunk, buffer := w.borrow(buf.LenMulti(buffers) + len(buffers)*chunkSlack)
+	defer w.giveBack(chunk)
 	var index int
 	var err error
-	for _, buffer := range buffers {
-		pLen := buffer.Len()
+	for _, data := range buffers {
+		pLen := data.Len()
 		if pLen > w.maxPacketSize {
-			_, err = w.Write(buffer.Bytes())
+			if index > 0 {
+				_, err = w.upstream.Write(buffer[:index])
+				index = 0
+				if err != nil {
+					return err
+				}
+			}
+			_, err = w.Write(data.Bytes())
 			if err != nil {
 				return err
 			}
 		} else {
-			if cap(w.buffer) < index+PacketLengthBufferSize+pLen+2*Overhead {
-				_, err = w.upstream.Write(w.buffer[:index])
+			if len(buffer) < index+PacketLengthBufferSize+pLen+2*Overhead {
+				_, err = w.upstream.Write(buffer[:index])
 				index = 0
 				if err != nil {
 					return err
 				}
 			}
 			w.access.Lock()
-			binary.BigEndian.PutUint16(w.buffer[index:index+PacketLengthBufferSize], uint16(pLen))
-			w.cipher.Seal(w.buffer[index:index], w.nonce, w.buffer[index:index+PacketLengthBufferSize], nil)
+			binary.BigEndian.PutUint16(buffer[index:index+PacketLengthBufferSize], uint16(pLen))
+			w.cipher.Seal(buffer[index:index], w.nonce, buffer[index:index+PacketLengthBufferSize], nil)
 			increaseNonce(w.nonce)
 			offset := index + Overhead + PacketLengthBufferSize
-			w.cipher.Seal(w.buffer[offset:offset], w.nonce, buffer.Bytes(), nil)
+			w.cipher.Seal(buffer[offset:offset], w.nonce, data.Bytes(), nil)
 			increaseNonce(w.nonce)
 			w.access.Unlock()
 			index = offset + pLen + Overhead
 		}
 	}
 	if index > 0 {
-		_, err = w.upstream.Write(w.buffer[:index])
+		_, err = w.upstream.Write(buffer[:index])
 	}
 	return err
 }
 
+// WriteBuffer seals buffer in place when it has room for the length chunk in front and the tag behind,
+// and falls back to Write otherwise.
+func (w *Writer) WriteBuffer(buffer *buf.Buffer) error {
+	defer buffer.Release()
+	dataLen := buffer.Len()
+	if dataLen == 0 {
+		return nil
+	}
+	if dataLen > w.maxPacketSize || buffer.Start() < PacketLengthBufferSize+Overhead || buffer.FreeLen() < Overhead {
+		return common.Error(w.Write(buffer.Bytes()))
+	}
+	header := buffer.ExtendHeader(PacketLengthBufferSize + Overhead)
+	payload := buffer.From(PacketLengthBufferSize + Overhead)
+	w.access.Lock()
+	binary.BigEndian.PutUint16(header[:PacketLengthBufferSize], uint16(dataLen))
+	w.cipher.Seal(header[:0], w.nonce, header[:PacketLengthBufferSize], nil)
+	increaseNonce(w.nonce)
+	w.cipher.Seal(payload[:0], w.nonce, payload, nil)
+	increaseNonce(w.nonce)
+	w.access.Unlock()
+	buffer.Extend(Overhead)
+	return common.Error(w.upstream.Write(buffer.Bytes()))
+}
+
+func (w *Writer) FrontHeadroom() int {
+	return PacketLengthBufferSize + Overhead
+}
+
+func (w *Writer) RearHeadroom() int {
+	return Overhead
+}
+
+// headerBuffer borrows the buffer shared by Buffer and BufferedWriter until the next flush.
+func (w *Writer) headerBuffer() []byte {
+	if w.buffer == nil {
+		w.chunk = getChunkBuffer(w.maxPacketSize)
+		w.buffer = w.chunk.data[:w.maxPacketSize+chunkSlack]
+	}
+	return w.buffer
+}
+
+func (w *Writer) releaseHeaderBuffer() {
+	if w.chunk == nil {
+		return
+	}
+	putChunkBuffer(w.chunk)
+	w.chunk = nil
+	w.buffer = nil
+}
+
+// Buffer returns the buffer for the handshake header, held until the BufferedWriter is flushed.
 func (w *Writer) Buffer() *buf.Buffer {
-	return buf.With(w.buffer)
+	return buf.With(w.headerBuffer())
 }
 
 func (w *Writer) WriteChunk(buffer *buf.Buffer, chunk []byte) {
@@ -407,20 +556,23 @@ func (w *Writer) BufferedWriter(reversed int) *BufferedWriter {
 	return &BufferedWriter{
 		upstream: w,
 		reversed: reversed,
-		data:     w.buffer[PacketLengthBufferSize+Overhead : len(w.buffer)-Overhead],
 	}
 }
 
 type BufferedWriter struct {
 	upstream *Writer
-	data     []byte
 	reversed int
 	index    int
 }
 
+func (w *BufferedWriter) data() []byte {
+	buffer := w.upstream.headerBuffer()
+	return buffer[PacketLengthBufferSize+Overhead : len(buffer)-Overhead]
+}
+
 func (w *BufferedWriter) Write(p []byte) (n int, err error) {
 	for {
-		cachedN := copy(w.data[w.reversed+w.index:], p[n:])
+		cachedN := copy(w.data()[w.reversed+w.index:], p[n:])
 		w.index += cachedN
 		if cachedN == len(p[n:]) {
 			n += cachedN
@@ -434,7 +586,9 @@ func (w *BufferedWriter) Write(p []byte) (n int, err error) {
 	}
 }
 
+// Flush writes the buffered chunk and returns the header buffer.
 func (w *BufferedWriter) Flush() error {
+	defer w.upstream.releaseHeaderBuffer()
 	if w.index == 0 {
 		if w.reversed > 0 {
 			_, err := w.upstream.upstream.Write(w.upstream.buffer[:w.reversed])
@@ -0,0 +1,271 @@
+package shadowaead_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/sagernet/sing-shadowsocks/shadowaead"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func FuzzReader(f *testing.F) {
+	for _, payload := range [][]byte{nil, []byte("hello"), bytes.Repeat([]byte("hello"), 10)} {
+		var output bytes.Buffer
+		writer := shadowaead.NewWriter(&output, nullAEAD{}, 16)
+		_, err := writer.Write(payload)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(output.Bytes())
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := shadowaead.NewReader(bytes.NewReader(data), nullAEAD{}, shadowaead.MaxPacketSize)
+		reader.WriteTo(io.Discard)
+
+		reader = shadowaead.NewReader(bytes.NewReader(data), nullAEAD{}, shadowaead.MaxPacketSize)
+		buffer := make([]byte, 512)
+		for {
+			_, err := reader.Read(buffer)
+			if err != nil {
+				break
+			}
+		}
+
+		reader = shadowaead.NewReader(bytes.NewReader(data), nullAEAD{}, shadowaead.MaxPacketSize)
+		for {
+			_, err := reader.ReadByte()
+			if err != nil {
+				break
+			}
+			err = reader.Discard(7)
+			if err != nil {
+				break
+			}
+		}
+	})
+}
+
+func TestBufferedWriter(t *testing.T) {
+	t.Parallel()
+	aead := newAEAD(t, "aes-128-gcm")
+	payload := make([]byte, shadowaead.MaxPacketSize*2+100)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	var output bytes.Buffer
+	writer := shadowaead.NewWriter(&output, aead, shadowaead.MaxPacketSize)
+	header := writer.Buffer()
+	header.WriteString("salt")
+	bufferedWriter := writer.BufferedWriter(header.Len())
+	_, err := bufferedWriter.Write(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bufferedWriter.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = writer.Write(payload[:10])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output.Next(4)) != "salt" {
+		t.Fatal("bad header")
+	}
+
+	reader := shadowaead.NewReader(&output, aead, shadowaead.MaxPacketSize)
+	first, err := reader.ReadByte()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := []byte{first}
+	readBuffer := make([]byte, 1000)
+	for len(received) < len(payload)+10 {
+		n, err := reader.Read(readBuffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, readBuffer[:n]...)
+	}
+	if !bytes.Equal(received[:len(payload)], payload) || !bytes.Equal(received[len(payload):], payload[:10]) {
+		t.Fatal("bad payload")
+	}
+}
+
+func TestWriterReadFrom(t *testing.T) {
+	t.Parallel()
+	aead := newAEAD(t, "aes-128-gcm")
+	payload := make([]byte, shadowaead.MaxPacketSize*3)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	for _, source := range []io.Reader{bytes.NewReader(payload), iotest.HalfReader(bytes.NewReader(payload))} {
+		var output bytes.Buffer
+		_, err := shadowaead.NewWriter(&output, aead, shadowaead.MaxPacketSize).ReadFrom(source)
+		if err != io.EOF {
+			t.Fatal("expected EOF, got ", err)
+		}
+		received, err := io.ReadAll(shadowaead.NewReader(&output, aead, shadowaead.MaxPacketSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(received, payload) {
+			t.Fatal("bad payload")
+		}
+	}
+}
+
+func TestReaderBuffer(t *testing.T) {
+	t.Parallel()
+	aead := newAEAD(t, "aes-128-gcm")
+	var output bytes.Buffer
+	writer := shadowaead.NewWriter(&output, aead, shadowaead.MaxPacketSize)
+	for _, chunk := range []string{"hello world", "again"} {
+		_, err := writer.Write([]byte(chunk))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader := shadowaead.NewReader(&output, aead, shadowaead.MaxPacketSize)
+	head := make([]byte, 6)
+	_, err := io.ReadFull(reader, head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := reader.Buffer()
+	_, err = io.ReadFull(reader, make([]byte, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer.Bytes()) != "world" {
+		t.Fatal("unread data changed by later reads: ", string(buffer.Bytes()))
+	}
+	if reader.Buffer().Len() != 0 {
+		t.Fatal("drained reader returned data")
+	}
+}
+
+func TestReaderReadChunk(t *testing.T) {
+	t.Parallel()
+	aead := newAEAD(t, "aes-128-gcm")
+	writer := shadowaead.NewWriter(io.Discard, aead, shadowaead.MaxPacketSize)
+	sealed := buf.New()
+	defer sealed.Release()
+	writer.WriteChunk(sealed, []byte("chunk"))
+	reader := shadowaead.NewReader(nil, aead, shadowaead.MaxPacketSize)
+	opened := buf.New()
+	defer opened.Release()
+	opened.WriteString("external ")
+	err := reader.ReadChunk(opened, sealed.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(opened.Bytes()) != "external chunk" {
+		t.Fatal("bad chunk: ", string(opened.Bytes()))
+	}
+}
+
+// Writer.ReadFrom and Reader.WriteTo report the end of the stream as io.EOF.
+
+func BenchmarkWriter(b *testing.B) {
+	for _, method := range shadowaead.List {
+		b.Run(method, func(b *testing.B) {
+			aead := newAEAD(b, method)
+			data := make([]byte, 1024*1024)
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				writer := shadowaead.NewWriter(io.Discard, aead, shadowaead.MaxPacketSize)
+				_, err := writer.ReadFrom(bytes.NewReader(data))
+				if err != io.EOF {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkReader(b *testing.B) {
+	for _, method := range shadowaead.List {
+		b.Run(method, func(b *testing.B) {
+			aead := newAEAD(b, method)
+			data := make([]byte, 1024*1024)
+			var output bytes.Buffer
+			_, err := shadowaead.NewWriter(&output, aead, shadowaead.MaxPacketSize).Write(data)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				reader := shadowaead.NewReader(bytes.NewReader(output.Bytes()), aead, shadowaead.MaxPacketSize)
+				_, err = reader.WriteTo(io.Discard)
+				if err != io.EOF {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func newAEAD(t testing.TB, method string) cipher.AEAD {
+	var aead cipher.AEAD
+	var err error
+	switch method {
+	case "aes-128-gcm", "aes-192-gcm", "aes-256-gcm":
+		var block cipher.Block
+		block, err = aes.NewCipher(make([]byte, map[string]int{"aes-128-gcm": 16, "aes-192-gcm": 24, "aes-256-gcm": 32}[method]))
+		if err == nil {
+			aead, err = cipher.NewGCM(block)
+		}
+	case "chacha20-ietf-poly1305":
+		aead, err = chacha20poly1305.New(make([]byte, chacha20poly1305.KeySize))
+	case "xchacha20-ietf-poly1305":
+		aead, err = chacha20poly1305.NewX(make([]byte, chacha20poly1305.KeySize))
+	default:
+		t.Fatal("unknown method ", method)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+var errBadTag = E.New("bad tag")
+
+// nullAEAD leaves plaintext as is and uses an all-zero tag, so the fuzzer can reach the chunk framing.
+type nullAEAD struct{}
+
+func (nullAEAD) NonceSize() int {
+	return 12
+}
+
+func (nullAEAD) Overhead() int {
+	return shadowaead.Overhead
+}
+
+func (nullAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	dst = append(dst, plaintext...)
+	return append(dst, make([]byte, shadowaead.Overhead)...)
+}
+
+func (nullAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < shadowaead.Overhead {
+		return nil, errBadTag
+	}
+	for _, b := range ciphertext[len(ciphertext)-shadowaead.Overhead:] {
+		if b != 0 {
+			return nil, errBadTag
+		}
+	}
+	return append(dst, ciphertext[:len(ciphertext)-shadowaead.Overhead]...), nil
+}
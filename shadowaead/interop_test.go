@@ -0,0 +1,89 @@
+package shadowaead_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/sagernet/sing-shadowsocks/internal/vectortest"
+
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	ssaead "github.com/shadowsocks/go-shadowsocks2/shadowaead"
+)
+
+// TestVectorsInterop checks the vectors against go-shadowsocks2, the Go implementation of the
+// shadowsocks organization. It re-encodes the TCP streams from the vector salts byte for byte
+// and decodes every direction. go-shadowsocks2 has no aes-192-gcm or xchacha20-ietf-poly1305.
+func TestVectorsInterop(t *testing.T) {
+	// ATYP domain name, length, name, port
+	address := append([]byte{3, 11}, "example.com"...)
+	address = append(address, 0x01, 0xbb)
+	var tested int
+	for _, v := range loadVectors(t) {
+		if v.Method == "aes-192-gcm" || v.Method == "xchacha20-ietf-poly1305" {
+			continue
+		}
+		tested++
+		t.Run(v.Method, func(t *testing.T) {
+			method, err := core.PickCipher(strings.ToUpper(v.Method), nil, v.Password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ciph := method.(ssaead.Cipher)
+			saltSize := ciph.SaltSize()
+			for _, test := range []struct {
+				name      string
+				content   string
+				plaintext []byte
+			}{
+				{"tcp request", v.TCPRequest, append(address, vectortest.Request...)},
+				{"tcp response", v.TCPResponse, vectortest.Response},
+			} {
+				data := vectortest.DecodeHex(t, test.content)
+				encrypter, err := ciph.Encrypter(data[:saltSize])
+				if err != nil {
+					t.Fatal(err)
+				}
+				encoded := bytes.NewBuffer(append([]byte(nil), data[:saltSize]...))
+				_, err = ssaead.NewWriter(encoded, encrypter).Write(test.plaintext)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(encoded.Bytes(), data) {
+					t.Fatalf("%s: go-shadowsocks2 encoded %x", test.name, encoded.Bytes())
+				}
+				decrypter, err := ciph.Decrypter(data[:saltSize])
+				if err != nil {
+					t.Fatal(err)
+				}
+				decoded, err := io.ReadAll(ssaead.NewReader(bytes.NewReader(data[saltSize:]), decrypter))
+				if err != nil {
+					t.Fatal(test.name, ": ", err)
+				}
+				if !bytes.Equal(decoded, test.plaintext) {
+					t.Fatalf("%s: go-shadowsocks2 decoded %x", test.name, decoded)
+				}
+			}
+			for _, test := range []struct {
+				name      string
+				content   string
+				plaintext []byte
+			}{
+				{"udp request", v.UDPRequest, append(address, vectortest.Request...)},
+				{"udp response", v.UDPResponse, append(address, vectortest.Response...)},
+			} {
+				decoded, err := ssaead.Unpack(make([]byte, 2048), vectortest.DecodeHex(t, test.content), ciph)
+				if err != nil {
+					t.Fatal(test.name, ": ", err)
+				}
+				if !bytes.Equal(decoded, test.plaintext) {
+					t.Fatalf("%s: go-shadowsocks2 decoded %x", test.name, decoded)
+				}
+			}
+		})
+	}
+	if tested != 3 {
+		t.Fatal("missing vectors")
+	}
+}
@@ -0,0 +1,52 @@
+package shadowaead
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// chunkSlack is the room a chunk needs beyond its payload: the sealed length and both tags.
+const chunkSlack = PacketLengthBufferSize + Overhead*2
+
+const (
+	minChunkClass = 8
+	maxChunkClass = 16
+)
+
+// chunkBuffer holds room for one chunk with a payload of up to 1<<class bytes.
+// Pools store the pointer, so returning a buffer does not allocate.
+type chunkBuffer struct {
+	data  []byte
+	class int
+}
+
+var chunkPools [maxChunkClass - minChunkClass + 1]sync.Pool
+
+func init() {
+	for i := range chunkPools {
+		class := minChunkClass + i
+		chunkPools[i].New = func() any {
+			return &chunkBuffer{data: make([]byte, 1<<class+chunkSlack), class: class}
+		}
+	}
+}
+
+// getChunkBuffer borrows a buffer for a chunk with a payload of up to payloadLen bytes.
+// Payloads above the largest class get a buffer of their own.
+func getChunkBuffer(payloadLen int) *chunkBuffer {
+	class := minChunkClass
+	if payloadLen > 1<<minChunkClass {
+		class = bits.Len(uint(payloadLen - 1))
+	}
+	if class > maxChunkClass {
+		return &chunkBuffer{data: make([]byte, payloadLen+chunkSlack), class: -1}
+	}
+	return chunkPools[class-minChunkClass].Get().(*chunkBuffer)
+}
+
+func putChunkBuffer(buffer *chunkBuffer) {
+	if buffer.class < 0 {
+		return
+	}
+	chunkPools[buffer.class-minChunkClass].Put(buffer)
+}
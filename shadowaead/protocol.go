@@ -3,6 +3,7 @@ package shadowaead
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"crypto/sha1"
 	"io"
 	"net"
@@ -30,7 +31,8 @@ var _ shadowsocks.Method = (*Method)(nil)
 
 func New(method string, key []byte, password string) (*Method, error) {
 	m := &Method{
-		name: method,
+		name:   method,
+		random: rand.Reader,
 	}
 	switch method {
 	case "aes-128-gcm":
@@ -81,12 +83,21 @@ type Method struct {
 	keySaltLength int
 	constructor   func(key []byte) (cipher.AEAD, error)
 	key           []byte
+	random        io.Reader
 }
 
 func (m *Method) Name() string {
 	return m.name
 }
 
+// SetRandom replaces the entropy source of salts. A nil random restores crypto/rand.
+func (m *Method) SetRandom(random io.Reader) {
+	if random == nil {
+		random = rand.Reader
+	}
+	m.random = random
+}
+
 func (m *Method) DialConn(conn net.Conn, destination M.Socksaddr) (net.Conn, error) {
 	shadowsocksConn := &clientConn{
 		Conn:        conn,
@@ -105,7 +116,7 @@ func (m *Method) DialEarlyConn(conn net.Conn, destination M.Socksaddr) net.Conn
 }
 
 func (m *Method) DialPacketConn(conn net.Conn) N.NetPacketConn {
-	return &clientPacketConn{m, conn}
+	return &clientPacketConn{Method: m, Conn: conn}
 }
 
 type clientConn struct {
@@ -114,12 +125,13 @@ type clientConn struct {
 	destination M.Socksaddr
 	reader      *Reader
 	writer      *Writer
+	newBuffer   func() *buf.Buffer
 }
 
 func (c *clientConn) writeRequest(payload []byte) error {
 	salt := buf.NewSize(c.keySaltLength)
 	defer salt.Release()
-	salt.WriteRandom(c.keySaltLength)
+	common.Must1(salt.ReadFullFrom(c.random, c.keySaltLength))
 
 	key := buf.NewSize(c.keySaltLength)
 
@@ -211,6 +223,54 @@ func (c *clientConn) Write(p []byte) (n int, err error) {
 	return c.writer.Write(p)
 }
 
+var (
+	_ N.ExtendedConn = (*clientConn)(nil)
+	_ N.ReadWaiter   = (*clientConn)(nil)
+)
+
+func (c *clientConn) ReadBuffer(buffer *buf.Buffer) error {
+	if c.reader == nil {
+		err := c.readResponse()
+		if err != nil {
+			return err
+		}
+	}
+	return c.reader.ReadBuffer(buffer)
+}
+
+func (c *clientConn) WriteBuffer(buffer *buf.Buffer) error {
+	if c.writer == nil {
+		defer buffer.Release()
+		return c.writeRequest(buffer.Bytes())
+	}
+	return c.writer.WriteBuffer(buffer)
+}
+
+func (c *clientConn) InitializeReadWaiter(newBuffer func() *buf.Buffer) {
+	c.newBuffer = newBuffer
+}
+
+func (c *clientConn) WaitReadBuffer() error {
+	buffer := c.newBuffer()
+	err := c.ReadBuffer(buffer)
+	if err != nil {
+		buffer.Release()
+	}
+	return err
+}
+
+func (c *clientConn) FrontHeadroom() int {
+	return PacketLengthBufferSize + Overhead
+}
+
+func (c *clientConn) RearHeadroom() int {
+	return Overhead
+}
+
+func (c *clientConn) WriterMTU() int {
+	return MaxPacketSize
+}
+
 func (c *clientConn) NeedHandshake() bool {
 	return c.writer == nil
 }
@@ -226,12 +286,13 @@ func (c *clientConn) Upstream() any {
 type clientPacketConn struct {
 	*Method
 	net.Conn
+	newBuffer func() *buf.Buffer
 }
 
 func (c *clientPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
 	defer buffer.Release()
 	header := buf.With(buffer.ExtendHeader(c.keySaltLength + M.SocksaddrSerializer.AddrPortLen(destination)))
-	header.WriteRandom(c.keySaltLength)
+	common.Must1(header.ReadFullFrom(c.random, c.keySaltLength))
 	err := M.SocksaddrSerializer.WriteAddrPort(header, destination)
 	if err != nil {
 		return err
@@ -276,6 +337,21 @@ func (c *clientPacketConn) ReadPacket(buffer *buf.Buffer) (M.Socksaddr, error) {
 	return M.SocksaddrSerializer.ReadAddrPort(buffer)
 }
 
+var _ N.PacketReadWaiter = (*clientPacketConn)(nil)
+
+func (c *clientPacketConn) InitializeReadWaiter(newBuffer func() *buf.Buffer) {
+	c.newBuffer = newBuffer
+}
+
+func (c *clientPacketConn) WaitReadPacket() (destination M.Socksaddr, err error) {
+	buffer := c.newBuffer()
+	destination, err = c.ReadPacket(buffer)
+	if err != nil {
+		buffer.Release()
+	}
+	return
+}
+
 func (c *clientPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	buffer := buf.With(p)
 	destination, err := c.ReadPacket(buffer)
@@ -2,20 +2,20 @@ package shadowaead
 
 import (
 	"context"
-	"crypto/rand"
 	"io"
 	"net"
 	"net/netip"
 	"sync"
+	"time"
 
 	"github.com/sagernet/sing-shadowsocks"
 	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/atomic"
 	"github.com/sagernet/sing/common/buf"
 	E "github.com/sagernet/sing/common/exceptions"
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
 	"github.com/sagernet/sing/common/rw"
-	"github.com/sagernet/sing/common/udpnat"
 )
 
 var ErrBadHeader = E.New("bad header")
@@ -24,9 +24,16 @@ var _ shadowsocks.Service = (*Service)(nil)
 
 type Service struct {
 	*Method
-	password string
-	handler  shadowsocks.Handler
-	udpNat   *udpnat.Service[netip.AddrPort]
+	*shadowsocks.UDPServer[netip.AddrPort]
+	keys       atomic.TypedValue[[]serverKey]
+	handler    shadowsocks.Handler
+	udpHandler *shadowsocks.MetricsUDPHandler
+	udpNat     *shadowsocks.UDPNAT[netip.AddrPort]
+	metrics    shadowsocks.Metrics
+	handshake  shadowsocks.HandshakeLimiter
+	lifecycle  shadowsocks.Lifecycle
+	registry   shadowsocks.SessionRegistry
+	acl        *shadowsocks.ACL
 }
 
 func NewService(method string, key []byte, password string, udpTimeout int64, handler shadowsocks.Handler) (*Service, error) {
@@ -35,67 +42,203 @@ func NewService(method string, key []byte, password string, udpTimeout int64, ha
 		return nil, err
 	}
 	s := &Service{
-		Method:  m,
-		handler: handler,
-		udpNat:  udpnat.New[netip.AddrPort](udpTimeout, handler),
+		Method:     m,
+		handler:    handler,
+		udpHandler: shadowsocks.NewMetricsUDPHandler(method, handler),
 	}
+	s.keys.Store([]serverKey{{Method: m, ServerKey: shadowsocks.ServerKey{Key: key, Password: password}}})
+	s.udpNat = shadowsocks.NewUDPNAT[netip.AddrPort](udpTimeout, s.udpHandler, shadowsocks.HashAddrPort)
+	s.udpNat.SetSessionRegistry(&s.registry)
+	s.UDPServer = shadowsocks.NewUDPServer[netip.AddrPort](method, handler, s.udpNat, &s.lifecycle, &s.metrics)
 	return s, nil
 }
 
+// serverKey is a Method with one of the keys accepted by a Service.
+type serverKey struct {
+	*Method
+	shadowsocks.ServerKey
+}
+
+// activeKeys returns the keys accepted now, copying the key list only if some are not.
+func (s *Service) activeKeys() []serverKey {
+	keys := s.keys.Load()
+	now := time.Now()
+	for i := range keys {
+		if keys[i].Active(now) {
+			continue
+		}
+		active := append(make([]serverKey, 0, len(keys)), keys[:i]...)
+		for _, key := range keys[i+1:] {
+			if key.Active(now) {
+				active = append(active, key)
+			}
+		}
+		return active
+	}
+	return keys
+}
+
+func (s *Service) UpdateKeys(keys []shadowsocks.ServerKey) error {
+	if len(keys) == 0 {
+		return shadowsocks.ErrMissingPassword
+	}
+	serverKeys := make([]serverKey, 0, len(keys))
+	for _, key := range keys {
+		m, err := New(s.name, key.Key, key.Password)
+		if err != nil {
+			return err
+		}
+		m.random = s.random
+		serverKeys = append(serverKeys, serverKey{Method: m, ServerKey: key})
+	}
+	s.keys.Store(serverKeys)
+	return nil
+}
+
+func (s *Service) SetHandshakeTimeout(timeout time.Duration) {
+	s.handshake.SetHandshakeTimeout(timeout)
+}
+
+func (s *Service) SetHandshakeLimit(limit int, queueTimeout time.Duration) {
+	s.handshake.SetHandshakeLimit(limit, queueTimeout)
+}
+
+func (s *Service) SetACL(acl *shadowsocks.ACL) {
+	s.acl = acl
+}
+
+func (s *Service) SetMetrics(metrics shadowsocks.Metrics) {
+	s.metrics = metrics
+	s.udpHandler.Metrics = metrics
+}
+
 func (s *Service) Name() string {
 	return s.name
 }
 
 func (s *Service) Password() string {
-	return s.password
+	return s.keys.Load()[0].Password
+}
+
+func (s *Service) Sessions() []shadowsocks.SessionInfo {
+	return s.registry.Sessions()
+}
+
+func (s *Service) UserSessions(user any) []shadowsocks.SessionInfo {
+	return s.registry.UserSessions(user)
+}
+
+func (s *Service) CloseSession(id uint64) bool {
+	return s.registry.CloseSession(id)
+}
+
+func (s *Service) CloseUserSessions(user any) int {
+	return s.registry.CloseUserSessions(user)
+}
+
+func (s *Service) Close() error {
+	s.lifecycle.Close()
+	s.udpNat.Close()
+	return nil
+}
+
+func (s *Service) Shutdown(ctx context.Context) (shadowsocks.ShutdownStats, error) {
+	stats, err := s.lifecycle.Shutdown(ctx)
+	stats.Sessions = s.udpNat.Close()
+	return stats, err
 }
 
 func (s *Service) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
-	err := s.newConnection(ctx, conn, metadata)
+	element, err := s.lifecycle.Acquire(conn)
+	if err != nil {
+		return &shadowsocks.ServerConnError{Conn: conn, Source: metadata.Source, Cause: err}
+	}
+	defer s.lifecycle.Release(element)
+	protocolConn, err := s.newConnection(ctx, conn, &metadata)
+	if err != nil {
+		if s.metrics != nil {
+			s.metrics.HandshakeRejected(s.name, err)
+		}
+	} else {
+		session := s.registry.Register(N.NetworkTCP, nil, metadata, conn)
+		defer session.Unregister()
+		if s.metrics != nil {
+			s.metrics.HandshakeAccepted(s.name)
+			protocolConn = shadowsocks.NewMetricsConn(protocolConn, s.name, s.metrics)
+		}
+		err = s.handler.NewConnection(ctx, session.Conn(protocolConn), metadata)
+	}
 	if err != nil {
 		err = &shadowsocks.ServerConnError{Conn: conn, Source: metadata.Source, Cause: err}
 	}
 	return err
 }
 
-func (s *Service) newConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+func (s *Service) newConnection(ctx context.Context, conn net.Conn, metadata *M.Metadata) (net.Conn, error) {
+	err := s.handshake.Start(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	defer s.handshake.Finish(conn)
 	header := buf.NewSize(s.keySaltLength + PacketLengthBufferSize + Overhead)
 	defer header.Release()
 
-	_, err := header.ReadFullFrom(conn, header.FreeLen())
+	handshakeReader := &shadowsocks.HandshakeReader{Reader: conn}
+	_, err = header.ReadFullFrom(handshakeReader, header.FreeLen())
 	if err != nil {
-		return E.Cause(err, "read header")
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReadReason(err, shadowsocks.ReasonReadFailed), handshakeReader.Consumed, E.Cause(err, "read header"))
 	} else if !header.IsFull() {
-		return ErrBadHeader
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonBadHeader, handshakeReader.Consumed, ErrBadHeader)
 	}
 
+	// Each key is tried on the length chunk, the first one that opens it decrypts the connection.
+	var (
+		method *Method
+		reader *Reader
+		length int
+	)
+	err = ErrBadHeader
 	key := buf.NewSize(s.keySaltLength)
-	Kdf(s.key, header.To(s.keySaltLength), key)
-	readCipher, err := s.constructor(key.Bytes())
+	for _, serverKey := range s.activeKeys() {
+		key.FullReset()
+		Kdf(serverKey.key, header.To(s.keySaltLength), key)
+		readCipher, cipherErr := s.constructor(key.Bytes())
+		if cipherErr != nil {
+			key.Release()
+			return nil, cipherErr
+		}
+		candidate := NewReader(handshakeReader, readCipher, MaxPacketSize)
+		length, err = candidate.openLength(header.From(s.keySaltLength))
+		if err == nil {
+			method, reader = serverKey.Method, candidate
+			break
+		}
+	}
 	key.Release()
-	if err != nil {
-		return err
+	if reader == nil {
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonDecryptFailed, handshakeReader.Consumed, err)
 	}
-	reader := NewReader(conn, readCipher, MaxPacketSize)
-
-	err = reader.ReadWithLengthChunk(header.From(s.keySaltLength))
+	err = reader.readChunk(length)
 	if err != nil {
-		return err
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReadReason(err, shadowsocks.ReasonDecryptFailed), handshakeReader.Consumed, err)
 	}
 
 	destination, err := M.SocksaddrSerializer.ReadAddrPort(reader)
 	if err != nil {
-		return err
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReadReason(err, shadowsocks.ReasonBadAddress), handshakeReader.Consumed, err)
+	}
+	if !s.acl.Allow(N.NetworkTCP, nil, destination) {
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonDenied, handshakeReader.Consumed, E.Extend(shadowsocks.ErrDestinationDenied, destination))
 	}
 
 	metadata.Protocol = "shadowsocks"
 	metadata.Destination = destination
 
-	return s.handler.NewConnection(ctx, &serverConn{
-		Method: s.Method,
+	return &serverConn{
+		Method: method,
 		Conn:   conn,
 		reader: reader,
-	}, metadata)
+	}, nil
 }
 
 func (s *Service) NewError(ctx context.Context, err error) {
@@ -105,14 +248,15 @@ func (s *Service) NewError(ctx context.Context, err error) {
 type serverConn struct {
 	*Method
 	net.Conn
-	access sync.Mutex
-	reader *Reader
-	writer *Writer
+	access    sync.Mutex
+	reader    *Reader
+	writer    *Writer
+	newBuffer func() *buf.Buffer
 }
 
 func (c *serverConn) writeResponse(payload []byte) (n int, err error) {
 	salt := buf.NewSize(c.keySaltLength)
-	salt.WriteRandom(c.keySaltLength)
+	common.Must1(salt.ReadFullFrom(c.random, c.keySaltLength))
 
 	key := buf.NewSize(c.keySaltLength)
 
@@ -167,6 +311,54 @@ func (c *serverConn) WriteTo(w io.Writer) (n int64, err error) {
 	return c.reader.WriteTo(w)
 }
 
+var (
+	_ N.ExtendedConn = (*serverConn)(nil)
+	_ N.ReadWaiter   = (*serverConn)(nil)
+)
+
+func (c *serverConn) ReadBuffer(buffer *buf.Buffer) error {
+	return c.reader.ReadBuffer(buffer)
+}
+
+func (c *serverConn) WriteBuffer(buffer *buf.Buffer) error {
+	if c.writer != nil {
+		return c.writer.WriteBuffer(buffer)
+	}
+	c.access.Lock()
+	if c.writer != nil {
+		c.access.Unlock()
+		return c.writer.WriteBuffer(buffer)
+	}
+	defer c.access.Unlock()
+	defer buffer.Release()
+	return common.Error(c.writeResponse(buffer.Bytes()))
+}
+
+func (c *serverConn) InitializeReadWaiter(newBuffer func() *buf.Buffer) {
+	c.newBuffer = newBuffer
+}
+
+func (c *serverConn) WaitReadBuffer() error {
+	buffer := c.newBuffer()
+	err := c.ReadBuffer(buffer)
+	if err != nil {
+		buffer.Release()
+	}
+	return err
+}
+
+func (c *serverConn) FrontHeadroom() int {
+	return PacketLengthBufferSize + Overhead
+}
+
+func (c *serverConn) RearHeadroom() int {
+	return Overhead
+}
+
+func (c *serverConn) WriterMTU() int {
+	return MaxPacketSize
+}
+
 func (c *serverConn) NeedAdditionalReadDeadline() bool {
 	return true
 }
@@ -183,68 +375,150 @@ func (c *Service) WriteIsThreadUnsafe() {
 }
 
 func (s *Service) NewPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
-	err := s.newPacket(ctx, conn, buffer, metadata)
-	if err != nil {
-		err = &shadowsocks.ServerPacketError{Source: metadata.Source, Cause: err}
-	}
-	return err
+	return s.ServePacket(metadata, func() error {
+		key := buf.NewSize(s.keySaltLength)
+		defer key.Release()
+		return s.newPacket(ctx, conn, buffer, metadata, key)
+	})
 }
 
-func (s *Service) newPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
-	if buffer.Len() < s.keySaltLength {
-		return io.ErrShortBuffer
-	}
+// NewPackets handles a batch of packets read from conn, sharing one subkey buffer across the batch.
+func (s *Service) NewPackets(ctx context.Context, conn N.PacketConn, buffers []*buf.Buffer, metadata []M.Metadata) {
 	key := buf.NewSize(s.keySaltLength)
-	Kdf(s.key, buffer.To(s.keySaltLength), key)
-	readCipher, err := s.constructor(key.Bytes())
-	key.Release()
-	if err != nil {
-		return err
+	defer key.Release()
+	s.ServePackets(ctx, buffers, metadata, func(buffer *buf.Buffer, metadata M.Metadata) error {
+		key.FullReset()
+		return s.newPacket(ctx, conn, buffer, metadata, key)
+	})
+}
+
+func (s *Service) newPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata, key *buf.Buffer) error {
+	packetLen := buffer.Len()
+	if packetLen < s.keySaltLength {
+		return shadowsocks.NewHandshakeError(shadowsocks.ReasonBadHeader, packetLen, io.ErrShortBuffer)
 	}
-	packet, err := readCipher.Open(buffer.Index(s.keySaltLength), rw.ZeroBytes[:readCipher.NonceSize()], buffer.From(s.keySaltLength), nil)
+	method, packet, err := s.openPacket(buffer, key)
 	if err != nil {
-		return err
+		return shadowsocks.NewHandshakeError(shadowsocks.ReasonDecryptFailed, packetLen, err)
 	}
 	buffer.Advance(s.keySaltLength)
 	buffer.Truncate(len(packet))
 
 	destination, err := M.SocksaddrSerializer.ReadAddrPort(buffer)
 	if err != nil {
-		return err
+		return shadowsocks.NewHandshakeError(shadowsocks.ReasonBadAddress, packetLen, err)
+	}
+	if !s.acl.Allow(N.NetworkUDP, nil, destination) {
+		return shadowsocks.NewHandshakeError(shadowsocks.ReasonDenied, packetLen, E.Extend(shadowsocks.ErrDestinationDenied, destination))
 	}
 
 	metadata.Protocol = "shadowsocks"
 	metadata.Destination = destination
+	if s.metrics != nil {
+		s.metrics.ReadBytes(s.name, int64(buffer.Len()))
+	}
 	s.udpNat.NewPacket(ctx, metadata.Source.AddrPort(), buffer, metadata, func(natConn N.PacketConn) N.PacketWriter {
-		return &serverPacketWriter{s.Method, conn, natConn}
+		return &serverPacketWriter{method, conn, natConn, s.metrics}
 	})
 	return nil
 }
 
+// openPacket decrypts buffer in place with the first key that opens it. With several keys, all but
+// the last one are tried into a scratch buffer, as a failed Open clears its output.
+func (s *Service) openPacket(buffer *buf.Buffer, key *buf.Buffer) (*Method, []byte, error) {
+	keys := s.activeKeys()
+	var scratch *buf.Buffer
+	if len(keys) > 1 {
+		scratch = buf.NewSize(buffer.Len())
+		defer scratch.Release()
+	}
+	for i, serverKey := range keys {
+		key.FullReset()
+		Kdf(serverKey.key, buffer.To(s.keySaltLength), key)
+		readCipher, err := s.constructor(key.Bytes())
+		if err != nil {
+			return nil, nil, err
+		}
+		nonce := rw.ZeroBytes[:readCipher.NonceSize()]
+		if i == len(keys)-1 {
+			packet, err := readCipher.Open(buffer.Index(s.keySaltLength), nonce, buffer.From(s.keySaltLength), nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			return serverKey.Method, packet, nil
+		}
+		packet, err := readCipher.Open(scratch.Index(0), nonce, buffer.From(s.keySaltLength), nil)
+		if err == nil {
+			return serverKey.Method, buffer.Index(s.keySaltLength)[:copy(buffer.From(s.keySaltLength), packet)], nil
+		}
+	}
+	return nil, nil, ErrBadHeader
+}
+
 type serverPacketWriter struct {
 	*Method
-	source N.PacketConn
-	nat    N.PacketConn
+	source  N.PacketConn
+	nat     N.PacketConn
+	metrics shadowsocks.Metrics
 }
 
 func (w *serverPacketWriter) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	key := buf.NewSize(w.keySaltLength)
+	err := w.sealPacket(buffer, destination, nil, key)
+	key.Release()
+	if err != nil {
+		return err
+	}
+	return w.source.WritePacket(buffer, M.SocksaddrFromNet(w.nat.LocalAddr()))
+}
+
+// WritePackets seals a batch of packets with salts read in one call,
+// and writes them to the source with one call if it is a shadowsocks.PacketBatchWriter.
+func (w *serverPacketWriter) WritePackets(buffers []*buf.Buffer, destinations []M.Socksaddr) error {
+	salts := make([]byte, len(buffers)*w.keySaltLength)
+	common.Must1(io.ReadFull(w.random, salts))
+	key := buf.NewSize(w.keySaltLength)
+	defer key.Release()
+	sources := make([]M.Socksaddr, len(buffers))
+	source := M.SocksaddrFromNet(w.nat.LocalAddr())
+	for i, buffer := range buffers {
+		key.FullReset()
+		err := w.sealPacket(buffer, destinations[i], salts[i*w.keySaltLength:(i+1)*w.keySaltLength], key)
+		if err != nil {
+			buf.ReleaseMulti(buffers[:i])
+			buf.ReleaseMulti(buffers[i+1:])
+			return err
+		}
+		sources[i] = source
+	}
+	return shadowsocks.WritePackets(w.source, buffers, sources)
+}
+
+// sealPacket encrypts buffer in place with salt, or a random salt if nil, releasing it on error.
+func (w *serverPacketWriter) sealPacket(buffer *buf.Buffer, destination M.Socksaddr, salt []byte, key *buf.Buffer) error {
+	if w.metrics != nil {
+		w.metrics.WriteBytes(w.name, int64(buffer.Len()))
+	}
 	header := buffer.ExtendHeader(w.keySaltLength + M.SocksaddrSerializer.AddrPortLen(destination))
-	common.Must1(io.ReadFull(rand.Reader, header[:w.keySaltLength]))
+	if salt != nil {
+		copy(header, salt)
+	} else {
+		common.Must1(io.ReadFull(w.random, header[:w.keySaltLength]))
+	}
 	err := M.SocksaddrSerializer.WriteAddrPort(buf.With(header[w.keySaltLength:]), destination)
 	if err != nil {
 		buffer.Release()
 		return err
 	}
-	key := buf.NewSize(w.keySaltLength)
 	Kdf(w.key, buffer.To(w.keySaltLength), key)
 	writeCipher, err := w.constructor(key.Bytes())
-	key.Release()
 	if err != nil {
+		buffer.Release()
 		return err
 	}
 	writeCipher.Seal(buffer.From(w.keySaltLength)[:0], rw.ZeroBytes[:writeCipher.NonceSize()], buffer.From(w.keySaltLength), nil)
 	buffer.Extend(Overhead)
-	return w.source.WritePacket(buffer, M.SocksaddrFromNet(w.nat.LocalAddr()))
+	return nil
 }
 
 func (w *serverPacketWriter) FrontHeadroom() int {
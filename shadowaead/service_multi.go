@@ -2,10 +2,10 @@ package shadowaead
 
 import (
 	"context"
-	"crypto/cipher"
 	"io"
 	"net"
 	"net/netip"
+	"time"
 
 	"github.com/sagernet/sing-shadowsocks"
 	"github.com/sagernet/sing/common/auth"
@@ -15,187 +15,372 @@ import (
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
 	"github.com/sagernet/sing/common/rw"
-	"github.com/sagernet/sing/common/udpnat"
 )
 
 var _ shadowsocks.MultiService[int] = (*MultiService[int])(nil)
 
 type MultiService[U comparable] struct {
-	name      string
-	methodMap map[U]*Method
-	handler   shadowsocks.Handler
-	udpNat    *udpnat.Service[netip.AddrPort]
+	*shadowsocks.UDPServer[netip.AddrPort]
+	name       string
+	users      []*userMethod[U]
+	handler    shadowsocks.Handler
+	udpHandler *shadowsocks.MetricsUDPHandler
+	udpNat     *shadowsocks.UDPNAT[netip.AddrPort]
+	metrics    shadowsocks.Metrics
+	handshake  shadowsocks.HandshakeLimiter
+	lifecycle  shadowsocks.Lifecycle
+	registry   shadowsocks.SessionRegistry
+	acl        *shadowsocks.ACL
+	random     io.Reader
+}
+
+// userMethod is a Method with one of the keys of a user.
+type userMethod[U comparable] struct {
+	*Method
+	shadowsocks.ServerKey
+	user  U
+	index int
+}
+
+// context returns ctx carrying the user and the index of the key.
+func (m *userMethod[U]) context(ctx context.Context) context.Context {
+	return shadowsocks.ContextWithKeyIndex(auth.ContextWithUser(ctx, m.user), m.index)
 }
 
 func NewMultiService[U comparable](method string, udpTimeout int64, handler shadowsocks.Handler) (*MultiService[U], error) {
 	s := &MultiService[U]{
-		name:    method,
-		handler: handler,
-		udpNat:  udpnat.New[netip.AddrPort](udpTimeout, handler),
+		name:       method,
+		handler:    handler,
+		udpHandler: shadowsocks.NewMetricsUDPHandler(method, handler),
 	}
+	s.udpNat = shadowsocks.NewUDPNAT[netip.AddrPort](udpTimeout, s.udpHandler, shadowsocks.HashAddrPort)
+	s.udpNat.SetSessionRegistry(&s.registry)
+	s.UDPServer = shadowsocks.NewUDPServer[netip.AddrPort](method, handler, s.udpNat, &s.lifecycle, &s.metrics)
 	return s, nil
 }
 
+func (s *MultiService[U]) SetHandshakeTimeout(timeout time.Duration) {
+	s.handshake.SetHandshakeTimeout(timeout)
+}
+
+func (s *MultiService[U]) SetHandshakeLimit(limit int, queueTimeout time.Duration) {
+	s.handshake.SetHandshakeLimit(limit, queueTimeout)
+}
+
+func (s *MultiService[U]) SetACL(acl *shadowsocks.ACL) {
+	s.acl = acl
+}
+
+func (s *MultiService[U]) SetMetrics(metrics shadowsocks.Metrics) {
+	s.metrics = metrics
+	s.udpHandler.Metrics = metrics
+}
+
+// SetRandom replaces the entropy source of salts for all users. A nil random restores crypto/rand.
+func (s *MultiService[U]) SetRandom(random io.Reader) {
+	s.random = random
+	for _, user := range s.users {
+		user.SetRandom(random)
+	}
+}
+
 func (s *MultiService[U]) Name() string {
 	return s.name
 }
 
+// UpdateUsers replaces the users. A key given to several users authenticates the last of them.
 func (s *MultiService[U]) UpdateUsers(userList []U, keyList [][]byte) error {
-	s.methodMap = make(map[U]*Method)
+	keyLists := make([][]shadowsocks.ServerKey, len(userList))
+	for i := range userList {
+		keyLists[i] = []shadowsocks.ServerKey{{Key: keyList[i]}}
+	}
+	return s.updateUsers(userList, keyLists, false)
+}
+
+// UpdateUsersWithPasswords replaces the users. A password given to several users authenticates the last of them.
+func (s *MultiService[U]) UpdateUsersWithPasswords(userList []U, passwordList []string) error {
+	keyLists := make([][]shadowsocks.ServerKey, len(userList))
+	for i := range userList {
+		keyLists[i] = []shadowsocks.ServerKey{{Password: passwordList[i]}}
+	}
+	return s.updateUsers(userList, keyLists, false)
+}
+
+// UpdateUsersWithKeys replaces the users, each with a primary key followed by secondary keys.
+// All keys of a user authenticate as that user, and the index of the key used is stored in the context
+// with shadowsocks.ContextWithKeyIndex. Since a request cannot tell the users of a shared key apart,
+// a key listed more than once is rejected with shadowsocks.ErrDuplicateUserKey.
+func (s *MultiService[U]) UpdateUsersWithKeys(userList []U, keyLists [][]shadowsocks.ServerKey) error {
+	return s.updateUsers(userList, keyLists, true)
+}
+
+func (s *MultiService[U]) updateUsers(userList []U, keyLists [][]shadowsocks.ServerKey, rejectDuplicates bool) error {
+	var users []*userMethod[U]
+	keyIndex := make(map[string]int)
 	for i, user := range userList {
-		key := keyList[i]
-		method, err := New(s.name, key, "")
-		if err != nil {
-			return err
+		for index, key := range keyLists[i] {
+			method, err := New(s.name, key.Key, key.Password)
+			if err != nil {
+				return err
+			}
+			method.SetRandom(s.random)
+			userKey := &userMethod[U]{
+				Method:    method,
+				ServerKey: key,
+				user:      user,
+				index:     index,
+			}
+			if previous, loaded := keyIndex[string(method.key)]; loaded {
+				if rejectDuplicates {
+					return E.Extend(shadowsocks.ErrDuplicateUserKey, "user ", i, " key ", index)
+				}
+				users[previous] = userKey
+				continue
+			}
+			keyIndex[string(method.key)] = len(users)
+			users = append(users, userKey)
 		}
-		s.methodMap[user] = method
 	}
+	s.users = users
 	return nil
 }
 
-func (s *MultiService[U]) UpdateUsersWithPasswords(userList []U, passwordList []string) error {
-	s.methodMap = make(map[U]*Method)
-	for i, user := range userList {
-		password := passwordList[i]
-		method, err := New(s.name, nil, password)
-		if err != nil {
-			return err
+// activeUsers returns the user keys accepted now, copying the list only if some are not.
+func (s *MultiService[U]) activeUsers() []*userMethod[U] {
+	users := s.users
+	now := time.Now()
+	for i := range users {
+		if users[i].Active(now) {
+			continue
 		}
-		s.methodMap[user] = method
+		active := append(make([]*userMethod[U], 0, len(users)), users[:i]...)
+		for _, user := range users[i+1:] {
+			if user.Active(now) {
+				active = append(active, user)
+			}
+		}
+		return active
 	}
+	return users
+}
+
+func (s *MultiService[U]) Sessions() []shadowsocks.SessionInfo {
+	return s.registry.Sessions()
+}
+
+func (s *MultiService[U]) UserSessions(user any) []shadowsocks.SessionInfo {
+	return s.registry.UserSessions(user)
+}
+
+func (s *MultiService[U]) CloseSession(id uint64) bool {
+	return s.registry.CloseSession(id)
+}
+
+func (s *MultiService[U]) CloseUserSessions(user any) int {
+	return s.registry.CloseUserSessions(user)
+}
+
+func (s *MultiService[U]) Close() error {
+	s.lifecycle.Close()
+	s.udpNat.Close()
 	return nil
 }
 
+func (s *MultiService[U]) Shutdown(ctx context.Context) (shadowsocks.ShutdownStats, error) {
+	stats, err := s.lifecycle.Shutdown(ctx)
+	stats.Sessions = s.udpNat.Close()
+	return stats, err
+}
+
 func (s *MultiService[U]) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
-	err := s.newConnection(ctx, conn, metadata)
+	element, err := s.lifecycle.Acquire(conn)
+	if err != nil {
+		return &shadowsocks.ServerConnError{Conn: conn, Source: metadata.Source, Cause: err}
+	}
+	defer s.lifecycle.Release(element)
+	user, protocolConn, err := s.newConnection(ctx, conn, &metadata)
+	if err != nil {
+		if s.metrics != nil {
+			s.metrics.HandshakeRejected(s.name, err)
+		}
+	} else {
+		session := s.registry.RegisterKey(N.NetworkTCP, user.user, user.index, metadata, conn)
+		defer session.Unregister()
+		if s.metrics != nil {
+			s.metrics.HandshakeAccepted(s.name)
+			protocolConn = shadowsocks.NewMetricsConn(protocolConn, s.name, s.metrics)
+		}
+		err = s.handler.NewConnection(user.context(ctx), session.Conn(protocolConn), metadata)
+	}
 	if err != nil {
 		err = &shadowsocks.ServerConnError{Conn: conn, Source: metadata.Source, Cause: err}
 	}
 	return err
 }
 
-func (s *MultiService[U]) newConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
-	var user U
-	var method *Method
-	for u, m := range s.methodMap {
-		user, method = u, m
-		break
+func (s *MultiService[U]) newConnection(ctx context.Context, conn net.Conn, metadata *M.Metadata) (*userMethod[U], net.Conn, error) {
+	err := s.handshake.Start(ctx, conn)
+	if err != nil {
+		return nil, nil, err
 	}
-	if method == nil {
-		return shadowsocks.ErrNoUsers
+	defer s.handshake.Finish(conn)
+	users := s.activeUsers()
+	if len(users) == 0 {
+		return nil, nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonUnknownUser, 0, shadowsocks.ErrNoUsers)
 	}
-	header := buf.NewSize(method.keySaltLength + PacketLengthBufferSize + Overhead)
+	keySaltLength := users[0].keySaltLength
+	header := buf.NewSize(keySaltLength + PacketLengthBufferSize + Overhead)
 	defer header.Release()
 
-	_, err := header.ReadFullFrom(conn, header.FreeLen())
+	handshakeReader := &shadowsocks.HandshakeReader{Reader: conn}
+	_, err = header.ReadFullFrom(handshakeReader, header.FreeLen())
 	if err != nil {
-		return E.Cause(err, "read header")
+		return nil, nil, shadowsocks.NewHandshakeError(shadowsocks.ReadReason(err, shadowsocks.ReasonReadFailed), handshakeReader.Consumed, E.Cause(err, "read header"))
 	} else if !header.IsFull() {
-		return ErrBadHeader
+		return nil, nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonBadHeader, handshakeReader.Consumed, ErrBadHeader)
 	}
 
-	var reader *Reader
-	var readCipher cipher.AEAD
-	for u, m := range s.methodMap {
-		key := buf.NewSize(method.keySaltLength)
-		Kdf(m.key, header.To(m.keySaltLength), key)
-		readCipher, err = m.constructor(key.Bytes())
-		key.Release()
-		if err != nil {
-			return err
+	var (
+		user   *userMethod[U]
+		reader *Reader
+		length int
+	)
+	var lookupStart time.Time
+	if s.metrics != nil {
+		lookupStart = time.Now()
+	}
+	key := buf.NewSize(keySaltLength)
+	for _, candidateUser := range users {
+		key.FullReset()
+		Kdf(candidateUser.key, header.To(keySaltLength), key)
+		readCipher, cipherErr := candidateUser.constructor(key.Bytes())
+		if cipherErr != nil {
+			key.Release()
+			return nil, nil, cipherErr
 		}
-		reader = NewReader(conn, readCipher, MaxPacketSize)
-
-		err = reader.ReadWithLengthChunk(header.From(method.keySaltLength))
-		if err != nil {
-			continue
+		candidate := NewReader(handshakeReader, readCipher, MaxPacketSize)
+		length, err = candidate.openLength(header.From(keySaltLength))
+		if err == nil {
+			user, reader = candidateUser, candidate
+			break
 		}
-
-		user, method = u, m
-		break
 	}
+	key.Release()
+	if s.metrics != nil {
+		s.metrics.UserLookup(s.name, time.Since(lookupStart))
+	}
+	if reader == nil {
+		return nil, nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonUnknownUser, handshakeReader.Consumed, err)
+	}
+	err = reader.readChunk(length)
 	if err != nil {
-		return err
+		return nil, nil, shadowsocks.NewHandshakeError(shadowsocks.ReadReason(err, shadowsocks.ReasonDecryptFailed), handshakeReader.Consumed, err)
 	}
 
 	destination, err := M.SocksaddrSerializer.ReadAddrPort(reader)
 	if err != nil {
-		return err
+		return nil, nil, shadowsocks.NewHandshakeError(shadowsocks.ReadReason(err, shadowsocks.ReasonBadAddress), handshakeReader.Consumed, err)
+	}
+	if !s.acl.Allow(N.NetworkTCP, user.user, destination) {
+		return nil, nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonDenied, handshakeReader.Consumed, E.Extend(shadowsocks.ErrDestinationDenied, destination))
 	}
 
 	metadata.Protocol = "shadowsocks"
 	metadata.Destination = destination
 
-	return s.handler.NewConnection(auth.ContextWithUser(ctx, user), deadline.NewConn(&serverConn{
-		Method: method,
+	return user, deadline.NewConn(&serverConn{
+		Method: user.Method,
 		Conn:   conn,
 		reader: reader,
-	}), metadata)
+	}), nil
 }
 
 func (s *MultiService[U]) WriteIsThreadUnsafe() {
 }
 
 func (s *MultiService[U]) NewPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
-	err := s.newPacket(ctx, conn, buffer, metadata)
-	if err != nil {
-		err = &shadowsocks.ServerPacketError{Source: metadata.Source, Cause: err}
-	}
-	return err
+	return s.ServePacket(metadata, func() error {
+		return s.newPacket(ctx, conn, buffer, metadata)
+	})
 }
 
 func (s *MultiService[U]) newPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
-	var user U
-	var method *Method
-	for u, m := range s.methodMap {
-		user, method = u, m
-		break
-	}
-	if method == nil {
-		return shadowsocks.ErrNoUsers
-	}
-	if buffer.Len() < method.keySaltLength {
-		return io.ErrShortBuffer
-	}
-	var readCipher cipher.AEAD
-	var err error
-	for u, m := range s.methodMap {
-		key := buf.NewSize(m.keySaltLength)
-		Kdf(m.key, buffer.To(m.keySaltLength), key)
-		readCipher, err = m.constructor(key.Bytes())
-		key.Release()
-		if err != nil {
-			return err
-		}
-		var packet []byte
-		packet, err = readCipher.Open(buffer.Index(m.keySaltLength), rw.ZeroBytes[:readCipher.NonceSize()], buffer.From(m.keySaltLength), nil)
-		if err != nil {
-			continue
-		}
-
-		buffer.Advance(m.keySaltLength)
-		buffer.Truncate(len(packet))
-
-		user, method = u, m
-		break
+	users := s.activeUsers()
+	packetLen := buffer.Len()
+	if len(users) == 0 {
+		return shadowsocks.NewHandshakeError(shadowsocks.ReasonUnknownUser, packetLen, shadowsocks.ErrNoUsers)
+	}
+	keySaltLength := users[0].keySaltLength
+	if packetLen < keySaltLength {
+		return shadowsocks.NewHandshakeError(shadowsocks.ReasonBadHeader, packetLen, io.ErrShortBuffer)
+	}
+	var lookupStart time.Time
+	if s.metrics != nil {
+		lookupStart = time.Now()
+	}
+	user, packet, err := openUserPacket(users, buffer)
+	if s.metrics != nil {
+		s.metrics.UserLookup(s.name, time.Since(lookupStart))
 	}
 	if err != nil {
-		return err
+		return shadowsocks.NewHandshakeError(shadowsocks.ReasonUnknownUser, packetLen, err)
 	}
+	buffer.Advance(keySaltLength)
+	buffer.Truncate(len(packet))
 
 	destination, err := M.SocksaddrSerializer.ReadAddrPort(buffer)
 	if err != nil {
-		return err
+		return shadowsocks.NewHandshakeError(shadowsocks.ReasonBadAddress, packetLen, err)
+	}
+	if !s.acl.Allow(N.NetworkUDP, user.user, destination) {
+		return shadowsocks.NewHandshakeError(shadowsocks.ReasonDenied, packetLen, E.Extend(shadowsocks.ErrDestinationDenied, destination))
 	}
 
 	metadata.Protocol = "shadowsocks"
 	metadata.Destination = destination
-	s.udpNat.NewPacket(auth.ContextWithUser(ctx, user), metadata.Source.AddrPort(), buffer, metadata, func(natConn N.PacketConn) N.PacketWriter {
-		return &serverPacketWriter{method, conn, natConn}
+	if s.metrics != nil {
+		s.metrics.ReadBytes(s.name, int64(buffer.Len()))
+	}
+	s.udpNat.NewPacket(user.context(ctx), metadata.Source.AddrPort(), buffer, metadata, func(natConn N.PacketConn) N.PacketWriter {
+		return &serverPacketWriter{user.Method, conn, natConn, s.metrics}
 	})
 	return nil
 }
 
+// openUserPacket decrypts buffer in place with the first user key that opens it, trying all but
+// the last one into a scratch buffer as in Service.openPacket.
+func openUserPacket[U comparable](users []*userMethod[U], buffer *buf.Buffer) (*userMethod[U], []byte, error) {
+	keySaltLength := users[0].keySaltLength
+	var scratch *buf.Buffer
+	if len(users) > 1 {
+		scratch = buf.NewSize(buffer.Len())
+		defer scratch.Release()
+	}
+	key := buf.NewSize(keySaltLength)
+	defer key.Release()
+	for i, user := range users {
+		key.FullReset()
+		Kdf(user.key, buffer.To(keySaltLength), key)
+		readCipher, err := user.constructor(key.Bytes())
+		if err != nil {
+			return nil, nil, err
+		}
+		nonce := rw.ZeroBytes[:readCipher.NonceSize()]
+		if i == len(users)-1 {
+			packet, err := readCipher.Open(buffer.Index(keySaltLength), nonce, buffer.From(keySaltLength), nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			return user, packet, nil
+		}
+		packet, err := readCipher.Open(scratch.Index(0), nonce, buffer.From(keySaltLength), nil)
+		if err == nil {
+			return user, buffer.Index(keySaltLength)[:copy(buffer.From(keySaltLength), packet)], nil
+		}
+	}
+	return nil, nil, ErrBadHeader
+}
+
 func (s *MultiService[U]) NewError(ctx context.Context, err error) {
 	s.handler.NewError(ctx, err)
 }
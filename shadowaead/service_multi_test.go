@@ -0,0 +1,168 @@
+package shadowaead_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing-shadowsocks/internal/vectortest"
+	"github.com/sagernet/sing-shadowsocks/shadowaead"
+	"github.com/sagernet/sing/common/auth"
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+func FuzzMultiServiceNewConnection(f *testing.F) {
+	for _, password := range []string{"alice", "bob"} {
+		f.Add(clientRequest(f, testMethod, password, "test.com:443"))
+	}
+	service := newMultiService(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		service.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(data)}, M.Metadata{})
+	})
+}
+
+func FuzzMultiServiceNewPacket(f *testing.F) {
+	for _, password := range []string{"alice", "bob"} {
+		f.Add(clientPacket(f, testMethod, password, "test.com:443"))
+	}
+	service := newMultiService(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		buffer := buf.NewSize(len(data))
+		buffer.Write(data)
+		service.NewPacket(context.Background(), nil, buffer, M.Metadata{})
+	})
+}
+
+func BenchmarkMultiServiceNewConnection(b *testing.B) {
+	for _, userCount := range []int{10, 1000, 100000} {
+		b.Run(strconv.Itoa(userCount), func(b *testing.B) {
+			userList := make([]string, 0, userCount)
+			for i := 0; i < userCount; i++ {
+				userList = append(userList, strconv.Itoa(i))
+			}
+			service, err := shadowaead.NewMultiService[string](testMethod, 60, &benchmarkHandler{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = service.UpdateUsersWithPasswords(userList, userList)
+			if err != nil {
+				b.Fatal(err)
+			}
+			request := clientRequest(b, testMethod, userList[userCount/2], "test.com:443")
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err = service.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMultiServiceUserKeys(t *testing.T) {
+	t.Parallel()
+	handler := &keyIndexHandler{}
+	service, err := shadowaead.NewMultiService[string](testMethod, 60, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = service.UpdateUsersWithKeys([]string{"alice", "bob"}, [][]shadowsocks.ServerKey{
+		{
+			{Password: "alice"},
+			{Password: "alice old", NotAfter: time.Now().Add(time.Hour)},
+			{Password: "alice expired", NotAfter: time.Now().Add(-time.Second)},
+		},
+		{{Password: "bob"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index, password := range []string{"alice", "alice old"} {
+		err = service.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(clientRequest(t, testMethod, password, "test.com:443"))}, M.Metadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if handler.user != "alice" || handler.index != index {
+			t.Fatal("expected alice with key ", index, ", got ", handler.user, " with key ", handler.index)
+		}
+		source := M.ParseSocksaddrHostPort("127.0.0.1", uint16(10000+index))
+		err = service.NewPacket(context.Background(), &vectortest.BufferPacketConn{}, buf.As(clientPacket(t, testMethod, password, "1.1.1.1:53")), M.Metadata{Source: source})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var keyIndexes []int
+	for _, session := range service.UserSessions("alice") {
+		keyIndexes = append(keyIndexes, session.KeyIndex)
+	}
+	if len(keyIndexes) != 2 || keyIndexes[0]+keyIndexes[1] != 1 {
+		t.Fatal("bad session key indexes ", keyIndexes)
+	}
+
+	err = service.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(clientRequest(t, testMethod, "alice expired", "test.com:443"))}, M.Metadata{})
+	if shadowsocks.HandshakeReasonOf(err) != shadowsocks.ReasonUnknownUser {
+		t.Fatal("expected unknown user, got ", err)
+	}
+}
+
+func TestMultiServiceDuplicateUserKey(t *testing.T) {
+	t.Parallel()
+	handler := &keyIndexHandler{}
+	service, err := shadowaead.NewMultiService[string](testMethod, 60, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// UpdateUsersWithPasswords keeps loading configurations sharing a password, the last user wins.
+	err = service.UpdateUsersWithPasswords([]string{"alice", "bob"}, []string{"shared", "shared"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = service.UpdateUsersWithKeys([]string{"alice", "bob"}, [][]shadowsocks.ServerKey{
+		{{Password: "alice"}},
+		{{Password: "bob"}, {Password: "alice", NotAfter: time.Now().Add(time.Hour)}},
+	})
+	if !errors.Is(err, shadowsocks.ErrDuplicateUserKey) {
+		t.Fatal("expected duplicate key, got ", err)
+	}
+	// The failed update leaves the users in place.
+	err = service.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(clientRequest(t, testMethod, "shared", "test.com:443"))}, M.Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handler.user != "bob" {
+		t.Fatal("expected bob, got ", handler.user)
+	}
+}
+
+// keyIndexHandler records the user and key index of the last connection.
+type keyIndexHandler struct {
+	discardHandler
+	user  string
+	index int
+}
+
+func (h *keyIndexHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	h.user, _ = auth.UserFromContext[string](ctx)
+	h.index, _ = shadowsocks.KeyIndexFromContext(ctx)
+	return h.discardHandler.NewConnection(ctx, conn, metadata)
+}
+
+func newMultiService(t testing.TB) *shadowaead.MultiService[string] {
+	service, err := shadowaead.NewMultiService[string](testMethod, 60, &discardHandler{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = service.UpdateUsersWithPasswords([]string{"alice", "bob"}, []string{"alice", "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
@@ -0,0 +1,331 @@
+package shadowaead_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing-shadowsocks/internal/vectortest"
+	"github.com/sagernet/sing-shadowsocks/shadowaead"
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+const (
+	testMethod   = "aes-128-gcm"
+	testPassword = "password"
+)
+
+func TestServiceHandshakeTimeout(t *testing.T) {
+	t.Parallel()
+	service, err := shadowaead.NewService(testMethod, nil, testPassword, 60, &discardHandler{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.SetHandshakeTimeout(100 * time.Millisecond)
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	done := make(chan error)
+	go func() {
+		done <- service.NewConnection(context.Background(), serverConn, M.Metadata{})
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handshake not timed out")
+	}
+	if shadowsocks.HandshakeReasonOf(err) != shadowsocks.ReasonTimeout {
+		t.Fatal("expected timeout, got ", err)
+	}
+}
+
+func TestServiceUpdateKeys(t *testing.T) {
+	t.Parallel()
+	service, err := shadowaead.NewService(testMethod, nil, testPassword, 60, &replyHandler{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = service.UpdateKeys([]shadowsocks.ServerKey{
+		{Password: "new password"},
+		{Password: testPassword, NotAfter: time.Now().Add(time.Hour)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.Password() != "new password" {
+		t.Fatal("bad primary key")
+	}
+	for _, password := range []string{"new password", testPassword} {
+		method, err := shadowaead.New(testMethod, nil, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverConn, clientConn := net.Pipe()
+		go service.NewConnection(context.Background(), serverConn, M.Metadata{})
+		conn := method.DialEarlyConn(clientConn, M.ParseSocksaddr("test.com:443"))
+		_, err = conn.Write([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := make([]byte, 5)
+		_, err = io.ReadFull(conn, response)
+		if err != nil || string(response) != "hello" {
+			t.Fatal("bad response with ", password, ": ", err)
+		}
+		conn.Close()
+
+		err = service.NewPacket(context.Background(), &vectortest.BufferPacketConn{}, buf.As(clientPacket(t, testMethod, password, "1.1.1.1:53")), M.Metadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = service.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(clientRequest(t, testMethod, "bad password", "test.com:443"))}, M.Metadata{})
+	if shadowsocks.HandshakeReasonOf(err) != shadowsocks.ReasonDecryptFailed {
+		t.Fatal("expected decrypt failure, got ", err)
+	}
+	err = service.UpdateKeys([]shadowsocks.ServerKey{
+		{Password: "new password"},
+		{Password: testPassword, NotAfter: time.Now().Add(-time.Second)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = service.NewPacket(context.Background(), &vectortest.BufferPacketConn{}, buf.As(clientPacket(t, testMethod, testPassword, "1.1.1.1:53")), M.Metadata{})
+	if shadowsocks.HandshakeReasonOf(err) != shadowsocks.ReasonDecryptFailed {
+		t.Fatal("expected decrypt failure, got ", err)
+	}
+}
+
+func FuzzServiceNewConnection(f *testing.F) {
+	for _, destination := range []string{"test.com:443", "1.1.1.1:53", "[::1]:80"} {
+		f.Add(clientRequest(f, testMethod, testPassword, destination))
+	}
+	service, err := shadowaead.NewService(testMethod, nil, testPassword, 60, &discardHandler{})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		service.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(data)}, M.Metadata{})
+	})
+}
+
+func FuzzServiceNewPacket(f *testing.F) {
+	for _, destination := range []string{"test.com:443", "1.1.1.1:53", "[::1]:80"} {
+		f.Add(clientPacket(f, testMethod, testPassword, destination))
+	}
+	service, err := shadowaead.NewService(testMethod, nil, testPassword, 60, &discardHandler{})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		buffer := buf.NewSize(len(data))
+		buffer.Write(data)
+		service.NewPacket(context.Background(), nil, buffer, M.Metadata{})
+	})
+}
+
+func BenchmarkServiceNewConnection(b *testing.B) {
+	for _, method := range shadowaead.List {
+		b.Run(method, func(b *testing.B) {
+			service, err := shadowaead.NewService(method, nil, testPassword, 60, &benchmarkHandler{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			request := clientRequest(b, method, testPassword, "test.com:443")
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err = service.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkServiceNewPacket(b *testing.B) {
+	for _, method := range shadowaead.List {
+		b.Run(method, func(b *testing.B) {
+			service, err := shadowaead.NewService(method, nil, testPassword, 60, &discardHandler{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			packet := clientPacket(b, method, testPassword, "test.com:443")
+			b.SetBytes(int64(len(packet)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				buffer := buf.NewPacket()
+				buffer.Write(packet)
+				err = service.NewPacket(ctx, nil, buffer, M.Metadata{})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkServiceWritePacket(b *testing.B) {
+	for _, method := range shadowaead.List {
+		b.Run(method, func(b *testing.B) {
+			handler := &benchmarkHandler{conns: make(chan N.PacketConn, 1)}
+			service, err := shadowaead.NewService(method, nil, testPassword, 60, handler)
+			if err != nil {
+				b.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			packet := clientPacket(b, method, testPassword, "test.com:443")
+			err = service.NewPacket(ctx, &vectortest.BufferPacketConn{}, buf.As(packet), M.Metadata{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			conn := <-handler.conns
+			destination := M.ParseSocksaddr("test.com:443")
+			payload := make([]byte, 1024)
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				buffer := buf.NewPacket()
+				buffer.Resize(256, 0)
+				buffer.Write(payload)
+				err = conn.WritePacket(buffer, destination)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func clientRequest(t testing.TB, methodName string, password string, destination string) []byte {
+	method, err := shadowaead.New(methodName, nil, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufferConn{}
+	_, err = method.DialEarlyConn(conn, M.ParseSocksaddr(destination)).Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn.writer.Bytes()
+}
+
+func clientPacket(t testing.TB, methodName string, password string, destination string) []byte {
+	method, err := shadowaead.New(methodName, nil, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufferConn{}
+	_, err = method.DialPacketConn(conn).WriteTo([]byte("hello"), M.ParseSocksaddr(destination))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn.writer.Bytes()
+}
+
+type bufferConn struct {
+	reader io.Reader
+	writer bytes.Buffer
+}
+
+func (c *bufferConn) Read(p []byte) (n int, err error) {
+	if c.reader == nil {
+		return 0, io.EOF
+	}
+	return c.reader.Read(p)
+}
+
+func (c *bufferConn) Write(p []byte) (n int, err error) {
+	return c.writer.Write(p)
+}
+
+func (c *bufferConn) Close() error {
+	return nil
+}
+
+func (c *bufferConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *bufferConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *bufferConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *bufferConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *bufferConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type discardHandler struct{}
+
+func (h *discardHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	_, err := io.Copy(io.Discard, conn)
+	return err
+}
+
+func (h *discardHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	for {
+		buffer := buf.NewPacket()
+		_, err := conn.ReadPacket(buffer)
+		buffer.Release()
+		if errors.Is(err, io.ErrClosedPipe) {
+			return nil
+		}
+	}
+}
+
+func (h *discardHandler) NewError(ctx context.Context, err error) {
+}
+
+// replyHandler echoes the first read of a connection.
+type replyHandler struct {
+	discardHandler
+}
+
+func (h *replyHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	buffer := make([]byte, 1024)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(buffer[:n])
+	return err
+}
+
+// benchmarkHandler returns as soon as the handshake is done, and hands out the first packet connection
+// holding it until the context is done.
+type benchmarkHandler struct {
+	discardHandler
+	conns chan N.PacketConn
+}
+
+func (h *benchmarkHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	return nil
+}
+
+func (h *benchmarkHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	h.conns <- conn
+	<-ctx.Done()
+	return nil
+}
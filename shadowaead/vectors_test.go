@@ -0,0 +1,225 @@
+package shadowaead_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/sagernet/sing-shadowsocks/internal/vectortest"
+	"github.com/sagernet/sing-shadowsocks/shadowaead"
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+var vectorDestination = M.ParseSocksaddr("example.com:443")
+
+type vector struct {
+	Method   string `json:"method"`
+	Password string `json:"password"`
+
+	TCPClientRandom string `json:"tcp_client_random"`
+	TCPServerRandom string `json:"tcp_server_random"`
+	TCPRequest      string `json:"tcp_request"`
+	TCPResponse     string `json:"tcp_response"`
+
+	UDPClientRandom string `json:"udp_client_random"`
+	UDPServerRandom string `json:"udp_server_random"`
+	UDPRequest      string `json:"udp_request"`
+	UDPResponse     string `json:"udp_response"`
+}
+
+func TestVectors(t *testing.T) {
+	vectors := loadVectors(t)
+	if len(vectors) != len(shadowaead.List) {
+		t.Fatal("missing vectors")
+	}
+	for _, v := range vectors {
+		t.Run(v.Method, func(t *testing.T) {
+			testTCPVector(t, v)
+			testUDPVector(t, v)
+		})
+	}
+}
+
+// TestVectorsSpec decodes the vectors with bare primitives, following SIP004 rather than this package.
+func TestVectorsSpec(t *testing.T) {
+	// ATYP domain name, length, name, port
+	address := append([]byte{3, 11}, "example.com"...)
+	address = append(address, 0x01, 0xbb)
+	for _, v := range loadVectors(t) {
+		t.Run(v.Method, func(t *testing.T) {
+			var keyLength int
+			var constructor func(key []byte) (cipher.AEAD, error)
+			switch v.Method {
+			case "aes-128-gcm", "aes-192-gcm", "aes-256-gcm":
+				keyLength = map[string]int{"aes-128-gcm": 16, "aes-192-gcm": 24, "aes-256-gcm": 32}[v.Method]
+				constructor = func(key []byte) (cipher.AEAD, error) {
+					block, err := aes.NewCipher(key)
+					if err != nil {
+						return nil, err
+					}
+					return cipher.NewGCM(block)
+				}
+			case "chacha20-ietf-poly1305":
+				keyLength = chacha20poly1305.KeySize
+				constructor = chacha20poly1305.New
+			case "xchacha20-ietf-poly1305":
+				keyLength = chacha20poly1305.KeySize
+				constructor = chacha20poly1305.NewX
+			default:
+				t.Fatal("unknown method")
+			}
+			var key, digest []byte
+			for len(key) < keyLength {
+				hash := md5.Sum(append(digest, v.Password...))
+				digest = hash[:]
+				key = append(key, digest...)
+			}
+			newAEAD := func(salt []byte) cipher.AEAD {
+				subkey := make([]byte, keyLength)
+				common.Must1(io.ReadFull(hkdf.New(sha1.New, key[:keyLength], salt, []byte("ss-subkey")), subkey))
+				return common.Must1(constructor(subkey))
+			}
+			decodeStream := func(name string, content string, expected []byte) {
+				data := vectortest.DecodeHex(t, content)
+				aead := newAEAD(data[:keyLength])
+				nonce := make([]byte, aead.NonceSize())
+				var payload []byte
+				for chunk := data[keyLength:]; len(chunk) > 0; {
+					length, err := aead.Open(nil, nonce, chunk[:2+aead.Overhead()], nil)
+					if err != nil {
+						t.Fatal(name, ": ", err)
+					}
+					nonce[0]++
+					chunk = chunk[2+aead.Overhead():]
+					payloadLength := int(binary.BigEndian.Uint16(length)) + aead.Overhead()
+					chunkPayload, err := aead.Open(nil, nonce, chunk[:payloadLength], nil)
+					if err != nil {
+						t.Fatal(name, ": ", err)
+					}
+					nonce[0]++
+					chunk = chunk[payloadLength:]
+					payload = append(payload, chunkPayload...)
+				}
+				if !bytes.Equal(payload, expected) {
+					t.Fatalf("%s: decoded %x", name, payload)
+				}
+			}
+			decodePacket := func(name string, content string, expected []byte) {
+				data := vectortest.DecodeHex(t, content)
+				aead := newAEAD(data[:keyLength])
+				payload, err := aead.Open(nil, make([]byte, aead.NonceSize()), data[keyLength:], nil)
+				if err != nil {
+					t.Fatal(name, ": ", err)
+				}
+				if !bytes.Equal(payload, expected) {
+					t.Fatalf("%s: decoded %x", name, payload)
+				}
+			}
+			decodeStream("tcp request", v.TCPRequest, append(address, vectortest.Request...))
+			decodeStream("tcp response", v.TCPResponse, vectortest.Response)
+			decodePacket("udp request", v.UDPRequest, append(address, vectortest.Request...))
+			decodePacket("udp response", v.UDPResponse, append(address, vectortest.Response...))
+		})
+	}
+}
+
+func testTCPVector(t *testing.T, v *vector) {
+	client, err := shadowaead.New(v.Method, nil, v.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetRandom(vectortest.HexReader(t, v.TCPClientRandom))
+	clientConn := &bufferConn{}
+	conn := client.DialEarlyConn(clientConn, vectorDestination)
+	_, err = conn.Write(vectortest.Request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectortest.Check(t, "tcp request", v.TCPRequest, clientConn.writer.Bytes())
+
+	service, err := shadowaead.NewService(v.Method, nil, v.Password, 60, &vectortest.Handler{T: t, Destination: vectorDestination})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.SetRandom(vectortest.HexReader(t, v.TCPServerRandom))
+	serverConn := &bufferConn{reader: bytes.NewReader(vectortest.DecodeHex(t, v.TCPRequest))}
+	err = service.NewConnection(context.Background(), serverConn, M.Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectortest.Check(t, "tcp response", v.TCPResponse, serverConn.writer.Bytes())
+
+	clientConn.reader = bytes.NewReader(vectortest.DecodeHex(t, v.TCPResponse))
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, vectortest.Response) {
+		t.Fatalf("tcp response: decoded %q", response)
+	}
+}
+
+func testUDPVector(t *testing.T, v *vector) {
+	client, err := shadowaead.New(v.Method, nil, v.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetRandom(vectortest.HexReader(t, v.UDPClientRandom))
+	clientConn := &bufferConn{}
+	packetConn := client.DialPacketConn(clientConn)
+	_, err = packetConn.WriteTo(vectortest.Request, vectorDestination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectortest.Check(t, "udp request", v.UDPRequest, clientConn.writer.Bytes())
+
+	handler := &vectortest.Handler{T: t, Destination: vectorDestination, Done: make(chan struct{})}
+	service, err := shadowaead.NewService(v.Method, nil, v.Password, 60, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.SetRandom(vectortest.HexReader(t, v.UDPServerRandom))
+	serverConn := &vectortest.BufferPacketConn{}
+	err = service.NewPacket(context.Background(), serverConn, buf.As(vectortest.DecodeHex(t, v.UDPRequest)), M.Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-handler.Done
+	vectortest.Check(t, "udp response", v.UDPResponse, serverConn.Packet)
+
+	clientConn.reader = bytes.NewReader(vectortest.DecodeHex(t, v.UDPResponse))
+	response := make([]byte, 1024)
+	n, addr, err := packetConn.ReadFrom(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if M.SocksaddrFromNet(addr) != vectorDestination || !bytes.Equal(response[:n], vectortest.Response) {
+		t.Fatalf("udp response: decoded %q from %s", response[:n], addr)
+	}
+}
+
+func loadVectors(t *testing.T) []*vector {
+	content, err := os.ReadFile("testdata/vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []*vector
+	err = json.Unmarshal(content, &vectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vectors
+}
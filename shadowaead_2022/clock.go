@@ -0,0 +1,38 @@
+package shadowaead_2022
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/atomic"
+)
+
+// clockSkew estimates the offset of the server clock from the local clock with the timestamps
+// of server responses, smoothed over the last few of them.
+type clockSkew struct {
+	access   sync.Mutex
+	samples  uint64
+	estimate time.Duration
+	current  atomic.TypedValue[time.Duration]
+}
+
+// observe updates the estimate with a server timestamp received at local time now.
+func (c *clockSkew) observe(epoch uint64, now time.Time) {
+	// The server truncates its clock to the second, the middle of that second is the best guess.
+	skew := time.Unix(int64(epoch), int64(time.Second/2)).Sub(now)
+	c.access.Lock()
+	if c.samples == 0 {
+		c.estimate = skew
+	} else {
+		c.estimate += (skew - c.estimate) / 8
+	}
+	c.samples++
+	c.current.Store(c.estimate)
+	c.access.Unlock()
+}
+
+func (c *clockSkew) load() (time.Duration, bool) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.estimate, c.samples > 0
+}
@@ -0,0 +1,40 @@
+package shadowaead_2022
+
+import (
+	"io"
+	"time"
+
+	"github.com/sagernet/sing/common/replay"
+)
+
+// ServiceOption configures a service at construction.
+type ServiceOption func(options *serviceOptions)
+
+type serviceOptions struct {
+	replayFilter replay.Filter
+}
+
+// WithReplayFilter replaces the in-memory filter used to reject replayed request salts.
+// The service owns the filter: Close and Shutdown close it if it implements io.Closer.
+func WithReplayFilter(filter replay.Filter) ServiceOption {
+	return func(options *serviceOptions) {
+		options.replayFilter = filter
+	}
+}
+
+func newServiceOptions(options []ServiceOption) serviceOptions {
+	serviceOptions := serviceOptions{
+		replayFilter: replay.NewSimple(60 * time.Second),
+	}
+	for _, option := range options {
+		option(&serviceOptions)
+	}
+	return serviceOptions
+}
+
+func closeReplayFilter(filter replay.Filter) error {
+	if closer, isCloser := filter.(io.Closer); isCloser {
+		return closer.Close()
+	}
+	return nil
+}
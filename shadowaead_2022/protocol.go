@@ -14,6 +14,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -26,7 +27,6 @@ import (
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
 	"github.com/sagernet/sing/common/random"
-	"github.com/sagernet/sing/common/rw"
 
 	"golang.org/x/crypto/chacha20poly1305"
 	"lukechampine.com/blake3"
@@ -40,6 +40,9 @@ const (
 	MaxPacketSize                 = 65535
 	RequestHeaderFixedChunkLength = 1 + 8 + 2
 	PacketMinimalHeaderSize       = 30
+	// MaxTimestampDiff is the largest difference in seconds between the clocks of a client and a server
+	// that still accept each other's timestamps.
+	MaxTimestampDiff = 30
 )
 
 var (
@@ -52,6 +55,7 @@ var (
 	ErrPacketIdNotUnique     = E.New("packet id not unique")
 	ErrTooManyServerSessions = E.New("server session changed more than once during the last minute")
 	ErrPacketTooShort        = E.New("packet too short")
+	ErrPacketTooLarge        = E.New("packet too large")
 )
 
 var List = []string{
@@ -85,6 +89,8 @@ func New(method string, pskList [][]byte, timeFunc func() time.Time) (shadowsock
 	m := &Method{
 		name:     method,
 		timeFunc: timeFunc,
+		random:   rand.Reader,
+		intn:     mRand.Intn,
 	}
 
 	switch method {
@@ -156,14 +162,79 @@ func Key(key []byte, keyLength int) []byte {
 }
 
 func SessionKey(psk []byte, salt []byte, keyLength int) []byte {
-	sessionKey := make([]byte, len(psk)+len(salt))
-	copy(sessionKey, psk)
-	copy(sessionKey[len(psk):], salt)
 	outKey := make([]byte, keyLength)
-	blake3.DeriveKey(outKey, "shadowsocks 2022 session subkey", sessionKey)
+	deriveKey(outKey, "shadowsocks 2022 session subkey", psk, salt)
 	return outKey
 }
 
+// deriveKey derives the subkey of psk and salt for context into dst.
+func deriveKey(dst []byte, context string, psk []byte, salt []byte) {
+	var _keyMaterial [2 * keySaltMaxLength]byte
+	keyMaterial := append(append(_keyMaterial[:0], psk...), salt...)
+	blake3.DeriveKey(dst, context, keyMaterial)
+}
+
+// newSessionCipher returns the AEAD keyed with the session subkey of psk and salt.
+func newSessionCipher(constructor func(key []byte) (cipher.AEAD, error), psk []byte, salt []byte, keyLength int) (cipher.AEAD, error) {
+	scratch := newHandshakeBuffer()
+	defer scratch.release()
+	key := scratch[:keyLength]
+	deriveKey(key, "shadowsocks 2022 session subkey", psk, salt)
+	return constructor(key)
+}
+
+// newIdentityCipher returns the block cipher keyed with the identity subkey of psk and salt.
+func newIdentityCipher(blockConstructor func(key []byte) (cipher.Block, error), psk []byte, salt []byte, keyLength int) (cipher.Block, error) {
+	scratch := newHandshakeBuffer()
+	defer scratch.release()
+	key := scratch[:keyLength]
+	deriveKey(key, "shadowsocks 2022 identity subkey", psk, salt)
+	return blockConstructor(key)
+}
+
+// keySaltMaxLength is the largest key and salt length of all methods.
+const keySaltMaxLength = 32
+
+// handshakeBuffer is scratch space for subkeys and fixed length headers,
+// pooled so that handshakes do not allocate.
+type handshakeBuffer [128]byte
+
+var handshakeBufferPool = sync.Pool{
+	New: func() any {
+		return new(handshakeBuffer)
+	},
+}
+
+func newHandshakeBuffer() *handshakeBuffer {
+	return handshakeBufferPool.Get().(*handshakeBuffer)
+}
+
+// release clears the buffer, which may hold key material, and returns it to the pool.
+func (b *handshakeBuffer) release() {
+	*b = handshakeBuffer{}
+	handshakeBufferPool.Put(b)
+}
+
+// readUint16 reads a big endian uint16 without the allocation of binary.Read.
+func readUint16(reader io.ByteReader) (uint16, error) {
+	high, err := reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	low, err := reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	return uint16(high)<<8 | uint16(low), nil
+}
+
+// clearPadding zeroes padding extended from a pooled buffer, which may hold stale data.
+func clearPadding(padding []byte) {
+	for i := range padding {
+		padding[i] = 0
+	}
+}
+
 func aeadCipher(block func(key []byte) (cipher.Block, error), aead func(block cipher.Block) (cipher.AEAD, error)) func(key []byte) (cipher.AEAD, error) {
 	return func(key []byte) (cipher.AEAD, error) {
 		b, err := block(key)
@@ -178,6 +249,14 @@ type Method struct {
 	name          string
 	keySaltLength int
 	timeFunc      func() time.Time
+	random        io.Reader
+	intn          func(n int) int
+
+	udpSessionLifetime time.Duration
+	udpSessionPackets  uint64
+	mtu                int
+	skew               clockSkew
+	skewCorrection     bool
 
 	constructor           func(key []byte) (cipher.AEAD, error)
 	blockConstructor      func(key []byte) (cipher.Block, error)
@@ -192,6 +271,49 @@ func (m *Method) Name() string {
 	return m.name
 }
 
+// SetRandom replaces the entropy source of salts and UDP sessions. A nil random restores crypto/rand.
+func (m *Method) SetRandom(random io.Reader) {
+	if random == nil {
+		random = rand.Reader
+	}
+	m.random = random
+}
+
+// SetPaddingRNG replaces the generator of padding lengths, which must return a value in [0, n).
+// A nil intn restores math/rand.
+func (m *Method) SetPaddingRNG(intn func(n int) int) {
+	if intn == nil {
+		intn = mRand.Intn
+	}
+	m.intn = intn
+}
+
+// SetUDPSessionRotation makes packet connections start a new session once the current one is older than lifetime
+// or has sent packets packets. Zero disables either limit. Sessions always rotate before the packet ID wraps.
+func (m *Method) SetUDPSessionRotation(lifetime time.Duration, packets uint64) {
+	m.udpSessionLifetime = lifetime
+	m.udpSessionPackets = packets
+}
+
+// SetMTU sets the path MTU of UDP packets, padding is capped to fit it and larger packets are rejected.
+// Zero disables the limit.
+func (m *Method) SetMTU(mtu int) {
+	m.mtu = mtu
+}
+
+// SetClockSkewCorrection makes later requests and packets use the local clock shifted by the estimated
+// clock skew, so a drifting client clock stays within MaxTimestampDiff of the server.
+func (m *Method) SetClockSkewCorrection(enabled bool) {
+	m.skewCorrection = enabled
+}
+
+// ClockSkew returns the estimated offset of the server clock from the local clock, positive if the server
+// is ahead. It is estimated from the timestamps of server responses, ok is false until one is received.
+// Clients can warn when it approaches MaxTimestampDiff, as servers reject requests beyond it.
+func (m *Method) ClockSkew() (skew time.Duration, ok bool) {
+	return m.skew.load()
+}
+
 func (m *Method) DialConn(conn net.Conn, destination M.Socksaddr) (net.Conn, error) {
 	shadowsocksConn := &clientConn{
 		Method:      m,
@@ -210,19 +332,24 @@ func (m *Method) DialEarlyConn(conn net.Conn, destination M.Socksaddr) net.Conn
 }
 
 func (m *Method) DialPacketConn(conn net.Conn) N.NetPacketConn {
-	return &clientPacketConn{m, conn, m.newUDPSession()}
+	return &clientPacketConn{Method: m, Conn: conn, session: m.newUDPSession()}
 }
 
 type clientConn struct {
 	*Method
 	net.Conn
 	destination M.Socksaddr
-	requestSalt []byte
+	requestSalt [keySaltMaxLength]byte
 	reader      *shadowaead.Reader
 	writer      *shadowaead.Writer
+	newBuffer   func() *buf.Buffer
 }
 
 func (m *Method) time() time.Time {
+	return m.correctTime(m.localTime())
+}
+
+func (m *Method) localTime() time.Time {
 	if m.timeFunc != nil {
 		return m.timeFunc()
 	} else {
@@ -230,28 +357,40 @@ func (m *Method) time() time.Time {
 	}
 }
 
+func (m *Method) correctTime(now time.Time) time.Time {
+	if m.skewCorrection {
+		now = now.Add(m.skew.current.Load())
+	}
+	return now
+}
+
+// checkTimestamp records the skew of a server timestamp, then checks it against the clock
+// the request was made with.
+func (m *Method) checkTimestamp(epoch uint64) error {
+	now := m.localTime()
+	current := m.correctTime(now)
+	m.skew.observe(epoch, now)
+	diff := int(math.Abs(float64(current.Unix() - int64(epoch))))
+	if diff > MaxTimestampDiff {
+		return E.Extend(ErrBadTimestamp, "received ", epoch, ", diff ", diff, "s")
+	}
+	return nil
+}
+
 func (m *Method) writeExtendedIdentityHeaders(request *buf.Buffer, salt []byte) error {
 	pskLen := len(m.pskList)
 	if pskLen < 2 {
 		return nil
 	}
 	for i, psk := range m.pskList {
-		keyMaterial := make([]byte, m.keySaltLength*2)
-		copy(keyMaterial, psk)
-		copy(keyMaterial[m.keySaltLength:], salt)
-		identitySubkey := buf.NewSize(m.keySaltLength)
-		identitySubkey.Extend(identitySubkey.FreeLen())
-		blake3.DeriveKey(identitySubkey.Bytes(), "shadowsocks 2022 identity subkey", keyMaterial)
-
 		pskHash := m.pskHash[aes.BlockSize*i : aes.BlockSize*(i+1)]
 
 		header := request.Extend(16)
-		b, err := m.blockConstructor(identitySubkey.Bytes())
+		b, err := newIdentityCipher(m.blockConstructor, psk, salt, m.keySaltLength)
 		if err != nil {
 			return err
 		}
 		b.Encrypt(header, pskHash)
-		identitySubkey.Release()
 		if i == pskLen-2 {
 			break
 		}
@@ -260,11 +399,10 @@ func (m *Method) writeExtendedIdentityHeaders(request *buf.Buffer, salt []byte)
 }
 
 func (c *clientConn) writeRequest(payload []byte) error {
-	salt := make([]byte, c.keySaltLength)
-	common.Must1(io.ReadFull(rand.Reader, salt))
+	salt := c.requestSalt[:c.keySaltLength]
+	common.Must1(io.ReadFull(c.random, salt))
 
-	key := SessionKey(c.pskList[len(c.pskList)-1], salt, c.keySaltLength)
-	writeCipher, err := c.constructor(key)
+	writeCipher, err := newSessionCipher(c.constructor, c.pskList[len(c.pskList)-1], salt, c.keySaltLength)
 	if err != nil {
 		return err
 	}
@@ -282,19 +420,24 @@ func (c *clientConn) writeRequest(payload []byte) error {
 		return err
 	}
 
-	var _fixedLengthBuffer [RequestHeaderFixedChunkLength]byte
-	fixedLengthBuffer := buf.With(_fixedLengthBuffer[:])
-	common.Must(fixedLengthBuffer.WriteByte(HeaderTypeClient))
-	common.Must(binary.Write(fixedLengthBuffer, binary.BigEndian, uint64(c.time().Unix())))
+	scratch := newHandshakeBuffer()
+	defer scratch.release()
+	fixedLengthChunk := scratch[:RequestHeaderFixedChunkLength]
+	fixedLengthChunk[0] = HeaderTypeClient
+	binary.BigEndian.PutUint64(fixedLengthChunk[1:], uint64(c.time().Unix()))
 	var paddingLen int
 	if len(payload) < MaxPaddingLength {
-		paddingLen = mRand.Intn(MaxPaddingLength) + 1
+		paddingLen = c.intn(MaxPaddingLength) + 1
 	}
 	variableLengthHeaderLen := M.SocksaddrSerializer.AddrPortLen(c.destination) + 2 + paddingLen
 	payloadLen := len(payload)
+	maxPayloadLen := header.FreeLen() - RequestHeaderFixedChunkLength - 2*shadowaead.Overhead - variableLengthHeaderLen
+	if payloadLen > maxPayloadLen {
+		payloadLen = maxPayloadLen
+	}
 	variableLengthHeaderLen += payloadLen
-	common.Must(binary.Write(fixedLengthBuffer, binary.BigEndian, uint16(variableLengthHeaderLen)))
-	writer.WriteChunk(header, fixedLengthBuffer.Bytes())
+	binary.BigEndian.PutUint16(fixedLengthChunk[9:], uint16(variableLengthHeaderLen))
+	writer.WriteChunk(header, fixedLengthChunk)
 
 	variableLengthBuffer := buf.NewSize(variableLengthHeaderLen)
 	err = M.SocksaddrSerializer.WriteAddrPort(variableLengthBuffer, c.destination)
@@ -303,7 +446,7 @@ func (c *clientConn) writeRequest(payload []byte) error {
 	}
 	common.Must(binary.Write(variableLengthBuffer, binary.BigEndian, uint16(paddingLen)))
 	if paddingLen > 0 {
-		variableLengthBuffer.Extend(paddingLen)
+		clearPadding(variableLengthBuffer.Extend(paddingLen))
 	}
 	if payloadLen > 0 {
 		common.Must1(variableLengthBuffer.Write(payload[:payloadLen]))
@@ -316,7 +459,13 @@ func (c *clientConn) writeRequest(payload []byte) error {
 		return E.Cause(err, "client handshake")
 	}
 
-	c.requestSalt = salt
+	if payloadLen < len(payload) {
+		_, err = writer.Write(payload[payloadLen:])
+		if err != nil {
+			return err
+		}
+	}
+
 	c.writer = writer
 	return nil
 }
@@ -326,18 +475,15 @@ func (c *clientConn) readResponse() error {
 		return nil
 	}
 
-	salt := buf.NewSize(c.keySaltLength)
-
-	_, err := salt.ReadFullFrom(c.Conn, salt.FreeLen())
+	scratch := newHandshakeBuffer()
+	defer scratch.release()
+	salt := scratch[:c.keySaltLength]
+	_, err := io.ReadFull(c.Conn, salt)
 	if err != nil {
-		salt.Release()
 		return err
 	}
 
-	key := SessionKey(c.pskList[len(c.pskList)-1], salt.Bytes(), c.keySaltLength)
-	salt.Release()
-
-	readCipher, err := c.constructor(key)
+	readCipher, err := newSessionCipher(c.constructor, c.pskList[len(c.pskList)-1], salt, c.keySaltLength)
 	if err != nil {
 		return err
 	}
@@ -352,43 +498,22 @@ func (c *clientConn) readResponse() error {
 		return E.Cause(err, "read response fixed length chunk")
 	}
 
-	headerType, err := rw.ReadByte(reader)
-	if err != nil {
-		return err
-	}
+	fixedChunk := reader.CachedSlice()
+	headerType := fixedChunk[0]
 	if headerType != HeaderTypeServer /* && headerType != HeaderTypeServerEncrypted*/ {
 		return E.Extend(ErrBadHeaderType, "expected ", HeaderTypeServer, ", got ", headerType)
 	}
 
-	var epoch uint64
-	err = binary.Read(reader, binary.BigEndian, &epoch)
+	err = c.checkTimestamp(binary.BigEndian.Uint64(fixedChunk[1:]))
 	if err != nil {
 		return err
 	}
 
-	diff := int(math.Abs(float64(c.time().Unix() - int64(epoch))))
-	if diff > 30 {
-		return E.Extend(ErrBadTimestamp, "received ", epoch, ", diff ", diff, "s")
-	}
-
-	requestSalt := buf.NewSize(c.keySaltLength)
-	_, err = requestSalt.ReadFullFrom(reader, requestSalt.FreeLen())
-	if err != nil {
-		return err
-	}
-
-	if bytes.Compare(requestSalt.Bytes(), c.requestSalt) > 0 {
+	if bytes.Compare(fixedChunk[9:9+c.keySaltLength], c.requestSalt[:c.keySaltLength]) > 0 {
 		return ErrBadRequestSalt
 	}
-	requestSalt.Release()
-	c.requestSalt = nil
-
-	var length uint16
-	err = binary.Read(reader, binary.BigEndian, &length)
-	if err != nil {
-		return err
-	}
 
+	length := binary.BigEndian.Uint16(fixedChunk[9+c.keySaltLength:])
 	err = reader.ReadWithLength(length)
 	if err != nil {
 		return err
@@ -439,6 +564,48 @@ func (c *clientConn) WriteVectorised(buffers []*buf.Buffer) error {
 	return c.writer.WriteVectorised(buffers[1:])
 }
 
+var (
+	_ N.ExtendedConn = (*clientConn)(nil)
+	_ N.ReadWaiter   = (*clientConn)(nil)
+)
+
+func (c *clientConn) ReadBuffer(buffer *buf.Buffer) error {
+	err := c.readResponse()
+	if err != nil {
+		return err
+	}
+	return c.reader.ReadBuffer(buffer)
+}
+
+func (c *clientConn) WriteBuffer(buffer *buf.Buffer) error {
+	if c.writer == nil {
+		defer buffer.Release()
+		return c.writeRequest(buffer.Bytes())
+	}
+	return c.writer.WriteBuffer(buffer)
+}
+
+func (c *clientConn) InitializeReadWaiter(newBuffer func() *buf.Buffer) {
+	c.newBuffer = newBuffer
+}
+
+func (c *clientConn) WaitReadBuffer() error {
+	buffer := c.newBuffer()
+	err := c.ReadBuffer(buffer)
+	if err != nil {
+		buffer.Release()
+	}
+	return err
+}
+
+func (c *clientConn) FrontHeadroom() int {
+	return shadowaead.PacketLengthBufferSize + shadowaead.Overhead
+}
+
+func (c *clientConn) RearHeadroom() int {
+	return shadowaead.Overhead
+}
+
 func (c *clientConn) NeedHandshake() bool {
 	return c.writer == nil
 }
@@ -459,39 +626,89 @@ func (c *clientConn) Close() error {
 	)
 }
 
+// UDPSessionRotator is implemented by packet connections returned from Method.DialPacketConn.
+type UDPSessionRotator interface {
+	// RotateSession starts a new client session. Responses to the previous session are still accepted
+	// until the next rotation.
+	RotateSession()
+}
+
+var _ UDPSessionRotator = (*clientPacketConn)(nil)
+
 type clientPacketConn struct {
 	*Method
 	net.Conn
-	session *udpSession
+	access      sync.Mutex
+	session     *udpSession
+	lastSession *udpSession
+	newBuffer   func() *buf.Buffer
 }
 
-func (c *clientPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
-	defer buffer.Release()
-	var hdrLen int
-	if c.udpCipher != nil {
-		hdrLen = PacketNonceSize
+func (c *clientPacketConn) RotateSession() {
+	c.access.Lock()
+	c.lastSession = c.session
+	c.session = c.newUDPSession()
+	c.access.Unlock()
+}
+
+// nextPacket returns the session to send with and its next packet ID, rotating the session when it is due.
+func (c *clientPacketConn) nextPacket() (*udpSession, uint64) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	session := c.session
+	sent := session.packetId + 1
+	if sent == math.MaxUint64 ||
+		c.udpSessionPackets > 0 && sent >= c.udpSessionPackets ||
+		c.udpSessionLifetime > 0 && c.time().Sub(session.created) >= c.udpSessionLifetime {
+		c.lastSession = session
+		c.session = c.newUDPSession()
+		session = c.session
+	}
+	return session, session.nextPacketId()
+}
+
+// remoteSession returns the client session that has seen the server session sessionId, and its cipher.
+func (c *clientPacketConn) remoteSession(sessionId uint64) (*udpSession, cipher.AEAD) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	for _, session := range []*udpSession{c.session, c.lastSession} {
+		if session == nil {
+			continue
+		}
+		if sessionId == session.remoteSessionId {
+			return session, session.remoteCipher
+		} else if sessionId == session.lastRemoteSessionId {
+			return session, session.lastRemoteCipher
+		}
 	}
+	return nil, nil
+}
 
-	var paddingLen int
-	if destination.Port == 53 && buffer.Len() < MaxPaddingLength {
-		paddingLen = mRand.Intn(MaxPaddingLength-buffer.Len()) + 1
+func (c *clientPacketConn) clientSession(sessionId uint64) *udpSession {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if sessionId == c.session.sessionId {
+		return c.session
+	} else if c.lastSession != nil && sessionId == c.lastSession.sessionId {
+		return c.lastSession
 	}
+	return nil
+}
 
-	hdrLen += 16 // packet header
-	pskLen := len(c.pskList)
-	if c.udpCipher == nil && pskLen > 1 {
-		hdrLen += (pskLen - 1) * aes.BlockSize
+func (c *clientPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	defer buffer.Release()
+	overhead := c.packetOverhead(M.SocksaddrSerializer.AddrPortLen(destination))
+	paddingLen, err := packetPadding(c.mtu, c.intn, destination, overhead, buffer.Len())
+	if err != nil {
+		return err
 	}
-	hdrLen += 1 // header type
-	hdrLen += 8 // timestamp
-	hdrLen += 2 // padding length
-	hdrLen += paddingLen
-	hdrLen += M.SocksaddrSerializer.AddrPortLen(destination)
-	header := buf.With(buffer.ExtendHeader(hdrLen))
+	pskLen := len(c.pskList)
+	header := buf.With(buffer.ExtendHeader(overhead - shadowaead.Overhead + paddingLen))
 
+	session, packetId := c.nextPacket()
 	var dataIndex int
 	if c.udpCipher != nil {
-		common.Must1(header.ReadFullFrom(c.session.rng, PacketNonceSize))
+		common.Must1(header.ReadFullFrom(session.rng, PacketNonceSize))
 		if pskLen > 1 {
 			panic("unsupported chacha extended header")
 		}
@@ -501,8 +718,8 @@ func (c *clientPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksad
 	}
 
 	common.Must(
-		binary.Write(header, binary.BigEndian, c.session.sessionId),
-		binary.Write(header, binary.BigEndian, c.session.nextPacketId()),
+		binary.Write(header, binary.BigEndian, session.sessionId),
+		binary.Write(header, binary.BigEndian, packetId),
 	)
 
 	if c.udpCipher == nil && pskLen > 1 {
@@ -530,10 +747,10 @@ func (c *clientPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksad
 	)
 
 	if paddingLen > 0 {
-		header.Extend(paddingLen)
+		clearPadding(header.Extend(paddingLen))
 	}
 
-	err := M.SocksaddrSerializer.WriteAddrPort(header, destination)
+	err = M.SocksaddrSerializer.WriteAddrPort(header, destination)
 	if err != nil {
 		return err
 	}
@@ -542,7 +759,7 @@ func (c *clientPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksad
 		buffer.Extend(shadowaead.Overhead)
 	} else {
 		packetHeader := buffer.To(aes.BlockSize)
-		c.session.cipher.Seal(buffer.Index(dataIndex), packetHeader[4:16], buffer.From(dataIndex), nil)
+		session.cipher.Seal(buffer.Index(dataIndex), packetHeader[4:16], buffer.From(dataIndex), nil)
 		buffer.Extend(shadowaead.Overhead)
 		c.udpBlockEncryptCipher.Encrypt(packetHeader, packetHeader)
 	}
@@ -585,23 +802,13 @@ func (c *clientPacketConn) ReadPacket(buffer *buf.Buffer) (M.Socksaddr, error) {
 		return M.Socksaddr{}, err
 	}
 
-	if sessionId == c.session.remoteSessionId {
-		if !c.session.window.Check(packetId) {
-			return M.Socksaddr{}, ErrPacketIdNotUnique
-		}
-	} else if sessionId == c.session.lastRemoteSessionId {
-		if !c.session.lastWindow.Check(packetId) {
-			return M.Socksaddr{}, ErrPacketIdNotUnique
-		}
+	session, remoteCipher := c.remoteSession(sessionId)
+	if session != nil && !session.checkRemote(sessionId, packetId) {
+		return M.Socksaddr{}, ErrPacketIdNotUnique
 	}
 
-	var remoteCipher cipher.AEAD
 	if packetHeader != nil {
-		if sessionId == c.session.remoteSessionId {
-			remoteCipher = c.session.remoteCipher
-		} else if sessionId == c.session.lastRemoteSessionId {
-			remoteCipher = c.session.lastRemoteCipher
-		} else {
+		if remoteCipher == nil {
 			key := SessionKey(c.pskList[len(c.pskList)-1], packetHeader[:8], c.keySaltLength)
 			remoteCipher, err = c.constructor(key)
 			if err != nil {
@@ -630,31 +837,9 @@ func (c *clientPacketConn) ReadPacket(buffer *buf.Buffer) (M.Socksaddr, error) {
 		return M.Socksaddr{}, err
 	}
 
-	diff := int(math.Abs(float64(c.time().Unix() - int64(epoch))))
-	if diff > 30 {
-		return M.Socksaddr{}, E.Extend(ErrBadTimestamp, "received ", epoch, ", diff ", diff, "s")
-	}
-
-	if sessionId == c.session.remoteSessionId {
-		c.session.window.Add(packetId)
-	} else if sessionId == c.session.lastRemoteSessionId {
-		c.session.lastWindow.Add(packetId)
-		c.session.lastRemoteSeen = c.time().Unix()
-	} else {
-		if c.session.remoteSessionId != 0 {
-			if c.time().Unix()-c.session.lastRemoteSeen < 60 {
-				return M.Socksaddr{}, ErrTooManyServerSessions
-			} else {
-				c.session.lastRemoteSessionId = c.session.remoteSessionId
-				c.session.lastWindow = c.session.window
-				c.session.lastRemoteSeen = c.time().Unix()
-				c.session.lastRemoteCipher = c.session.remoteCipher
-				c.session.window = SlidingWindow{}
-			}
-		}
-		c.session.remoteSessionId = sessionId
-		c.session.remoteCipher = remoteCipher
-		c.session.window.Add(packetId)
+	err = c.checkTimestamp(epoch)
+	if err != nil {
+		return M.Socksaddr{}, err
 	}
 
 	var clientSessionId uint64
@@ -663,9 +848,16 @@ func (c *clientPacketConn) ReadPacket(buffer *buf.Buffer) (M.Socksaddr, error) {
 		return M.Socksaddr{}, err
 	}
 
-	if clientSessionId != c.session.sessionId {
+	if session == nil {
+		session = c.clientSession(clientSessionId)
+	}
+	if session == nil || clientSessionId != session.sessionId {
 		return M.Socksaddr{}, ErrBadClientSessionId
 	}
+	err = session.addRemote(sessionId, packetId, remoteCipher, c.time().Unix())
+	if err != nil {
+		return M.Socksaddr{}, err
+	}
 
 	var paddingLen uint16
 	err = binary.Read(buffer, binary.BigEndian, &paddingLen)
@@ -681,6 +873,21 @@ func (c *clientPacketConn) ReadPacket(buffer *buf.Buffer) (M.Socksaddr, error) {
 	return destination, nil
 }
 
+var _ N.PacketReadWaiter = (*clientPacketConn)(nil)
+
+func (c *clientPacketConn) InitializeReadWaiter(newBuffer func() *buf.Buffer) {
+	c.newBuffer = newBuffer
+}
+
+func (c *clientPacketConn) WaitReadPacket() (destination M.Socksaddr, err error) {
+	buffer := c.newBuffer()
+	destination, err = c.ReadPacket(buffer)
+	if err != nil {
+		buffer.Release()
+	}
+	return
+}
+
 func (c *clientPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	buffer := buf.With(p)
 	destination, err := c.ReadPacket(buffer)
@@ -698,33 +905,20 @@ func (c *clientPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error)
 
 func (c *clientPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	destination := M.SocksaddrFromNet(addr)
-	var overHead int
-	if c.udpCipher != nil {
-		overHead = PacketNonceSize + shadowaead.Overhead
-	} else {
-		overHead = shadowaead.Overhead
+	overhead := c.packetOverhead(M.SocksaddrSerializer.AddrPortLen(destination))
+	paddingLen, err := packetPadding(c.mtu, c.intn, destination, overhead, len(p))
+	if err != nil {
+		return
 	}
-	overHead += 16 // packet header
 	pskLen := len(c.pskList)
-	if c.udpCipher == nil && pskLen > 1 {
-		overHead += (pskLen - 1) * aes.BlockSize
-	}
-	var paddingLen int
-	if destination.Port == 53 && len(p) < MaxPaddingLength {
-		paddingLen = mRand.Intn(MaxPaddingLength-len(p)) + 1
-	}
-	overHead += 1 // header type
-	overHead += 8 // timestamp
-	overHead += 2 // padding length
-	overHead += paddingLen
-	overHead += M.SocksaddrSerializer.AddrPortLen(destination)
 
-	buffer := buf.NewSize(overHead + len(p))
+	buffer := buf.NewSize(overhead + paddingLen + len(p))
 	defer buffer.Release()
 
+	session, packetId := c.nextPacket()
 	var dataIndex int
 	if c.udpCipher != nil {
-		common.Must1(buffer.ReadFullFrom(c.session.rng, PacketNonceSize))
+		common.Must1(buffer.ReadFullFrom(session.rng, PacketNonceSize))
 		if pskLen > 1 {
 			panic("unsupported chacha extended header")
 		}
@@ -734,8 +928,8 @@ func (c *clientPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	}
 
 	common.Must(
-		binary.Write(buffer, binary.BigEndian, c.session.sessionId),
-		binary.Write(buffer, binary.BigEndian, c.session.nextPacketId()),
+		binary.Write(buffer, binary.BigEndian, session.sessionId),
+		binary.Write(buffer, binary.BigEndian, packetId),
 	)
 
 	if c.udpCipher == nil && pskLen > 1 {
@@ -763,7 +957,7 @@ func (c *clientPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	)
 
 	if paddingLen > 0 {
-		buffer.Extend(paddingLen)
+		clearPadding(buffer.Extend(paddingLen))
 	}
 
 	err = M.SocksaddrSerializer.WriteAddrPort(buffer, destination)
@@ -776,7 +970,7 @@ func (c *clientPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 		buffer.Extend(shadowaead.Overhead)
 	} else {
 		packetHeader := buffer.To(aes.BlockSize)
-		c.session.cipher.Seal(buffer.Index(dataIndex), packetHeader[4:16], buffer.From(dataIndex), nil)
+		session.cipher.Seal(buffer.Index(dataIndex), packetHeader[4:16], buffer.From(dataIndex), nil)
 		buffer.Extend(shadowaead.Overhead)
 		c.udpBlockEncryptCipher.Encrypt(packetHeader, packetHeader)
 	}
@@ -788,29 +982,58 @@ func (c *clientPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 }
 
 func (c *clientPacketConn) FrontHeadroom() int {
-	var overHead int
-	if c.udpCipher != nil {
-		overHead = PacketNonceSize + shadowaead.Overhead
-	} else {
-		overHead = shadowaead.Overhead
-	}
-	overHead += 16 // packet header
-	pskLen := len(c.pskList)
-	if c.udpCipher == nil && pskLen > 1 {
-		overHead += (pskLen - 1) * aes.BlockSize
-	}
-	overHead += 1 // header type
-	overHead += 8 // timestamp
-	overHead += 2 // padding length
-	overHead += MaxPaddingLength
-	overHead += M.MaxSocksaddrLength
-	return overHead
+	return c.packetOverhead(M.MaxSocksaddrLength) + MaxPaddingLength
 }
 
 func (c *clientPacketConn) RearHeadroom() int {
 	return shadowaead.Overhead
 }
 
+func (c *clientPacketConn) ReaderMTU() int {
+	return MaxPacketSize
+}
+
+// WriterMTU returns the largest payload that fits the configured path MTU for any destination.
+func (c *clientPacketConn) WriterMTU() int {
+	if c.mtu == 0 {
+		return MaxPacketSize
+	}
+	return c.mtu - c.packetOverhead(M.MaxSocksaddrLength)
+}
+
+// packetOverhead returns the bytes a client packet adds to its payload, not counting padding.
+func (m *Method) packetOverhead(addrLen int) int {
+	overhead := shadowaead.Overhead
+	if m.udpCipher != nil {
+		overhead += PacketNonceSize
+	}
+	overhead += 16 // packet header
+	if m.udpCipher == nil && len(m.pskList) > 1 {
+		overhead += (len(m.pskList) - 1) * aes.BlockSize
+	}
+	overhead += 1 // header type
+	overhead += 8 // timestamp
+	overhead += 2 // padding length
+	overhead += addrLen
+	return overhead
+}
+
+// packetPadding returns the padding length of a packet, capped so that the packet fits mtu.
+// Packets that do not fit mtu even without padding are rejected.
+func packetPadding(mtu int, intn func(n int) int, destination M.Socksaddr, overhead int, payloadLen int) (int, error) {
+	if mtu > 0 && overhead+payloadLen > mtu {
+		return 0, E.Extend(ErrPacketTooLarge, overhead+payloadLen, " bytes, mtu ", mtu)
+	}
+	var paddingLen int
+	if destination.Port == 53 && payloadLen < MaxPaddingLength {
+		paddingLen = intn(MaxPaddingLength-payloadLen) + 1
+	}
+	if mtu > 0 && overhead+payloadLen+paddingLen > mtu {
+		paddingLen = mtu - overhead - payloadLen
+	}
+	return paddingLen, nil
+}
+
 type udpSession struct {
 	sessionId           uint64
 	packetId            uint64
@@ -823,21 +1046,59 @@ type udpSession struct {
 	window              SlidingWindow
 	lastWindow          SlidingWindow
 	rng                 io.Reader
+	created             time.Time
 }
 
 func (s *udpSession) nextPacketId() uint64 {
 	return atomic.AddUint64(&s.packetId, 1)
 }
 
+func (s *udpSession) checkRemote(sessionId uint64, packetId uint64) bool {
+	if sessionId == s.remoteSessionId {
+		return s.window.Check(packetId)
+	} else if sessionId == s.lastRemoteSessionId {
+		return s.lastWindow.Check(packetId)
+	}
+	return true
+}
+
+// addRemote records a packet of the server session sessionId. The server may change its session
+// at most once a minute, the previous one is kept to accept reordered packets.
+func (s *udpSession) addRemote(sessionId uint64, packetId uint64, remoteCipher cipher.AEAD, now int64) error {
+	if sessionId == s.remoteSessionId {
+		s.window.Add(packetId)
+	} else if sessionId == s.lastRemoteSessionId {
+		s.lastWindow.Add(packetId)
+		s.lastRemoteSeen = now
+	} else {
+		if s.remoteSessionId != 0 {
+			if now-s.lastRemoteSeen < 60 {
+				return ErrTooManyServerSessions
+			} else {
+				s.lastRemoteSessionId = s.remoteSessionId
+				s.lastWindow = s.window
+				s.lastRemoteSeen = now
+				s.lastRemoteCipher = s.remoteCipher
+				s.window = SlidingWindow{}
+			}
+		}
+		s.remoteSessionId = sessionId
+		s.remoteCipher = remoteCipher
+		s.window.Add(packetId)
+	}
+	return nil
+}
+
 func (m *Method) newUDPSession() *udpSession {
 	session := &udpSession{}
 	if m.udpCipher != nil {
-		session.rng = Blake3KeyedHash(rand.Reader)
+		session.rng = Blake3KeyedHash(m.random)
 		common.Must(binary.Read(session.rng, binary.BigEndian, &session.sessionId))
 	} else {
-		common.Must(binary.Read(rand.Reader, binary.BigEndian, &session.sessionId))
+		common.Must(binary.Read(m.random, binary.BigEndian, &session.sessionId))
 	}
 	session.packetId--
+	session.created = m.time()
 	if m.udpCipher == nil {
 		sessionId := make([]byte, 8)
 		binary.BigEndian.PutUint64(sessionId, session.sessionId)
@@ -0,0 +1,218 @@
+package shadowaead_2022_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks/shadowaead_2022"
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestClientClockSkew(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	psk := benchmarkPSK(method)
+	service, err := shadowaead_2022.NewService(method, psk, 60, &echoHandler{}, testTimeFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offset int64
+	client, err := shadowaead_2022.New(method, [][]byte{psk}, func() time.Time {
+		return testTime.Add(time.Duration(atomic.LoadInt64(&offset)))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	method2022 := client.(*shadowaead_2022.Method)
+	method2022.SetClockSkewCorrection(true)
+	if _, ok := method2022.ClockSkew(); ok {
+		t.Fatal("skew estimated without responses")
+	}
+
+	atomic.StoreInt64(&offset, int64(-20*time.Second))
+	testClientPacketRoundTrip(t, service, client)
+	skew, ok := method2022.ClockSkew()
+	if !ok || skew < 20*time.Second || skew > 21*time.Second {
+		t.Fatal("bad skew ", skew)
+	}
+
+	// The client clock drifts beyond the limit, the correction keeps it accepted.
+	atomic.StoreInt64(&offset, int64(-40*time.Second))
+	testClientPacketRoundTrip(t, service, client)
+	skew, _ = method2022.ClockSkew()
+	if skew <= 21*time.Second {
+		t.Fatal("skew not updated: ", skew)
+	}
+}
+
+func TestClientPacketSessionRotation(t *testing.T) {
+	t.Parallel()
+	for _, method := range shadowaead_2022.List {
+		t.Run(method, func(t *testing.T) {
+			psk := benchmarkPSK(method)
+			handler := &echoHandler{}
+			service, err := shadowaead_2022.NewService(method, psk, 60, handler, testTimeFunc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := shadowaead_2022.New(method, [][]byte{psk}, testTimeFunc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.(*shadowaead_2022.Method).SetUDPSessionRotation(0, 2)
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go servePacketPipe(ctx, service, serverConn)
+
+			packetConn := client.DialPacketConn(clientConn)
+			destination := M.ParseSocksaddr("192.0.2.1:443").UDPAddr()
+			roundTrip := func(rotate bool) {
+				_, err := packetConn.WriteTo([]byte("hello"), destination)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if rotate {
+					// The response to the previous session is still accepted.
+					packetConn.(shadowaead_2022.UDPSessionRotator).RotateSession()
+				}
+				response := make([]byte, 1024)
+				n, _, err := packetConn.ReadFrom(response)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(response[:n]) != "hello" {
+					t.Fatal("bad response: ", string(response[:n]))
+				}
+			}
+			roundTrip(false)
+			roundTrip(false)
+			roundTrip(true)
+			roundTrip(false)
+			// Two packets per session by count, then one forced rotation.
+			if sessions := atomic.LoadInt32(&handler.sessions); sessions != 3 {
+				t.Fatal("expected 3 sessions, got ", sessions)
+			}
+		})
+	}
+}
+
+func TestClientPacketMTU(t *testing.T) {
+	t.Parallel()
+	const mtu = 600
+	for _, method := range shadowaead_2022.List {
+		t.Run(method, func(t *testing.T) {
+			client, err := shadowaead_2022.New(method, [][]byte{benchmarkPSK(method)}, testTimeFunc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.(*shadowaead_2022.Method).SetMTU(mtu)
+			conn := &bufferConn{}
+			packetConn := client.DialPacketConn(conn)
+			payloadMTU := packetConn.(N.WriterWithMTU).WriterMTU()
+			if payloadMTU <= 0 || payloadMTU >= mtu {
+				t.Fatal("bad payload mtu: ", payloadMTU)
+			}
+			// DNS packets are padded up to the MTU at most.
+			destination := M.ParseSocksaddr("192.0.2.1:53").UDPAddr()
+			for i := 0; i < 100; i++ {
+				_, err = packetConn.WriteTo(make([]byte, payloadMTU), destination)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if conn.writer.Len() > mtu {
+					t.Fatal("packet exceeds mtu: ", conn.writer.Len())
+				}
+				conn.writer.Reset()
+			}
+			_, err = packetConn.WriteTo(make([]byte, mtu), destination)
+			if !errors.Is(err, shadowaead_2022.ErrPacketTooLarge) {
+				t.Fatal("expected packet too large, got ", err)
+			}
+			if conn.writer.Len() != 0 {
+				t.Fatal("oversize packet sent")
+			}
+		})
+	}
+}
+
+func BenchmarkClientHandshake(b *testing.B) {
+	iPSK, uPSKList := multiKeys()
+	for _, pskList := range [][][]byte{{benchmarkPSK(multiMethod)}, {iPSK, uPSKList[0]}} {
+		b.Run(strconv.Itoa(len(pskList))+"-psk", func(b *testing.B) {
+			client, err := shadowaead_2022.New(multiMethod, pskList, testTimeFunc)
+			if err != nil {
+				b.Fatal(err)
+			}
+			conn := &bufferConn{}
+			destination := M.ParseSocksaddr("test.com:443")
+			payload := []byte("hello")
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err = client.DialEarlyConn(conn, destination).Write(payload)
+				if err != nil {
+					b.Fatal(err)
+				}
+				conn.writer.Reset()
+			}
+		})
+	}
+}
+
+func servePacketPipe(ctx context.Context, service N.UDPHandler, conn net.Conn) {
+	source := M.ParseSocksaddr("127.0.0.1:10000")
+	for {
+		buffer := buf.NewPacket()
+		n, err := conn.Read(buffer.FreeBytes())
+		if err != nil {
+			buffer.Release()
+			return
+		}
+		buffer.Truncate(n)
+		service.NewPacket(ctx, &pipePacketConn{conn}, buffer, M.Metadata{Source: source})
+	}
+}
+
+// echoHandler writes packets back and counts packet sessions.
+type echoHandler struct {
+	discardHandler
+	sessions int32
+}
+
+func (h *echoHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	atomic.AddInt32(&h.sessions, 1)
+	for {
+		buffer := buf.NewPacket()
+		destination, err := conn.ReadPacket(buffer)
+		if err != nil {
+			buffer.Release()
+			return nil
+		}
+		conn.WritePacket(buffer, destination)
+	}
+}
+
+type pipePacketConn struct {
+	net.Conn
+}
+
+func (c *pipePacketConn) ReadPacket(buffer *buf.Buffer) (M.Socksaddr, error) {
+	n, err := c.Read(buffer.FreeBytes())
+	buffer.Truncate(n)
+	return M.Socksaddr{}, err
+}
+
+func (c *pipePacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	defer buffer.Release()
+	_, err := c.Write(buffer.Bytes())
+	return err
+}
@@ -8,15 +8,18 @@ import (
 	"encoding/binary"
 	"net"
 	"os"
+	"time"
 
 	"github.com/sagernet/sing-shadowsocks"
 	"github.com/sagernet/sing-shadowsocks/shadowaead"
+	"github.com/sagernet/sing/common/atomic"
 	"github.com/sagernet/sing/common/auth"
 	"github.com/sagernet/sing/common/buf"
 	"github.com/sagernet/sing/common/bufio"
 	E "github.com/sagernet/sing/common/exceptions"
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/replay"
 	"github.com/sagernet/sing/common/udpnat"
 
 	"lukechampine.com/blake3"
@@ -24,6 +27,10 @@ import (
 
 var _ shadowsocks.Service = (*RelayService[int])(nil)
 
+// RelayService strips the identity header of each request and forwards it to an upstream of its user.
+// UDP sessions stick to one upstream until it is banned. A TCP connection moves to the next upstream only
+// while its dial fails: with a dialer set by SetDialer the relay dials and copies the connection itself,
+// otherwise the handler dials and must return ErrUpstreamUnreachable to fail over.
 type RelayService[U comparable] struct {
 	name          string
 	keySaltLength int
@@ -33,11 +40,23 @@ type RelayService[U comparable] struct {
 	blockConstructor func(key []byte) (cipher.Block, error)
 	udpBlockCipher   cipher.Block
 
+	*relayTable[U]
+	*shadowsocks.UDPServer[uint64]
 	iPSK         []byte
-	uPSKHash     map[[aes.BlockSize]byte]U
-	uDestination map[U]M.Socksaddr
-	uCipher      map[U]cipher.Block
-	udpNat       *udpnat.Service[uint64]
+	users        atomic.TypedValue[*relayUsers[U]]
+	udpHandler   *shadowsocks.MetricsUDPHandler
+	udpNat       *shadowsocks.UDPNAT[uint64]
+	metrics      shadowsocks.Metrics
+	replayFilter replay.Filter
+	handshake    shadowsocks.HandshakeLimiter
+	lifecycle    shadowsocks.Lifecycle
+	registry     shadowsocks.SessionRegistry
+}
+
+// relayUsers is replaced as a whole when users are updated while serving.
+type relayUsers[U comparable] struct {
+	uPSKHash map[[aes.BlockSize]byte]U
+	uCipher  map[U]cipher.Block
 }
 
 func (s *RelayService[U]) Name() string {
@@ -49,24 +68,30 @@ func (s *RelayService[U]) Password() string {
 }
 
 func (s *RelayService[U]) UpdateUsers(userList []U, keyList [][]byte, destinationList []M.Socksaddr) error {
+	return s.UpdateUsersWithUpstreams(userList, keyList, singleUpstreams(destinationList))
+}
+
+// UpdateUsersWithUpstreams replaces the users, each with a list of upstreams picked by the relay policy.
+// Upstreams kept across updates keep their connection count and health state.
+func (s *RelayService[U]) UpdateUsersWithUpstreams(userList []U, keyList [][]byte, upstreamList [][]M.Socksaddr) error {
 	uPSKHash := make(map[[aes.BlockSize]byte]U)
-	uDestination := make(map[U]M.Socksaddr)
 	uCipher := make(map[U]cipher.Block)
 	for i, user := range userList {
 		key := keyList[i]
-		destination := destinationList[i]
 		if len(key) < s.keySaltLength {
 			return shadowsocks.ErrBadKey
 		} else if len(key) > s.keySaltLength {
 			key = Key(key, s.keySaltLength)
 		}
+		if len(upstreamList[i]) == 0 {
+			return ErrNoUpstream
+		}
 
 		var hash [aes.BlockSize]byte
 		hash512 := blake3.Sum512(key)
 		copy(hash[:], hash512[:])
 
 		uPSKHash[hash] = user
-		uDestination[user] = destination
 		var err error
 		uCipher[user], err = s.blockConstructor(key)
 		if err != nil {
@@ -74,13 +99,17 @@ func (s *RelayService[U]) UpdateUsers(userList []U, keyList [][]byte, destinatio
 		}
 	}
 
-	s.uPSKHash = uPSKHash
-	s.uDestination = uDestination
-	s.uCipher = uCipher
+	// Upstreams go first so that new users never lack them.
+	s.setUpstreams(userList, upstreamList)
+	s.users.Store(&relayUsers[U]{uPSKHash, uCipher})
 	return nil
 }
 
 func (s *RelayService[U]) UpdateUsersWithPasswords(userList []U, passwordList []string, destinationList []M.Socksaddr) error {
+	return s.UpdateUsersWithPasswordsAndUpstreams(userList, passwordList, singleUpstreams(destinationList))
+}
+
+func (s *RelayService[U]) UpdateUsersWithPasswordsAndUpstreams(userList []U, passwordList []string, upstreamList [][]M.Socksaddr) error {
 	keyList := make([][]byte, 0, len(passwordList))
 	for _, password := range passwordList {
 		if password == "" {
@@ -92,10 +121,18 @@ func (s *RelayService[U]) UpdateUsersWithPasswords(userList []U, passwordList []
 		}
 		keyList = append(keyList, uPSK)
 	}
-	return s.UpdateUsers(userList, keyList, destinationList)
+	return s.UpdateUsersWithUpstreams(userList, keyList, upstreamList)
 }
 
-func NewRelayServiceWithPassword[U comparable](method string, password string, udpTimeout int64, handler shadowsocks.Handler) (*RelayService[U], error) {
+func singleUpstreams(destinationList []M.Socksaddr) [][]M.Socksaddr {
+	upstreamList := make([][]M.Socksaddr, 0, len(destinationList))
+	for _, destination := range destinationList {
+		upstreamList = append(upstreamList, []M.Socksaddr{destination})
+	}
+	return upstreamList
+}
+
+func NewRelayServiceWithPassword[U comparable](method string, password string, udpTimeout int64, handler shadowsocks.Handler, options ...ServiceOption) (*RelayService[U], error) {
 	if password == "" {
 		return nil, ErrMissingPSK
 	}
@@ -103,20 +140,23 @@ func NewRelayServiceWithPassword[U comparable](method string, password string, u
 	if err != nil {
 		return nil, E.Cause(err, "decode psk")
 	}
-	return NewRelayService[U](method, iPSK, udpTimeout, handler)
+	return NewRelayService[U](method, iPSK, udpTimeout, handler, options...)
 }
 
-func NewRelayService[U comparable](method string, psk []byte, udpTimeout int64, handler shadowsocks.Handler) (*RelayService[U], error) {
+func NewRelayService[U comparable](method string, psk []byte, udpTimeout int64, handler shadowsocks.Handler, options ...ServiceOption) (*RelayService[U], error) {
 	s := &RelayService[U]{
 		name:    method,
 		handler: handler,
 
-		uPSKHash:     make(map[[aes.BlockSize]byte]U),
-		uDestination: make(map[U]M.Socksaddr),
-		uCipher:      make(map[U]cipher.Block),
+		relayTable: newRelayTable[U](udpTimeout, handler),
 
-		udpNat: udpnat.New[uint64](udpTimeout, handler),
+		udpHandler:   shadowsocks.NewMetricsUDPHandler(method, handler),
+		replayFilter: newServiceOptions(options).replayFilter,
 	}
+	s.users.Store(&relayUsers[U]{make(map[[aes.BlockSize]byte]U), make(map[U]cipher.Block)})
+	s.udpNat = shadowsocks.NewUDPNAT[uint64](udpTimeout, &relayUDPHandler{s.udpHandler}, shadowsocks.HashUint64)
+	s.udpNat.SetSessionRegistry(&s.registry)
+	s.UDPServer = shadowsocks.NewUDPServer[uint64](method, handler, s.udpNat, &s.lifecycle, &s.metrics)
 
 	switch method {
 	case "2022-blake3-aes-128-gcm":
@@ -143,98 +183,209 @@ func NewRelayService[U comparable](method string, psk []byte, udpTimeout int64,
 	return s, err
 }
 
+func (s *RelayService[U]) SetHandshakeTimeout(timeout time.Duration) {
+	s.handshake.SetHandshakeTimeout(timeout)
+}
+
+func (s *RelayService[U]) SetHandshakeLimit(limit int, queueTimeout time.Duration) {
+	s.handshake.SetHandshakeLimit(limit, queueTimeout)
+}
+
+func (s *RelayService[U]) SetMetrics(metrics shadowsocks.Metrics) {
+	s.metrics = metrics
+	s.udpHandler.Metrics = metrics
+}
+
+// SetUDPSessionLimit bounds the number of relayed UDP sessions and their NAT entries. Zero means unbounded.
+func (s *RelayService[U]) SetUDPSessionLimit(limit int) {
+	s.setSessionLimit(limit)
+	s.UDPServer.SetUDPSessionLimit(limit)
+}
+
+func (s *RelayService[U]) Sessions() []shadowsocks.SessionInfo {
+	return s.registry.Sessions()
+}
+
+func (s *RelayService[U]) UserSessions(user any) []shadowsocks.SessionInfo {
+	return s.registry.UserSessions(user)
+}
+
+func (s *RelayService[U]) CloseSession(id uint64) bool {
+	return s.registry.CloseSession(id)
+}
+
+func (s *RelayService[U]) CloseUserSessions(user any) int {
+	return s.registry.CloseUserSessions(user)
+}
+
+func (s *RelayService[U]) Close() error {
+	s.lifecycle.Close()
+	s.udpNat.Close()
+	s.sessions.Clear()
+	return closeReplayFilter(s.replayFilter)
+}
+
+func (s *RelayService[U]) Shutdown(ctx context.Context) (shadowsocks.ShutdownStats, error) {
+	stats, err := s.lifecycle.Shutdown(ctx)
+	stats.Sessions = s.udpNat.Close()
+	s.sessions.Clear()
+	return stats, E.Errors(err, closeReplayFilter(s.replayFilter))
+}
+
 func (s *RelayService[U]) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
-	err := s.newConnection(ctx, conn, metadata)
+	element, err := s.lifecycle.Acquire(conn)
+	if err != nil {
+		return &shadowsocks.ServerConnError{Conn: conn, Source: metadata.Source, Cause: err}
+	}
+	defer s.lifecycle.Release(element)
+	user, protocolConn, err := s.newConnection(ctx, conn, &metadata)
+	if err != nil {
+		if s.metrics != nil {
+			s.metrics.HandshakeRejected(s.name, err)
+		}
+	} else {
+		session := s.registry.Register(N.NetworkTCP, user, metadata, conn)
+		defer session.Unregister()
+		if s.metrics != nil {
+			s.metrics.HandshakeAccepted(s.name)
+			protocolConn = shadowsocks.NewMetricsConn(protocolConn, s.name, s.metrics)
+		}
+		err = s.relayConnection(auth.ContextWithUser(ctx, user), user, session.Conn(protocolConn), metadata)
+	}
 	if err != nil {
 		err = &shadowsocks.ServerConnError{Conn: conn, Source: metadata.Source, Cause: err}
 	}
 	return err
 }
 
-func (s *RelayService[U]) newConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+func (s *RelayService[U]) newConnection(ctx context.Context, conn net.Conn, metadata *M.Metadata) (U, net.Conn, error) {
+	var user U
+	err := s.handshake.Start(ctx, conn)
+	if err != nil {
+		return user, nil, err
+	}
+	defer s.handshake.Finish(conn)
 	requestHeader := buf.New()
-	defer requestHeader.Release()
 	n, err := requestHeader.ReadOnceFrom(conn)
 	if err != nil {
-		return err
+		requestHeader.Release()
+		return user, nil, shadowsocks.NewHandshakeError(shadowsocks.ReadReason(err, shadowsocks.ReasonReadFailed), int(n), err)
 	} else if int(n) < s.keySaltLength+aes.BlockSize {
-		return shadowaead.ErrBadHeader
+		requestHeader.Release()
+		return user, nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonBadHeader, int(n), shadowaead.ErrBadHeader)
 	}
 	requestSalt := requestHeader.To(s.keySaltLength)
+	if !s.replayFilter.Check(requestSalt) {
+		requestHeader.Release()
+		return user, nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonReplay, int(n), ErrSaltNotUnique)
+	}
+	var lookupStart time.Time
+	if s.metrics != nil {
+		lookupStart = time.Now()
+	}
 	var _eiHeader [aes.BlockSize]byte
 	eiHeader := _eiHeader[:]
 	copy(eiHeader, requestHeader.Range(s.keySaltLength, s.keySaltLength+aes.BlockSize))
 
-	keyMaterial := make([]byte, s.keySaltLength*2)
-	copy(keyMaterial, s.iPSK)
-	copy(keyMaterial[s.keySaltLength:], requestSalt)
-	identitySubkey := buf.NewSize(s.keySaltLength)
-	identitySubkey.Extend(identitySubkey.FreeLen())
-	blake3.DeriveKey(identitySubkey.Bytes(), "shadowsocks 2022 identity subkey", keyMaterial)
-	b, err := s.blockConstructor(identitySubkey.Bytes())
-	identitySubkey.Release()
+	b, err := newIdentityCipher(s.blockConstructor, s.iPSK, requestSalt, s.keySaltLength)
 	if err != nil {
-		return err
+		requestHeader.Release()
+		return user, nil, err
 	}
 	b.Decrypt(eiHeader, eiHeader)
 
-	var user U
-	if u, loaded := s.uPSKHash[_eiHeader]; loaded {
-		user = u
-	} else {
-		return E.New("invalid request")
+	u, loaded := s.users.Load().uPSKHash[_eiHeader]
+	if s.metrics != nil {
+		s.metrics.UserLookup(s.name, time.Since(lookupStart))
+	}
+	if !loaded {
+		requestHeader.Release()
+		return user, nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonUnknownUser, int(n), ErrInvalidRequest)
+	}
+	user = u
+	if !s.allow(user) {
+		requestHeader.Release()
+		return user, nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonRateLimited, int(n), ErrRateLimited)
 	}
 
 	copy(requestHeader.Range(aes.BlockSize, aes.BlockSize+s.keySaltLength), requestHeader.To(s.keySaltLength))
 	requestHeader.Advance(aes.BlockSize)
 
 	metadata.Protocol = "shadowsocks-relay"
-	metadata.Destination = s.uDestination[user]
-	conn = bufio.NewCachedConn(conn, requestHeader)
-	return s.handler.NewConnection(auth.ContextWithUser(ctx, user), conn, metadata)
+	return user, bufio.NewCachedConn(conn, requestHeader), nil
 }
 
 func (s *RelayService[U]) WriteIsThreadUnsafe() {
 }
 
 func (s *RelayService[U]) NewPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
-	err := s.newPacket(ctx, conn, buffer, metadata)
-	if err != nil {
-		err = &shadowsocks.ServerPacketError{Source: metadata.Source, Cause: err}
-	}
-	return err
+	return s.ServePacket(metadata, func() error {
+		return s.newPacket(ctx, conn, buffer, metadata)
+	})
 }
 
 func (s *RelayService[U]) newPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
+	packetLen := buffer.Len()
+	if packetLen < PacketMinimalHeaderSize+aes.BlockSize {
+		return shadowsocks.NewHandshakeError(shadowsocks.ReasonBadHeader, packetLen, ErrPacketTooShort)
+	}
+	var lookupStart time.Time
+	if s.metrics != nil {
+		lookupStart = time.Now()
+	}
 	packetHeader := buffer.To(aes.BlockSize)
 	s.udpBlockCipher.Decrypt(packetHeader, packetHeader)
 
 	sessionId := binary.BigEndian.Uint64(packetHeader)
+	packetId := binary.BigEndian.Uint64(packetHeader[8:])
 
 	var _eiHeader [aes.BlockSize]byte
 	eiHeader := _eiHeader[:]
 	s.udpBlockCipher.Decrypt(eiHeader, buffer.Range(aes.BlockSize, 2*aes.BlockSize))
 	xorWords(eiHeader, eiHeader, packetHeader)
 
-	var user U
-	if u, loaded := s.uPSKHash[_eiHeader]; loaded {
-		user = u
-	} else {
-		return E.New("invalid request")
+	users := s.users.Load()
+	user, loaded := users.uPSKHash[_eiHeader]
+	if s.metrics != nil {
+		s.metrics.UserLookup(s.name, time.Since(lookupStart))
+	}
+	if !loaded {
+		return shadowsocks.NewHandshakeError(shadowsocks.ReasonUnknownUser, packetLen, ErrInvalidRequest)
 	}
 
-	s.uCipher[user].Encrypt(packetHeader, packetHeader)
+	users.uCipher[user].Encrypt(packetHeader, packetHeader)
 	copy(buffer.Range(aes.BlockSize, 2*aes.BlockSize), packetHeader)
 	buffer.Advance(aes.BlockSize)
 
+	upstream, err := s.packetUpstream(user, sessionId, packetId, packetLen)
+	if err != nil {
+		return err
+	}
+
 	metadata.Protocol = "shadowsocks-relay"
-	metadata.Destination = s.uDestination[user]
+	metadata.Destination = upstream.destination
+	if s.metrics != nil {
+		s.metrics.ReadBytes(s.name, int64(buffer.Len()))
+	}
 	s.udpNat.NewContextPacket(ctx, sessionId, buffer, metadata, func(natConn N.PacketConn) (context.Context, N.PacketWriter) {
-		return auth.ContextWithUser(ctx, user), &udpnat.DirectBackWriter{Source: conn, Nat: natConn}
+		return context.WithValue(auth.ContextWithUser(ctx, user), relayUpstreamKey{}, upstream), &relayPacketWriter{udpnat.DirectBackWriter{Source: conn, Nat: natConn}, s.name, s.metrics}
 	})
 	return nil
 }
 
+type relayPacketWriter struct {
+	udpnat.DirectBackWriter
+	name    string
+	metrics shadowsocks.Metrics
+}
+
+func (w *relayPacketWriter) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	if w.metrics != nil {
+		w.metrics.WriteBytes(w.name, int64(buffer.Len()))
+	}
+	return w.DirectBackWriter.WritePacket(buffer, destination)
+}
+
 func (s *RelayService[U]) NewError(ctx context.Context, err error) {
 	s.handler.NewError(ctx, err)
 }
@@ -0,0 +1,53 @@
+package shadowaead_2022
+
+import (
+	"sync"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+var ErrRateLimited = E.New("connection rate limit exceeded")
+
+// rateLimiter is a token bucket refilled at rate tokens per second up to burst.
+type rateLimiter struct {
+	access sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (l *rateLimiter) allow(now time.Time, rate float64, burst int) bool {
+	l.access.Lock()
+	defer l.access.Unlock()
+	if l.last.IsZero() {
+		l.tokens = float64(burst)
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * rate
+		if l.tokens > float64(burst) {
+			l.tokens = float64(burst)
+		}
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+type relaySession struct {
+	upstream *relayUpstream
+	access   sync.Mutex
+	window   SlidingWindow
+}
+
+// checkPacketId adds packetId to the session window, reporting whether it was not seen before.
+func (s *relaySession) checkPacketId(packetId uint64) bool {
+	s.access.Lock()
+	defer s.access.Unlock()
+	if !s.window.Check(packetId) {
+		return false
+	}
+	s.window.Add(packetId)
+	return true
+}
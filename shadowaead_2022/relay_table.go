@@ -0,0 +1,260 @@
+package shadowaead_2022
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing/common/bufio"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// relayTable holds the upstreams of relayed users and the state used to pick and limit them.
+type relayTable[U comparable] struct {
+	handler       shadowsocks.Handler
+	configAccess  sync.Mutex
+	config        atomic.Value
+	udpTimeout    int64
+	sessions      *shadowsocks.SessionTable[uint64, *relaySession]
+	limiterAccess sync.Mutex
+	limiters      map[U]*rateLimiter
+}
+
+// relayConfig is never modified once stored, updates store a changed copy so that
+// connections being relayed keep reading a consistent configuration.
+type relayConfig[U comparable] struct {
+	uUpstream    map[U]*relayGroup
+	policy       RelayPolicy
+	packetWindow bool
+	rateLimit    float64
+	rateBurst    int
+	dialer       N.Dialer
+}
+
+func newRelayTable[U comparable](udpTimeout int64, handler shadowsocks.Handler) *relayTable[U] {
+	t := &relayTable[U]{
+		handler:    handler,
+		udpTimeout: udpTimeout,
+		sessions:   shadowsocks.NewSessionTable[uint64, *relaySession](shadowsocks.HashUint64, udpTimeout, 0, nil),
+		limiters:   make(map[U]*rateLimiter),
+	}
+	t.config.Store(&relayConfig[U]{uUpstream: make(map[U]*relayGroup)})
+	return t
+}
+
+func (t *relayTable[U]) loadConfig() *relayConfig[U] {
+	return t.config.Load().(*relayConfig[U])
+}
+
+// updateConfig stores a copy of the configuration changed by update.
+func (t *relayTable[U]) updateConfig(update func(config *relayConfig[U])) {
+	t.configAccess.Lock()
+	defer t.configAccess.Unlock()
+	config := *t.loadConfig()
+	update(&config)
+	t.config.Store(&config)
+}
+
+// upstreamGroup returns the upstreams of user, nil if the user is not relayed.
+func (t *relayTable[U]) upstreamGroup(user U) *relayGroup {
+	return t.loadConfig().uUpstream[user]
+}
+
+// setUpstreams replaces the upstreams of relayed users, users with an empty list are not relayed.
+// Upstreams kept across updates keep their connection count and health state.
+func (t *relayTable[U]) setUpstreams(userList []U, upstreamList [][]M.Socksaddr) {
+	t.configAccess.Lock()
+	defer t.configAccess.Unlock()
+	config := *t.loadConfig()
+	upstreams := make(map[M.Socksaddr]*relayUpstream)
+	for _, group := range config.uUpstream {
+		for _, upstream := range group.upstreams {
+			upstreams[upstream.destination] = upstream
+		}
+	}
+	uUpstream := make(map[U]*relayGroup)
+	for i, user := range userList {
+		if len(upstreamList[i]) == 0 {
+			continue
+		}
+		group := &relayGroup{}
+		for _, destination := range upstreamList[i] {
+			upstream, loaded := upstreams[destination]
+			if !loaded {
+				upstream = &relayUpstream{destination: destination}
+				upstreams[destination] = upstream
+			}
+			group.upstreams = append(group.upstreams, upstream)
+		}
+		uUpstream[user] = group
+	}
+	config.uUpstream = uUpstream
+	t.config.Store(&config)
+	t.limiterAccess.Lock()
+	for user := range t.limiters {
+		if _, loaded := uUpstream[user]; !loaded {
+			delete(t.limiters, user)
+		}
+	}
+	t.limiterAccess.Unlock()
+}
+
+// SetPolicy sets how upstreams are picked for new connections and UDP sessions.
+func (t *relayTable[U]) SetPolicy(policy RelayPolicy) {
+	t.updateConfig(func(config *relayConfig[U]) {
+		config.policy = policy
+	})
+}
+
+// SetRateLimit limits each user to rate new connections or UDP sessions per second, allowing bursts of burst.
+// A zero rate disables the limit. A burst below one allows bursts of rate rounded up, and at least one.
+func (t *relayTable[U]) SetRateLimit(rate float64, burst int) {
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	t.updateConfig(func(config *relayConfig[U]) {
+		config.rateLimit = rate
+		config.rateBurst = burst
+	})
+}
+
+// SetDialer makes the relay dial the upstreams of TCP connections itself and copy the connections to them,
+// failing over to the next upstream whenever a dial fails. A nil dialer hands the connections to the handler.
+func (t *relayTable[U]) SetDialer(dialer N.Dialer) {
+	t.updateConfig(func(config *relayConfig[U]) {
+		config.dialer = dialer
+	})
+}
+
+// SetPacketWindow enables packet ID replay checks for relayed UDP sessions.
+func (t *relayTable[U]) SetPacketWindow(enabled bool) {
+	t.updateConfig(func(config *relayConfig[U]) {
+		config.packetWindow = enabled
+	})
+}
+
+func (t *relayTable[U]) setSessionLimit(limit int) {
+	t.sessions = shadowsocks.NewSessionTable[uint64, *relaySession](shadowsocks.HashUint64, t.udpTimeout, limit, nil)
+}
+
+func (t *relayTable[U]) allow(user U) bool {
+	return t.allowConfig(t.loadConfig(), user)
+}
+
+func (t *relayTable[U]) allowConfig(config *relayConfig[U], user U) bool {
+	if config.rateLimit == 0 {
+		return true
+	}
+	t.limiterAccess.Lock()
+	limiter, loaded := t.limiters[user]
+	if !loaded {
+		limiter = &rateLimiter{}
+		t.limiters[user] = limiter
+	}
+	t.limiterAccess.Unlock()
+	return limiter.allow(time.Now(), config.rateLimit, config.rateBurst)
+}
+
+// relayConnection dials the upstream with the dialer or hands the connection to the handler, failing over
+// to the next upstream while the result is ErrUpstreamUnreachable, which guarantees that the connection is untouched.
+func (t *relayTable[U]) relayConnection(ctx context.Context, user U, conn net.Conn, metadata M.Metadata) error {
+	config := t.loadConfig()
+	group := config.uUpstream[user]
+	if group == nil {
+		return ErrNoUpstream
+	}
+	var hash uint64
+	if config.policy == RelayPolicyHashSource {
+		hasher := fnv.New64a()
+		hasher.Write(metadata.Source.Addr.AsSlice())
+		hash = hasher.Sum64()
+	}
+	var tried []*relayUpstream
+	err := ErrNoUpstream
+	for {
+		upstream := group.pick(config.policy, hash, tried)
+		if upstream == nil {
+			return err
+		}
+		metadata.Destination = upstream.destination
+		atomic.AddInt64(&upstream.connections, 1)
+		if config.dialer != nil {
+			err = dialConnection(ctx, config.dialer, conn, metadata.Destination)
+		} else {
+			err = t.handler.NewConnection(ctx, conn, metadata)
+		}
+		atomic.AddInt64(&upstream.connections, -1)
+		upstream.report(err)
+		if !errors.Is(err, ErrUpstreamUnreachable) {
+			return err
+		}
+		tried = append(tried, upstream)
+	}
+}
+
+// dialConnection dials destination and copies conn to it. A failed dial leaves conn untouched
+// and is reported as ErrUpstreamUnreachable.
+func dialConnection(ctx context.Context, dialer N.Dialer, conn net.Conn, destination M.Socksaddr) error {
+	upstreamConn, err := dialer.DialContext(ctx, N.NetworkTCP, destination)
+	if err != nil {
+		return E.Extend(ErrUpstreamUnreachable, destination, ": ", err)
+	}
+	return bufio.CopyConn(ctx, conn, upstreamConn)
+}
+
+// packetSession returns the session of a UDP packet. New sessions pick an upstream,
+// and sessions whose upstream has been banned move to another one.
+func (t *relayTable[U]) packetSession(config *relayConfig[U], user U, sessionId uint64) (*relaySession, error) {
+	group := config.uUpstream[user]
+	if group == nil {
+		return nil, ErrNoUpstream
+	}
+	session, loaded := t.sessions.Load(sessionId)
+	if !loaded {
+		if !t.allowConfig(config, user) {
+			return nil, ErrRateLimited
+		}
+		session, _ = t.sessions.LoadOrStore(sessionId, func() *relaySession {
+			return &relaySession{upstream: group.pick(config.policy, sessionId, nil)}
+		})
+	}
+	session.access.Lock()
+	if session.upstream == nil || !session.upstream.available(time.Now().UnixNano()) {
+		session.upstream = group.pick(config.policy, sessionId, nil)
+	}
+	session.access.Unlock()
+	return session, nil
+}
+
+// packetUpstream returns the upstream for a relayed packet, checking the rate limit for new sessions
+// and the packet ID if the packet window is enabled.
+func (t *relayTable[U]) packetUpstream(user U, sessionId uint64, packetId uint64, packetLen int) (*relayUpstream, error) {
+	config := t.loadConfig()
+	session, err := t.packetSession(config, user, sessionId)
+	if err == ErrRateLimited {
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonRateLimited, packetLen, err)
+	} else if err != nil {
+		return nil, err
+	}
+	if config.packetWindow && !session.checkPacketId(packetId) {
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonReplay, packetLen, ErrPacketIdNotUnique)
+	}
+	session.access.Lock()
+	upstream := session.upstream
+	session.access.Unlock()
+	if upstream == nil {
+		return nil, ErrNoUpstream
+	}
+	return upstream, nil
+}
@@ -0,0 +1,446 @@
+package shadowaead_2022_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing-shadowsocks/shadowaead_2022"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+var relayUpstreams = []M.Socksaddr{
+	M.ParseSocksaddr("127.0.0.1:10001"),
+	M.ParseSocksaddr("127.0.0.1:10002"),
+	M.ParseSocksaddr("127.0.0.1:10003"),
+}
+
+func TestRelayServiceFailover(t *testing.T) {
+	t.Parallel()
+	iPSK, uPSKList := multiKeys()
+	handler := &relayHandler{fail: relayUpstreams[0]}
+	relayService := newRelayService(t, handler, relayUpstreams[:2])
+	for i := 0; i < 5; i++ {
+		request := clientRequest(t, multiMethod, [][]byte{iPSK, uPSKList[0]}, "test.com:443")
+		err := relayService.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var failed, relayed int
+	for _, destination := range handler.destinations {
+		switch destination {
+		case relayUpstreams[0]:
+			failed++
+		case relayUpstreams[1]:
+			relayed++
+		}
+	}
+	// The failing upstream is banned after three dial errors.
+	if failed != 3 || relayed != 5 {
+		t.Fatal("bad relay destinations: ", handler.destinations)
+	}
+}
+
+func TestRelayServiceDialer(t *testing.T) {
+	t.Parallel()
+	iPSK, uPSKList := multiKeys()
+	handler := &relayHandler{}
+	relayService := newRelayService(t, handler, relayUpstreams[:2])
+	dialer := &relayDialer{fail: relayUpstreams[0]}
+	relayService.SetDialer(dialer)
+	request := clientRequest(t, multiMethod, [][]byte{iPSK, uPSKList[0]}, "test.com:443")
+	err := relayService.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dialer.destinations) != 2 || dialer.destinations[0] != relayUpstreams[0] || dialer.destinations[1] != relayUpstreams[1] {
+		t.Fatal("bad dial destinations: ", dialer.destinations)
+	}
+	if len(handler.destinations) != 0 {
+		t.Fatal("handler called with a dialer set")
+	}
+	// The relay forwards the request without its identity header.
+	if n := dialer.conns[0].writer.Len(); n == 0 || n >= len(request) {
+		t.Fatal("bad relayed length: ", n)
+	}
+}
+
+func TestRelayServiceDialErrorAfterUse(t *testing.T) {
+	t.Parallel()
+	iPSK, uPSKList := multiKeys()
+	handler := &usedConnHandler{}
+	relayService, err := shadowaead_2022.NewRelayService[string](multiMethod, iPSK, 60, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = relayService.UpdateUsersWithUpstreams([]string{"alice"}, uPSKList[:1], [][]M.Socksaddr{relayUpstreams[:2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := clientRequest(t, multiMethod, [][]byte{iPSK, uPSKList[0]}, "test.com:443")
+	err = relayService.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+	if err == nil {
+		t.Fatal("expected dial error")
+	}
+	// The connection was read by the handler, so it is not handed over again.
+	if handler.calls != 1 {
+		t.Fatal("connection reused after the handler read it: ", handler.calls, " calls")
+	}
+}
+
+func TestRelayServiceLeastConnections(t *testing.T) {
+	t.Parallel()
+	iPSK, uPSKList := multiKeys()
+	handler := &relayHandler{accepted: make(chan M.Socksaddr), hold: make(chan struct{})}
+	relayService := newRelayService(t, handler, relayUpstreams)
+	relayService.SetPolicy(shadowaead_2022.RelayPolicyLeastConnections)
+	var wg sync.WaitGroup
+	newConnection := func() M.Socksaddr {
+		request := clientRequest(t, multiMethod, [][]byte{iPSK, uPSKList[0]}, "test.com:443")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			relayService.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+		}()
+		return <-handler.accepted
+	}
+	for _, upstream := range relayUpstreams {
+		if destination := newConnection(); destination != upstream {
+			t.Fatal("bad destination: ", destination, ", expected ", upstream)
+		}
+	}
+	close(handler.hold)
+	wg.Wait()
+	if destination := newConnection(); destination != relayUpstreams[0] {
+		t.Fatal("bad destination: ", destination)
+	}
+	wg.Wait()
+}
+
+func TestRelayServiceStickySession(t *testing.T) {
+	t.Parallel()
+	iPSK, uPSKList := multiKeys()
+	handler := &relayHandler{packets: make(chan M.Socksaddr, 8)}
+	relayService := newRelayService(t, handler, relayUpstreams[:2])
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sessions := [][][]byte{
+		clientPackets(t, multiMethod, [][]byte{iPSK, uPSKList[0]}, 3),
+		clientPackets(t, multiMethod, [][]byte{iPSK, uPSKList[0]}, 3),
+	}
+	for i := 0; i < 3; i++ {
+		for j, packets := range sessions {
+			buffer := buf.As(append([]byte(nil), packets[i]...))
+			err := relayService.NewPacket(ctx, nil, buffer, M.Metadata{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if destination := <-handler.packets; destination != relayUpstreams[j] {
+				t.Fatal("session ", j, " packet ", i, ": bad destination: ", destination)
+			}
+		}
+	}
+}
+
+func TestRelayServiceConcurrentUpdate(t *testing.T) {
+	t.Parallel()
+	iPSK, uPSKList := multiKeys()
+	handler := &relayHandler{packets: make(chan M.Socksaddr, 64)}
+	relayService := newRelayService(t, handler, relayUpstreams[:1])
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for {
+			select {
+			case <-handler.packets:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		requests := make([][]byte, 50)
+		for j := range requests {
+			requests[j] = clientRequest(t, multiMethod, [][]byte{iPSK, uPSKList[i%2]}, "test.com:443")
+		}
+		packets := clientPackets(t, multiMethod, [][]byte{iPSK, uPSKList[i%2]}, 50)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range requests {
+				relayService.NewConnection(ctx, &bufferConn{reader: bytes.NewReader(requests[j])}, M.Metadata{})
+				relayService.NewPacket(ctx, nil, buf.As(packets[j]), M.Metadata{})
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		upstreams := relayUpstreams[:1+i%len(relayUpstreams)]
+		err := relayService.UpdateUsersWithUpstreams([]string{"alice", "bob"}, uPSKList, [][]M.Socksaddr{upstreams, upstreams})
+		if err != nil {
+			t.Fatal(err)
+		}
+		relayService.SetPolicy(shadowaead_2022.RelayPolicy(i % 3))
+		relayService.SetRateLimit(float64(1000+i), 1000)
+		relayService.SetPacketWindow(i%2 == 0)
+	}
+	wg.Wait()
+}
+
+func FuzzRelayServiceNewConnection(f *testing.F) {
+	iPSK, uPSKList := multiKeys()
+	for _, uPSK := range uPSKList {
+		f.Add(clientRequest(f, multiMethod, [][]byte{iPSK, uPSK}, "test.com:443"))
+	}
+	relayService := newFuzzRelayService(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		relayService.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(data)}, M.Metadata{})
+	})
+}
+
+func FuzzRelayServiceNewPacket(f *testing.F) {
+	iPSK, uPSKList := multiKeys()
+	for _, uPSK := range uPSKList {
+		f.Add(clientPacket(f, multiMethod, [][]byte{iPSK, uPSK}, "1.1.1.1:53"))
+	}
+	relayService := newFuzzRelayService(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		buffer := buf.NewSize(len(data))
+		buffer.Write(data)
+		relayService.NewPacket(ctx, nil, buffer, M.Metadata{})
+	})
+}
+
+func BenchmarkRelayServiceNewConnection(b *testing.B) {
+	iPSK, uPSKList := multiKeys()
+	relayService, err := shadowaead_2022.NewRelayService[string](multiMethod, iPSK, 60, &benchmarkHandler{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	destination := M.ParseSocksaddr("127.0.0.1:10000")
+	err = relayService.UpdateUsers([]string{"alice", "bob"}, uPSKList, []M.Socksaddr{destination, destination})
+	if err != nil {
+		b.Fatal(err)
+	}
+	// Salts are checked for replay, so every handshake needs its own request.
+	requests := make([][]byte, b.N)
+	for i := range requests {
+		requests[i] = clientRequest(b, multiMethod, [][]byte{iPSK, uPSKList[0]}, "test.com:443")
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for _, request := range requests {
+		err = relayService.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRelayServiceReplay(t *testing.T) {
+	t.Parallel()
+	iPSK, uPSKList := multiKeys()
+	relayService := newRelayService(t, &relayHandler{}, relayUpstreams[:1])
+	request := clientRequest(t, multiMethod, [][]byte{iPSK, uPSKList[0]}, "test.com:443")
+	err := relayService.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = relayService.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+	if !errors.Is(err, shadowaead_2022.ErrSaltNotUnique) {
+		t.Fatal("expected salt replay, got ", err)
+	}
+}
+
+func TestRelayServiceRateLimit(t *testing.T) {
+	t.Parallel()
+	iPSK, uPSKList := multiKeys()
+	relayService := newRelayService(t, &relayHandler{}, relayUpstreams[:1])
+	relayService.SetRateLimit(0.001, 2)
+	for i := 0; i < 3; i++ {
+		request := clientRequest(t, multiMethod, [][]byte{iPSK, uPSKList[0]}, "test.com:443")
+		err := relayService.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+		if i < 2 && err != nil {
+			t.Fatal(err)
+		} else if i == 2 && shadowsocks.HandshakeReasonOf(err) != shadowsocks.ReasonRateLimited {
+			t.Fatal("expected rate limit, got ", err)
+		}
+	}
+	// Other users have their own budget.
+	request := clientRequest(t, multiMethod, [][]byte{iPSK, uPSKList[1]}, "test.com:443")
+	err := relayService.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRelayServiceRateLimitZeroBurst(t *testing.T) {
+	t.Parallel()
+	iPSK, uPSKList := multiKeys()
+	relayService := newRelayService(t, &relayHandler{}, relayUpstreams[:1])
+	relayService.SetRateLimit(0.001, 0)
+	for i := 0; i < 2; i++ {
+		request := clientRequest(t, multiMethod, [][]byte{iPSK, uPSKList[0]}, "test.com:443")
+		err := relayService.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+		if i == 0 && err != nil {
+			t.Fatal(err)
+		} else if i == 1 && shadowsocks.HandshakeReasonOf(err) != shadowsocks.ReasonRateLimited {
+			t.Fatal("expected rate limit, got ", err)
+		}
+	}
+}
+
+func TestRelayServicePacketWindow(t *testing.T) {
+	t.Parallel()
+	iPSK, uPSKList := multiKeys()
+	handler := &relayHandler{packets: make(chan M.Socksaddr, 8)}
+	relayService := newRelayService(t, handler, relayUpstreams[:1])
+	relayService.SetPacketWindow(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	packets := clientPackets(t, multiMethod, [][]byte{iPSK, uPSKList[0]}, 2)
+	for _, packet := range [][]byte{packets[1], packets[0]} {
+		err := relayService.NewPacket(ctx, nil, buf.As(append([]byte(nil), packet...)), M.Metadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-handler.packets
+	}
+	err := relayService.NewPacket(ctx, nil, buf.As(append([]byte(nil), packets[1]...)), M.Metadata{})
+	if !errors.Is(err, shadowaead_2022.ErrPacketIdNotUnique) {
+		t.Fatal("expected packet replay, got ", err)
+	}
+}
+
+func newRelayService(t *testing.T, handler *relayHandler, upstreams []M.Socksaddr) *shadowaead_2022.RelayService[string] {
+	iPSK, uPSKList := multiKeys()
+	relayService, err := shadowaead_2022.NewRelayService[string](multiMethod, iPSK, 60, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = relayService.UpdateUsersWithUpstreams([]string{"alice", "bob"}, uPSKList, [][]M.Socksaddr{upstreams, upstreams})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return relayService
+}
+
+func newFuzzRelayService(f *testing.F) *shadowaead_2022.RelayService[string] {
+	iPSK, uPSKList := multiKeys()
+	relayService, err := shadowaead_2022.NewRelayService[string](multiMethod, iPSK, 60, &discardHandler{})
+	if err != nil {
+		f.Fatal(err)
+	}
+	destination := M.ParseSocksaddr("127.0.0.1:10000")
+	err = relayService.UpdateUsers([]string{"alice", "bob"}, uPSKList, []M.Socksaddr{destination, destination})
+	if err != nil {
+		f.Fatal(err)
+	}
+	return relayService
+}
+
+// relayHandler records relay destinations and reports fail as unreachable.
+type relayHandler struct {
+	discardHandler
+	access       sync.Mutex
+	destinations []M.Socksaddr
+	fail         M.Socksaddr
+	accepted     chan M.Socksaddr
+	hold         chan struct{}
+	packets      chan M.Socksaddr
+}
+
+func (h *relayHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	h.access.Lock()
+	h.destinations = append(h.destinations, metadata.Destination)
+	h.access.Unlock()
+	if metadata.Destination == h.fail {
+		return E.Cause(shadowaead_2022.ErrUpstreamUnreachable, metadata.Destination)
+	}
+	if h.accepted != nil {
+		h.accepted <- metadata.Destination
+		<-h.hold
+	}
+	_, err := io.Copy(io.Discard, conn)
+	return err
+}
+
+func (h *relayHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	for {
+		buffer := buf.NewPacket()
+		destination, err := conn.ReadPacket(buffer)
+		buffer.Release()
+		if errors.Is(err, io.ErrClosedPipe) {
+			return nil
+		} else if err == nil {
+			h.packets <- destination
+		}
+	}
+}
+
+// relayDialer records dial destinations and refuses fail.
+type relayDialer struct {
+	access       sync.Mutex
+	destinations []M.Socksaddr
+	conns        []*upstreamConn
+	fail         M.Socksaddr
+}
+
+func (d *relayDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	d.access.Lock()
+	defer d.access.Unlock()
+	d.destinations = append(d.destinations, destination)
+	if destination == d.fail {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+	}
+	conn := &upstreamConn{done: make(chan struct{})}
+	d.conns = append(d.conns, conn)
+	return conn, nil
+}
+
+func (d *relayDialer) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	return nil, syscall.ENOTSUP
+}
+
+// upstreamConn records writes and blocks reads until closed, like an upstream waiting for the request.
+type upstreamConn struct {
+	bufferConn
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (c *upstreamConn) Read(p []byte) (n int, err error) {
+	<-c.done
+	return 0, io.EOF
+}
+
+func (c *upstreamConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return nil
+}
+
+// usedConnHandler reads the connection, then fails with a dial error.
+type usedConnHandler struct {
+	discardHandler
+	calls int
+}
+
+func (h *usedConnHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	h.calls++
+	conn.Read(make([]byte, 1))
+	return &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+}
@@ -0,0 +1,140 @@
+package shadowaead_2022
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// RelayPolicy selects one of the upstreams of a relay user.
+type RelayPolicy uint8
+
+const (
+	// RelayPolicyRoundRobin rotates through the upstreams.
+	RelayPolicyRoundRobin RelayPolicy = iota
+	// RelayPolicyLeastConnections picks the upstream with the fewest active connections and UDP sessions.
+	RelayPolicyLeastConnections
+	// RelayPolicyHashSource hashes the client address of TCP connections and the session ID of UDP sessions,
+	// so that a client keeps using the same upstream. TCP clients behind one address share an upstream.
+	RelayPolicyHashSource
+)
+
+const (
+	relayMaxFailures   = 3
+	relayFailureBanned = 30 * time.Second
+)
+
+var ErrNoUpstream = E.New("no upstream available")
+
+// ErrUpstreamUnreachable is returned, possibly wrapped, by a handler that failed to dial the upstream of
+// a relayed connection without reading, writing, closing or keeping the connection. The relay then hands
+// the connection over again with another upstream. Any other error ends the connection.
+// Relays with a dialer set by SetDialer report their own failed dials with it.
+var ErrUpstreamUnreachable = E.New("upstream unreachable")
+
+type relayUpstream struct {
+	destination M.Socksaddr
+	connections int64
+	failures    int32
+	bannedUntil int64
+}
+
+func (u *relayUpstream) available(now int64) bool {
+	return atomic.LoadInt64(&u.bannedUntil) <= now
+}
+
+// report updates the passive health state from the handler result.
+// Only dial failures count against the upstream, any other result proves it reachable.
+func (u *relayUpstream) report(err error) {
+	if !isDialError(err) && !errors.Is(err, ErrUpstreamUnreachable) {
+		atomic.StoreInt32(&u.failures, 0)
+		atomic.StoreInt64(&u.bannedUntil, 0)
+		return
+	}
+	if atomic.AddInt32(&u.failures, 1) >= relayMaxFailures {
+		atomic.StoreInt64(&u.bannedUntil, time.Now().Add(relayFailureBanned).UnixNano())
+	}
+}
+
+type relayGroup struct {
+	upstreams []*relayUpstream
+	next      uint32
+}
+
+// pick selects an upstream not in exclude, preferring healthy ones.
+// If every remaining upstream is banned, they are all tried anyway.
+func (g *relayGroup) pick(policy RelayPolicy, hash uint64, exclude []*relayUpstream) *relayUpstream {
+	now := time.Now().UnixNano()
+	candidates := make([]*relayUpstream, 0, len(g.upstreams))
+	var banned []*relayUpstream
+	for _, upstream := range g.upstreams {
+		if containsUpstream(exclude, upstream) {
+			continue
+		}
+		if upstream.available(now) {
+			candidates = append(candidates, upstream)
+		} else {
+			banned = append(banned, upstream)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = banned
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	switch policy {
+	case RelayPolicyLeastConnections:
+		selected := candidates[0]
+		for _, upstream := range candidates[1:] {
+			if atomic.LoadInt64(&upstream.connections) < atomic.LoadInt64(&selected.connections) {
+				selected = upstream
+			}
+		}
+		return selected
+	case RelayPolicyHashSource:
+		return candidates[hash%uint64(len(candidates))]
+	default:
+		return candidates[(atomic.AddUint32(&g.next, 1)-1)%uint32(len(candidates))]
+	}
+}
+
+func containsUpstream(upstreamList []*relayUpstream, upstream *relayUpstream) bool {
+	for _, item := range upstreamList {
+		if item == upstream {
+			return true
+		}
+	}
+	return false
+}
+
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+type relayUpstreamKey struct{}
+
+// relayUDPHandler accounts UDP sessions against the upstream chosen when the session was created.
+type relayUDPHandler struct {
+	*shadowsocks.MetricsUDPHandler
+}
+
+func (h *relayUDPHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	upstream, _ := ctx.Value(relayUpstreamKey{}).(*relayUpstream)
+	if upstream == nil {
+		return h.MetricsUDPHandler.NewPacketConnection(ctx, conn, metadata)
+	}
+	atomic.AddInt64(&upstream.connections, 1)
+	err := h.MetricsUDPHandler.NewPacketConnection(ctx, conn, metadata)
+	atomic.AddInt64(&upstream.connections, -1)
+	upstream.report(err)
+	return err
+}
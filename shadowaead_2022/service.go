@@ -1,6 +1,7 @@
 package shadowaead_2022
 
 import (
+	"bytes"
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
@@ -13,19 +14,17 @@ import (
 	"net"
 	"os"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/sagernet/sing-shadowsocks"
 	"github.com/sagernet/sing-shadowsocks/shadowaead"
 	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/atomic"
 	"github.com/sagernet/sing/common/buf"
-	"github.com/sagernet/sing/common/cache"
 	E "github.com/sagernet/sing/common/exceptions"
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
 	"github.com/sagernet/sing/common/replay"
-	"github.com/sagernet/sing/common/udpnat"
 
 	"golang.org/x/crypto/chacha20poly1305"
 )
@@ -39,23 +38,32 @@ var (
 var _ shadowsocks.Service = (*Service)(nil)
 
 type Service struct {
+	*shadowsocks.UDPServer[uint64]
 	name          string
 	keySaltLength int
 	handler       shadowsocks.Handler
 	timeFunc      func() time.Time
+	random        io.Reader
+	intn          func(n int) int
+	mtu           int
+	udpTimeout    int64
 
 	constructor      func(key []byte) (cipher.AEAD, error)
 	blockConstructor func(key []byte) (cipher.Block, error)
-	udpCipher        cipher.AEAD
-	udpBlockCipher   cipher.Block
-	psk              []byte
+	keys             atomic.TypedValue[[]*serverKey]
 
 	replayFilter replay.Filter
-	udpNat       *udpnat.Service[uint64]
-	udpSessions  *cache.LruCache[uint64, *serverUDPSession]
+	udpHandler   *shadowsocks.MetricsUDPHandler
+	udpNat       *shadowsocks.UDPNAT[uint64]
+	udpSessions  *shadowsocks.SessionTable[uint64, *serverUDPSession]
+	metrics      shadowsocks.Metrics
+	handshake    shadowsocks.HandshakeLimiter
+	lifecycle    shadowsocks.Lifecycle
+	registry     shadowsocks.SessionRegistry
+	acl          *shadowsocks.ACL
 }
 
-func NewServiceWithPassword(method string, password string, udpTimeout int64, handler shadowsocks.Handler, timeFunc func() time.Time) (shadowsocks.Service, error) {
+func NewServiceWithPassword(method string, password string, udpTimeout int64, handler shadowsocks.Handler, timeFunc func() time.Time, options ...ServiceOption) (shadowsocks.Service, error) {
 	if password == "" {
 		return nil, ErrMissingPSK
 	}
@@ -63,22 +71,25 @@ func NewServiceWithPassword(method string, password string, udpTimeout int64, ha
 	if err != nil {
 		return nil, E.Cause(err, "decode psk")
 	}
-	return NewService(method, psk, udpTimeout, handler, timeFunc)
+	return NewService(method, psk, udpTimeout, handler, timeFunc, options...)
 }
 
-func NewService(method string, psk []byte, udpTimeout int64, handler shadowsocks.Handler, timeFunc func() time.Time) (shadowsocks.Service, error) {
+func NewService(method string, psk []byte, udpTimeout int64, handler shadowsocks.Handler, timeFunc func() time.Time, options ...ServiceOption) (shadowsocks.Service, error) {
 	s := &Service{
-		name:     method,
-		handler:  handler,
-		timeFunc: timeFunc,
-
-		replayFilter: replay.NewSimple(60 * time.Second),
-		udpNat:       udpnat.New[uint64](udpTimeout, handler),
-		udpSessions: cache.New[uint64, *serverUDPSession](
-			cache.WithAge[uint64, *serverUDPSession](udpTimeout),
-			cache.WithUpdateAgeOnGet[uint64, *serverUDPSession](),
-		),
+		name:       method,
+		handler:    handler,
+		timeFunc:   timeFunc,
+		random:     rand.Reader,
+		intn:       mRand.Intn,
+		udpTimeout: udpTimeout,
+
+		replayFilter: newServiceOptions(options).replayFilter,
+		udpHandler:   shadowsocks.NewMetricsUDPHandler(method, handler),
+		udpSessions:  shadowsocks.NewSessionTable[uint64, *serverUDPSession](shadowsocks.HashUint64, udpTimeout, 0, nil),
 	}
+	s.udpNat = shadowsocks.NewUDPNAT[uint64](udpTimeout, s.udpHandler, shadowsocks.HashUint64)
+	s.udpNat.SetSessionRegistry(&s.registry)
+	s.UDPServer = shadowsocks.NewUDPServer[uint64](method, handler, s.udpNat, &s.lifecycle, &s.metrics)
 
 	switch method {
 	case "2022-blake3-aes-128-gcm":
@@ -96,6 +107,23 @@ func NewService(method string, psk []byte, udpTimeout int64, handler shadowsocks
 		return nil, os.ErrInvalid
 	}
 
+	key, err := s.newServerKey(psk, shadowsocks.ServerKey{})
+	if err != nil {
+		return nil, err
+	}
+	s.keys.Store([]*serverKey{key})
+	return s, nil
+}
+
+// serverKey is a PSK accepted by a Service, the identity PSK for multi-user services.
+type serverKey struct {
+	shadowsocks.ServerKey
+	psk            []byte
+	udpCipher      cipher.AEAD
+	udpBlockCipher cipher.Block
+}
+
+func (s *Service) newServerKey(psk []byte, config shadowsocks.ServerKey) (*serverKey, error) {
 	if len(psk) != s.keySaltLength {
 		if len(psk) < s.keySaltLength {
 			return nil, shadowsocks.ErrBadKey
@@ -105,20 +133,68 @@ func NewService(method string, psk []byte, udpTimeout int64, handler shadowsocks
 			return nil, ErrMissingPSK
 		}
 	}
-
+	key := &serverKey{ServerKey: config, psk: psk}
 	var err error
-	switch method {
-	case "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
-		s.udpBlockCipher, err = aes.NewCipher(psk)
-	case "2022-blake3-chacha20-poly1305":
-		s.udpCipher, err = chacha20poly1305.NewX(psk)
+	if s.udpChaCha() {
+		key.udpCipher, err = chacha20poly1305.NewX(psk)
+	} else {
+		key.udpBlockCipher, err = s.blockConstructor(psk)
 	}
 	if err != nil {
 		return nil, err
 	}
+	return key, nil
+}
 
-	s.psk = psk
-	return s, nil
+func (s *Service) UpdateKeys(keys []shadowsocks.ServerKey) error {
+	if len(keys) == 0 {
+		return ErrMissingPSK
+	}
+	serverKeys := make([]*serverKey, 0, len(keys))
+	for _, key := range keys {
+		psk := key.Key
+		if len(psk) == 0 {
+			if key.Password == "" {
+				return ErrMissingPSK
+			}
+			var err error
+			psk, err = base64.StdEncoding.DecodeString(key.Password)
+			if err != nil {
+				return E.Cause(err, "decode psk")
+			}
+		}
+		serverKey, err := s.newServerKey(psk, key)
+		if err != nil {
+			return err
+		}
+		serverKeys = append(serverKeys, serverKey)
+	}
+	s.keys.Store(serverKeys)
+	return nil
+}
+
+// activeKeys returns the keys accepted now, the primary key first. The key list is copied only if some are not.
+func (s *Service) activeKeys() []*serverKey {
+	keys := s.keys.Load()
+	now := s.time()
+	for i, key := range keys {
+		if key.Active(now) {
+			continue
+		}
+		active := append(make([]*serverKey, 0, len(keys)), keys[:i]...)
+		for _, key := range keys[i+1:] {
+			if key.Active(now) {
+				active = append(active, key)
+			}
+		}
+		return active
+	}
+	return keys
+}
+
+// udpChaCha reports whether packets are sealed whole with XChaCha20-Poly1305 instead of having a separate AES header.
+func (s *Service) udpChaCha() bool {
+	return s.blockConstructor == nil
 }
 
 func (s *Service) Name() string {
@@ -126,17 +202,127 @@ func (s *Service) Name() string {
 }
 
 func (s *Service) Password() string {
-	return base64.StdEncoding.EncodeToString(s.psk)
+	return base64.StdEncoding.EncodeToString(s.keys.Load()[0].psk)
+}
+
+func (s *Service) SetHandshakeTimeout(timeout time.Duration) {
+	s.handshake.SetHandshakeTimeout(timeout)
+}
+
+func (s *Service) SetHandshakeLimit(limit int, queueTimeout time.Duration) {
+	s.handshake.SetHandshakeLimit(limit, queueTimeout)
+}
+
+func (s *Service) SetACL(acl *shadowsocks.ACL) {
+	s.acl = acl
+}
+
+func (s *Service) SetMetrics(metrics shadowsocks.Metrics) {
+	s.metrics = metrics
+	s.udpHandler.Metrics = metrics
+}
+
+// SetRandom replaces the entropy source of salts and UDP sessions. A nil random restores crypto/rand.
+func (s *Service) SetRandom(random io.Reader) {
+	if random == nil {
+		random = rand.Reader
+	}
+	s.random = random
+}
+
+// SetPaddingRNG replaces the generator of padding lengths, which must return a value in [0, n).
+// A nil intn restores math/rand.
+func (s *Service) SetPaddingRNG(intn func(n int) int) {
+	if intn == nil {
+		intn = mRand.Intn
+	}
+	s.intn = intn
+}
+
+// SetMTU sets the path MTU of UDP packets, padding is capped to fit it and larger packets are rejected.
+// Zero disables the limit.
+func (s *Service) SetMTU(mtu int) {
+	s.mtu = mtu
+}
+
+// SetUDPSessionLimit bounds the number of UDP sessions and their NAT entries. Zero means unbounded.
+func (s *Service) SetUDPSessionLimit(limit int) {
+	s.udpSessions = shadowsocks.NewSessionTable[uint64, *serverUDPSession](shadowsocks.HashUint64, s.udpTimeout, limit, nil)
+	s.UDPServer.SetUDPSessionLimit(limit)
+}
+
+func (s *Service) Sessions() []shadowsocks.SessionInfo {
+	return s.registry.Sessions()
+}
+
+func (s *Service) UserSessions(user any) []shadowsocks.SessionInfo {
+	return s.registry.UserSessions(user)
+}
+
+func (s *Service) CloseSession(id uint64) bool {
+	return s.registry.CloseSession(id)
+}
+
+func (s *Service) CloseUserSessions(user any) int {
+	return s.registry.CloseUserSessions(user)
+}
+
+func (s *Service) Close() error {
+	s.lifecycle.Close()
+	s.udpNat.Close()
+	s.udpSessions.Clear()
+	return closeReplayFilter(s.replayFilter)
+}
+
+func (s *Service) Shutdown(ctx context.Context) (shadowsocks.ShutdownStats, error) {
+	stats, err := s.lifecycle.Shutdown(ctx)
+	stats.Sessions = s.udpNat.Close()
+	s.udpSessions.Clear()
+	return stats, E.Errors(err, closeReplayFilter(s.replayFilter))
 }
 
 func (s *Service) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
-	err := s.newConnection(ctx, conn, metadata)
+	element, err := s.lifecycle.Acquire(conn)
+	if err != nil {
+		return &shadowsocks.ServerConnError{Conn: conn, Source: metadata.Source, Cause: err}
+	}
+	defer s.lifecycle.Release(element)
+	protocolConn, err := s.newConnection(ctx, conn, &metadata)
+	if err != nil {
+		if s.metrics != nil {
+			s.metrics.HandshakeRejected(s.name, err)
+		}
+	} else {
+		session := s.registry.Register(N.NetworkTCP, nil, metadata, conn)
+		defer session.Unregister()
+		err = s.handler.NewConnection(ctx, session.Conn(s.wrapConn(protocolConn)), metadata)
+	}
 	if err != nil {
 		err = &shadowsocks.ServerConnError{Conn: conn, Source: metadata.Source, Cause: err}
 	}
 	return err
 }
 
+func (s *Service) wrapConn(conn net.Conn) net.Conn {
+	if s.metrics == nil {
+		return conn
+	}
+	s.metrics.HandshakeAccepted(s.name)
+	return shadowsocks.NewMetricsConn(conn, s.name, s.metrics)
+}
+
+func (s *Service) checkTimestamp(epoch uint64) error {
+	skew := s.time().Unix() - int64(epoch)
+	if s.metrics != nil {
+		s.metrics.ClockSkew(s.name, time.Duration(skew)*time.Second)
+	}
+	diff := int(math.Abs(float64(skew)))
+	if diff > MaxTimestampDiff {
+		return E.Extend(ErrBadTimestamp, "received ", epoch, ", diff ", diff, "s")
+	}
+	return nil
+}
+
 func (s *Service) time() time.Time {
 	if s.timeFunc != nil {
 		return s.timeFunc()
@@ -145,106 +331,110 @@ func (s *Service) time() time.Time {
 	}
 }
 
-func (s *Service) newConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
-	header := make([]byte, s.keySaltLength+shadowaead.Overhead+RequestHeaderFixedChunkLength)
+func (s *Service) newConnection(ctx context.Context, conn net.Conn, metadata *M.Metadata) (net.Conn, error) {
+	err := s.handshake.Start(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	defer s.handshake.Finish(conn)
+	scratch := newHandshakeBuffer()
+	defer scratch.release()
+	header := scratch[:s.keySaltLength+shadowaead.Overhead+RequestHeaderFixedChunkLength]
 
-	n, err := conn.Read(header)
+	protocolConn := &serverConn{
+		Service: s,
+		Conn:    conn,
+	}
+	handshakeReader := &protocolConn.handshakeReader
+	handshakeReader.Reader = conn
+	n, err := handshakeReader.Read(header)
 	if err != nil {
-		return E.Cause(err, "read header")
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReadReason(err, shadowsocks.ReasonReadFailed), n, E.Cause(err, "read header"))
 	} else if n < len(header) {
-		return shadowaead.ErrBadHeader
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonBadHeader, n, shadowaead.ErrBadHeader)
 	}
 
 	requestSalt := header[:s.keySaltLength]
 
 	if !s.replayFilter.Check(requestSalt) {
-		return ErrSaltNotUnique
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonReplay, n, ErrSaltNotUnique)
 	}
 
-	requestKey := SessionKey(s.psk, requestSalt, s.keySaltLength)
-	readCipher, err := s.constructor(requestKey)
-	if err != nil {
-		return err
-	}
-	reader := shadowaead.NewReader(
-		conn,
-		readCipher,
-		MaxPacketSize,
-	)
-
-	err = reader.ReadExternalChunk(header[s.keySaltLength:])
-	if err != nil {
-		return err
+	// Each key is tried on the fixed length chunk, the first one that opens it decrypts the connection.
+	var reader *shadowaead.Reader
+	err = ErrInvalidRequest
+	for _, key := range s.activeKeys() {
+		readCipher, cipherErr := newSessionCipher(s.constructor, key.psk, requestSalt, s.keySaltLength)
+		if cipherErr != nil {
+			return nil, cipherErr
+		}
+		candidate := shadowaead.NewReader(
+			handshakeReader,
+			readCipher,
+			MaxPacketSize,
+		)
+		err = candidate.ReadExternalChunk(header[s.keySaltLength:])
+		if err == nil {
+			reader = candidate
+			protocolConn.uPSK = key.psk
+			break
+		}
 	}
-
-	headerType, err := reader.ReadByte()
-	if err != nil {
-		return E.Cause(err, "read header")
+	if reader == nil {
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonDecryptFailed, n, err)
 	}
 
+	fixedChunk := reader.CachedSlice()
+	headerType := fixedChunk[0]
 	if headerType != HeaderTypeClient {
-		return E.Extend(ErrBadHeaderType, "expected ", HeaderTypeClient, ", got ", headerType)
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonBadHeader, n, E.Extend(ErrBadHeaderType, "expected ", HeaderTypeClient, ", got ", headerType))
 	}
 
-	var epoch uint64
-	err = binary.Read(reader, binary.BigEndian, &epoch)
+	epoch := binary.BigEndian.Uint64(fixedChunk[1:])
+	err = s.checkTimestamp(epoch)
 	if err != nil {
-		return err
-	}
-
-	diff := int(math.Abs(float64(s.time().Unix() - int64(epoch))))
-	if diff > 30 {
-		return E.Extend(ErrBadTimestamp, "received ", epoch, ", diff ", diff, "s")
-	}
-
-	var length uint16
-	err = binary.Read(reader, binary.BigEndian, &length)
-	if err != nil {
-		return err
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonBadTimestamp, n, err)
 	}
 
+	length := binary.BigEndian.Uint16(fixedChunk[9:])
 	err = reader.ReadWithLength(length)
 	if err != nil {
-		return err
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReadReason(err, shadowsocks.ReasonDecryptFailed), handshakeReader.Consumed, err)
 	}
 
 	destination, err := M.SocksaddrSerializer.ReadAddrPort(reader)
 	if err != nil {
-		return err
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonBadAddress, handshakeReader.Consumed, err)
+	}
+	if !s.acl.Allow(N.NetworkTCP, nil, destination) {
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonDenied, handshakeReader.Consumed, E.Extend(shadowsocks.ErrDestinationDenied, destination))
 	}
 
-	var paddingLen uint16
-	err = binary.Read(reader, binary.BigEndian, &paddingLen)
+	paddingLen, err := readUint16(reader)
 	if err != nil {
-		return err
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonBadPadding, handshakeReader.Consumed, err)
 	}
 
 	if uint16(reader.Cached()) < paddingLen {
-		return ErrNoPadding
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonBadPadding, handshakeReader.Consumed, ErrNoPadding)
 	}
 
 	if paddingLen > 0 {
 		err = reader.Discard(int(paddingLen))
 		if err != nil {
-			return E.Cause(err, "discard padding")
+			return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonBadPadding, handshakeReader.Consumed, E.Cause(err, "discard padding"))
 		}
 	} else if reader.Cached() == 0 {
-		return ErrNoPadding
-	}
-
-	protocolConn := &serverConn{
-		Service:     s,
-		Conn:        conn,
-		uPSK:        s.psk,
-		headerType:  headerType,
-		requestSalt: requestSalt,
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonBadPadding, handshakeReader.Consumed, ErrNoPadding)
 	}
 
+	protocolConn.headerType = headerType
+	copy(protocolConn.requestSalt[:], requestSalt)
 	protocolConn.reader = reader
 
 	metadata.Protocol = "shadowsocks"
 	metadata.Destination = destination
-	return s.handler.NewConnection(ctx, protocolConn, metadata)
+	return protocolConn, nil
 }
 
 type serverConn struct {
@@ -255,17 +445,20 @@ type serverConn struct {
 	headerType  byte
 	reader      *shadowaead.Reader
 	writer      *shadowaead.Writer
-	requestSalt []byte
+	requestSalt [keySaltMaxLength]byte
+	newBuffer   func() *buf.Buffer
+
+	handshakeReader shadowsocks.HandshakeReader
 }
 
 func (c *serverConn) writeResponse(payload []byte) (n int, err error) {
-	salt := buf.NewSize(c.keySaltLength)
-	salt.WriteRandom(salt.FreeLen())
+	scratch := newHandshakeBuffer()
+	defer scratch.release()
+	salt := scratch[:c.keySaltLength]
+	common.Must1(io.ReadFull(c.random, salt))
 
-	key := SessionKey(c.uPSK, salt.Bytes(), c.keySaltLength)
-	writeCipher, err := c.constructor(key)
+	writeCipher, err := newSessionCipher(c.constructor, c.uPSK, salt, c.keySaltLength)
 	if err != nil {
-		salt.Release()
 		return
 	}
 	writer := shadowaead.NewWriter(
@@ -274,22 +467,21 @@ func (c *serverConn) writeResponse(payload []byte) (n int, err error) {
 		MaxPacketSize,
 	)
 	header := writer.Buffer()
-	header.Write(salt.Bytes())
-
-	salt.Release()
+	common.Must1(header.Write(salt))
 
 	headerType := byte(HeaderTypeServer)
 	payloadLen := len(payload)
+	maxPayloadLen := header.FreeLen() - (1 + 8 + c.keySaltLength + 2) - 2*shadowaead.Overhead
+	if payloadLen > maxPayloadLen {
+		payloadLen = maxPayloadLen
+	}
 
-	headerFixedChunk := buf.NewSize(1 + 8 + c.keySaltLength + 2)
-	common.Must(headerFixedChunk.WriteByte(headerType))
-	common.Must(binary.Write(headerFixedChunk, binary.BigEndian, uint64(c.time().Unix())))
-	common.Must1(headerFixedChunk.Write(c.requestSalt))
-	common.Must(binary.Write(headerFixedChunk, binary.BigEndian, uint16(payloadLen)))
-
-	writer.WriteChunk(header, headerFixedChunk.Bytes())
-	headerFixedChunk.Release()
-	c.requestSalt = nil
+	headerFixedChunk := scratch[c.keySaltLength : c.keySaltLength+1+8+c.keySaltLength+2]
+	headerFixedChunk[0] = headerType
+	binary.BigEndian.PutUint64(headerFixedChunk[1:], uint64(c.time().Unix()))
+	copy(headerFixedChunk[9:], c.requestSalt[:c.keySaltLength])
+	binary.BigEndian.PutUint16(headerFixedChunk[9+c.keySaltLength:], uint16(payloadLen))
+	writer.WriteChunk(header, headerFixedChunk)
 
 	if payloadLen > 0 {
 		writer.WriteChunk(header, payload[:payloadLen])
@@ -300,6 +492,13 @@ func (c *serverConn) writeResponse(payload []byte) (n int, err error) {
 		return
 	}
 
+	if payloadLen < len(payload) {
+		_, err = writer.Write(payload[payloadLen:])
+		if err != nil {
+			return
+		}
+	}
+
 	switch headerType {
 	case HeaderTypeServer:
 		c.writer = writer
@@ -354,6 +553,50 @@ func (c *serverConn) WriteVectorised(buffers []*buf.Buffer) error {
 	return c.writer.WriteVectorised(buffers[1:])
 }
 
+var (
+	_ N.ExtendedConn = (*serverConn)(nil)
+	_ N.ReadWaiter   = (*serverConn)(nil)
+)
+
+func (c *serverConn) ReadBuffer(buffer *buf.Buffer) error {
+	return c.reader.ReadBuffer(buffer)
+}
+
+func (c *serverConn) WriteBuffer(buffer *buf.Buffer) error {
+	if c.writer != nil {
+		return c.writer.WriteBuffer(buffer)
+	}
+	c.access.Lock()
+	if c.writer != nil {
+		c.access.Unlock()
+		return c.writer.WriteBuffer(buffer)
+	}
+	defer c.access.Unlock()
+	defer buffer.Release()
+	return common.Error(c.writeResponse(buffer.Bytes()))
+}
+
+func (c *serverConn) InitializeReadWaiter(newBuffer func() *buf.Buffer) {
+	c.newBuffer = newBuffer
+}
+
+func (c *serverConn) WaitReadBuffer() error {
+	buffer := c.newBuffer()
+	err := c.ReadBuffer(buffer)
+	if err != nil {
+		buffer.Release()
+	}
+	return err
+}
+
+func (c *serverConn) FrontHeadroom() int {
+	return shadowaead.PacketLengthBufferSize + shadowaead.Overhead
+}
+
+func (c *serverConn) RearHeadroom() int {
+	return shadowaead.Overhead
+}
+
 func (c *serverConn) Close() error {
 	return common.Close(
 		c.Conn,
@@ -374,49 +617,70 @@ func (s *Service) WriteIsThreadUnsafe() {
 }
 
 func (s *Service) NewPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
-	err := s.newPacket(ctx, conn, buffer, metadata)
-	if err != nil {
-		err = &shadowsocks.ServerPacketError{Source: metadata.Source, Cause: err}
-	}
-	return err
+	return s.ServePacket(metadata, func() error {
+		return s.newPacket(ctx, conn, buffer, metadata, nil)
+	})
 }
 
-func (s *Service) newPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
-	var packetHeader []byte
-	if s.udpCipher != nil {
-		if buffer.Len() < PacketNonceSize+PacketMinimalHeaderSize {
-			return ErrPacketTooShort
+// NewPackets handles a batch of packets read from conn.
+// Consecutive packets of one session share a single session lookup.
+func (s *Service) NewPackets(ctx context.Context, conn N.PacketConn, buffers []*buf.Buffer, metadata []M.Metadata) {
+	var batch packetBatch
+	s.ServePackets(ctx, buffers, metadata, func(buffer *buf.Buffer, metadata M.Metadata) error {
+		return s.newPacket(ctx, conn, buffer, metadata, &batch)
+	})
+}
+
+func (s *Service) newPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata, batch *packetBatch) error {
+	packetLen := buffer.Len()
+	var (
+		key          *serverKey
+		packetHeader []byte
+	)
+	if s.udpChaCha() {
+		if packetLen < PacketNonceSize+PacketMinimalHeaderSize {
+			return shadowsocks.NewHandshakeError(shadowsocks.ReasonBadHeader, packetLen, ErrPacketTooShort)
 		}
-		_, err := s.udpCipher.Open(buffer.Index(PacketNonceSize), buffer.To(PacketNonceSize), buffer.From(PacketNonceSize), nil)
+		var err error
+		key, err = s.openChaChaPacket(buffer, s.activeKeys())
 		if err != nil {
-			return E.Cause(err, "decrypt packet header")
+			return shadowsocks.NewHandshakeError(shadowsocks.ReasonDecryptFailed, packetLen, E.Cause(err, "decrypt packet header"))
 		}
 		buffer.Advance(PacketNonceSize)
 		buffer.Truncate(buffer.Len() - shadowaead.Overhead)
 	} else {
-		if buffer.Len() < PacketMinimalHeaderSize {
-			return ErrPacketTooShort
+		if packetLen < PacketMinimalHeaderSize {
+			return shadowsocks.NewHandshakeError(shadowsocks.ReasonBadHeader, packetLen, ErrPacketTooShort)
 		}
 		packetHeader = buffer.To(aes.BlockSize)
-		s.udpBlockCipher.Decrypt(packetHeader, packetHeader)
+		key = s.decryptPacketHeader(packetHeader, buffer.From(aes.BlockSize), s.activeKeys())
+		if key == nil {
+			return shadowsocks.NewHandshakeError(shadowsocks.ReasonDecryptFailed, packetLen, E.Cause(ErrInvalidRequest, "decrypt packet header"))
+		}
 	}
 
 	var sessionId, packetId uint64
 	err := binary.Read(buffer, binary.BigEndian, &sessionId)
 	if err != nil {
-		return err
+		return shadowsocks.NewHandshakeError(shadowsocks.ReasonBadHeader, packetLen, err)
 	}
 	err = binary.Read(buffer, binary.BigEndian, &packetId)
 	if err != nil {
-		return err
+		return shadowsocks.NewHandshakeError(shadowsocks.ReasonBadHeader, packetLen, err)
 	}
+	var reason shadowsocks.HandshakeReason
 
-	session, loaded := s.udpSessions.LoadOrStore(sessionId, s.newUDPSession)
+	session := batch.load(sessionId)
+	loaded := session != nil
+	if !loaded {
+		session, loaded = s.udpSessions.LoadOrStore(sessionId, func() *serverUDPSession {
+			return s.newUDPSessionWithPSK(key.psk)
+		})
+	}
 	if !loaded {
 		session.remoteSessionId = sessionId
 		if packetHeader != nil {
-			key := SessionKey(s.psk, packetHeader[:8], s.keySaltLength)
-			session.remoteCipher, err = s.constructor(key)
+			session.remoteCipher, err = s.constructor(SessionKey(key.psk, packetHeader[:8], s.keySaltLength))
 			if err != nil {
 				return err
 			}
@@ -428,18 +692,18 @@ returnErr:
 	if !loaded {
 		s.udpSessions.Delete(sessionId)
 	}
-	return err
+	return shadowsocks.NewHandshakeError(reason, packetLen, err)
 
 process:
 	if !session.window.Check(packetId) {
-		err = ErrPacketIdNotUnique
+		reason, err = shadowsocks.ReasonReplay, ErrPacketIdNotUnique
 		goto returnErr
 	}
 
 	if packetHeader != nil {
 		_, err = session.remoteCipher.Open(buffer.Index(0), packetHeader[4:16], buffer.Bytes(), nil)
 		if err != nil {
-			err = E.Cause(err, "decrypt packet")
+			reason, err = shadowsocks.ReasonDecryptFailed, E.Cause(err, "decrypt packet")
 			goto returnErr
 		}
 		buffer.Truncate(buffer.Len() - shadowaead.Overhead)
@@ -450,45 +714,121 @@ process:
 	var headerType byte
 	headerType, err = buffer.ReadByte()
 	if err != nil {
-		err = E.Cause(err, "decrypt packet")
+		reason, err = shadowsocks.ReasonBadHeader, E.Cause(err, "decrypt packet")
 		goto returnErr
 	}
 	if headerType != HeaderTypeClient {
-		err = E.Extend(ErrBadHeaderType, "expected ", HeaderTypeClient, ", got ", headerType)
+		reason, err = shadowsocks.ReasonBadHeader, E.Extend(ErrBadHeaderType, "expected ", HeaderTypeClient, ", got ", headerType)
 		goto returnErr
 	}
 
 	var epoch uint64
 	err = binary.Read(buffer, binary.BigEndian, &epoch)
 	if err != nil {
+		reason = shadowsocks.ReasonBadHeader
 		goto returnErr
 	}
-	diff := int(math.Abs(float64(s.time().Unix() - int64(epoch))))
-	if diff > 30 {
-		err = E.Extend(ErrBadTimestamp, "received ", epoch, ", diff ", diff, "s")
+	err = s.checkTimestamp(epoch)
+	if err != nil {
+		reason = shadowsocks.ReasonBadTimestamp
 		goto returnErr
 	}
 
 	var paddingLen uint16
 	err = binary.Read(buffer, binary.BigEndian, &paddingLen)
 	if err != nil {
-		err = E.Cause(err, "read padding length")
+		reason, err = shadowsocks.ReasonBadPadding, E.Cause(err, "read padding length")
+		goto returnErr
+	}
+	if buffer.Len() < int(paddingLen) {
+		reason, err = shadowsocks.ReasonBadPadding, ErrBadPadding
 		goto returnErr
 	}
 	buffer.Advance(int(paddingLen))
 
 	destination, err := M.SocksaddrSerializer.ReadAddrPort(buffer)
 	if err != nil {
+		reason = shadowsocks.ReasonBadAddress
+		goto returnErr
+	}
+	if !s.acl.Allow(N.NetworkUDP, nil, destination) {
+		reason, err = shadowsocks.ReasonDenied, E.Extend(shadowsocks.ErrDestinationDenied, destination)
 		goto returnErr
 	}
 	metadata.Protocol = "shadowsocks"
 	metadata.Destination = destination
+	if s.metrics != nil {
+		s.metrics.ReadBytes(s.name, int64(buffer.Len()))
+	}
+	batch.store(sessionId, session)
 	s.udpNat.NewPacket(ctx, sessionId, buffer, metadata, func(natConn N.PacketConn) N.PacketWriter {
-		return &serverPacketWriter{s, conn, natConn, session, s.udpBlockCipher}
+		return &serverPacketWriter{s, conn, natConn, session, key.udpCipher, key.udpBlockCipher}
 	})
 	return nil
 }
 
+// openChaChaPacket opens a whole packet in place with the first key that opens it. With several keys,
+// all but the last one are tried into a scratch buffer, as a failed Open clears its output.
+func (s *Service) openChaChaPacket(buffer *buf.Buffer, keys []*serverKey) (*serverKey, error) {
+	nonce, ciphertext := buffer.To(PacketNonceSize), buffer.From(PacketNonceSize)
+	var scratch []byte
+	for i, key := range keys {
+		if i == len(keys)-1 {
+			_, err := key.udpCipher.Open(ciphertext[:0], nonce, ciphertext, nil)
+			if err != nil {
+				return nil, err
+			}
+			return key, nil
+		}
+		if scratch == nil {
+			scratch = make([]byte, 0, len(ciphertext))
+		}
+		plaintext, err := key.udpCipher.Open(scratch, nonce, ciphertext, nil)
+		if err == nil {
+			copy(ciphertext, plaintext)
+			return key, nil
+		}
+	}
+	return nil, ErrInvalidRequest
+}
+
+// decryptPacketHeader decrypts the separate header of a packet in place with the key it was sent with.
+// With several keys, a known session is matched by its session ID and PSK, and a new session
+// by opening the packet into a scratch buffer.
+func (s *Service) decryptPacketHeader(packetHeader []byte, ciphertext []byte, keys []*serverKey) *serverKey {
+	if len(keys) == 1 {
+		keys[0].udpBlockCipher.Decrypt(packetHeader, packetHeader)
+		return keys[0]
+	}
+	var (
+		header  [aes.BlockSize]byte
+		scratch []byte
+	)
+	for _, key := range keys {
+		key.udpBlockCipher.Decrypt(header[:], packetHeader)
+		if session, loaded := s.udpSessions.Load(binary.BigEndian.Uint64(header[:8])); loaded {
+			if !bytes.Equal(session.psk, key.psk) {
+				continue
+			}
+		} else {
+			sessionCipher, err := s.constructor(SessionKey(key.psk, header[:8], s.keySaltLength))
+			if err != nil {
+				continue
+			}
+			if scratch == nil {
+				scratch = make([]byte, 0, len(ciphertext))
+			}
+			_, err = sessionCipher.Open(scratch, header[4:16], ciphertext, nil)
+			if err != nil {
+				continue
+			}
+		}
+		copy(packetHeader, header[:])
+		return key
+	}
+	return nil
+}
+
 func (s *Service) NewError(ctx context.Context, err error) {
 	s.handler.NewError(ctx, err)
 }
@@ -498,28 +838,54 @@ type serverPacketWriter struct {
 	source         N.PacketConn
 	nat            N.PacketConn
 	session        *serverUDPSession
+	udpCipher      cipher.AEAD
 	udpBlockCipher cipher.Block
 }
 
+// Close shadows Service.Close, closing a NAT session must not close the service.
+func (w *serverPacketWriter) Close() error {
+	return nil
+}
+
 func (w *serverPacketWriter) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
-	var hdrLen int
-	if w.udpCipher != nil {
-		hdrLen = PacketNonceSize
+	sessionId, packetId, sessionCipher := w.nextPacket(w.session)
+	err := w.sealPacket(buffer, destination, sessionId, packetId, sessionCipher)
+	if err != nil {
+		return err
 	}
+	return w.source.WritePacket(buffer, M.SocksaddrFromNet(w.nat.LocalAddr()))
+}
 
-	var paddingLen int
-	if destination.Port == 53 && buffer.Len() < MaxPaddingLength {
-		paddingLen = mRand.Intn(MaxPaddingLength-buffer.Len()) + 1
+// WritePackets seals a batch of packets with consecutive packet IDs reserved at once,
+// and writes them to the source with one call if it is a shadowsocks.PacketBatchWriter.
+func (w *serverPacketWriter) WritePackets(buffers []*buf.Buffer, destinations []M.Socksaddr) error {
+	sessionId, packetId, sessionCipher := w.nextPackets(w.session, len(buffers))
+	sources := make([]M.Socksaddr, len(buffers))
+	source := M.SocksaddrFromNet(w.nat.LocalAddr())
+	for i, buffer := range buffers {
+		err := w.sealPacket(buffer, destinations[i], sessionId, packetId+uint64(i), sessionCipher)
+		if err != nil {
+			buf.ReleaseMulti(buffers[:i])
+			buf.ReleaseMulti(buffers[i+1:])
+			return err
+		}
+		sources[i] = source
 	}
+	return shadowsocks.WritePackets(w.source, buffers, sources)
+}
 
-	hdrLen += 16 // packet header
-	hdrLen += 1  // header type
-	hdrLen += 8  // timestamp
-	hdrLen += 8  // remote session id
-	hdrLen += 2  // padding length
-	hdrLen += paddingLen
-	hdrLen += M.SocksaddrSerializer.AddrPortLen(destination)
-	header := buf.With(buffer.ExtendHeader(hdrLen))
+// sealPacket encrypts buffer in place as a server packet, releasing it on error.
+func (w *serverPacketWriter) sealPacket(buffer *buf.Buffer, destination M.Socksaddr, sessionId uint64, packetId uint64, sessionCipher cipher.AEAD) error {
+	if w.metrics != nil {
+		w.metrics.WriteBytes(w.name, int64(buffer.Len()))
+	}
+	overhead := w.packetOverhead(M.SocksaddrSerializer.AddrPortLen(destination))
+	paddingLen, err := packetPadding(w.mtu, w.intn, destination, overhead, buffer.Len())
+	if err != nil {
+		buffer.Release()
+		return err
+	}
+	header := buf.With(buffer.ExtendHeader(overhead - shadowaead.Overhead + paddingLen))
 
 	var dataIndex int
 	if w.udpCipher != nil {
@@ -530,8 +896,8 @@ func (w *serverPacketWriter) WritePacket(buffer *buf.Buffer, destination M.Socks
 	}
 
 	common.Must(
-		binary.Write(header, binary.BigEndian, w.session.sessionId),
-		binary.Write(header, binary.BigEndian, w.session.nextPacketId()),
+		binary.Write(header, binary.BigEndian, sessionId),
+		binary.Write(header, binary.BigEndian, packetId),
 		header.WriteByte(HeaderTypeServer),
 		binary.Write(header, binary.BigEndian, uint64(w.time().Unix())),
 		binary.Write(header, binary.BigEndian, w.session.remoteSessionId),
@@ -539,10 +905,10 @@ func (w *serverPacketWriter) WritePacket(buffer *buf.Buffer, destination M.Socks
 	)
 
 	if paddingLen > 0 {
-		header.Extend(paddingLen)
+		clearPadding(header.Extend(paddingLen))
 	}
 
-	err := M.SocksaddrSerializer.WriteAddrPort(header, destination)
+	err = M.SocksaddrSerializer.WriteAddrPort(header, destination)
 	if err != nil {
 		buffer.Release()
 		return err
@@ -553,37 +919,55 @@ func (w *serverPacketWriter) WritePacket(buffer *buf.Buffer, destination M.Socks
 		buffer.Extend(shadowaead.Overhead)
 	} else {
 		packetHeader := buffer.To(aes.BlockSize)
-		w.session.cipher.Seal(buffer.Index(dataIndex), packetHeader[4:16], buffer.From(dataIndex), nil)
+		sessionCipher.Seal(buffer.Index(dataIndex), packetHeader[4:16], buffer.From(dataIndex), nil)
 		buffer.Extend(shadowaead.Overhead)
 		w.udpBlockCipher.Encrypt(packetHeader, packetHeader)
 	}
-	return w.source.WritePacket(buffer, M.SocksaddrFromNet(w.nat.LocalAddr()))
+	return nil
 }
 
 func (w *serverPacketWriter) FrontHeadroom() int {
-	var hdrLen int
-	if w.udpCipher != nil {
-		hdrLen = PacketNonceSize
-	}
-	hdrLen += 16 // packet header
-	hdrLen += 1  // header type
-	hdrLen += 8  // timestamp
-	hdrLen += 8  // remote session id
-	hdrLen += 2  // padding length
-	hdrLen += MaxPaddingLength
-	hdrLen += M.MaxSocksaddrLength
-	return hdrLen
+	return w.packetOverhead(M.MaxSocksaddrLength) - shadowaead.Overhead + MaxPaddingLength
 }
 
 func (w *serverPacketWriter) RearHeadroom() int {
 	return shadowaead.Overhead
 }
 
+func (w *serverPacketWriter) ReaderMTU() int {
+	return MaxPacketSize
+}
+
+// WriterMTU returns the largest payload that fits the configured path MTU for any destination.
+func (w *serverPacketWriter) WriterMTU() int {
+	if w.mtu == 0 {
+		return MaxPacketSize
+	}
+	return w.mtu - w.packetOverhead(M.MaxSocksaddrLength)
+}
+
+// packetOverhead returns the bytes a server packet adds to its payload, not counting padding.
+func (s *Service) packetOverhead(addrLen int) int {
+	overhead := shadowaead.Overhead
+	if s.udpChaCha() {
+		overhead += PacketNonceSize
+	}
+	overhead += 16 // packet header
+	overhead += 1  // header type
+	overhead += 8  // timestamp
+	overhead += 8  // remote session id
+	overhead += 2  // padding length
+	overhead += addrLen
+	return overhead
+}
+
 func (w *serverPacketWriter) Upstream() any {
 	return w.source
 }
 
 type serverUDPSession struct {
+	access          sync.Mutex
+	psk             []byte
 	sessionId       uint64
 	remoteSessionId uint64
 	packetId        uint64
@@ -593,26 +977,67 @@ type serverUDPSession struct {
 	rng             io.Reader
 }
 
-func (s *serverUDPSession) nextPacketId() uint64 {
-	return atomic.AddUint64(&s.packetId, 1)
+func (s *Service) newUDPSessionWithPSK(psk []byte) *serverUDPSession {
+	session := &serverUDPSession{psk: psk}
+	if s.udpChaCha() {
+		session.rng = Blake3KeyedHash(s.random)
+	}
+	s.renewUDPSession(session)
+	return session
 }
 
-func (s *Service) newUDPSession() *serverUDPSession {
-	session := &serverUDPSession{}
-	if s.udpCipher != nil {
-		session.rng = Blake3KeyedHash(rand.Reader)
+// renewUDPSession picks a new server session ID and restarts its packet IDs.
+func (s *Service) renewUDPSession(session *serverUDPSession) {
+	if s.udpChaCha() {
 		common.Must(binary.Read(session.rng, binary.BigEndian, &session.sessionId))
 	} else {
-		common.Must(binary.Read(rand.Reader, binary.BigEndian, &session.sessionId))
+		common.Must(binary.Read(s.random, binary.BigEndian, &session.sessionId))
 	}
-	session.packetId--
-	if s.udpCipher == nil {
+	session.packetId = math.MaxUint64
+	if !s.udpChaCha() {
 		sessionId := make([]byte, 8)
 		binary.BigEndian.PutUint64(sessionId, session.sessionId)
-		key := SessionKey(s.psk, sessionId, s.keySaltLength)
+		key := SessionKey(session.psk, sessionId, s.keySaltLength)
 		var err error
 		session.cipher, err = s.constructor(key)
 		common.Must(err)
 	}
-	return session
+}
+
+// nextPacket returns the server session ID, packet ID and cipher to send with.
+// The server session is renewed before its packet IDs wrap, which clients accept once a minute.
+func (s *Service) nextPacket(session *serverUDPSession) (uint64, uint64, cipher.AEAD) {
+	return s.nextPackets(session, 1)
+}
+
+// nextPackets reserves n consecutive packet IDs, returning the first.
+func (s *Service) nextPackets(session *serverUDPSession, n int) (uint64, uint64, cipher.AEAD) {
+	session.access.Lock()
+	defer session.access.Unlock()
+	first := session.packetId + 1
+	if first > math.MaxUint64-uint64(n) {
+		s.renewUDPSession(session)
+		first = 0
+	}
+	session.packetId = first + uint64(n) - 1
+	return session.sessionId, first, session.cipher
+}
+
+// packetBatch caches the last session looked up by NewPackets.
+type packetBatch struct {
+	sessionId uint64
+	session   *serverUDPSession
+}
+
+func (b *packetBatch) load(sessionId uint64) *serverUDPSession {
+	if b == nil || b.session == nil || b.sessionId != sessionId {
+		return nil
+	}
+	return b.session
+}
+
+func (b *packetBatch) store(sessionId uint64, session *serverUDPSession) {
+	if b != nil {
+		b.sessionId, b.session = sessionId, session
+	}
 }
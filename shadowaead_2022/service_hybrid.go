@@ -0,0 +1,230 @@
+package shadowaead_2022
+
+import (
+	"context"
+	"crypto/aes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/udpnat"
+)
+
+var _ shadowsocks.MultiService[int] = (*HybridService[int])(nil)
+
+// HybridService serves local and relayed users behind one iPSK, with one user table and one UDP NAT.
+// Local users are decrypted as by MultiService, relayed users have their identity header stripped
+// and are forwarded to their upstreams as by RelayService.
+type HybridService[U comparable] struct {
+	*MultiService[U]
+	*relayTable[U]
+}
+
+func NewHybridServiceWithPassword[U comparable](method string, password string, udpTimeout int64, handler shadowsocks.Handler, timeFunc func() time.Time, options ...ServiceOption) (*HybridService[U], error) {
+	if password == "" {
+		return nil, ErrMissingPSK
+	}
+	iPSK, err := base64.StdEncoding.DecodeString(password)
+	if err != nil {
+		return nil, E.Cause(err, "decode psk")
+	}
+	return NewHybridService[U](method, iPSK, udpTimeout, handler, timeFunc, options...)
+}
+
+func NewHybridService[U comparable](method string, iPSK []byte, udpTimeout int64, handler shadowsocks.Handler, timeFunc func() time.Time, options ...ServiceOption) (*HybridService[U], error) {
+	ms, err := NewMultiService[U](method, iPSK, udpTimeout, handler, timeFunc, options...)
+	if err != nil {
+		return nil, err
+	}
+	s := &HybridService[U]{
+		MultiService: ms,
+		relayTable:   newRelayTable[U](udpTimeout, handler),
+	}
+	s.udpNat = shadowsocks.NewUDPNAT[uint64](udpTimeout, &relayUDPHandler{s.udpHandler}, shadowsocks.HashUint64)
+	s.udpNat.SetSessionRegistry(&s.registry)
+	s.UDPServer = shadowsocks.NewUDPServer[uint64](method, handler, s.udpNat, &s.lifecycle, &s.metrics)
+	return s, nil
+}
+
+// SetUDPSessionLimit bounds the number of local and relayed UDP sessions. Zero means unbounded.
+func (s *HybridService[U]) SetUDPSessionLimit(limit int) {
+	s.MultiService.SetUDPSessionLimit(limit)
+	s.setSessionLimit(limit)
+}
+
+func (s *HybridService[U]) Close() error {
+	err := s.MultiService.Close()
+	s.sessions.Clear()
+	return err
+}
+
+func (s *HybridService[U]) Shutdown(ctx context.Context) (shadowsocks.ShutdownStats, error) {
+	stats, err := s.MultiService.Shutdown(ctx)
+	s.sessions.Clear()
+	return stats, err
+}
+
+// UpdateUsers replaces the users, all of them local.
+func (s *HybridService[U]) UpdateUsers(userList []U, keyList [][]byte) error {
+	return s.UpdateUsersWithUpstreams(userList, keyList, make([][]M.Socksaddr, len(userList)))
+}
+
+// UpdateUsersWithKeys replaces the users with several keys each, all of them local.
+func (s *HybridService[U]) UpdateUsersWithKeys(userList []U, keyLists [][]shadowsocks.ServerKey) error {
+	err := s.MultiService.UpdateUsersWithKeys(userList, keyLists)
+	if err != nil {
+		return err
+	}
+	s.setUpstreams(userList, make([][]M.Socksaddr, len(userList)))
+	return nil
+}
+
+func (s *HybridService[U]) UpdateUsersWithPasswords(userList []U, passwordList []string) error {
+	return s.UpdateUsersWithPasswordsAndUpstreams(userList, passwordList, make([][]M.Socksaddr, len(userList)))
+}
+
+// UpdateUsersWithUpstreams replaces the users. Users with an empty upstream list are local,
+// the others are relayed to their upstreams.
+func (s *HybridService[U]) UpdateUsersWithUpstreams(userList []U, keyList [][]byte, upstreamList [][]M.Socksaddr) error {
+	err := s.MultiService.UpdateUsers(userList, keyList)
+	if err != nil {
+		return err
+	}
+	s.setUpstreams(userList, upstreamList)
+	return nil
+}
+
+func (s *HybridService[U]) UpdateUsersWithPasswordsAndUpstreams(userList []U, passwordList []string, upstreamList [][]M.Socksaddr) error {
+	keyList := make([][]byte, 0, len(passwordList))
+	for _, password := range passwordList {
+		if password == "" {
+			return shadowsocks.ErrMissingPassword
+		}
+		uPSK, err := base64.StdEncoding.DecodeString(password)
+		if err != nil {
+			return E.Cause(err, "decode psk")
+		}
+		keyList = append(keyList, uPSK)
+	}
+	return s.UpdateUsersWithUpstreams(userList, keyList, upstreamList)
+}
+
+func (s *HybridService[U]) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	err := s.NewConnection0(ctx, conn, metadata, conn, nil)
+	if err != nil {
+		err = &shadowsocks.ServerConnError{Conn: conn, Source: metadata.Source, Cause: err}
+	}
+	return err
+}
+
+// NewConnection0 is MultiService.NewConnection0 relaying the connections of users with upstreams.
+func (s *HybridService[U]) NewConnection0(ctx context.Context, conn net.Conn, metadata M.Metadata, handshakeReader io.Reader, handshakeSuccess func()) error {
+	element, err := s.lifecycle.Acquire(conn)
+	if err != nil {
+		return err
+	}
+	defer s.lifecycle.Release(element)
+	uKey, protocolConn, relayed, err := s.newConnection(ctx, conn, &metadata, handshakeReader, handshakeSuccess)
+	if err != nil {
+		if s.metrics != nil {
+			s.metrics.HandshakeRejected(s.name, err)
+		}
+		return err
+	}
+	session := s.registry.RegisterKey(N.NetworkTCP, uKey.user, uKey.index, metadata, conn)
+	defer session.Unregister()
+	protocolConn = session.Conn(s.wrapConn(protocolConn))
+	if relayed {
+		return s.relayConnection(uKey.context(ctx), uKey.user, protocolConn, metadata)
+	}
+	return s.handler.NewConnection(uKey.context(ctx), protocolConn, metadata)
+}
+
+func (s *HybridService[U]) newConnection(ctx context.Context, conn net.Conn, metadata *M.Metadata, handshakeReader io.Reader, handshakeSuccess func()) (uKey *userKey[U], protocolConn net.Conn, relayed bool, err error) {
+	err = s.handshake.Start(ctx, conn)
+	if err != nil {
+		return
+	}
+	defer s.handshake.Finish(conn)
+	scratch := newHandshakeBuffer()
+	defer scratch.release()
+	uKey, requestHeader, n, err := s.readRequestUser(handshakeReader, handshakeSuccess, scratch)
+	if err != nil {
+		return
+	}
+	if handshakeSuccess != nil {
+		handshakeSuccess()
+	}
+	if s.upstreamGroup(uKey.user) == nil {
+		protocolConn, err = s.openConnection(conn, metadata, uKey, requestHeader, n)
+		return
+	}
+	if !s.allow(uKey.user) {
+		err = shadowsocks.NewHandshakeError(shadowsocks.ReasonRateLimited, n, ErrRateLimited)
+		return
+	}
+	relayHeader := buf.NewSize(len(requestHeader) - aes.BlockSize)
+	common.Must1(relayHeader.Write(requestHeader[:s.keySaltLength]))
+	common.Must1(relayHeader.Write(requestHeader[s.keySaltLength+aes.BlockSize:]))
+	metadata.Protocol = "shadowsocks-relay"
+	return uKey, bufio.NewCachedConn(conn, relayHeader), true, nil
+}
+
+func (s *HybridService[U]) NewPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
+	return s.ServePacket(metadata, func() error {
+		return s.newPacket(ctx, conn, buffer, metadata, nil)
+	})
+}
+
+// NewPackets handles a batch of packets read from conn.
+// Consecutive packets of one local session share a single session lookup.
+func (s *HybridService[U]) NewPackets(ctx context.Context, conn N.PacketConn, buffers []*buf.Buffer, metadata []M.Metadata) {
+	var batch packetBatch
+	s.ServePackets(ctx, buffers, metadata, func(buffer *buf.Buffer, metadata M.Metadata) error {
+		return s.newPacket(ctx, conn, buffer, metadata, &batch)
+	})
+}
+
+func (s *HybridService[U]) newPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata, batch *packetBatch) error {
+	uKey, packetHeader, err := s.readPacketUser(buffer)
+	if err != nil {
+		return err
+	}
+	user := uKey.user
+	if s.upstreamGroup(user) == nil {
+		return s.openPacket(ctx, conn, buffer, metadata, uKey, packetHeader, batch)
+	}
+	packetLen := buffer.Len()
+	if packetLen < PacketMinimalHeaderSize+aes.BlockSize {
+		return shadowsocks.NewHandshakeError(shadowsocks.ReasonBadHeader, packetLen, ErrPacketTooShort)
+	}
+	sessionId := binary.BigEndian.Uint64(packetHeader)
+	packetId := binary.BigEndian.Uint64(packetHeader[8:])
+	upstream, err := s.packetUpstream(user, sessionId, packetId, packetLen)
+	if err != nil {
+		return err
+	}
+
+	uKey.cipher.Encrypt(packetHeader, packetHeader)
+	copy(buffer.Range(aes.BlockSize, 2*aes.BlockSize), packetHeader)
+	buffer.Advance(aes.BlockSize)
+
+	metadata.Protocol = "shadowsocks-relay"
+	metadata.Destination = upstream.destination
+	if s.metrics != nil {
+		s.metrics.ReadBytes(s.name, int64(buffer.Len()))
+	}
+	s.udpNat.NewContextPacket(ctx, sessionId, buffer, metadata, func(natConn N.PacketConn) (context.Context, N.PacketWriter) {
+		return context.WithValue(uKey.context(ctx), relayUpstreamKey{}, upstream), &relayPacketWriter{udpnat.DirectBackWriter{Source: conn, Nat: natConn}, s.name, s.metrics}
+	})
+	return nil
+}
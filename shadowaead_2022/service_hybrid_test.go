@@ -0,0 +1,138 @@
+package shadowaead_2022_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing-shadowsocks/shadowaead_2022"
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestHybridService(t *testing.T) {
+	t.Parallel()
+	iPSK, uPSKList := multiKeys()
+	backendHandler := &relayHandler{packets: make(chan M.Socksaddr, 8)}
+	backend, err := shadowaead_2022.NewService(multiMethod, uPSKList[1], 60, backendHandler, testTimeFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &hybridHandler{relayHandler: relayHandler{packets: make(chan M.Socksaddr, 8)}, backend: backend}
+	service, err := shadowaead_2022.NewHybridService[string](multiMethod, iPSK, 60, handler, testTimeFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = service.UpdateUsersWithUpstreams([]string{"alice", "bob"}, uPSKList, [][]M.Socksaddr{nil, relayUpstreams[:1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	destination := M.ParseSocksaddr("test.com:443")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, uPSK := range uPSKList {
+		request := clientRequest(t, multiMethod, [][]byte{iPSK, uPSK}, destination.String())
+		err = service.NewConnection(ctx, &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(handler.destinations) != 2 || handler.destinations[0] != destination || handler.destinations[1] != relayUpstreams[0] {
+		t.Fatal("bad destinations: ", handler.destinations)
+	}
+	if len(backendHandler.destinations) != 1 || backendHandler.destinations[0] != destination {
+		t.Fatal("bad relayed destinations: ", backendHandler.destinations)
+	}
+
+	err = service.NewPacket(ctx, nil, buf.As(clientPacket(t, multiMethod, [][]byte{iPSK, uPSKList[0]}, destination.String())), M.Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packetDestination := <-handler.packets; packetDestination != destination {
+		t.Fatal("bad packet destination: ", packetDestination)
+	}
+	err = service.NewPacket(ctx, nil, buf.As(clientPacket(t, multiMethod, [][]byte{iPSK, uPSKList[1]}, destination.String())), M.Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packetDestination := <-backendHandler.packets; packetDestination != destination {
+		t.Fatal("bad relayed packet destination: ", packetDestination)
+	}
+}
+
+func TestHybridServiceNewConnection0(t *testing.T) {
+	t.Parallel()
+	iPSK, uPSKList := multiKeys()
+	backendHandler := &relayHandler{}
+	backend, err := shadowaead_2022.NewService(multiMethod, uPSKList[1], 60, backendHandler, testTimeFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &hybridHandler{backend: backend}
+	service, err := shadowaead_2022.NewHybridService[string](multiMethod, iPSK, 60, handler, testTimeFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = service.UpdateUsersWithUpstreams([]string{"alice", "bob"}, uPSKList, [][]M.Socksaddr{nil, relayUpstreams[:1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	destination := M.ParseSocksaddr("test.com:443")
+	request := clientRequest(t, multiMethod, [][]byte{iPSK, uPSKList[1]}, destination.String())
+	conn := &bufferConn{reader: bytes.NewReader(request)}
+	var handshakeDone bool
+	err = service.NewConnection0(context.Background(), conn, M.Metadata{}, conn, func() {
+		handshakeDone = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !handshakeDone {
+		t.Fatal("handshake success not reported")
+	}
+	if len(handler.destinations) != 1 || handler.destinations[0] != relayUpstreams[0] {
+		t.Fatal("connection not relayed: ", handler.destinations)
+	}
+	if len(backendHandler.destinations) != 1 || backendHandler.destinations[0] != destination {
+		t.Fatal("bad relayed destinations: ", backendHandler.destinations)
+	}
+}
+
+// hybridHandler passes relayed connections and packets to backend.
+type hybridHandler struct {
+	relayHandler
+	backend shadowsocks.Service
+}
+
+func (h *hybridHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	h.access.Lock()
+	h.destinations = append(h.destinations, metadata.Destination)
+	h.access.Unlock()
+	if metadata.Protocol == "shadowsocks-relay" {
+		return h.backend.NewConnection(ctx, conn, M.Metadata{})
+	}
+	_, err := io.Copy(io.Discard, conn)
+	return err
+}
+
+func (h *hybridHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	if metadata.Protocol != "shadowsocks-relay" {
+		return h.relayHandler.NewPacketConnection(ctx, conn, metadata)
+	}
+	for {
+		buffer := buf.NewPacket()
+		_, err := conn.ReadPacket(buffer)
+		if errors.Is(err, io.ErrClosedPipe) {
+			buffer.Release()
+			return nil
+		} else if err == nil {
+			h.backend.NewPacket(ctx, nil, buffer, M.Metadata{})
+		}
+	}
+}
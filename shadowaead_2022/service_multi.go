@@ -4,24 +4,20 @@ import (
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
 	"encoding/base64"
 	"encoding/binary"
 	"io"
-	"math"
 	"net"
 	"os"
 	"time"
 
 	"github.com/sagernet/sing-shadowsocks"
 	"github.com/sagernet/sing-shadowsocks/shadowaead"
-	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/auth"
 	"github.com/sagernet/sing/common/buf"
 	E "github.com/sagernet/sing/common/exceptions"
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
-	"github.com/sagernet/sing/common/rw"
 
 	"lukechampine.com/blake3"
 )
@@ -31,12 +27,24 @@ var _ shadowsocks.MultiService[int] = (*MultiService[int])(nil)
 type MultiService[U comparable] struct {
 	*Service
 
-	uPSK     map[U][]byte
-	uPSKHash map[[aes.BlockSize]byte]U
-	uCipher  map[U]cipher.Block
+	uPSKHash map[[aes.BlockSize]byte]*userKey[U]
 }
 
-func NewMultiServiceWithPassword[U comparable](method string, password string, udpTimeout int64, handler shadowsocks.Handler, timeFunc func() time.Time) (*MultiService[U], error) {
+// userKey is one of the PSKs of a user.
+type userKey[U comparable] struct {
+	shadowsocks.ServerKey
+	user   U
+	index  int
+	psk    []byte
+	cipher cipher.Block
+}
+
+// context returns ctx carrying the user and the index of the key.
+func (k *userKey[U]) context(ctx context.Context) context.Context {
+	return shadowsocks.ContextWithKeyIndex(auth.ContextWithUser(ctx, k.user), k.index)
+}
+
+func NewMultiServiceWithPassword[U comparable](method string, password string, udpTimeout int64, handler shadowsocks.Handler, timeFunc func() time.Time, options ...ServiceOption) (*MultiService[U], error) {
 	if password == "" {
 		return nil, ErrMissingPSK
 	}
@@ -44,10 +52,10 @@ func NewMultiServiceWithPassword[U comparable](method string, password string, u
 	if err != nil {
 		return nil, E.Cause(err, "decode psk")
 	}
-	return NewMultiService[U](method, iPSK, udpTimeout, handler, timeFunc)
+	return NewMultiService[U](method, iPSK, udpTimeout, handler, timeFunc, options...)
 }
 
-func NewMultiService[U comparable](method string, iPSK []byte, udpTimeout int64, handler shadowsocks.Handler, timeFunc func() time.Time) (*MultiService[U], error) {
+func NewMultiService[U comparable](method string, iPSK []byte, udpTimeout int64, handler shadowsocks.Handler, timeFunc func() time.Time, options ...ServiceOption) (*MultiService[U], error) {
 	switch method {
 	case "2022-blake3-aes-128-gcm":
 	case "2022-blake3-aes-256-gcm":
@@ -55,7 +63,7 @@ func NewMultiService[U comparable](method string, iPSK []byte, udpTimeout int64,
 		return nil, os.ErrInvalid
 	}
 
-	ss, err := NewService(method, iPSK, udpTimeout, handler, timeFunc)
+	ss, err := NewService(method, iPSK, udpTimeout, handler, timeFunc, options...)
 	if err != nil {
 		return nil, err
 	}
@@ -63,40 +71,75 @@ func NewMultiService[U comparable](method string, iPSK []byte, udpTimeout int64,
 	s := &MultiService[U]{
 		Service: ss.(*Service),
 
-		uPSK:     make(map[U][]byte),
-		uPSKHash: make(map[[aes.BlockSize]byte]U),
+		uPSKHash: make(map[[aes.BlockSize]byte]*userKey[U]),
 	}
 	return s, nil
 }
 
+// UpdateUsers replaces the users. A key given to several users authenticates the last of them.
 func (s *MultiService[U]) UpdateUsers(userList []U, keyList [][]byte) error {
-	uPSK := make(map[U][]byte)
-	uPSKHash := make(map[[aes.BlockSize]byte]U)
-	uCipher := make(map[U]cipher.Block)
-	for i, user := range userList {
-		key := keyList[i]
-		if len(key) < s.keySaltLength {
+	keyLists := make([][]shadowsocks.ServerKey, len(userList))
+	for i := range userList {
+		if len(keyList[i]) == 0 {
 			return shadowsocks.ErrBadKey
-		} else if len(key) > s.keySaltLength {
-			key = Key(key, s.keySaltLength)
 		}
+		keyLists[i] = []shadowsocks.ServerKey{{Key: keyList[i]}}
+	}
+	return s.updateUsers(userList, keyLists, false)
+}
 
-		var hash [aes.BlockSize]byte
-		hash512 := blake3.Sum512(key)
-		copy(hash[:], hash512[:])
+// UpdateUsersWithKeys replaces the users, each with a primary key followed by secondary keys.
+// All keys of a user authenticate as that user, and the index of the key used is stored in the context
+// with shadowsocks.ContextWithKeyIndex, so clients can be moved to a new key while the old one is still accepted.
+// Since the identity header only carries the key hash, a key listed more than once is rejected with
+// shadowsocks.ErrDuplicateUserKey.
+func (s *MultiService[U]) UpdateUsersWithKeys(userList []U, keyLists [][]shadowsocks.ServerKey) error {
+	return s.updateUsers(userList, keyLists, true)
+}
 
-		uPSKHash[hash] = user
-		uPSK[user] = key
-		var err error
-		uCipher[user], err = s.blockConstructor(key)
-		if err != nil {
-			return err
+func (s *MultiService[U]) updateUsers(userList []U, keyLists [][]shadowsocks.ServerKey, rejectDuplicates bool) error {
+	uPSKHash := make(map[[aes.BlockSize]byte]*userKey[U])
+	for i, user := range userList {
+		for index, config := range keyLists[i] {
+			psk := config.Key
+			if len(psk) == 0 {
+				if config.Password == "" {
+					return shadowsocks.ErrMissingPassword
+				}
+				var err error
+				psk, err = base64.StdEncoding.DecodeString(config.Password)
+				if err != nil {
+					return E.Cause(err, "decode psk")
+				}
+			}
+			if len(psk) < s.keySaltLength {
+				return shadowsocks.ErrBadKey
+			} else if len(psk) > s.keySaltLength {
+				psk = Key(psk, s.keySaltLength)
+			}
+			block, err := s.blockConstructor(psk)
+			if err != nil {
+				return err
+			}
+
+			var hash [aes.BlockSize]byte
+			hash512 := blake3.Sum512(psk)
+			copy(hash[:], hash512[:])
+			if _, loaded := uPSKHash[hash]; loaded && rejectDuplicates {
+				return E.Extend(shadowsocks.ErrDuplicateUserKey, "user ", i, " key ", index)
+			}
+
+			uPSKHash[hash] = &userKey[U]{
+				ServerKey: config,
+				user:      user,
+				index:     index,
+				psk:       psk,
+				cipher:    block,
+			}
 		}
 	}
 
-	s.uPSK = uPSK
 	s.uPSKHash = uPSKHash
-	s.uCipher = uCipher
 	return nil
 }
 
@@ -124,188 +167,258 @@ func (s *MultiService[U]) NewConnection(ctx context.Context, conn net.Conn, meta
 }
 
 func (s *MultiService[U]) NewConnection0(ctx context.Context, conn net.Conn, metadata M.Metadata, handshakeReader io.Reader, handshakeSuccess func()) error {
-	requestHeader := make([]byte, s.keySaltLength+aes.BlockSize+shadowaead.Overhead+RequestHeaderFixedChunkLength)
-	var (
-		n   int
-		err error
-	)
+	element, err := s.lifecycle.Acquire(conn)
+	if err != nil {
+		return err
+	}
+	defer s.lifecycle.Release(element)
+	uKey, protocolConn, err := s.newConnection(ctx, conn, &metadata, handshakeReader, handshakeSuccess)
+	if err != nil {
+		if s.metrics != nil {
+			s.metrics.HandshakeRejected(s.name, err)
+		}
+		return err
+	}
+	session := s.registry.RegisterKey(N.NetworkTCP, uKey.user, uKey.index, metadata, conn)
+	defer session.Unregister()
+	return s.handler.NewConnection(uKey.context(ctx), session.Conn(s.wrapConn(protocolConn)), metadata)
+}
+
+func (s *MultiService[U]) newConnection(ctx context.Context, conn net.Conn, metadata *M.Metadata, handshakeReader io.Reader, handshakeSuccess func()) (*userKey[U], net.Conn, error) {
+	err := s.handshake.Start(ctx, conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer s.handshake.Finish(conn)
+	scratch := newHandshakeBuffer()
+	defer scratch.release()
+	uKey, requestHeader, n, err := s.readRequestUser(handshakeReader, handshakeSuccess, scratch)
+	if err != nil {
+		return nil, nil, err
+	}
+	if handshakeSuccess != nil {
+		handshakeSuccess()
+	}
+	protocolConn, err := s.openConnection(conn, metadata, uKey, requestHeader, n)
+	return uKey, protocolConn, err
+}
+
+// readRequestUser reads the salt, the identity header and the fixed length chunk of a request,
+// and looks up the user from the identity header. The header is read into scratch.
+func (s *MultiService[U]) readRequestUser(handshakeReader io.Reader, handshakeSuccess func(), scratch *handshakeBuffer) (uKey *userKey[U], requestHeader []byte, n int, err error) {
+	requestHeader = scratch[:s.keySaltLength+aes.BlockSize+shadowaead.Overhead+RequestHeaderFixedChunkLength]
 	if handshakeSuccess != nil {
 		n, err = io.ReadFull(handshakeReader, requestHeader)
 	} else {
 		n, err = handshakeReader.Read(requestHeader)
 	}
 	if err != nil {
-		return err
+		return nil, nil, n, shadowsocks.NewHandshakeError(shadowsocks.ReadReason(err, shadowsocks.ReasonReadFailed), n, err)
 	} else if n < len(requestHeader) {
-		return shadowaead.ErrBadHeader
+		return nil, nil, n, shadowsocks.NewHandshakeError(shadowsocks.ReasonBadHeader, n, shadowaead.ErrBadHeader)
 	}
 	requestSalt := requestHeader[:s.keySaltLength]
 	if !s.replayFilter.Check(requestSalt) {
-		return ErrSaltNotUnique
+		return nil, nil, n, shadowsocks.NewHandshakeError(shadowsocks.ReasonReplay, n, ErrSaltNotUnique)
 	}
 
-	var _eiHeader [aes.BlockSize]byte
-	eiHeader := _eiHeader[:]
-	copy(eiHeader, requestHeader[s.keySaltLength:s.keySaltLength+aes.BlockSize])
-
-	keyMaterial := make([]byte, s.keySaltLength*2)
-	copy(keyMaterial, s.psk)
-	copy(keyMaterial[s.keySaltLength:], requestSalt)
-	identitySubkey := buf.NewSize(s.keySaltLength)
-	identitySubkey.Extend(identitySubkey.FreeLen())
-	blake3.DeriveKey(identitySubkey.Bytes(), "shadowsocks 2022 identity subkey", keyMaterial)
-	b, err := s.blockConstructor(identitySubkey.Bytes())
-	identitySubkey.Release()
-	if err != nil {
-		return err
+	var lookupStart time.Time
+	if s.metrics != nil {
+		lookupStart = time.Now()
 	}
-	b.Decrypt(eiHeader, eiHeader)
-
-	var user U
-	var uPSK []byte
-	if u, loaded := s.uPSKHash[_eiHeader]; loaded {
-		user = u
-		uPSK = s.uPSK[u]
-	} else {
-		return ErrInvalidRequest
+	// The identity header is decrypted with each identity PSK until one yields a known user.
+	var eiHeader [aes.BlockSize]byte
+	for _, key := range s.activeKeys() {
+		b, err := newIdentityCipher(s.blockConstructor, key.psk, requestSalt, s.keySaltLength)
+		if err != nil {
+			return nil, nil, n, err
+		}
+		b.Decrypt(eiHeader[:], requestHeader[s.keySaltLength:s.keySaltLength+aes.BlockSize])
+		uKey = s.lookupUser(eiHeader)
+		if uKey != nil {
+			break
+		}
 	}
+	if s.metrics != nil {
+		s.metrics.UserLookup(s.name, time.Since(lookupStart))
+	}
+	if uKey == nil {
+		return nil, nil, n, shadowsocks.NewHandshakeError(shadowsocks.ReasonUnknownUser, n, ErrInvalidRequest)
+	}
+	return
+}
 
-	if handshakeSuccess != nil {
-		handshakeSuccess()
+// lookupUser returns the user key identified by a decrypted identity header, if it is accepted now.
+func (s *MultiService[U]) lookupUser(eiHeader [aes.BlockSize]byte) *userKey[U] {
+	uKey, loaded := s.uPSKHash[eiHeader]
+	if !loaded || !uKey.Active(s.time()) {
+		return nil
 	}
+	return uKey
+}
 
-	requestKey := SessionKey(uPSK, requestSalt, s.keySaltLength)
-	readCipher, err := s.constructor(requestKey)
+// openConnection decrypts the rest of a request whose user has been looked up by readRequestUser.
+func (s *MultiService[U]) openConnection(conn net.Conn, metadata *M.Metadata, uKey *userKey[U], requestHeader []byte, n int) (net.Conn, error) {
+	requestSalt := requestHeader[:s.keySaltLength]
+
+	readCipher, err := newSessionCipher(s.constructor, uKey.psk, requestSalt, s.keySaltLength)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	protocolConn := &serverConn{
+		Service: s.Service,
+		Conn:    conn,
+		uPSK:    uKey.psk,
 	}
+	countReader := &protocolConn.handshakeReader
+	countReader.Reader = conn
 	reader := shadowaead.NewReader(
-		conn,
+		countReader,
 		readCipher,
 		MaxPacketSize,
 	)
 
 	err = reader.ReadExternalChunk(requestHeader[s.keySaltLength+aes.BlockSize:])
 	if err != nil {
-		return err
-	}
-
-	headerType, err := rw.ReadByte(reader)
-	if err != nil {
-		return E.Cause(err, "read header")
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonDecryptFailed, n, err)
 	}
 
+	fixedChunk := reader.CachedSlice()
+	headerType := fixedChunk[0]
 	if headerType != HeaderTypeClient {
-		return E.Extend(ErrBadHeaderType, "expected ", HeaderTypeClient, ", got ", headerType)
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonBadHeader, n, E.Extend(ErrBadHeaderType, "expected ", HeaderTypeClient, ", got ", headerType))
 	}
 
-	var epoch uint64
-	err = binary.Read(reader, binary.BigEndian, &epoch)
-	if err != nil {
-		return E.Cause(err, "read timestamp")
-	}
-	diff := int(math.Abs(float64(s.time().Unix() - int64(epoch))))
-	if diff > 30 {
-		return E.Extend(ErrBadTimestamp, "received ", epoch, ", diff ", diff, "s")
-	}
-	var length uint16
-	err = binary.Read(reader, binary.BigEndian, &length)
+	epoch := binary.BigEndian.Uint64(fixedChunk[1:])
+	err = s.checkTimestamp(epoch)
 	if err != nil {
-		return E.Cause(err, "read length")
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonBadTimestamp, n, err)
 	}
 
+	length := binary.BigEndian.Uint16(fixedChunk[9:])
 	err = reader.ReadWithLength(length)
 	if err != nil {
-		return err
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReadReason(err, shadowsocks.ReasonDecryptFailed), n+countReader.Consumed, err)
 	}
 
 	destination, err := M.SocksaddrSerializer.ReadAddrPort(reader)
 	if err != nil {
-		return E.Cause(err, "read destination")
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonBadAddress, n+countReader.Consumed, E.Cause(err, "read destination"))
+	}
+	if !s.acl.Allow(N.NetworkTCP, uKey.user, destination) {
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonDenied, n+countReader.Consumed, E.Extend(shadowsocks.ErrDestinationDenied, destination))
 	}
 
-	var paddingLen uint16
-	err = binary.Read(reader, binary.BigEndian, &paddingLen)
+	paddingLen, err := readUint16(reader)
 	if err != nil {
-		return E.Cause(err, "read padding length")
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonBadPadding, n+countReader.Consumed, E.Cause(err, "read padding length"))
 	}
 
 	if reader.Cached() < int(paddingLen) {
-		return ErrBadPadding
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonBadPadding, n+countReader.Consumed, ErrBadPadding)
 	} else if paddingLen > 0 {
 		err = reader.Discard(int(paddingLen))
 		if err != nil {
-			return E.Cause(err, "discard padding")
+			return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonBadPadding, n+countReader.Consumed, E.Cause(err, "discard padding"))
 		}
 	} else if reader.Cached() == 0 {
-		return ErrNoPadding
-	}
-
-	protocolConn := &serverConn{
-		Service:     s.Service,
-		Conn:        conn,
-		uPSK:        uPSK,
-		headerType:  headerType,
-		requestSalt: requestSalt,
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonBadPadding, n+countReader.Consumed, ErrNoPadding)
 	}
 
+	protocolConn.headerType = headerType
+	copy(protocolConn.requestSalt[:], requestSalt)
 	protocolConn.reader = reader
 	metadata.Protocol = "shadowsocks"
 	metadata.Destination = destination
-	return s.handler.NewConnection(auth.ContextWithUser(ctx, user), protocolConn, metadata)
+	return protocolConn, nil
 }
 
 func (s *MultiService[U]) WriteIsThreadUnsafe() {
 }
 
 func (s *MultiService[U]) NewPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
-	err := s.newPacket(ctx, conn, buffer, metadata)
+	return s.ServePacket(metadata, func() error {
+		return s.newPacket(ctx, conn, buffer, metadata, nil)
+	})
+}
+
+// NewPackets handles a batch of packets read from conn.
+// Consecutive packets of one session share a single session lookup.
+func (s *MultiService[U]) NewPackets(ctx context.Context, conn N.PacketConn, buffers []*buf.Buffer, metadata []M.Metadata) {
+	var batch packetBatch
+	s.ServePackets(ctx, buffers, metadata, func(buffer *buf.Buffer, metadata M.Metadata) error {
+		return s.newPacket(ctx, conn, buffer, metadata, &batch)
+	})
+}
+
+func (s *MultiService[U]) newPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata, batch *packetBatch) error {
+	uKey, packetHeader, err := s.readPacketUser(buffer)
 	if err != nil {
-		err = &shadowsocks.ServerPacketError{Source: metadata.Source, Cause: err}
+		return err
 	}
-	return err
+	return s.openPacket(ctx, conn, buffer, metadata, uKey, packetHeader, batch)
 }
 
-func (s *MultiService[U]) newPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
-	if buffer.Len() < PacketMinimalHeaderSize {
-		return ErrPacketTooShort
+// readPacketUser decrypts the separate header of a packet in place and looks up the user from the identity header.
+func (s *MultiService[U]) readPacketUser(buffer *buf.Buffer) (uKey *userKey[U], packetHeader []byte, err error) {
+	packetLen := buffer.Len()
+	if packetLen < PacketMinimalHeaderSize {
+		return nil, nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonBadHeader, packetLen, ErrPacketTooShort)
 	}
 
-	packetHeader := buffer.To(aes.BlockSize)
-	s.udpBlockCipher.Decrypt(packetHeader, packetHeader)
-
-	var _eiHeader [aes.BlockSize]byte
-	eiHeader := _eiHeader[:]
-	s.udpBlockCipher.Decrypt(eiHeader, buffer.Range(aes.BlockSize, 2*aes.BlockSize))
-	xorWords(eiHeader, eiHeader, packetHeader)
+	var lookupStart time.Time
+	if s.metrics != nil {
+		lookupStart = time.Now()
+	}
 
-	var user U
-	var uPSK []byte
-	if u, loaded := s.uPSKHash[_eiHeader]; loaded {
-		user = u
-		uPSK = s.uPSK[u]
-	} else {
-		return E.New("invalid request")
+	packetHeader = buffer.To(aes.BlockSize)
+	var header, eiHeader [aes.BlockSize]byte
+	for _, key := range s.activeKeys() {
+		key.udpBlockCipher.Decrypt(header[:], packetHeader)
+		key.udpBlockCipher.Decrypt(eiHeader[:], buffer.Range(aes.BlockSize, 2*aes.BlockSize))
+		xorWords(eiHeader[:], eiHeader[:], header[:])
+		uKey = s.lookupUser(eiHeader)
+		if uKey != nil {
+			copy(packetHeader, header[:])
+			break
+		}
+	}
+	if s.metrics != nil {
+		s.metrics.UserLookup(s.name, time.Since(lookupStart))
 	}
+	if uKey == nil {
+		return nil, nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonUnknownUser, packetLen, ErrInvalidRequest)
+	}
+	return
+}
+
+// openPacket decrypts and dispatches a packet whose user has been looked up by readPacketUser.
+func (s *MultiService[U]) openPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata, uKey *userKey[U], packetHeader []byte, batch *packetBatch) error {
+	packetLen := buffer.Len()
 
 	var sessionId, packetId uint64
 	err := binary.Read(buffer, binary.BigEndian, &sessionId)
 	if err != nil {
-		return err
+		return shadowsocks.NewHandshakeError(shadowsocks.ReasonBadHeader, packetLen, err)
 	}
 	err = binary.Read(buffer, binary.BigEndian, &packetId)
 	if err != nil {
-		return err
+		return shadowsocks.NewHandshakeError(shadowsocks.ReasonBadHeader, packetLen, err)
 	}
+	var reason shadowsocks.HandshakeReason
 
 	buffer.Advance(aes.BlockSize)
 
-	session, loaded := s.udpSessions.LoadOrStore(sessionId, func() *serverUDPSession {
-		return s.newUDPSession(uPSK)
-	})
+	session := batch.load(sessionId)
+	loaded := session != nil
+	if !loaded {
+		session, loaded = s.udpSessions.LoadOrStore(sessionId, func() *serverUDPSession {
+			return s.newUDPSessionWithPSK(uKey.psk)
+		})
+	}
 	if !loaded {
 		session.remoteSessionId = sessionId
-		key := SessionKey(uPSK, packetHeader[:8], s.keySaltLength)
+		key := SessionKey(uKey.psk, packetHeader[:8], s.keySaltLength)
 		session.remoteCipher, err = s.constructor(key)
 		if err != nil {
 			return err
@@ -318,18 +431,18 @@ returnErr:
 	if !loaded {
 		s.udpSessions.Delete(sessionId)
 	}
-	return err
+	return shadowsocks.NewHandshakeError(reason, packetLen, err)
 
 process:
 	if !session.window.Check(packetId) {
-		err = ErrPacketIdNotUnique
+		reason, err = shadowsocks.ReasonReplay, ErrPacketIdNotUnique
 		goto returnErr
 	}
 
 	if packetHeader != nil {
 		_, err = session.remoteCipher.Open(buffer.Index(0), packetHeader[4:16], buffer.Bytes(), nil)
 		if err != nil {
-			err = E.Cause(err, "decrypt packet")
+			reason, err = shadowsocks.ReasonDecryptFailed, E.Cause(err, "decrypt packet")
 			goto returnErr
 		}
 		buffer.Truncate(buffer.Len() - shadowaead.Overhead)
@@ -340,60 +453,56 @@ process:
 	var headerType byte
 	headerType, err = buffer.ReadByte()
 	if err != nil {
-		err = E.Cause(err, "decrypt packet")
+		reason, err = shadowsocks.ReasonBadHeader, E.Cause(err, "decrypt packet")
 		goto returnErr
 	}
 	if headerType != HeaderTypeClient {
-		err = E.Extend(ErrBadHeaderType, "expected ", HeaderTypeClient, ", got ", headerType)
+		reason, err = shadowsocks.ReasonBadHeader, E.Extend(ErrBadHeaderType, "expected ", HeaderTypeClient, ", got ", headerType)
 		goto returnErr
 	}
 
 	var epoch uint64
 	err = binary.Read(buffer, binary.BigEndian, &epoch)
 	if err != nil {
+		reason = shadowsocks.ReasonBadHeader
 		goto returnErr
 	}
-	diff := int(math.Abs(float64(s.time().Unix() - int64(epoch))))
-	if diff > 30 {
-		err = E.Extend(ErrBadTimestamp, "received ", epoch, ", diff ", diff, "s")
+	err = s.checkTimestamp(epoch)
+	if err != nil {
+		reason = shadowsocks.ReasonBadTimestamp
 		goto returnErr
 	}
 
 	var paddingLen uint16
 	err = binary.Read(buffer, binary.BigEndian, &paddingLen)
 	if err != nil {
-		err = E.Cause(err, "read padding length")
+		reason, err = shadowsocks.ReasonBadPadding, E.Cause(err, "read padding length")
+		goto returnErr
+	}
+	if buffer.Len() < int(paddingLen) {
+		reason, err = shadowsocks.ReasonBadPadding, ErrBadPadding
 		goto returnErr
 	}
 	buffer.Advance(int(paddingLen))
 
 	destination, err := M.SocksaddrSerializer.ReadAddrPort(buffer)
 	if err != nil {
+		reason = shadowsocks.ReasonBadAddress
+		goto returnErr
+	}
+	if !s.acl.Allow(N.NetworkUDP, uKey.user, destination) {
+		reason, err = shadowsocks.ReasonDenied, E.Extend(shadowsocks.ErrDestinationDenied, destination)
 		goto returnErr
 	}
 
 	metadata.Protocol = "shadowsocks"
 	metadata.Destination = destination
+	if s.metrics != nil {
+		s.metrics.ReadBytes(s.name, int64(buffer.Len()))
+	}
+	batch.store(sessionId, session)
 	s.udpNat.NewContextPacket(ctx, sessionId, buffer, metadata, func(natConn N.PacketConn) (context.Context, N.PacketWriter) {
-		return auth.ContextWithUser(ctx, user), &serverPacketWriter{s.Service, conn, natConn, session, s.uCipher[user]}
+		return uKey.context(ctx), &serverPacketWriter{s.Service, conn, natConn, session, nil, uKey.cipher}
 	})
 	return nil
 }
-
-func (s *MultiService[U]) newUDPSession(uPSK []byte) *serverUDPSession {
-	session := &serverUDPSession{}
-	if s.udpCipher != nil {
-		session.rng = Blake3KeyedHash(rand.Reader)
-		common.Must(binary.Read(session.rng, binary.BigEndian, &session.sessionId))
-	} else {
-		common.Must(binary.Read(rand.Reader, binary.BigEndian, &session.sessionId))
-	}
-	session.packetId--
-	sessionId := make([]byte, 8)
-	binary.BigEndian.PutUint64(sessionId, session.sessionId)
-	key := SessionKey(uPSK, sessionId, s.keySaltLength)
-	var err error
-	session.cipher, err = s.constructor(key)
-	common.Must(err)
-	return session
-}
@@ -1,14 +1,23 @@
 package shadowaead_2022_test
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"net"
+	"strconv"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing-shadowsocks/internal/vectortest"
 	"github.com/sagernet/sing-shadowsocks/shadowaead_2022"
 	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/auth"
+	"github.com/sagernet/sing/common/buf"
 	E "github.com/sagernet/sing/common/exceptions"
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
@@ -54,6 +63,318 @@ func TestMultiService(t *testing.T) {
 	wg.Wait()
 }
 
+func TestMultiServiceCloseUserSessions(t *testing.T) {
+	t.Parallel()
+	iPSK, uPSKList := multiKeys()
+	handler := &holdHandler{opened: make(chan struct{}, 1)}
+	multiService, err := shadowaead_2022.NewMultiService[string](multiMethod, iPSK, 60, handler, testTimeFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = multiService.UpdateUsers([]string{"alice", "bob"}, uPSKList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	defer common.Close(serverConn, clientConn)
+	go clientConn.Write(clientRequest(t, multiMethod, [][]byte{iPSK, uPSKList[0]}, "test.com:443"))
+	done := make(chan error, 1)
+	go func() {
+		done <- multiService.NewConnection(context.Background(), serverConn, M.Metadata{})
+	}()
+	<-handler.opened
+	for i := range uPSKList {
+		err = multiService.NewPacket(context.Background(), &vectortest.BufferPacketConn{}, buf.As(clientPacket(t, multiMethod, [][]byte{iPSK, uPSKList[i]}, "1.1.1.1:53")), M.Metadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sessions := multiService.UserSessions("alice")
+	if len(sessions) != 2 {
+		t.Fatal("expected 2 sessions, got ", len(sessions))
+	}
+	for _, session := range sessions {
+		if session.Network == N.NetworkUDP && session.ReadBytes == 0 {
+			t.Fatal("UDP bytes not counted")
+		}
+	}
+	if len(multiService.Sessions()) != 3 {
+		t.Fatal("expected 3 sessions, got ", len(multiService.Sessions()))
+	}
+	if closed := multiService.CloseUserSessions("alice"); closed != 2 {
+		t.Fatal("expected 2 closed sessions, got ", closed)
+	}
+	<-done
+	for deadline := time.Now().Add(5 * time.Second); len(multiService.UserSessions("alice")) > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("sessions not unregistered")
+		}
+	}
+	if len(multiService.UserSessions("bob")) != 1 {
+		t.Fatal("session of another user closed")
+	}
+}
+
+func FuzzMultiServiceNewConnection(f *testing.F) {
+	iPSK, uPSKList := multiKeys()
+	for _, uPSK := range uPSKList {
+		f.Add(clientRequest(f, multiMethod, [][]byte{iPSK, uPSK}, "test.com:443"))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		multiService := newFuzzMultiService(t)
+		multiService.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(data)}, M.Metadata{})
+	})
+}
+
+func FuzzMultiServiceNewPacket(f *testing.F) {
+	iPSK, uPSKList := multiKeys()
+	for _, uPSK := range uPSKList {
+		f.Add(clientPacket(f, multiMethod, [][]byte{iPSK, uPSK}, "1.1.1.1:53"))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		multiService := newFuzzMultiService(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		buffer := buf.NewSize(len(data))
+		buffer.Write(data)
+		multiService.NewPacket(ctx, nil, buffer, M.Metadata{})
+	})
+}
+
+func FuzzMultiServicePacketPlaintext(f *testing.F) {
+	for _, destination := range []string{"test.com:443", "1.1.1.1:53"} {
+		f.Add(false, packetPlaintext(destination, 0))
+		f.Add(true, packetPlaintext(destination, 16))
+	}
+	f.Fuzz(func(t *testing.T, bob bool, plaintext []byte) {
+		iPSK, uPSKList := multiKeys()
+		uPSK := uPSKList[0]
+		if bob {
+			uPSK = uPSKList[1]
+		}
+		multiService := newFuzzMultiService(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		packet := sealPacket(iPSK, uPSK, plaintext)
+		buffer := buf.NewSize(len(packet))
+		buffer.Write(packet)
+		multiService.NewPacket(ctx, nil, buffer, M.Metadata{})
+	})
+}
+
+func BenchmarkMultiServiceNewConnection(b *testing.B) {
+	for _, userCount := range []int{10, 1000, 100000} {
+		b.Run(strconv.Itoa(userCount), func(b *testing.B) {
+			iPSK, _ := multiKeys()
+			userList := make([]int, 0, userCount)
+			keyList := make([][]byte, 0, userCount)
+			for i := 0; i < userCount; i++ {
+				key := make([]byte, 16)
+				binary.BigEndian.PutUint64(key, uint64(i))
+				userList = append(userList, i)
+				keyList = append(keyList, key)
+			}
+			service, err := shadowaead_2022.NewMultiService[int](multiMethod, iPSK, 60, &benchmarkHandler{}, testTimeFunc)
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = service.UpdateUsers(userList, keyList)
+			if err != nil {
+				b.Fatal(err)
+			}
+			// Salts are checked for replay, so every handshake needs its own request.
+			requests := make([][]byte, b.N)
+			for i := range requests {
+				requests[i] = clientRequest(b, multiMethod, [][]byte{iPSK, keyList[userCount/2]}, "test.com:443")
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for _, request := range requests {
+				err = service.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMultiServiceACL(t *testing.T) {
+	t.Parallel()
+	multiService := newFuzzMultiService(t)
+	multiService.SetACL(shadowsocks.NewACL([]shadowsocks.ACLRule{
+		shadowsocks.BlockPrivate(),
+		{
+			Action:  shadowsocks.ACLDeny,
+			Network: N.NetworkUDP,
+			Ports:   []shadowsocks.PortRange{{Start: 53, End: 53}},
+			Users:   []any{"bob"},
+		},
+	}, nil, shadowsocks.ACLAllow))
+	iPSK, uPSKList := multiKeys()
+
+	request := clientRequest(t, multiMethod, [][]byte{iPSK, uPSKList[0]}, "127.0.0.1:80")
+	err := multiService.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+	if !errors.Is(err, shadowsocks.ErrDestinationDenied) || !errors.Is(err, &shadowsocks.HandshakeError{Reason: shadowsocks.ReasonDenied}) {
+		t.Fatal("expected denied destination, got ", err)
+	}
+
+	for i, allow := range []bool{true, false} {
+		packet := clientPacket(t, multiMethod, [][]byte{iPSK, uPSKList[i]}, "1.1.1.1:53")
+		err = multiService.NewPacket(context.Background(), &vectortest.BufferPacketConn{}, buf.As(packet), M.Metadata{})
+		if allow && err != nil {
+			t.Fatal(err)
+		} else if !allow && !errors.Is(err, &shadowsocks.HandshakeError{Reason: shadowsocks.ReasonDenied}) {
+			t.Fatal("expected denied destination, got ", err)
+		}
+	}
+	if len(multiService.UserSessions("bob")) != 0 {
+		t.Fatal("denied packet opened a session")
+	}
+}
+
+func TestMultiServiceUpdateKeys(t *testing.T) {
+	t.Parallel()
+	iPSK, uPSKList := multiKeys()
+	newIPSK := bytes.Repeat([]byte{4}, 16)
+	multiService, err := shadowaead_2022.NewMultiService[string](multiMethod, iPSK, 60, &echoHandler{}, testTimeFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = multiService.UpdateUsers([]string{"alice", "bob"}, uPSKList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = multiService.UpdateKeys([]shadowsocks.ServerKey{{Key: newIPSK}, {Key: iPSK}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range [][]byte{newIPSK, iPSK} {
+		request := clientRequest(t, multiMethod, [][]byte{key, uPSKList[1]}, "test.com:443")
+		err = multiService.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		testPacketRoundTrip(t, multiService, multiMethod, key, uPSKList[1])
+	}
+	request := clientRequest(t, multiMethod, [][]byte{bytes.Repeat([]byte{5}, 16), uPSKList[1]}, "test.com:443")
+	err = multiService.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+	if shadowsocks.HandshakeReasonOf(err) != shadowsocks.ReasonUnknownUser {
+		t.Fatal("expected unknown user, got ", err)
+	}
+}
+
+func TestMultiServiceUserKeys(t *testing.T) {
+	t.Parallel()
+	iPSK, uPSKList := multiKeys()
+	expiredPSK := bytes.Repeat([]byte{5}, 16)
+	handler := &keyIndexHandler{}
+	multiService, err := shadowaead_2022.NewMultiService[string](multiMethod, iPSK, 60, handler, testTimeFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = multiService.UpdateUsersWithKeys([]string{"alice"}, [][]shadowsocks.ServerKey{{
+		{Key: uPSKList[0]},
+		{Key: uPSKList[1], NotAfter: testTime.Add(time.Hour)},
+		{Key: expiredPSK, NotAfter: testTime},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index, uPSK := range uPSKList {
+		request := clientRequest(t, multiMethod, [][]byte{iPSK, uPSK}, "test.com:443")
+		err = multiService.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if handler.user != "alice" || handler.index != index {
+			t.Fatal("expected alice with key ", index, ", got ", handler.user, " with key ", handler.index)
+		}
+		err = multiService.NewPacket(context.Background(), &vectortest.BufferPacketConn{}, buf.As(clientPacket(t, multiMethod, [][]byte{iPSK, uPSK}, "1.1.1.1:53")), M.Metadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var keyIndexes []int
+	for _, session := range multiService.UserSessions("alice") {
+		keyIndexes = append(keyIndexes, session.KeyIndex)
+	}
+	if len(keyIndexes) != 2 || keyIndexes[0]+keyIndexes[1] != 1 {
+		t.Fatal("bad session key indexes ", keyIndexes)
+	}
+
+	request := clientRequest(t, multiMethod, [][]byte{iPSK, expiredPSK}, "test.com:443")
+	err = multiService.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+	if shadowsocks.HandshakeReasonOf(err) != shadowsocks.ReasonUnknownUser {
+		t.Fatal("expected unknown user, got ", err)
+	}
+}
+
+func TestMultiServiceDuplicateUserKey(t *testing.T) {
+	t.Parallel()
+	iPSK, uPSKList := multiKeys()
+	handler := &keyIndexHandler{}
+	multiService, err := shadowaead_2022.NewMultiService[string](multiMethod, iPSK, 60, handler, testTimeFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// UpdateUsers keeps loading configurations sharing a key, the last user wins.
+	err = multiService.UpdateUsers([]string{"alice", "bob"}, [][]byte{uPSKList[0], uPSKList[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = multiService.UpdateUsersWithKeys([]string{"alice", "bob"}, [][]shadowsocks.ServerKey{
+		{{Key: uPSKList[1]}},
+		{{Key: uPSKList[0]}, {Key: uPSKList[1], NotAfter: testTime.Add(time.Hour)}},
+	})
+	if !errors.Is(err, shadowsocks.ErrDuplicateUserKey) {
+		t.Fatal("expected duplicate key, got ", err)
+	}
+	// The failed update leaves the users in place.
+	request := clientRequest(t, multiMethod, [][]byte{iPSK, uPSKList[0]}, "test.com:443")
+	err = multiService.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handler.user != "bob" {
+		t.Fatal("expected bob, got ", handler.user)
+	}
+}
+
+const multiMethod = "2022-blake3-aes-128-gcm"
+
+func multiKeys() ([]byte, [][]byte) {
+	return bytes.Repeat([]byte{1}, 16), [][]byte{bytes.Repeat([]byte{2}, 16), bytes.Repeat([]byte{3}, 16)}
+}
+
+func newFuzzMultiService(t *testing.T) *shadowaead_2022.MultiService[string] {
+	iPSK, uPSKList := multiKeys()
+	multiService, err := shadowaead_2022.NewMultiService[string](multiMethod, iPSK, 60, &discardHandler{}, testTimeFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = multiService.UpdateUsers([]string{"alice", "bob"}, uPSKList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return multiService
+}
+
+// keyIndexHandler records the user and key index of the last connection.
+type keyIndexHandler struct {
+	discardHandler
+	user  string
+	index int
+}
+
+func (h *keyIndexHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	h.user, _ = auth.UserFromContext[string](ctx)
+	h.index, _ = shadowsocks.KeyIndexFromContext(ctx)
+	return h.discardHandler.NewConnection(ctx, conn, metadata)
+}
+
 type multiHandler struct {
 	t  *testing.T
 	wg *sync.WaitGroup
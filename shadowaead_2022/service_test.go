@@ -1,16 +1,32 @@
 package shadowaead_2022_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
 	"net"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing-shadowsocks/internal/vectortest"
+	"github.com/sagernet/sing-shadowsocks/shadowaead"
 	"github.com/sagernet/sing-shadowsocks/shadowaead_2022"
+	"github.com/sagernet/sing-shadowsocks/shadowreplay"
 	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
 	E "github.com/sagernet/sing/common/exceptions"
 	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/replay"
+
+	"lukechampine.com/blake3"
 )
 
 func TestService(t *testing.T) {
@@ -48,3 +64,813 @@ func TestService(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestServiceReplay(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var psk [16]byte
+	rand.Reader.Read(psk[:])
+
+	var wg sync.WaitGroup
+
+	service, err := shadowaead_2022.NewService(method, psk[:], 500, &multiHandler{t, &wg}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := shadowaead_2022.New(method, [][]byte{psk[:]}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	go client.DialConn(clientConn, M.ParseSocksaddr("test.com:443"))
+	request := make([]byte, 4096)
+	n, err := serverConn.Read(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request = request[:n]
+	common.Close(serverConn, clientConn)
+
+	for i := 0; i < 2; i++ {
+		serverConn, clientConn = net.Pipe()
+		go func() {
+			clientConn.Write(request)
+		}()
+		if i == 0 {
+			wg.Add(1)
+			err = service.NewConnection(context.Background(), serverConn, M.Metadata{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			wg.Wait()
+		} else {
+			err = service.NewConnection(context.Background(), serverConn, M.Metadata{})
+			if !errors.Is(err, shadowaead_2022.ErrSaltNotUnique) {
+				t.Fatal("expected salt not unique, got ", err)
+			}
+			if !errors.Is(err, &shadowsocks.HandshakeError{Reason: shadowsocks.ReasonReplay}) {
+				t.Fatal("expected replay reason, got ", err)
+			}
+		}
+		common.Close(serverConn, clientConn)
+	}
+}
+
+func TestServiceSharedReplayFilter(t *testing.T) {
+	t.Parallel()
+	psk := bytes.Repeat([]byte{1}, 16)
+	filter := shadowreplay.NewBloom(time.Minute, 1000, 0.000001)
+	request := clientRequest(t, multiMethod, [][]byte{psk}, "test.com:443")
+	for i := 0; i < 2; i++ {
+		service, err := shadowaead_2022.NewService(multiMethod, psk, 60, &discardHandler{}, testTimeFunc, shadowaead_2022.WithReplayFilter(filter))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = service.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+		if i == 0 && err != nil {
+			t.Fatal(err)
+		} else if i == 1 && !errors.Is(err, &shadowsocks.HandshakeError{Reason: shadowsocks.ReasonReplay}) {
+			t.Fatal("expected replay reason, got ", err)
+		}
+	}
+}
+
+func TestServiceCloseReplayFilter(t *testing.T) {
+	t.Parallel()
+	psk := bytes.Repeat([]byte{1}, 16)
+	filter := &closeFilter{Filter: replay.NewSimple(time.Minute)}
+	newFilter := func() replay.Filter {
+		return filter
+	}
+	service, err := shadowaead_2022.NewService(multiMethod, psk, 60, &discardHandler{}, testTimeFunc, shadowaead_2022.WithReplayFilter(shadowreplay.Shared(t.Name(), newFilter)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayService, err := shadowaead_2022.NewRelayService[int](multiMethod, psk, 60, &discardHandler{}, shadowaead_2022.WithReplayFilter(shadowreplay.Shared(t.Name(), newFilter)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = service.(io.Closer).Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.closed {
+		t.Fatal("shared filter closed while still in use")
+	}
+	_, err = relayService.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filter.closed {
+		t.Fatal("replay filter not closed")
+	}
+}
+
+func TestServiceUpdateKeys(t *testing.T) {
+	t.Parallel()
+	for _, method := range shadowaead_2022.List {
+		t.Run(method, func(t *testing.T) {
+			oldPSK := benchmarkPSK(method)
+			newPSK := bytes.Repeat([]byte{2}, len(oldPSK))
+			service, err := shadowaead_2022.NewService(method, oldPSK, 60, &echoHandler{}, testTimeFunc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keyService := service.(shadowsocks.KeyService)
+			err = keyService.UpdateKeys([]shadowsocks.ServerKey{
+				{Key: newPSK},
+				{Key: oldPSK, NotAfter: testTimeFunc().Add(time.Hour)},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, psk := range [][]byte{newPSK, oldPSK} {
+				request := clientRequest(t, method, [][]byte{psk}, "test.com:443")
+				err = service.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				testPacketRoundTrip(t, service, method, psk)
+			}
+
+			err = keyService.UpdateKeys([]shadowsocks.ServerKey{
+				{Key: newPSK},
+				{Key: oldPSK, NotAfter: testTimeFunc().Add(-time.Second)},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			request := clientRequest(t, method, [][]byte{oldPSK}, "test.com:443")
+			err = service.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+			if shadowsocks.HandshakeReasonOf(err) != shadowsocks.ReasonDecryptFailed {
+				t.Fatal("expected decrypt failure, got ", err)
+			}
+		})
+	}
+}
+
+// testPacketRoundTrip sends two packets of one session through service and checks the echoed responses.
+func testPacketRoundTrip(t *testing.T, service N.UDPHandler, method string, pskList ...[]byte) {
+	client, err := shadowaead_2022.New(method, pskList, testTimeFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testClientPacketRoundTrip(t, service, client)
+}
+
+func testClientPacketRoundTrip(t *testing.T, service N.UDPHandler, client shadowsocks.Method) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go servePacketPipe(ctx, service, serverConn)
+	packetConn := client.DialPacketConn(clientConn)
+	destination := M.ParseSocksaddr("192.0.2.1:443").UDPAddr()
+	for i := 0; i < 2; i++ {
+		_, err := packetConn.WriteTo([]byte("hello"), destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := make([]byte, 1024)
+		n, _, err := packetConn.ReadFrom(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(response[:n]) != "hello" {
+			t.Fatal("bad response: ", string(response[:n]))
+		}
+	}
+}
+
+func TestServiceHandshakeTimeout(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var psk [16]byte
+	rand.Reader.Read(psk[:])
+
+	service, err := shadowaead_2022.NewService(method, psk[:], 500, &discardHandler{}, testTimeFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.(shadowsocks.HandshakeService).SetHandshakeTimeout(100 * time.Millisecond)
+
+	serverConn, clientConn := net.Pipe()
+	defer common.Close(serverConn, clientConn)
+	request := clientRequest(t, method, [][]byte{psk[:]}, "test.com:443")
+	go clientConn.Write(request[:len(request)-1])
+	done := make(chan error)
+	go func() {
+		done <- service.NewConnection(context.Background(), serverConn, M.Metadata{})
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handshake not timed out")
+	}
+	if shadowsocks.HandshakeReasonOf(err) != shadowsocks.ReasonTimeout {
+		t.Fatal("expected timeout, got ", err)
+	}
+}
+
+func TestServiceHandshakeLimit(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var psk [16]byte
+	rand.Reader.Read(psk[:])
+
+	service, err := shadowaead_2022.NewService(method, psk[:], 500, &discardHandler{}, testTimeFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.(shadowsocks.HandshakeService).SetHandshakeLimit(1, 0)
+
+	serverConn, clientConn := net.Pipe()
+	stalled := &readSignalConn{Conn: serverConn, reading: make(chan struct{})}
+	done := make(chan error)
+	go func() {
+		done <- service.NewConnection(context.Background(), stalled, M.Metadata{})
+	}()
+	<-stalled.reading
+
+	shedConn, shedClientConn := net.Pipe()
+	err = service.NewConnection(context.Background(), shedConn, M.Metadata{})
+	common.Close(shedConn, shedClientConn)
+	if shadowsocks.HandshakeReasonOf(err) != shadowsocks.ReasonOverloaded {
+		t.Fatal("expected overloaded, got ", err)
+	}
+
+	clientConn.Close()
+	err = <-done
+	if shadowsocks.HandshakeReasonOf(err) != shadowsocks.ReasonReadFailed {
+		t.Fatal("expected read failed, got ", err)
+	}
+
+	serverConn, clientConn = net.Pipe()
+	defer common.Close(serverConn, clientConn)
+	request := clientRequest(t, method, [][]byte{psk[:]}, "test.com:443")
+	go func() {
+		clientConn.Write(request)
+		clientConn.Close()
+	}()
+	err = service.NewConnection(context.Background(), serverConn, M.Metadata{})
+	if err != nil {
+		t.Fatal("slot not released: ", err)
+	}
+}
+
+func TestServiceShutdown(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	psk := benchmarkPSK(method)
+	for _, drain := range []bool{true, false} {
+		handler := &holdHandler{opened: make(chan struct{}, 1)}
+		service, err := shadowaead_2022.NewService(method, psk, 60, handler, testTimeFunc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = service.NewPacket(context.Background(), &vectortest.BufferPacketConn{}, buf.As(clientPackets(t, method, [][]byte{psk}, 1)[0]), M.Metadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		serverConn, clientConn := net.Pipe()
+		go clientConn.Write(clientRequest(t, method, [][]byte{psk}, "test.com:443"))
+		done := make(chan error, 1)
+		go func() {
+			done <- service.NewConnection(context.Background(), serverConn, M.Metadata{})
+		}()
+		<-handler.opened
+		if drain {
+			go func() {
+				for !errors.Is(service.NewPacket(context.Background(), nil, buf.New(), M.Metadata{}), shadowsocks.ErrServiceClosed) {
+					time.Sleep(time.Millisecond)
+				}
+				clientConn.Close()
+			}()
+		}
+
+		timeout := 100 * time.Millisecond
+		if drain {
+			timeout = 5 * time.Second
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		stats, err := service.(shadowsocks.ShutdownService).Shutdown(ctx)
+		cancel()
+		if drain {
+			if err != nil || stats != (shadowsocks.ShutdownStats{Drained: 1, Sessions: 1}) {
+				t.Fatal("bad drain: ", stats, " ", err)
+			}
+		} else if !errors.Is(err, context.DeadlineExceeded) || stats != (shadowsocks.ShutdownStats{Cut: 1, Sessions: 1}) {
+			t.Fatal("bad cut: ", stats, " ", err)
+		}
+		<-done
+		clientConn.Close()
+
+		serverConn, clientConn = net.Pipe()
+		err = service.NewConnection(context.Background(), serverConn, M.Metadata{})
+		common.Close(serverConn, clientConn)
+		if !errors.Is(err, shadowsocks.ErrServiceClosed) {
+			t.Fatal("expected service closed, got ", err)
+		}
+	}
+}
+
+func TestServiceNewPackets(t *testing.T) {
+	t.Parallel()
+	const count = 4
+	for _, method := range shadowaead_2022.List {
+		t.Run(method, func(t *testing.T) {
+			psk := benchmarkPSK(method)
+			handler := &batchHandler{count: count}
+			service, err := shadowaead_2022.NewService(method, psk, 60, handler, testTimeFunc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := shadowaead_2022.New(method, [][]byte{psk}, testTimeFunc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := &bufferConn{}
+			packetConn := client.DialPacketConn(conn)
+			destination := M.ParseSocksaddr("192.0.2.1:443").UDPAddr()
+			buffers := make([]*buf.Buffer, 0, count+1)
+			for i := 0; i < count; i++ {
+				_, err = packetConn.WriteTo([]byte("hello"), destination)
+				if err != nil {
+					t.Fatal(err)
+				}
+				buffers = append(buffers, buf.As(append([]byte(nil), conn.writer.Bytes()...)))
+				conn.writer.Reset()
+			}
+			buffers = append(buffers, buf.As(make([]byte, 64)))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			batchConn := &batchPacketConn{writes: make(chan [][]byte, 1)}
+			service.(shadowsocks.PacketBatchHandler).NewPackets(ctx, batchConn, buffers, make([]M.Metadata, len(buffers)))
+			if handler.errors != 1 {
+				t.Fatal("expected 1 error, got ", handler.errors)
+			}
+			responses := <-batchConn.writes
+			if len(responses) != count {
+				t.Fatal("expected ", count, " responses, got ", len(responses))
+			}
+			for _, response := range responses {
+				conn.reader = bytes.NewReader(response)
+				payload := make([]byte, 1024)
+				n, _, err := packetConn.ReadFrom(payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(payload[:n]) != "hello" {
+					t.Fatal("bad response: ", string(payload[:n]))
+				}
+			}
+		})
+	}
+}
+
+var testTime = time.Unix(1700000000, 0)
+
+func testTimeFunc() time.Time {
+	return testTime
+}
+
+func FuzzServiceNewConnection(f *testing.F) {
+	method := "2022-blake3-aes-128-gcm"
+	psk := bytes.Repeat([]byte{1}, 16)
+	for _, destination := range []string{"test.com:443", "1.1.1.1:53", "[::1]:80"} {
+		f.Add(clientRequest(f, method, [][]byte{psk}, destination))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		service, err := shadowaead_2022.NewService(method, psk, 60, &discardHandler{}, testTimeFunc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		service.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(data)}, M.Metadata{})
+	})
+}
+
+func FuzzServiceNewPacket(f *testing.F) {
+	for _, chacha := range []bool{false, true} {
+		method, psk := packetMethod(chacha)
+		for _, destination := range []string{"test.com:443", "1.1.1.1:53", "[::1]:80"} {
+			f.Add(chacha, clientPacket(f, method, [][]byte{psk}, destination))
+		}
+	}
+	f.Fuzz(func(t *testing.T, chacha bool, data []byte) {
+		method, psk := packetMethod(chacha)
+		service, err := shadowaead_2022.NewService(method, psk, 60, &discardHandler{}, testTimeFunc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		buffer := buf.NewSize(len(data))
+		buffer.Write(data)
+		service.NewPacket(ctx, nil, buffer, M.Metadata{})
+	})
+}
+
+// FuzzServicePacketPlaintext seals the fuzzed plaintext with the server key,
+// so that the parser behind the AEAD is reachable.
+func FuzzServicePacketPlaintext(f *testing.F) {
+	method := "2022-blake3-aes-128-gcm"
+	psk := bytes.Repeat([]byte{1}, 16)
+	for _, destination := range []string{"test.com:443", "1.1.1.1:53", "[::1]:80"} {
+		f.Add(packetPlaintext(destination, 0))
+		f.Add(packetPlaintext(destination, 16))
+	}
+	f.Fuzz(func(t *testing.T, plaintext []byte) {
+		service, err := shadowaead_2022.NewService(method, psk, 60, &discardHandler{}, testTimeFunc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		packet := sealPacket(psk, nil, plaintext)
+		buffer := buf.NewSize(len(packet))
+		buffer.Write(packet)
+		service.NewPacket(ctx, nil, buffer, M.Metadata{})
+	})
+}
+
+func BenchmarkServiceNewConnection(b *testing.B) {
+	for _, method := range shadowaead_2022.List {
+		b.Run(method, func(b *testing.B) {
+			psk := benchmarkPSK(method)
+			service, err := shadowaead_2022.NewService(method, psk, 60, &benchmarkHandler{}, testTimeFunc)
+			if err != nil {
+				b.Fatal(err)
+			}
+			// Salts are checked for replay, so every handshake needs its own request.
+			requests := make([][]byte, b.N)
+			for i := range requests {
+				requests[i] = clientRequest(b, method, [][]byte{psk}, "test.com:443")
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for _, request := range requests {
+				err = service.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkServiceNewPacket(b *testing.B) {
+	for _, method := range shadowaead_2022.List {
+		b.Run(method, func(b *testing.B) {
+			psk := benchmarkPSK(method)
+			service, err := shadowaead_2022.NewService(method, psk, 60, &discardHandler{}, testTimeFunc)
+			if err != nil {
+				b.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			packets := clientPackets(b, method, [][]byte{psk}, b.N)
+			b.SetBytes(int64(len(packets[0])))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for _, packet := range packets {
+				buffer := buf.NewPacket()
+				buffer.Write(packet)
+				err = service.NewPacket(ctx, nil, buffer, M.Metadata{})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkServiceNewPackets(b *testing.B) {
+	const batchSize = 32
+	for _, method := range shadowaead_2022.List {
+		b.Run(method, func(b *testing.B) {
+			psk := benchmarkPSK(method)
+			service, err := shadowaead_2022.NewService(method, psk, 60, &discardHandler{}, testTimeFunc)
+			if err != nil {
+				b.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			packets := clientPackets(b, method, [][]byte{psk}, b.N)
+			buffers := make([]*buf.Buffer, 0, batchSize)
+			metadata := make([]M.Metadata, batchSize)
+			b.SetBytes(int64(len(packets[0])))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i, packet := range packets {
+				buffer := buf.NewPacket()
+				buffer.Write(packet)
+				buffers = append(buffers, buffer)
+				if len(buffers) == batchSize || i == len(packets)-1 {
+					service.(shadowsocks.PacketBatchHandler).NewPackets(ctx, nil, buffers, metadata[:len(buffers)])
+					buffers = buffers[:0]
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkServiceWritePacket(b *testing.B) {
+	for _, method := range shadowaead_2022.List {
+		b.Run(method, func(b *testing.B) {
+			psk := benchmarkPSK(method)
+			handler := &benchmarkHandler{conns: make(chan N.PacketConn, 1)}
+			service, err := shadowaead_2022.NewService(method, psk, 60, handler, testTimeFunc)
+			if err != nil {
+				b.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			err = service.NewPacket(ctx, &vectortest.BufferPacketConn{}, buf.As(clientPackets(b, method, [][]byte{psk}, 1)[0]), M.Metadata{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			conn := <-handler.conns
+			destination := M.ParseSocksaddr("test.com:443")
+			payload := make([]byte, 1024)
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				buffer := buf.NewPacket()
+				buffer.Resize(256, 0)
+				buffer.Write(payload)
+				err = conn.WritePacket(buffer, destination)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func benchmarkPSK(method string) []byte {
+	if method == "2022-blake3-aes-128-gcm" {
+		return bytes.Repeat([]byte{1}, 16)
+	}
+	return bytes.Repeat([]byte{1}, 32)
+}
+
+// clientPackets returns count packets of one client session, with increasing packet ids.
+func clientPackets(t testing.TB, method string, pskList [][]byte, count int) [][]byte {
+	client, err := shadowaead_2022.New(method, pskList, testTimeFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufferConn{}
+	packetConn := client.DialPacketConn(conn)
+	destination := M.ParseSocksaddr("test.com:443")
+	payload := make([]byte, 1024)
+	packets := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		_, err = packetConn.WriteTo(payload, destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, append([]byte(nil), conn.writer.Bytes()...))
+		conn.writer.Reset()
+	}
+	return packets
+}
+
+func packetMethod(chacha bool) (string, []byte) {
+	if chacha {
+		return "2022-blake3-chacha20-poly1305", bytes.Repeat([]byte{1}, 32)
+	}
+	return "2022-blake3-aes-128-gcm", bytes.Repeat([]byte{1}, 16)
+}
+
+func clientRequest(t testing.TB, method string, pskList [][]byte, destination string) []byte {
+	client, err := shadowaead_2022.New(method, pskList, testTimeFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufferConn{}
+	_, err = client.DialEarlyConn(conn, M.ParseSocksaddr(destination)).Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn.writer.Bytes()
+}
+
+func clientPacket(t testing.TB, method string, pskList [][]byte, destination string) []byte {
+	client, err := shadowaead_2022.New(method, pskList, testTimeFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufferConn{}
+	_, err = client.DialPacketConn(conn).WriteTo([]byte("hello"), M.ParseSocksaddr(destination))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn.writer.Bytes()
+}
+
+func packetPlaintext(destination string, paddingLen uint16) []byte {
+	plaintext := buf.NewSize(1024)
+	defer plaintext.Release()
+	common.Must(
+		binary.Write(plaintext, binary.BigEndian, uint64(1)),
+		binary.Write(plaintext, binary.BigEndian, uint64(0)),
+		plaintext.WriteByte(shadowaead_2022.HeaderTypeClient),
+		binary.Write(plaintext, binary.BigEndian, uint64(testTime.Unix())),
+		binary.Write(plaintext, binary.BigEndian, paddingLen),
+	)
+	plaintext.Extend(int(paddingLen))
+	common.Must(M.SocksaddrSerializer.WriteAddrPort(plaintext, M.ParseSocksaddr(destination)))
+	common.Must1(plaintext.WriteString("hello"))
+	return append([]byte(nil), plaintext.Bytes()...)
+}
+
+// sealPacket encrypts a plaintext packet for an AES method, with an identity header for uPSK if not nil.
+func sealPacket(psk []byte, uPSK []byte, plaintext []byte) []byte {
+	if len(plaintext) < aes.BlockSize {
+		plaintext = append(plaintext, make([]byte, aes.BlockSize-len(plaintext))...)
+	}
+	header := plaintext[:aes.BlockSize]
+	block, err := aes.NewCipher(psk)
+	common.Must(err)
+	packet := make([]byte, aes.BlockSize, 2*aes.BlockSize+len(plaintext)+shadowaead.Overhead)
+	block.Encrypt(packet, header)
+	sessionPSK := psk
+	if uPSK != nil {
+		hash := blake3.Sum512(uPSK)
+		identityHeader := make([]byte, aes.BlockSize)
+		for i := range identityHeader {
+			identityHeader[i] = hash[i] ^ header[i]
+		}
+		block.Encrypt(identityHeader, identityHeader)
+		packet = append(packet, identityHeader...)
+		sessionPSK = uPSK
+	}
+	sessionCipher, err := aes.NewCipher(shadowaead_2022.SessionKey(sessionPSK, header[:8], len(psk)))
+	common.Must(err)
+	aead, err := cipher.NewGCM(sessionCipher)
+	common.Must(err)
+	return aead.Seal(packet, header[4:16], plaintext[aes.BlockSize:], nil)
+}
+
+type bufferConn struct {
+	reader io.Reader
+	writer bytes.Buffer
+}
+
+func (c *bufferConn) Read(p []byte) (n int, err error) {
+	if c.reader == nil {
+		return 0, io.EOF
+	}
+	return c.reader.Read(p)
+}
+
+func (c *bufferConn) Write(p []byte) (n int, err error) {
+	return c.writer.Write(p)
+}
+
+func (c *bufferConn) Close() error {
+	return nil
+}
+
+func (c *bufferConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *bufferConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *bufferConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *bufferConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *bufferConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// readSignalConn closes reading on its first read.
+type readSignalConn struct {
+	net.Conn
+	once    sync.Once
+	reading chan struct{}
+}
+
+func (c *readSignalConn) Read(p []byte) (n int, err error) {
+	c.once.Do(func() {
+		close(c.reading)
+	})
+	return c.Conn.Read(p)
+}
+
+// holdHandler signals opened for each connection and discards it until it is closed.
+type holdHandler struct {
+	discardHandler
+	opened chan struct{}
+}
+
+func (h *holdHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	h.opened <- struct{}{}
+	return h.discardHandler.NewConnection(ctx, conn, metadata)
+}
+
+type discardHandler struct{}
+
+func (h *discardHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	_, err := io.Copy(io.Discard, conn)
+	return err
+}
+
+func (h *discardHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	for {
+		buffer := buf.NewPacket()
+		_, err := conn.ReadPacket(buffer)
+		buffer.Release()
+		if errors.Is(err, io.ErrClosedPipe) {
+			return nil
+		}
+	}
+}
+
+func (h *discardHandler) NewError(ctx context.Context, err error) {
+}
+
+// batchHandler echoes count packets of a session back with one batch write, and counts errors.
+type batchHandler struct {
+	discardHandler
+	count  int
+	errors int
+}
+
+func (h *batchHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	buffers := make([]*buf.Buffer, 0, h.count)
+	destinations := make([]M.Socksaddr, 0, h.count)
+	for len(buffers) < h.count {
+		buffer := buf.NewPacket()
+		destination, err := conn.ReadPacket(buffer)
+		if err != nil {
+			buffer.Release()
+			buf.ReleaseMulti(buffers)
+			return err
+		}
+		buffers = append(buffers, buffer)
+		destinations = append(destinations, destination)
+	}
+	writer, _ := common.Cast[shadowsocks.PacketBatchWriter](conn)
+	return writer.WritePackets(buffers, destinations)
+}
+
+func (h *batchHandler) NewError(ctx context.Context, err error) {
+	h.errors++
+}
+
+// batchPacketConn collects each batch write.
+type batchPacketConn struct {
+	vectortest.BufferPacketConn
+	writes chan [][]byte
+}
+
+func (c *batchPacketConn) WritePackets(buffers []*buf.Buffer, destinations []M.Socksaddr) error {
+	packets := make([][]byte, 0, len(buffers))
+	for _, buffer := range buffers {
+		packets = append(packets, append([]byte(nil), buffer.Bytes()...))
+	}
+	buf.ReleaseMulti(buffers)
+	c.writes <- packets
+	return nil
+}
+
+// benchmarkHandler returns as soon as the handshake is done, and hands out the first packet connection
+// holding it until the context is done.
+type benchmarkHandler struct {
+	discardHandler
+	conns chan N.PacketConn
+}
+
+func (h *benchmarkHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	return nil
+}
+
+func (h *benchmarkHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	h.conns <- conn
+	<-ctx.Done()
+	return nil
+}
+
+type closeFilter struct {
+	replay.Filter
+	closed bool
+}
+
+func (f *closeFilter) Close() error {
+	f.closed = true
+	return nil
+}
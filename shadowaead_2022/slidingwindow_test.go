@@ -0,0 +1,36 @@
+package shadowaead_2022_test
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/sagernet/sing-shadowsocks/shadowaead_2022"
+)
+
+func FuzzSlidingWindow(f *testing.F) {
+	f.Add(uint64(0), []byte{0, 0, 0, 1, 0, 2, 0, 1, 0, 0})
+	f.Add(uint64(0), []byte{0, 10, 0xff, 0xff, 0, 64, 0x1f, 0xc0, 0x1f, 0xc1, 0, 64})
+	f.Add(^uint64(0)-100, []byte{0, 0, 0, 50, 0, 200, 0, 100})
+	f.Fuzz(func(t *testing.T, base uint64, data []byte) {
+		// window size of SlidingWindow: (swRingBlocks - 1) * swBlockBits
+		const windowSize = 127 * 64
+		var window shadowaead_2022.SlidingWindow
+		var last uint64
+		seen := make(map[uint64]bool)
+		for len(data) >= 2 {
+			counter := base + uint64(binary.BigEndian.Uint16(data))
+			data = data[2:]
+			expected := counter > last || last-counter <= windowSize && !seen[counter]
+			if window.Check(counter) != expected {
+				t.Fatalf("check %d after %d: expected %v", counter, last, expected)
+			}
+			if expected {
+				window.Add(counter)
+				seen[counter] = true
+				if counter > last {
+					last = counter
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,324 @@
+package shadowaead_2022_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing-shadowsocks/internal/vectortest"
+	"github.com/sagernet/sing-shadowsocks/shadowaead_2022"
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"lukechampine.com/blake3"
+)
+
+var vectorMultiUserList = []string{
+	"2022-blake3-aes-128-gcm",
+	"2022-blake3-aes-256-gcm",
+}
+
+// Port 53 makes both peers pad UDP packets.
+var vectorDestination = M.ParseSocksaddr("example.com:53")
+
+type vector struct {
+	Name    string   `json:"name"`
+	Method  string   `json:"method"`
+	PSK     []string `json:"psk"`
+	Padding int      `json:"padding"`
+
+	TCPClientRandom string `json:"tcp_client_random"`
+	TCPServerRandom string `json:"tcp_server_random"`
+	TCPRequest      string `json:"tcp_request"`
+	TCPResponse     string `json:"tcp_response"`
+
+	UDPClientRandom string `json:"udp_client_random"`
+	UDPServerRandom string `json:"udp_server_random"`
+	UDPRequest      string `json:"udp_request"`
+	UDPResponse     string `json:"udp_response"`
+}
+
+func TestVectors(t *testing.T) {
+	vectors := loadVectors(t)
+	if len(vectors) != len(shadowaead_2022.List)+len(vectorMultiUserList) {
+		t.Fatal("missing vectors")
+	}
+	for _, v := range vectors {
+		t.Run(v.Name, func(t *testing.T) {
+			testTCPVector(t, v)
+			testUDPVector(t, v)
+		})
+	}
+}
+
+// TestVectorsSpec decodes the vectors with bare primitives, following SIP022 rather than this package.
+func TestVectorsSpec(t *testing.T) {
+	// ATYP domain name, length, name, port
+	address := append([]byte{3, 11}, "example.com"...)
+	address = append(address, 0, 53)
+	for _, v := range loadVectors(t) {
+		t.Run(v.Name, func(t *testing.T) {
+			iPSK := vectortest.DecodeHex(t, v.PSK[0])
+			uPSK := vectortest.DecodeHex(t, v.PSK[len(v.PSK)-1])
+			keyLength := len(uPSK)
+			newAEAD := func(key []byte) cipher.AEAD {
+				if v.Method == "2022-blake3-chacha20-poly1305" {
+					return common.Must1(chacha20poly1305.New(key))
+				}
+				return common.Must1(cipher.NewGCM(common.Must1(aes.NewCipher(key))))
+			}
+			subkey := func(context string, psk []byte, salt []byte) []byte {
+				key := make([]byte, keyLength)
+				blake3.DeriveKey(key, "shadowsocks 2022 "+context, append(append([]byte(nil), psk...), salt...))
+				return key
+			}
+			pskHash := blake3.Sum512(uPSK)
+			checkTime := func(name string, header []byte) {
+				if header[0] != shadowaead_2022.HeaderTypeClient && header[0] != shadowaead_2022.HeaderTypeServer ||
+					int64(binary.BigEndian.Uint64(header[1:9])) != testTime.Unix() {
+					t.Fatalf("%s: header %x", name, header)
+				}
+			}
+
+			request := vectortest.DecodeHex(t, v.TCPRequest)
+			requestSalt := request[:keyLength]
+			request = request[keyLength:]
+			if len(v.PSK) > 1 {
+				block := common.Must1(aes.NewCipher(subkey("identity subkey", iPSK, requestSalt)))
+				identityHeader := make([]byte, aes.BlockSize)
+				block.Encrypt(identityHeader, pskHash[:aes.BlockSize])
+				if !bytes.Equal(request[:aes.BlockSize], identityHeader) {
+					t.Fatalf("identity header: %x", request[:aes.BlockSize])
+				}
+				request = request[aes.BlockSize:]
+			}
+			aead := newAEAD(subkey("session subkey", uPSK, requestSalt))
+			nonce := make([]byte, aead.NonceSize())
+			fixedHeader, err := aead.Open(nil, nonce, request[:11+aead.Overhead()], nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTime("tcp request", fixedHeader)
+			nonce[0]++
+			request = request[11+aead.Overhead():]
+			variableHeader, err := aead.Open(nil, nonce, request[:int(binary.BigEndian.Uint16(fixedHeader[9:]))+aead.Overhead()], nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := append(append([]byte(nil), address...), byte(v.Padding>>8), byte(v.Padding))
+			expected = append(expected, make([]byte, v.Padding)...)
+			expected = append(expected, vectortest.Request...)
+			if !bytes.Equal(variableHeader, expected) {
+				t.Fatalf("variable header: %x", variableHeader)
+			}
+
+			response := vectortest.DecodeHex(t, v.TCPResponse)
+			aead = newAEAD(subkey("session subkey", uPSK, response[:keyLength]))
+			response = response[keyLength:]
+			nonce = make([]byte, aead.NonceSize())
+			headerLength := 1 + 8 + keyLength + 2
+			fixedHeader, err = aead.Open(nil, nonce, response[:headerLength+aead.Overhead()], nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTime("tcp response", fixedHeader)
+			if fixedHeader[0] != shadowaead_2022.HeaderTypeServer || !bytes.Equal(fixedHeader[9:9+keyLength], requestSalt) {
+				t.Fatalf("tcp response: header %x", fixedHeader)
+			}
+			nonce[0]++
+			response = response[headerLength+aead.Overhead():]
+			payload, err := aead.Open(nil, nonce, response[:int(binary.BigEndian.Uint16(fixedHeader[headerLength-2:]))+aead.Overhead()], nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(payload, vectortest.Response) {
+				t.Fatalf("tcp response: decoded %x", payload)
+			}
+
+			// decodePacket returns the session ID and the message after the packet ID.
+			decodePacket := func(name string, content string, psk []byte, identity bool) ([]byte, []byte) {
+				packet := vectortest.DecodeHex(t, content)
+				if v.Method == "2022-blake3-chacha20-poly1305" {
+					aead := common.Must1(chacha20poly1305.NewX(psk))
+					message, err := aead.Open(nil, packet[:aead.NonceSize()], packet[aead.NonceSize():], nil)
+					if err != nil {
+						t.Fatal(name, ": ", err)
+					}
+					return message[:8], message[16:]
+				}
+				separateHeader := make([]byte, aes.BlockSize)
+				common.Must1(aes.NewCipher(psk)).Decrypt(separateHeader, packet[:aes.BlockSize])
+				packet = packet[aes.BlockSize:]
+				if identity {
+					identityHeader := make([]byte, aes.BlockSize)
+					common.Must1(aes.NewCipher(psk)).Decrypt(identityHeader, packet[:aes.BlockSize])
+					for i := range identityHeader {
+						identityHeader[i] ^= separateHeader[i]
+					}
+					if !bytes.Equal(identityHeader, pskHash[:aes.BlockSize]) {
+						t.Fatalf("%s: identity header %x", name, identityHeader)
+					}
+					packet = packet[aes.BlockSize:]
+				}
+				aead := newAEAD(subkey("session subkey", uPSK, separateHeader[:8]))
+				message, err := aead.Open(nil, separateHeader[4:], packet, nil)
+				if err != nil {
+					t.Fatal(name, ": ", err)
+				}
+				return separateHeader[:8], message
+			}
+			// checkMessage checks the header, padding and address of a packet message and returns its payload.
+			checkMessage := func(name string, message []byte) []byte {
+				checkTime(name, message)
+				message = message[9:]
+				paddingLength := int(binary.BigEndian.Uint16(message))
+				if paddingLength == 0 || !bytes.Equal(message[2:2+paddingLength], make([]byte, paddingLength)) {
+					t.Fatalf("%s: padding %x", name, message)
+				}
+				message = message[2+paddingLength:]
+				if !bytes.HasPrefix(message, address) {
+					t.Fatalf("%s: address %x", name, message)
+				}
+				return message[len(address):]
+			}
+			requestPSK := iPSK
+			if v.Method == "2022-blake3-chacha20-poly1305" {
+				requestPSK = uPSK
+			}
+			sessionID, message := decodePacket("udp request", v.UDPRequest, requestPSK, len(v.PSK) > 1)
+			if message[0] != shadowaead_2022.HeaderTypeClient || !bytes.Equal(checkMessage("udp request", message), vectortest.Request) {
+				t.Fatalf("udp request: decoded %x", message)
+			}
+			_, message = decodePacket("udp response", v.UDPResponse, uPSK, false)
+			if message[0] != shadowaead_2022.HeaderTypeServer || !bytes.Equal(message[9:17], sessionID) {
+				t.Fatalf("udp response: header %x", message)
+			}
+			if !bytes.Equal(checkMessage("udp response", append(message[:9:9], message[17:]...)), vectortest.Response) {
+				t.Fatalf("udp response: decoded %x", message)
+			}
+		})
+	}
+}
+
+func testTCPVector(t *testing.T, v *vector) {
+	client := newVectorClient(t, v, v.TCPClientRandom)
+	clientConn := &bufferConn{}
+	conn := client.DialEarlyConn(clientConn, vectorDestination)
+	_, err := conn.Write(vectortest.Request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectortest.Check(t, "tcp request", v.TCPRequest, clientConn.writer.Bytes())
+
+	service := newVectorService(t, v, v.TCPServerRandom, &vectortest.Handler{T: t, Destination: vectorDestination})
+	serverConn := &bufferConn{reader: bytes.NewReader(vectortest.DecodeHex(t, v.TCPRequest))}
+	err = service.NewConnection(context.Background(), serverConn, M.Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectortest.Check(t, "tcp response", v.TCPResponse, serverConn.writer.Bytes())
+
+	clientConn.reader = bytes.NewReader(vectortest.DecodeHex(t, v.TCPResponse))
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, vectortest.Response) {
+		t.Fatalf("tcp response: decoded %q", response)
+	}
+}
+
+func testUDPVector(t *testing.T, v *vector) {
+	client := newVectorClient(t, v, v.UDPClientRandom)
+	clientConn := &bufferConn{}
+	packetConn := client.DialPacketConn(clientConn)
+	_, err := packetConn.WriteTo(vectortest.Request, vectorDestination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectortest.Check(t, "udp request", v.UDPRequest, clientConn.writer.Bytes())
+
+	handler := &vectortest.Handler{T: t, Destination: vectorDestination, Done: make(chan struct{})}
+	service := newVectorService(t, v, v.UDPServerRandom, handler)
+	serverConn := &vectortest.BufferPacketConn{}
+	err = service.NewPacket(context.Background(), serverConn, buf.As(vectortest.DecodeHex(t, v.UDPRequest)), M.Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-handler.Done
+	vectortest.Check(t, "udp response", v.UDPResponse, serverConn.Packet)
+
+	clientConn.reader = bytes.NewReader(vectortest.DecodeHex(t, v.UDPResponse))
+	response := make([]byte, 1024)
+	n, addr, err := packetConn.ReadFrom(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if M.SocksaddrFromNet(addr) != vectorDestination || !bytes.Equal(response[:n], vectortest.Response) {
+		t.Fatalf("udp response: decoded %q from %s", response[:n], addr)
+	}
+}
+
+func newVectorClient(t *testing.T, v *vector, random string) *shadowaead_2022.Method {
+	pskList := make([][]byte, 0, len(v.PSK))
+	for _, psk := range v.PSK {
+		pskList = append(pskList, vectortest.DecodeHex(t, psk))
+	}
+	client, err := shadowaead_2022.New(v.Method, pskList, testTimeFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	method := client.(*shadowaead_2022.Method)
+	method.SetRandom(vectortest.HexReader(t, random))
+	method.SetPaddingRNG(v.intn)
+	return method
+}
+
+func newVectorService(t *testing.T, v *vector, random string, handler shadowsocks.Handler) shadowsocks.Service {
+	if len(v.PSK) == 1 {
+		service, err := shadowaead_2022.NewService(v.Method, vectortest.DecodeHex(t, v.PSK[0]), 60, handler, testTimeFunc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		service.(*shadowaead_2022.Service).SetRandom(vectortest.HexReader(t, random))
+		service.(*shadowaead_2022.Service).SetPaddingRNG(v.intn)
+		return service
+	}
+	service, err := shadowaead_2022.NewMultiService[string](v.Method, vectortest.DecodeHex(t, v.PSK[0]), 60, handler, testTimeFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = service.UpdateUsers([]string{"user"}, [][]byte{vectortest.DecodeHex(t, v.PSK[1])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.SetRandom(vectortest.HexReader(t, random))
+	service.SetPaddingRNG(v.intn)
+	return service
+}
+
+func (v *vector) intn(n int) int {
+	return v.Padding - 1
+}
+
+func loadVectors(t *testing.T) []*vector {
+	content, err := os.ReadFile("testdata/vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []*vector
+	err = json.Unmarshal(content, &vectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vectors
+}
@@ -0,0 +1,474 @@
+package shadowimpl_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing-shadowsocks/shadowaead"
+	"github.com/sagernet/sing-shadowsocks/shadowaead_2022"
+	"github.com/sagernet/sing-shadowsocks/shadowimpl"
+	"github.com/sagernet/sing-shadowsocks/shadowstream"
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/rw"
+)
+
+const testTimeout = 10 * time.Second
+
+var (
+	tcpDestination  = M.ParseSocksaddr("example.com:443")
+	udpDestinations = []M.Socksaddr{
+		M.ParseSocksaddr("192.0.2.1:53"),
+		M.ParseSocksaddr("[2001:db8::1]:443"),
+		M.ParseSocksaddr("example.com:53"),
+	}
+)
+
+func methodList() []string {
+	methodList := []string{"none"}
+	methodList = append(methodList, shadowstream.List...)
+	methodList = append(methodList, shadowaead.List...)
+	methodList = append(methodList, shadowaead_2022.List...)
+	return methodList
+}
+
+func methodPassword(method string) string {
+	switch method {
+	case "2022-blake3-aes-128-gcm":
+		return base64.StdEncoding.EncodeToString(randomBytes(16))
+	case "2022-blake3-aes-256-gcm", "2022-blake3-chacha20-poly1305":
+		return base64.StdEncoding.EncodeToString(randomBytes(32))
+	default:
+		return "password"
+	}
+}
+
+func newService(method string, password string, handler shadowsocks.Handler) (shadowsocks.Service, error) {
+	if method == "none" {
+		return shadowsocks.NewNoneService(60, handler), nil
+	} else if common.Contains(shadowstream.List, method) {
+		return shadowstream.NewService(method, nil, password, 60, handler)
+	} else if common.Contains(shadowaead.List, method) {
+		return shadowaead.NewService(method, nil, password, 60, handler)
+	} else {
+		return shadowaead_2022.NewServiceWithPassword(method, password, 60, handler, nil)
+	}
+}
+
+type transport struct {
+	name      string
+	halfClose bool
+	tcp       func(t *testing.T) (client net.Conn, server net.Conn)
+	udp       func(t *testing.T, service shadowsocks.Service) net.Conn
+}
+
+var transportList = []transport{
+	{
+		name: "pipe",
+		tcp: func(t *testing.T) (net.Conn, net.Conn) {
+			return net.Pipe()
+		},
+		udp: func(t *testing.T, service shadowsocks.Service) net.Conn {
+			client, server := net.Pipe()
+			ctx, cancel := context.WithCancel(context.Background())
+			t.Cleanup(func() {
+				cancel()
+				client.Close()
+				server.Close()
+			})
+			source := M.ParseSocksaddr("127.0.0.1:10000")
+			packetConn := bufio.NewUnbindPacketConn(server)
+			go func() {
+				for {
+					buffer := buf.NewPacket()
+					_, err := buffer.ReadOnceFrom(server)
+					if err != nil {
+						buffer.Release()
+						return
+					}
+					err = service.NewPacket(ctx, packetConn, buffer, M.Metadata{Source: source})
+					if err != nil {
+						buffer.Release()
+						t.Error(err)
+					}
+				}
+			}()
+			return client
+		},
+	},
+	{
+		name:      "loopback",
+		halfClose: true,
+		tcp: func(t *testing.T) (net.Conn, net.Conn) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			client, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			server, err := listener.Accept()
+			if err != nil {
+				client.Close()
+				t.Fatal(err)
+			}
+			return client, server
+		},
+		udp: func(t *testing.T, service shadowsocks.Service) net.Conn {
+			server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+			if err != nil {
+				server.Close()
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			t.Cleanup(func() {
+				cancel()
+				client.Close()
+				server.Close()
+			})
+			packetConn := bufio.NewPacketConn(server)
+			go func() {
+				for {
+					buffer := buf.NewPacket()
+					source, err := packetConn.ReadPacket(buffer)
+					if err != nil {
+						buffer.Release()
+						return
+					}
+					err = service.NewPacket(ctx, packetConn, buffer, M.Metadata{Source: source})
+					if err != nil {
+						buffer.Release()
+						t.Error(err)
+					}
+				}
+			}()
+			return client
+		},
+	},
+}
+
+type tcpMode struct {
+	name      string
+	halfClose bool
+	extended  bool
+	dial      func(method shadowsocks.Method, conn net.Conn, request []byte) (net.Conn, error)
+}
+
+var tcpModeList = []tcpMode{
+	{
+		name: "DialConn",
+		dial: func(method shadowsocks.Method, conn net.Conn, request []byte) (net.Conn, error) {
+			serverConn, err := method.DialConn(conn, tcpDestination)
+			if err != nil {
+				return nil, err
+			}
+			_, err = serverConn.Write(request)
+			return serverConn, err
+		},
+	},
+	{
+		name: "DialEarlyConn",
+		dial: func(method shadowsocks.Method, conn net.Conn, request []byte) (net.Conn, error) {
+			serverConn := method.DialEarlyConn(conn, tcpDestination)
+			_, err := serverConn.Write(request)
+			return serverConn, err
+		},
+	},
+	{
+		name: "Vectorised",
+		dial: func(method shadowsocks.Method, conn net.Conn, request []byte) (net.Conn, error) {
+			serverConn := method.DialEarlyConn(conn, tcpDestination)
+			var buffers []*buf.Buffer
+			for _, data := range [][]byte{request[:1], request[1:4096], request[4096:]} {
+				buffer := buf.NewSize(len(data))
+				common.Must1(buffer.Write(data))
+				buffers = append(buffers, buffer)
+			}
+			return serverConn, bufio.NewVectorisedWriter(serverConn).WriteVectorised(buffers)
+		},
+	},
+	{
+		name:     "Extended",
+		extended: true,
+		dial: func(method shadowsocks.Method, conn net.Conn, request []byte) (net.Conn, error) {
+			serverConn := method.DialEarlyConn(conn, tcpDestination)
+			_, err := bufio.Copy(serverConn, bytes.NewReader(request))
+			return serverConn, err
+		},
+	},
+	{
+		name:      "HalfClose",
+		halfClose: true,
+		dial: func(method shadowsocks.Method, conn net.Conn, request []byte) (net.Conn, error) {
+			serverConn := method.DialEarlyConn(conn, tcpDestination)
+			_, err := serverConn.Write(request)
+			if err != nil {
+				return nil, err
+			}
+			return serverConn, rw.CloseWrite(serverConn)
+		},
+	},
+}
+
+func TestTCP(t *testing.T) {
+	for _, methodName := range methodList() {
+		for _, transport := range transportList {
+			for _, mode := range tcpModeList {
+				if mode.halfClose && !transport.halfClose {
+					continue
+				}
+				methodName, transport, mode := methodName, transport, mode
+				t.Run(methodName+"/"+transport.name+"/"+mode.name, func(t *testing.T) {
+					t.Parallel()
+					testTCP(t, methodName, transport, mode)
+				})
+			}
+		}
+	}
+}
+
+func testTCP(t *testing.T, methodName string, transport transport, mode tcpMode) {
+	password := methodPassword(methodName)
+	method, err := shadowimpl.FetchMethod(methodName, password, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := randomBytes(100 * 1024)
+	response := randomBytes(70 * 1024)
+	handler := &tcpHandler{halfClose: mode.halfClose, extended: mode.extended, request: request, response: response}
+	service, err := newService(methodName, password, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientConn, serverConn := transport.tcp(t)
+	defer common.Close(clientConn, serverConn)
+	deadline := time.Now().Add(testTimeout)
+	clientConn.SetDeadline(deadline)
+	serverConn.SetDeadline(deadline)
+
+	serverDone := make(chan error, 1)
+	go func() {
+		serverDone <- service.NewConnection(context.Background(), serverConn, M.Metadata{Source: M.SocksaddrFromNet(serverConn.RemoteAddr())})
+		serverConn.Close()
+	}()
+
+	conn, err := mode.dial(method, clientConn, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var content []byte
+	if mode.halfClose {
+		content, err = io.ReadAll(conn)
+	} else if mode.extended {
+		content, err = readExtended(conn, len(response))
+	} else {
+		content = make([]byte, len(response))
+		_, err = io.ReadFull(conn, content)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, response) {
+		t.Fatal("bad response")
+	}
+	err = <-serverDone
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type tcpHandler struct {
+	halfClose bool
+	extended  bool
+	request   []byte
+	response  []byte
+}
+
+func (h *tcpHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	if metadata.Destination != tcpDestination {
+		return E.New("bad destination: ", metadata.Destination)
+	}
+	var content []byte
+	var err error
+	if h.halfClose {
+		content, err = io.ReadAll(conn)
+	} else if h.extended {
+		content, err = readExtended(conn, len(h.request))
+	} else {
+		content = make([]byte, len(h.request))
+		_, err = io.ReadFull(conn, content)
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(content, h.request) {
+		return E.New("bad request")
+	}
+	if h.extended {
+		_, err = bufio.Copy(conn, bytes.NewReader(h.response))
+	} else {
+		_, err = conn.Write(h.response)
+	}
+	return err
+}
+
+// readExtended reads length bytes through the read waiter of conn, or through ReadBuffer if it has none.
+func readExtended(conn net.Conn, length int) ([]byte, error) {
+	var buffer *buf.Buffer
+	readWaiter, isReadWaiter := bufio.CreateReadWaiter(conn)
+	if isReadWaiter {
+		readWaiter.InitializeReadWaiter(func() *buf.Buffer {
+			buffer = buf.New()
+			return buffer
+		})
+		defer readWaiter.InitializeReadWaiter(nil)
+	}
+	reader := bufio.NewExtendedReader(conn)
+	content := make([]byte, 0, length)
+	for len(content) < length {
+		var err error
+		if isReadWaiter {
+			err = readWaiter.WaitReadBuffer()
+		} else {
+			buffer = buf.New()
+			err = reader.ReadBuffer(buffer)
+			if err != nil {
+				buffer.Release()
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, buffer.Bytes()...)
+		buffer.Release()
+	}
+	return content, nil
+}
+
+func (h *tcpHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	return os.ErrInvalid
+}
+
+func (h *tcpHandler) NewError(ctx context.Context, err error) {
+}
+
+func TestUDP(t *testing.T) {
+	for _, methodName := range methodList() {
+		for _, transport := range transportList {
+			methodName, transport := methodName, transport
+			t.Run(methodName+"/"+transport.name, func(t *testing.T) {
+				t.Parallel()
+				testUDP(t, methodName, transport)
+			})
+		}
+	}
+}
+
+func testUDP(t *testing.T, methodName string, transport transport) {
+	password := methodPassword(methodName)
+	method, err := shadowimpl.FetchMethod(methodName, password, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &udpHandler{t: t}
+	service, err := newService(methodName, password, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := transport.udp(t, service)
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	packetConn := method.DialPacketConn(conn)
+	for _, destination := range udpDestinations {
+		request := randomBytes(1200)
+		_, err = packetConn.WriteTo(request, destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := make([]byte, 2048)
+		n, addr, err := packetConn.ReadFrom(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if M.SocksaddrFromNet(addr).Unwrap() != destination {
+			t.Fatal("bad response source: ", addr)
+		}
+		if !bytes.Equal(response[:n], udpResponse(request)) {
+			t.Fatal("bad response to ", destination)
+		}
+	}
+}
+
+// udpResponse returns the reversed request, so the response differs from the request but can be checked without state.
+func udpResponse(request []byte) []byte {
+	response := make([]byte, len(request))
+	for i := range request {
+		response[len(request)-1-i] = request[i]
+	}
+	return response
+}
+
+type udpHandler struct {
+	t *testing.T
+}
+
+func (h *udpHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	return os.ErrInvalid
+}
+
+func (h *udpHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	if !common.Contains(udpDestinations, metadata.Destination) {
+		h.t.Error("bad destination: ", metadata.Destination)
+	}
+	for {
+		buffer := buf.NewPacket()
+		destination, err := conn.ReadPacket(buffer)
+		if err != nil {
+			buffer.Release()
+			if errors.Is(err, io.ErrClosedPipe) {
+				return nil
+			}
+			continue
+		}
+		if !common.Contains(udpDestinations, destination) {
+			h.t.Error("bad packet destination: ", destination)
+		}
+		response := buf.NewPacket()
+		response.Resize(2048, 0)
+		common.Must1(response.Write(udpResponse(buffer.Bytes())))
+		buffer.Release()
+		err = conn.WritePacket(response, destination)
+		if err != nil {
+			h.t.Error(err)
+		}
+	}
+}
+
+func (h *udpHandler) NewError(ctx context.Context, err error) {
+	h.t.Error(err)
+}
+
+func randomBytes(size int) []byte {
+	content := make([]byte, size)
+	common.Must1(rand.Read(content))
+	return content
+}
@@ -0,0 +1,292 @@
+package shadowmetrics
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing-shadowsocks/shadowaead_2022"
+	"github.com/sagernet/sing/common/atomic"
+)
+
+const (
+	CauseSaltNotUnique     = "salt_not_unique"
+	CauseBadTimestamp      = "bad_timestamp"
+	CausePacketIdNotUnique = "packet_id_not_unique"
+	CauseUnknownUser       = "unknown_user"
+	CauseAEADFailure       = "aead_failure"
+	CauseRateLimited       = "rate_limited"
+	CauseHandshakeTimeout  = "handshake_timeout"
+	CauseOverloaded        = "overloaded"
+	CauseDenied            = "denied"
+	CauseOther             = "other"
+)
+
+var causeList = [...]string{
+	CauseSaltNotUnique,
+	CauseBadTimestamp,
+	CausePacketIdNotUnique,
+	CauseUnknownUser,
+	CauseAEADFailure,
+	CauseRateLimited,
+	CauseHandshakeTimeout,
+	CauseOverloaded,
+	CauseDenied,
+	CauseOther,
+}
+
+var (
+	clockSkewBuckets  = []float64{1, 2, 5, 10, 15, 20, 25, 30, 60, 300}
+	userLookupBuckets = []float64{0.000001, 0.000005, 0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1}
+)
+
+var _ shadowsocks.Metrics = (*Collector)(nil)
+
+// Collector is a shadowsocks.Metrics implementation exposed in the Prometheus text format.
+type Collector struct {
+	access  sync.RWMutex
+	methods map[string]*methodMetrics
+}
+
+type methodMetrics struct {
+	accepted       atomic.Uint64
+	rejected       [len(causeList)]atomic.Uint64
+	connections    atomic.Int64
+	packetSessions atomic.Int64
+	readBytes      atomic.Uint64
+	writeBytes     atomic.Uint64
+	clockSkew      *histogram
+	userLookup     *histogram
+}
+
+func NewCollector() *Collector {
+	return &Collector{
+		methods: make(map[string]*methodMetrics),
+	}
+}
+
+func (c *Collector) method(name string) *methodMetrics {
+	c.access.RLock()
+	metrics, loaded := c.methods[name]
+	c.access.RUnlock()
+	if loaded {
+		return metrics
+	}
+	c.access.Lock()
+	defer c.access.Unlock()
+	metrics, loaded = c.methods[name]
+	if !loaded {
+		metrics = &methodMetrics{
+			clockSkew:  newHistogram(clockSkewBuckets),
+			userLookup: newHistogram(userLookupBuckets),
+		}
+		c.methods[name] = metrics
+	}
+	return metrics
+}
+
+func (c *Collector) HandshakeAccepted(method string) {
+	c.method(method).accepted.Add(1)
+}
+
+func (c *Collector) HandshakeRejected(method string, err error) {
+	cause := Cause(err)
+	for i, it := range causeList {
+		if it == cause {
+			c.method(method).rejected[i].Add(1)
+			return
+		}
+	}
+}
+
+func (c *Collector) ConnectionOpened(method string) {
+	c.method(method).connections.Add(1)
+}
+
+func (c *Collector) ConnectionClosed(method string) {
+	c.method(method).connections.Add(-1)
+}
+
+func (c *Collector) PacketSessionOpened(method string) {
+	c.method(method).packetSessions.Add(1)
+}
+
+func (c *Collector) PacketSessionClosed(method string) {
+	c.method(method).packetSessions.Add(-1)
+}
+
+func (c *Collector) ReadBytes(method string, n int64) {
+	c.method(method).readBytes.Add(uint64(n))
+}
+
+func (c *Collector) WriteBytes(method string, n int64) {
+	c.method(method).writeBytes.Add(uint64(n))
+}
+
+func (c *Collector) ClockSkew(method string, skew time.Duration) {
+	c.method(method).clockSkew.Observe(math.Abs(skew.Seconds()))
+}
+
+func (c *Collector) UserLookup(method string, duration time.Duration) {
+	c.method(method).userLookup.Observe(duration.Seconds())
+}
+
+// Cause returns the label used for a rejected handshake.
+func Cause(err error) string {
+	switch {
+	case errors.Is(err, shadowaead_2022.ErrSaltNotUnique):
+		return CauseSaltNotUnique
+	case errors.Is(err, shadowaead_2022.ErrPacketIdNotUnique):
+		return CausePacketIdNotUnique
+	}
+	switch shadowsocks.HandshakeReasonOf(err) {
+	case shadowsocks.ReasonBadTimestamp:
+		return CauseBadTimestamp
+	case shadowsocks.ReasonUnknownUser:
+		return CauseUnknownUser
+	case shadowsocks.ReasonDecryptFailed:
+		return CauseAEADFailure
+	case shadowsocks.ReasonRateLimited:
+		return CauseRateLimited
+	case shadowsocks.ReasonTimeout:
+		return CauseHandshakeTimeout
+	case shadowsocks.ReasonOverloaded:
+		return CauseOverloaded
+	case shadowsocks.ReasonDenied:
+		return CauseDenied
+	default:
+		return CauseOther
+	}
+}
+
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = c.WritePrometheus(w)
+}
+
+func (c *Collector) WritePrometheus(w io.Writer) error {
+	c.access.RLock()
+	names := make([]string, 0, len(c.methods))
+	for name := range c.methods {
+		names = append(names, name)
+	}
+	methods := make([]*methodMetrics, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		methods[i] = c.methods[name]
+	}
+	c.access.RUnlock()
+
+	var output bytes.Buffer
+	writeHeader(&output, "shadowsocks_handshakes_total", "counter", "Handshakes by method, result and cause.")
+	for i, name := range names {
+		writeSample(&output, "shadowsocks_handshakes_total", labels("method", name, "result", "accepted"), float64(methods[i].accepted.Load()))
+		for j, cause := range causeList {
+			writeSample(&output, "shadowsocks_handshakes_total", labels("method", name, "result", "rejected", "cause", cause), float64(methods[i].rejected[j].Load()))
+		}
+	}
+	writeHeader(&output, "shadowsocks_tcp_connections", "gauge", "Active TCP connections.")
+	for i, name := range names {
+		writeSample(&output, "shadowsocks_tcp_connections", labels("method", name), float64(methods[i].connections.Load()))
+	}
+	writeHeader(&output, "shadowsocks_udp_sessions", "gauge", "Active UDP sessions.")
+	for i, name := range names {
+		writeSample(&output, "shadowsocks_udp_sessions", labels("method", name), float64(methods[i].packetSessions.Load()))
+	}
+	writeHeader(&output, "shadowsocks_bytes_total", "counter", "Payload bytes by method and direction.")
+	for i, name := range names {
+		writeSample(&output, "shadowsocks_bytes_total", labels("method", name, "direction", "read"), float64(methods[i].readBytes.Load()))
+		writeSample(&output, "shadowsocks_bytes_total", labels("method", name, "direction", "write"), float64(methods[i].writeBytes.Load()))
+	}
+	writeHeader(&output, "shadowsocks_clock_skew_seconds", "histogram", "Absolute difference between client and server clocks.")
+	for i, name := range names {
+		methods[i].clockSkew.write(&output, "shadowsocks_clock_skew_seconds", name)
+	}
+	writeHeader(&output, "shadowsocks_user_lookup_seconds", "histogram", "Time spent identifying the user of a request.")
+	for i, name := range names {
+		methods[i].userLookup.write(&output, "shadowsocks_user_lookup_seconds", name)
+	}
+	_, err := w.Write(output.Bytes())
+	return err
+}
+
+type histogram struct {
+	access  sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) Observe(value float64) {
+	h.access.Lock()
+	defer h.access.Unlock()
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+func (h *histogram) write(output *bytes.Buffer, name string, method string) {
+	h.access.Lock()
+	defer h.access.Unlock()
+	for i, bound := range h.buckets {
+		writeSample(output, name+"_bucket", labels("method", method, "le", formatFloat(bound)), float64(h.counts[i]))
+	}
+	writeSample(output, name+"_bucket", labels("method", method, "le", "+Inf"), float64(h.count))
+	writeSample(output, name+"_sum", labels("method", method), h.sum)
+	writeSample(output, name+"_count", labels("method", method), float64(h.count))
+}
+
+func writeHeader(output *bytes.Buffer, name string, metricType string, help string) {
+	output.WriteString("# HELP " + name + " " + help + "\n")
+	output.WriteString("# TYPE " + name + " " + metricType + "\n")
+}
+
+func writeSample(output *bytes.Buffer, name string, labels string, value float64) {
+	output.WriteString(name + labels + " " + formatFloat(value) + "\n")
+}
+
+func labels(pairs ...string) string {
+	var builder strings.Builder
+	builder.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			builder.WriteByte(',')
+		}
+		builder.WriteString(pairs[i])
+		builder.WriteString("=\"")
+		builder.WriteString(escapeLabel(pairs[i+1]))
+		builder.WriteByte('"')
+	}
+	builder.WriteByte('}')
+	return builder.String()
+}
+
+var labelEscaper = strings.NewReplacer("\\", `\\`, "\n", `\n`, "\"", `\"`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
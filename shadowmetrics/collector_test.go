@@ -0,0 +1,85 @@
+package shadowmetrics_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing-shadowsocks/shadowaead_2022"
+	"github.com/sagernet/sing-shadowsocks/shadowmetrics"
+	"github.com/sagernet/sing/common"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestCollector(t *testing.T) {
+	t.Parallel()
+	method := "2022-blake3-aes-128-gcm"
+	var psk [16]byte
+	rand.Reader.Read(psk[:])
+
+	var wg sync.WaitGroup
+	collector := shadowmetrics.NewCollector()
+	service, err := shadowaead_2022.NewService(method, psk[:], 500, &handler{t, &wg}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.(shadowsocks.MetricsService).SetMetrics(collector)
+
+	client, err := shadowaead_2022.New(method, [][]byte{psk[:]}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Add(1)
+
+	serverConn, clientConn := net.Pipe()
+	defer common.Close(serverConn, clientConn)
+	go service.NewConnection(context.Background(), serverConn, M.Metadata{})
+	_, err = client.DialConn(clientConn, M.ParseSocksaddr("test.com:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	collector.HandshakeRejected(method, shadowaead_2022.ErrSaltNotUnique)
+
+	var output bytes.Buffer
+	err = collector.WritePrometheus(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sample := range []string{
+		`shadowsocks_handshakes_total{method="2022-blake3-aes-128-gcm",result="accepted"} 1`,
+		`shadowsocks_handshakes_total{method="2022-blake3-aes-128-gcm",result="rejected",cause="salt_not_unique"} 1`,
+		`shadowsocks_tcp_connections{method="2022-blake3-aes-128-gcm"} 0`,
+		`shadowsocks_clock_skew_seconds_count{method="2022-blake3-aes-128-gcm"} 1`,
+	} {
+		if !strings.Contains(output.String(), sample) {
+			t.Error("missing sample: ", sample)
+		}
+	}
+}
+
+type handler struct {
+	t  *testing.T
+	wg *sync.WaitGroup
+}
+
+func (h *handler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	conn.Close()
+	h.wg.Done()
+	return nil
+}
+
+func (h *handler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	return nil
+}
+
+func (h *handler) NewError(ctx context.Context, err error) {
+	h.t.Error(ctx, err)
+}
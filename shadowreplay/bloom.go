@@ -0,0 +1,88 @@
+package shadowreplay
+
+import (
+	"hash/maphash"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/replay"
+)
+
+var _ replay.Filter = (*BloomFilter)(nil)
+
+// BloomFilter is a replay.Filter of fixed size. It keeps the salts of the current and the previous
+// interval in two Bloom filters, so a salt is remembered for at least interval.
+// A false positive rejects a fresh salt as a replay, at most at the rate given to NewBloom
+// as long as each interval sees no more than capacity salts.
+type BloomFilter struct {
+	access   sync.Mutex
+	seed     maphash.Seed
+	hashes   uint64
+	current  []uint64
+	previous []uint64
+	lastSwap time.Time
+	interval time.Duration
+}
+
+// NewBloom creates a BloomFilter sized for capacity salts per interval at the false positive rate fpRate.
+func NewBloom(interval time.Duration, capacity int, fpRate float64) *BloomFilter {
+	if capacity < 1 {
+		capacity = 1
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = 0.000001
+	}
+	bits := math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	words := (uint64(bits) + 63) / 64
+	hashes := uint64(math.Max(1, math.Round(bits/float64(capacity)*math.Ln2)))
+	return &BloomFilter{
+		seed:     maphash.MakeSeed(),
+		hashes:   hashes,
+		current:  make([]uint64, words),
+		previous: make([]uint64, words),
+		lastSwap: time.Now(),
+		interval: interval,
+	}
+}
+
+func (f *BloomFilter) Check(salt []byte) bool {
+	var hash maphash.Hash
+	hash.SetSeed(f.seed)
+	hash.Write(salt)
+	sum := hash.Sum64()
+	// Double hashing, the upper half of the sum steps through the bits chosen by the lower half.
+	h1, h2 := sum&math.MaxUint32, sum>>32|1
+	now := time.Now()
+
+	f.access.Lock()
+	defer f.access.Unlock()
+	if elapsed := now.Sub(f.lastSwap); elapsed >= f.interval {
+		f.previous, f.current = f.current, f.previous
+		if elapsed >= 2*f.interval {
+			clearBits(f.previous)
+		}
+		clearBits(f.current)
+		f.lastSwap = now
+	}
+	size := uint64(len(f.current)) * 64
+	inCurrent, inPrevious := true, true
+	for i := uint64(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % size
+		mask := uint64(1) << (bit % 64)
+		if f.current[bit/64]&mask == 0 {
+			inCurrent = false
+			f.current[bit/64] |= mask
+		}
+		if f.previous[bit/64]&mask == 0 {
+			inPrevious = false
+		}
+	}
+	return !inCurrent && !inPrevious
+}
+
+func clearBits(bits []uint64) {
+	for i := range bits {
+		bits[i] = 0
+	}
+}
@@ -0,0 +1,166 @@
+package shadowreplay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/replay"
+)
+
+var _ replay.Filter = (*FileFilter)(nil)
+
+// FileFilter is a replay.Filter that appends accepted salts to a file, so a restarted
+// server keeps rejecting the salts it saw within timeout before the restart.
+// The file is rewritten with the live salts once per timeout.
+type FileFilter struct {
+	access    sync.Mutex
+	path      string
+	file      *os.File
+	timeout   time.Duration
+	lastClean time.Time
+	pool      map[string]time.Time
+	err       error
+}
+
+// NewFile opens the filter stored at path, creating it if it does not exist.
+func NewFile(path string, timeout time.Duration) (*FileFilter, error) {
+	f := &FileFilter{
+		path:      path,
+		timeout:   timeout,
+		lastClean: time.Now(),
+		pool:      make(map[string]time.Time),
+	}
+	file, err := os.Open(path)
+	if err == nil {
+		err = f.load(file)
+		file.Close()
+		if err != nil {
+			return nil, E.Cause(err, "load replay filter")
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	err = f.rewrite()
+	if err != nil {
+		return nil, E.Cause(err, "write replay filter")
+	}
+	return f, nil
+}
+
+func (f *FileFilter) load(file *os.File) error {
+	reader := bufio.NewReader(file)
+	now := time.Now()
+	var header [9]byte
+	for {
+		_, err := io.ReadFull(reader, header[:])
+		if err != nil {
+			// A record cut short by a crash ends the file.
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return err
+		}
+		salt := make([]byte, header[8])
+		_, err = io.ReadFull(reader, salt)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return err
+		}
+		seen := time.Unix(0, int64(binary.BigEndian.Uint64(header[:8])))
+		if now.Sub(seen) <= f.timeout {
+			f.pool[string(salt)] = seen
+		}
+	}
+}
+
+// rewrite replaces the file with the salts in the pool and reopens it for appending.
+func (f *FileFilter) rewrite() error {
+	tempPath := f.path + ".tmp"
+	file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for salt, seen := range f.pool {
+		writer.Write(saltRecord([]byte(salt), seen))
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tempPath, f.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file = file
+	return nil
+}
+
+func (f *FileFilter) Check(salt []byte) bool {
+	now := time.Now()
+	saltStr := string(salt)
+	f.access.Lock()
+	defer f.access.Unlock()
+
+	if now.Sub(f.lastClean) > f.timeout {
+		for oldSum, added := range f.pool {
+			if now.Sub(added) > f.timeout {
+				delete(f.pool, oldSum)
+			}
+		}
+		f.lastClean = now
+		if f.file != nil {
+			f.setErr(f.rewrite())
+		}
+	}
+	if added, loaded := f.pool[saltStr]; loaded && now.Sub(added) <= f.timeout {
+		return false
+	}
+	f.pool[saltStr] = now
+	if f.file != nil {
+		_, err := f.file.Write(saltRecord(salt, now))
+		f.setErr(err)
+	}
+	return true
+}
+
+func (f *FileFilter) setErr(err error) {
+	if err != nil && f.err == nil {
+		f.err = err
+	}
+}
+
+// Close closes the file. It returns the first error met while persisting salts, the filter keeps
+// working in memory after such errors.
+func (f *FileFilter) Close() error {
+	f.access.Lock()
+	defer f.access.Unlock()
+	if f.file != nil {
+		f.setErr(f.file.Close())
+		f.file = nil
+	}
+	return f.err
+}
+
+// saltRecord encodes an accepted salt with the unix nanoseconds it was seen at.
+func saltRecord(salt []byte, seen time.Time) []byte {
+	record := make([]byte, 9+len(salt))
+	binary.BigEndian.PutUint64(record, uint64(seen.UnixNano()))
+	record[8] = byte(len(salt))
+	copy(record[9:], salt)
+	return record
+}
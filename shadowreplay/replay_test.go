@@ -0,0 +1,129 @@
+package shadowreplay_test
+
+import (
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks/shadowreplay"
+	"github.com/sagernet/sing/common/replay"
+)
+
+func TestBloomFilter(t *testing.T) {
+	t.Parallel()
+	filter := shadowreplay.NewBloom(200*time.Millisecond, 1000, 0.000001)
+	salts := randomSalts(1000)
+	for _, salt := range salts {
+		if !filter.Check(salt) {
+			t.Fatal("fresh salt rejected")
+		}
+	}
+	for _, salt := range salts {
+		if filter.Check(salt) {
+			t.Fatal("replayed salt accepted")
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	if filter.Check(salts[0]) {
+		t.Fatal("salt of the previous interval accepted")
+	}
+	time.Sleep(400 * time.Millisecond)
+	if !filter.Check(salts[1]) {
+		t.Fatal("expired salt rejected")
+	}
+}
+
+func TestFileFilter(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "replay")
+	filter, err := shadowreplay.NewFile(path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salts := randomSalts(10)
+	for _, salt := range salts {
+		if !filter.Check(salt) {
+			t.Fatal("fresh salt rejected")
+		}
+	}
+	if filter.Check(salts[0]) {
+		t.Fatal("replayed salt accepted")
+	}
+	err = filter.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A record cut short by a crash is ignored.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{1, 2, 3})
+	file.Close()
+
+	filter, err = shadowreplay.NewFile(path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filter.Close()
+	for _, salt := range salts {
+		if filter.Check(salt) {
+			t.Fatal("salt accepted after restart")
+		}
+	}
+
+	expired, err := shadowreplay.NewFile(path, time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer expired.Close()
+	if !expired.Check(salts[0]) {
+		t.Fatal("expired salt rejected")
+	}
+}
+
+func TestShared(t *testing.T) {
+	t.Parallel()
+	var created int
+	newFilter := func() replay.Filter {
+		created++
+		return replay.NewSimple(time.Minute)
+	}
+	salts := randomSalts(2)
+	filter := shadowreplay.Shared(t.Name(), newFilter)
+	shared := shadowreplay.Shared(t.Name(), newFilter)
+	if !filter.Check(salts[0]) {
+		t.Fatal("fresh salt rejected")
+	}
+	if shared.Check(salts[0]) {
+		t.Fatal("filter not shared")
+	}
+	other := shadowreplay.Shared(t.Name()+"other", newFilter)
+	defer other.(io.Closer).Close()
+	if !other.Check(salts[0]) {
+		t.Fatal("filter shared under another name")
+	}
+	filter.(io.Closer).Close()
+	filter.(io.Closer).Close()
+	if shared.Check(salts[0]) {
+		t.Fatal("filter released while referenced")
+	}
+	shared.(io.Closer).Close()
+	filter = shadowreplay.Shared(t.Name(), newFilter)
+	defer filter.(io.Closer).Close()
+	if !filter.Check(salts[0]) || created != 3 {
+		t.Fatal("filter kept after the last reference closed")
+	}
+}
+
+func randomSalts(count int) [][]byte {
+	salts := make([][]byte, count)
+	for i := range salts {
+		salts[i] = make([]byte, 32)
+		rand.Read(salts[i])
+	}
+	return salts
+}
@@ -0,0 +1,62 @@
+package shadowreplay
+
+import (
+	"io"
+	"sync"
+
+	"github.com/sagernet/sing/common/replay"
+)
+
+var (
+	sharedAccess  sync.Mutex
+	sharedFilters = make(map[string]*sharedEntry)
+)
+
+type sharedEntry struct {
+	filter     replay.Filter
+	references int
+}
+
+// Shared returns a reference to the filter registered under name, creating it with newFilter on
+// first use. Services configured with the same name share their salts, so a request replayed to
+// another port of the same server is rejected too. All filters of this package are safe to share.
+// Closing the last reference closes the filter if it implements io.Closer and unregisters it.
+func Shared(name string, newFilter func() replay.Filter) replay.Filter {
+	sharedAccess.Lock()
+	defer sharedAccess.Unlock()
+	entry, loaded := sharedFilters[name]
+	if !loaded {
+		entry = &sharedEntry{filter: newFilter()}
+		sharedFilters[name] = entry
+	}
+	entry.references++
+	return &sharedFilter{name: name, entry: entry}
+}
+
+type sharedFilter struct {
+	name   string
+	entry  *sharedEntry
+	closed bool
+}
+
+func (f *sharedFilter) Check(salt []byte) bool {
+	return f.entry.filter.Check(salt)
+}
+
+func (f *sharedFilter) Close() error {
+	sharedAccess.Lock()
+	defer sharedAccess.Unlock()
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	f.entry.references--
+	if f.entry.references > 0 {
+		return nil
+	}
+	delete(sharedFilters, f.name)
+	if closer, isCloser := f.entry.filter.(io.Closer); isCloser {
+		return closer.Close()
+	}
+	return nil
+}
@@ -15,6 +15,8 @@ var (
 	ErrBadKey          = E.New("bad key")
 	ErrMissingPassword = E.New("missing password")
 	ErrNoUsers         = E.New("no users")
+	// ErrDuplicateUserKey is returned by UpdateUsersWithKeys for a key listed more than once.
+	ErrDuplicateUserKey = E.New("user key used more than once")
 )
 
 type Method interface {
@@ -38,11 +38,13 @@ type Method struct {
 	encryptConstructor func(key []byte, salt []byte) (cipher.Stream, error)
 	decryptConstructor func(key []byte, salt []byte) (cipher.Stream, error)
 	key                []byte
+	random             io.Reader
 }
 
 func New(method string, key []byte, password string) (shadowsocks.Method, error) {
 	m := &Method{
-		name: method,
+		name:   method,
+		random: rand.Reader,
 	}
 	switch method {
 	case "aes-128-ctr":
@@ -137,6 +139,14 @@ func (m *Method) Name() string {
 	return m.name
 }
 
+// SetRandom replaces the entropy source of salts. A nil random restores crypto/rand.
+func (m *Method) SetRandom(random io.Reader) {
+	if random == nil {
+		random = rand.Reader
+	}
+	m.random = random
+}
+
 func (m *Method) DialConn(conn net.Conn, destination M.Socksaddr) (net.Conn, error) {
 	shadowsocksConn := &clientConn{
 		Method:      m,
@@ -155,7 +165,7 @@ func (m *Method) DialEarlyConn(conn net.Conn, destination M.Socksaddr) net.Conn
 }
 
 func (m *Method) DialPacketConn(conn net.Conn) N.NetPacketConn {
-	return &clientPacketConn{m, conn}
+	return &clientPacketConn{Method: m, Conn: conn}
 }
 
 type clientConn struct {
@@ -164,6 +174,7 @@ type clientConn struct {
 	destination M.Socksaddr
 	readStream  cipher.Stream
 	writeStream cipher.Stream
+	newBuffer   func() *buf.Buffer
 }
 
 func (c *clientConn) writeRequest() error {
@@ -171,7 +182,7 @@ func (c *clientConn) writeRequest() error {
 	defer buffer.Release()
 
 	salt := buffer.Extend(c.saltLength)
-	common.Must1(io.ReadFull(rand.Reader, salt))
+	common.Must1(io.ReadFull(c.random, salt))
 
 	stream, err := c.encryptConstructor(c.key, salt)
 	if err != nil {
@@ -199,9 +210,9 @@ func (c *clientConn) readResponse() error {
 		return nil
 	}
 	salt := make([]byte, c.saltLength)
-	_, err := io.ReadFull(c.Conn, salt)
+	n, err := io.ReadFull(c.Conn, salt)
 	if err != nil {
-		return err
+		return shadowsocks.NewHandshakeError(shadowsocks.ReasonReadFailed, n, err)
 	}
 	c.readStream, err = c.decryptConstructor(c.key, salt)
 	return err
@@ -230,8 +241,50 @@ func (c *clientConn) Write(p []byte) (n int, err error) {
 		}
 	}
 
-	c.writeStream.XORKeyStream(p, p)
-	return c.Conn.Write(p)
+	buffer := buf.NewSize(len(p))
+	defer buffer.Release()
+	c.writeStream.XORKeyStream(buffer.Extend(len(p)), p)
+	return c.Conn.Write(buffer.Bytes())
+}
+
+var (
+	_ N.ExtendedConn = (*clientConn)(nil)
+	_ N.ReadWaiter   = (*clientConn)(nil)
+)
+
+func (c *clientConn) ReadBuffer(buffer *buf.Buffer) error {
+	n, err := c.Read(buffer.FreeBytes())
+	if err != nil {
+		return err
+	}
+	buffer.Extend(n)
+	return nil
+}
+
+// WriteBuffer encrypts buffer in place.
+func (c *clientConn) WriteBuffer(buffer *buf.Buffer) error {
+	defer buffer.Release()
+	if c.writeStream == nil {
+		err := c.writeRequest()
+		if err != nil {
+			return err
+		}
+	}
+	c.writeStream.XORKeyStream(buffer.Bytes(), buffer.Bytes())
+	return common.Error(c.Conn.Write(buffer.Bytes()))
+}
+
+func (c *clientConn) InitializeReadWaiter(newBuffer func() *buf.Buffer) {
+	c.newBuffer = newBuffer
+}
+
+func (c *clientConn) WaitReadBuffer() error {
+	buffer := c.newBuffer()
+	err := c.ReadBuffer(buffer)
+	if err != nil {
+		buffer.Release()
+	}
+	return err
 }
 
 func (c *clientConn) NeedAdditionalReadDeadline() bool {
@@ -245,12 +298,13 @@ func (c *clientConn) Upstream() any {
 type clientPacketConn struct {
 	*Method
 	net.Conn
+	newBuffer func() *buf.Buffer
 }
 
 func (c *clientPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
 	defer buffer.Release()
 	header := buf.With(buffer.ExtendHeader(c.saltLength + M.SocksaddrSerializer.AddrPortLen(destination)))
-	common.Must1(header.ReadFullFrom(rand.Reader, c.saltLength))
+	common.Must1(header.ReadFullFrom(c.random, c.saltLength))
 	err := M.SocksaddrSerializer.WriteAddrPort(header, destination)
 	if err != nil {
 		return err
@@ -269,13 +323,35 @@ func (c *clientPacketConn) ReadPacket(buffer *buf.Buffer) (M.Socksaddr, error) {
 		return M.Socksaddr{}, err
 	}
 	buffer.Truncate(n)
+	if n < c.saltLength {
+		return M.Socksaddr{}, shadowsocks.NewHandshakeError(shadowsocks.ReasonBadHeader, n, io.ErrShortBuffer)
+	}
 	stream, err := c.decryptConstructor(c.key, buffer.To(c.saltLength))
 	if err != nil {
 		return M.Socksaddr{}, err
 	}
 	stream.XORKeyStream(buffer.From(c.saltLength), buffer.From(c.saltLength))
 	buffer.Advance(c.saltLength)
-	return M.SocksaddrSerializer.ReadAddrPort(buffer)
+	destination, err := M.SocksaddrSerializer.ReadAddrPort(buffer)
+	if err != nil {
+		return M.Socksaddr{}, shadowsocks.NewHandshakeError(shadowsocks.ReasonBadAddress, n, err)
+	}
+	return destination, nil
+}
+
+var _ N.PacketReadWaiter = (*clientPacketConn)(nil)
+
+func (c *clientPacketConn) InitializeReadWaiter(newBuffer func() *buf.Buffer) {
+	c.newBuffer = newBuffer
+}
+
+func (c *clientPacketConn) WaitReadPacket() (destination M.Socksaddr, err error) {
+	buffer := c.newBuffer()
+	destination, err = c.ReadPacket(buffer)
+	if err != nil {
+		buffer.Release()
+	}
+	return
 }
 
 func (c *clientPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
@@ -283,6 +359,10 @@ func (c *clientPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error)
 	if err != nil {
 		return
 	}
+	if n < c.saltLength {
+		err = shadowsocks.NewHandshakeError(shadowsocks.ReasonBadHeader, n, io.ErrShortBuffer)
+		return
+	}
 	stream, err := c.decryptConstructor(c.key, p[:c.saltLength])
 	if err != nil {
 		return
@@ -291,6 +371,7 @@ func (c *clientPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error)
 	stream.XORKeyStream(buffer.Bytes(), buffer.Bytes())
 	destination, err := M.SocksaddrSerializer.ReadAddrPort(buffer)
 	if err != nil {
+		err = shadowsocks.NewHandshakeError(shadowsocks.ReasonBadAddress, n, err)
 		return
 	}
 	if destination.IsFqdn() {
@@ -306,7 +387,7 @@ func (c *clientPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	destination := M.SocksaddrFromNet(addr)
 	buffer := buf.NewSize(c.saltLength + M.SocksaddrSerializer.AddrPortLen(destination) + len(p))
 	defer buffer.Release()
-	common.Must1(buffer.ReadFullFrom(rand.Reader, c.saltLength))
+	common.Must1(buffer.ReadFullFrom(c.random, c.saltLength))
 	err = M.SocksaddrSerializer.WriteAddrPort(buffer, M.SocksaddrFromNet(addr))
 	if err != nil {
 		return
@@ -0,0 +1,102 @@
+package shadowstream_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing-shadowsocks/shadowstream"
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+func FuzzClientConn(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, methodIndex uint8, data []byte) {
+		method := newMethod(t, methodIndex)
+		conn := method.DialEarlyConn(&bufferConn{reader: bytes.NewReader(data)}, M.ParseSocksaddr("test.com:443"))
+		io.Copy(io.Discard, conn)
+	})
+}
+
+func FuzzClientPacketConn(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, methodIndex uint8, data []byte) {
+		method := newMethod(t, methodIndex)
+		packetConn := method.DialPacketConn(&bufferConn{reader: bytes.NewReader(data)})
+		buffer := buf.NewPacket()
+		packetConn.ReadPacket(buffer)
+		buffer.Release()
+
+		packetConn = method.DialPacketConn(&bufferConn{reader: bytes.NewReader(data)})
+		packetConn.ReadFrom(make([]byte, 65535))
+	})
+}
+
+func addSeeds(f *testing.F) {
+	for i, name := range shadowstream.List {
+		method, err := shadowstream.New(name, nil, "password")
+		if err != nil {
+			f.Fatal(err)
+		}
+		for _, destination := range []string{"test.com:443", "1.1.1.1:53", "[::1]:80"} {
+			conn := &bufferConn{}
+			_, err = method.DialPacketConn(conn).WriteTo([]byte("hello"), M.ParseSocksaddr(destination))
+			if err != nil {
+				f.Fatal(err)
+			}
+			f.Add(uint8(i), conn.writer.Bytes())
+		}
+	}
+}
+
+func newMethod(t *testing.T, methodIndex uint8) shadowsocks.Method {
+	method, err := shadowstream.New(shadowstream.List[int(methodIndex)%len(shadowstream.List)], nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return method
+}
+
+type bufferConn struct {
+	reader io.Reader
+	writer bytes.Buffer
+}
+
+func (c *bufferConn) Read(p []byte) (n int, err error) {
+	if c.reader == nil {
+		return 0, io.EOF
+	}
+	return c.reader.Read(p)
+}
+
+func (c *bufferConn) Write(p []byte) (n int, err error) {
+	return c.writer.Write(p)
+}
+
+func (c *bufferConn) Close() error {
+	return nil
+}
+
+func (c *bufferConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *bufferConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *bufferConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *bufferConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *bufferConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
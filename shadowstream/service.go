@@ -0,0 +1,345 @@
+package shadowstream
+
+import (
+	"context"
+	"crypto/cipher"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+var _ shadowsocks.Service = (*Service)(nil)
+
+type Service struct {
+	*Method
+	*shadowsocks.UDPServer[netip.AddrPort]
+	password   string
+	handler    shadowsocks.Handler
+	udpHandler *shadowsocks.MetricsUDPHandler
+	udpNat     *shadowsocks.UDPNAT[netip.AddrPort]
+	metrics    shadowsocks.Metrics
+	handshake  shadowsocks.HandshakeLimiter
+	lifecycle  shadowsocks.Lifecycle
+	registry   shadowsocks.SessionRegistry
+	acl        *shadowsocks.ACL
+}
+
+func NewService(method string, key []byte, password string, udpTimeout int64, handler shadowsocks.Handler) (*Service, error) {
+	m, err := New(method, key, password)
+	if err != nil {
+		return nil, err
+	}
+	s := &Service{
+		Method:     m.(*Method),
+		password:   password,
+		handler:    handler,
+		udpHandler: shadowsocks.NewMetricsUDPHandler(method, handler),
+	}
+	s.udpNat = shadowsocks.NewUDPNAT[netip.AddrPort](udpTimeout, s.udpHandler, shadowsocks.HashAddrPort)
+	s.udpNat.SetSessionRegistry(&s.registry)
+	s.UDPServer = shadowsocks.NewUDPServer[netip.AddrPort](method, handler, s.udpNat, &s.lifecycle, &s.metrics)
+	return s, nil
+}
+
+func (s *Service) SetHandshakeTimeout(timeout time.Duration) {
+	s.handshake.SetHandshakeTimeout(timeout)
+}
+
+func (s *Service) SetHandshakeLimit(limit int, queueTimeout time.Duration) {
+	s.handshake.SetHandshakeLimit(limit, queueTimeout)
+}
+
+func (s *Service) SetACL(acl *shadowsocks.ACL) {
+	s.acl = acl
+}
+
+func (s *Service) SetMetrics(metrics shadowsocks.Metrics) {
+	s.metrics = metrics
+	s.udpHandler.Metrics = metrics
+}
+
+func (s *Service) Name() string {
+	return s.name
+}
+
+func (s *Service) Password() string {
+	return s.password
+}
+
+func (s *Service) Sessions() []shadowsocks.SessionInfo {
+	return s.registry.Sessions()
+}
+
+func (s *Service) UserSessions(user any) []shadowsocks.SessionInfo {
+	return s.registry.UserSessions(user)
+}
+
+func (s *Service) CloseSession(id uint64) bool {
+	return s.registry.CloseSession(id)
+}
+
+func (s *Service) CloseUserSessions(user any) int {
+	return s.registry.CloseUserSessions(user)
+}
+
+func (s *Service) Close() error {
+	s.lifecycle.Close()
+	s.udpNat.Close()
+	return nil
+}
+
+func (s *Service) Shutdown(ctx context.Context) (shadowsocks.ShutdownStats, error) {
+	stats, err := s.lifecycle.Shutdown(ctx)
+	stats.Sessions = s.udpNat.Close()
+	return stats, err
+}
+
+func (s *Service) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	element, err := s.lifecycle.Acquire(conn)
+	if err != nil {
+		return &shadowsocks.ServerConnError{Conn: conn, Source: metadata.Source, Cause: err}
+	}
+	defer s.lifecycle.Release(element)
+	protocolConn, err := s.newConnection(ctx, conn, &metadata)
+	if err != nil {
+		if s.metrics != nil {
+			s.metrics.HandshakeRejected(s.name, err)
+		}
+	} else {
+		session := s.registry.Register(N.NetworkTCP, nil, metadata, conn)
+		defer session.Unregister()
+		if s.metrics != nil {
+			s.metrics.HandshakeAccepted(s.name)
+			protocolConn = shadowsocks.NewMetricsConn(protocolConn, s.name, s.metrics)
+		}
+		err = s.handler.NewConnection(ctx, session.Conn(protocolConn), metadata)
+	}
+	if err != nil {
+		err = &shadowsocks.ServerConnError{Conn: conn, Source: metadata.Source, Cause: err}
+	}
+	return err
+}
+
+func (s *Service) newConnection(ctx context.Context, conn net.Conn, metadata *M.Metadata) (net.Conn, error) {
+	err := s.handshake.Start(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	defer s.handshake.Finish(conn)
+	handshakeReader := &shadowsocks.HandshakeReader{Reader: conn}
+	salt := make([]byte, s.saltLength)
+	_, err = io.ReadFull(handshakeReader, salt)
+	if err != nil {
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReadReason(err, shadowsocks.ReasonReadFailed), handshakeReader.Consumed, E.Cause(err, "read salt"))
+	}
+	readStream, err := s.decryptConstructor(s.key, salt)
+	if err != nil {
+		return nil, err
+	}
+	reader := cipher.StreamReader{S: readStream, R: handshakeReader}
+	destination, err := M.SocksaddrSerializer.ReadAddrPort(reader)
+	if err != nil {
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReadReason(err, shadowsocks.ReasonBadAddress), handshakeReader.Consumed, err)
+	}
+	if !s.acl.Allow(N.NetworkTCP, nil, destination) {
+		return nil, shadowsocks.NewHandshakeError(shadowsocks.ReasonDenied, handshakeReader.Consumed, E.Extend(shadowsocks.ErrDestinationDenied, destination))
+	}
+
+	metadata.Protocol = "shadowsocks"
+	metadata.Destination = destination
+
+	return &serverConn{
+		Method:     s.Method,
+		Conn:       conn,
+		readStream: readStream,
+	}, nil
+}
+
+func (s *Service) NewError(ctx context.Context, err error) {
+	s.handler.NewError(ctx, err)
+}
+
+type serverConn struct {
+	*Method
+	net.Conn
+	access      sync.Mutex
+	readStream  cipher.Stream
+	writeStream cipher.Stream
+	newBuffer   func() *buf.Buffer
+}
+
+func (c *serverConn) writeResponse(payload []byte) (n int, err error) {
+	buffer := buf.NewSize(c.saltLength + len(payload))
+	defer buffer.Release()
+	salt := buffer.Extend(c.saltLength)
+	common.Must1(io.ReadFull(c.random, salt))
+	writeStream, err := c.encryptConstructor(c.key, salt)
+	if err != nil {
+		return
+	}
+	writeStream.XORKeyStream(buffer.Extend(len(payload)), payload)
+	_, err = c.Conn.Write(buffer.Bytes())
+	if err != nil {
+		return
+	}
+	c.writeStream = writeStream
+	return len(payload), nil
+}
+
+func (c *serverConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	c.readStream.XORKeyStream(p[:n], p[:n])
+	return
+}
+
+func (c *serverConn) Write(p []byte) (n int, err error) {
+	if c.writeStream == nil {
+		c.access.Lock()
+		if c.writeStream == nil {
+			defer c.access.Unlock()
+			return c.writeResponse(p)
+		}
+		c.access.Unlock()
+	}
+	buffer := buf.NewSize(len(p))
+	defer buffer.Release()
+	c.writeStream.XORKeyStream(buffer.Extend(len(p)), p)
+	return c.Conn.Write(buffer.Bytes())
+}
+
+var (
+	_ N.ExtendedConn = (*serverConn)(nil)
+	_ N.ReadWaiter   = (*serverConn)(nil)
+)
+
+func (c *serverConn) ReadBuffer(buffer *buf.Buffer) error {
+	n, err := c.Read(buffer.FreeBytes())
+	if err != nil {
+		return err
+	}
+	buffer.Extend(n)
+	return nil
+}
+
+// WriteBuffer encrypts buffer in place.
+func (c *serverConn) WriteBuffer(buffer *buf.Buffer) error {
+	defer buffer.Release()
+	if c.writeStream == nil {
+		c.access.Lock()
+		if c.writeStream == nil {
+			defer c.access.Unlock()
+			return common.Error(c.writeResponse(buffer.Bytes()))
+		}
+		c.access.Unlock()
+	}
+	c.writeStream.XORKeyStream(buffer.Bytes(), buffer.Bytes())
+	return common.Error(c.Conn.Write(buffer.Bytes()))
+}
+
+func (c *serverConn) InitializeReadWaiter(newBuffer func() *buf.Buffer) {
+	c.newBuffer = newBuffer
+}
+
+func (c *serverConn) WaitReadBuffer() error {
+	buffer := c.newBuffer()
+	err := c.ReadBuffer(buffer)
+	if err != nil {
+		buffer.Release()
+	}
+	return err
+}
+
+func (c *serverConn) NeedAdditionalReadDeadline() bool {
+	return true
+}
+
+func (c *serverConn) Upstream() any {
+	return c.Conn
+}
+
+func (s *Service) WriteIsThreadUnsafe() {
+}
+
+func (s *Service) NewPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
+	return s.ServePacket(metadata, func() error {
+		return s.newPacket(ctx, conn, buffer, metadata)
+	})
+}
+
+func (s *Service) newPacket(ctx context.Context, conn N.PacketConn, buffer *buf.Buffer, metadata M.Metadata) error {
+	packetLen := buffer.Len()
+	if packetLen < s.saltLength {
+		return shadowsocks.NewHandshakeError(shadowsocks.ReasonBadHeader, packetLen, io.ErrShortBuffer)
+	}
+	readStream, err := s.decryptConstructor(s.key, buffer.To(s.saltLength))
+	if err != nil {
+		return err
+	}
+	readStream.XORKeyStream(buffer.From(s.saltLength), buffer.From(s.saltLength))
+	buffer.Advance(s.saltLength)
+
+	destination, err := M.SocksaddrSerializer.ReadAddrPort(buffer)
+	if err != nil {
+		return shadowsocks.NewHandshakeError(shadowsocks.ReasonBadAddress, packetLen, err)
+	}
+	if !s.acl.Allow(N.NetworkUDP, nil, destination) {
+		return shadowsocks.NewHandshakeError(shadowsocks.ReasonDenied, packetLen, E.Extend(shadowsocks.ErrDestinationDenied, destination))
+	}
+
+	metadata.Protocol = "shadowsocks"
+	metadata.Destination = destination
+	if s.metrics != nil {
+		s.metrics.ReadBytes(s.name, int64(buffer.Len()))
+	}
+	s.udpNat.NewPacket(ctx, metadata.Source.AddrPort(), buffer, metadata, func(natConn N.PacketConn) N.PacketWriter {
+		return &serverPacketWriter{s.Method, conn, natConn, s.metrics}
+	})
+	return nil
+}
+
+type serverPacketWriter struct {
+	*Method
+	source  N.PacketConn
+	nat     N.PacketConn
+	metrics shadowsocks.Metrics
+}
+
+func (w *serverPacketWriter) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	if w.metrics != nil {
+		w.metrics.WriteBytes(w.name, int64(buffer.Len()))
+	}
+	header := buf.With(buffer.ExtendHeader(w.saltLength + M.SocksaddrSerializer.AddrPortLen(destination)))
+	common.Must1(header.ReadFullFrom(w.random, w.saltLength))
+	err := M.SocksaddrSerializer.WriteAddrPort(header, destination)
+	if err != nil {
+		buffer.Release()
+		return err
+	}
+	writeStream, err := w.encryptConstructor(w.key, buffer.To(w.saltLength))
+	if err != nil {
+		buffer.Release()
+		return err
+	}
+	writeStream.XORKeyStream(buffer.From(w.saltLength), buffer.From(w.saltLength))
+	return w.source.WritePacket(buffer, M.SocksaddrFromNet(w.nat.LocalAddr()))
+}
+
+func (w *serverPacketWriter) FrontHeadroom() int {
+	return w.saltLength + M.MaxSocksaddrLength
+}
+
+func (w *serverPacketWriter) Upstream() any {
+	return w.source
+}
+
+func (w *serverPacketWriter) WriteIsThreadUnsafe() {
+}
@@ -0,0 +1,156 @@
+package shadowstream_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/sagernet/sing-shadowsocks/internal/vectortest"
+	"github.com/sagernet/sing-shadowsocks/shadowstream"
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+const benchmarkPassword = "password"
+
+func BenchmarkServiceNewConnection(b *testing.B) {
+	for _, method := range shadowstream.List {
+		b.Run(method, func(b *testing.B) {
+			service, err := shadowstream.NewService(method, nil, benchmarkPassword, 60, &benchmarkHandler{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			client, err := shadowstream.New(method, nil, benchmarkPassword)
+			if err != nil {
+				b.Fatal(err)
+			}
+			conn := &bufferConn{}
+			_, err = client.DialEarlyConn(conn, M.ParseSocksaddr("test.com:443")).Write([]byte("hello"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			request := conn.writer.Bytes()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err = service.NewConnection(context.Background(), &bufferConn{reader: bytes.NewReader(request)}, M.Metadata{})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkServiceNewPacket(b *testing.B) {
+	for _, method := range shadowstream.List {
+		b.Run(method, func(b *testing.B) {
+			service, err := shadowstream.NewService(method, nil, benchmarkPassword, 60, &discardHandler{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			packet := clientPacket(b, method)
+			b.SetBytes(int64(len(packet)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				buffer := buf.NewPacket()
+				buffer.Write(packet)
+				err = service.NewPacket(ctx, nil, buffer, M.Metadata{})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkServiceWritePacket(b *testing.B) {
+	for _, method := range shadowstream.List {
+		b.Run(method, func(b *testing.B) {
+			handler := &benchmarkHandler{conns: make(chan N.PacketConn, 1)}
+			service, err := shadowstream.NewService(method, nil, benchmarkPassword, 60, handler)
+			if err != nil {
+				b.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			err = service.NewPacket(ctx, &vectortest.BufferPacketConn{}, buf.As(clientPacket(b, method)), M.Metadata{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			conn := <-handler.conns
+			destination := M.ParseSocksaddr("test.com:443")
+			payload := make([]byte, 1024)
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				buffer := buf.NewPacket()
+				buffer.Resize(256, 0)
+				buffer.Write(payload)
+				err = conn.WritePacket(buffer, destination)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func clientPacket(t testing.TB, method string) []byte {
+	client, err := shadowstream.New(method, nil, benchmarkPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &bufferConn{}
+	_, err = client.DialPacketConn(conn).WriteTo(make([]byte, 1024), M.ParseSocksaddr("test.com:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn.writer.Bytes()
+}
+
+type discardHandler struct{}
+
+func (h *discardHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	_, err := io.Copy(io.Discard, conn)
+	return err
+}
+
+func (h *discardHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	for {
+		buffer := buf.NewPacket()
+		_, err := conn.ReadPacket(buffer)
+		buffer.Release()
+		if errors.Is(err, io.ErrClosedPipe) {
+			return nil
+		}
+	}
+}
+
+func (h *discardHandler) NewError(ctx context.Context, err error) {
+}
+
+// benchmarkHandler returns as soon as the handshake is done, and hands out the first packet connection
+// holding it until the context is done.
+type benchmarkHandler struct {
+	discardHandler
+	conns chan N.PacketConn
+}
+
+func (h *benchmarkHandler) NewConnection(ctx context.Context, conn net.Conn, metadata M.Metadata) error {
+	return nil
+}
+
+func (h *benchmarkHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	h.conns <- conn
+	<-ctx.Done()
+	return nil
+}
@@ -0,0 +1,204 @@
+package shadowstream_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rc4"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sagernet/sing-shadowsocks/internal/vectortest"
+	"github.com/sagernet/sing-shadowsocks/shadowstream"
+	"github.com/sagernet/sing/common"
+	M "github.com/sagernet/sing/common/metadata"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+var vectorDestination = M.ParseSocksaddr("example.com:443")
+
+type vector struct {
+	Method   string `json:"method"`
+	Password string `json:"password"`
+
+	TCPClientRandom string `json:"tcp_client_random"`
+	TCPServerRandom string `json:"tcp_server_random"`
+	TCPRequest      string `json:"tcp_request"`
+	TCPResponse     string `json:"tcp_response"`
+
+	UDPClientRandom string `json:"udp_client_random"`
+	UDPServerRandom string `json:"udp_server_random"`
+	UDPRequest      string `json:"udp_request"`
+	UDPResponse     string `json:"udp_response"`
+}
+
+func TestVectors(t *testing.T) {
+	vectors := loadVectors(t)
+	if len(vectors) != len(shadowstream.List) {
+		t.Fatal("missing vectors")
+	}
+	for _, v := range vectors {
+		t.Run(v.Method, func(t *testing.T) {
+			testTCPVector(t, v)
+			testUDPVector(t, v)
+		})
+	}
+}
+
+// TestVectorsSpec decodes the vectors with the bare primitives of the stream ciphers as specified,
+// key = EVP_BytesToKey(password) and each direction being the IV followed by the encrypted stream.
+func TestVectorsSpec(t *testing.T) {
+	for _, v := range loadVectors(t) {
+		t.Run(v.Method, func(t *testing.T) {
+			c := newSpecCipher(t, v)
+			decode := func(name string, content string, expected []byte) {
+				data := vectortest.DecodeHex(t, content)
+				payload := data[c.ivLength:]
+				c.newStream(data[:c.ivLength], true).XORKeyStream(payload, payload)
+				if !bytes.Equal(payload, expected) {
+					t.Fatalf("%s: decoded %x", name, payload)
+				}
+			}
+			decode("tcp request", v.TCPRequest, append(vectorAddress(), vectortest.Request...))
+			decode("tcp response", v.TCPResponse, vectortest.Response)
+			decode("udp request", v.UDPRequest, append(vectorAddress(), vectortest.Request...))
+			decode("udp response", v.UDPResponse, append(vectorAddress(), vectortest.Response...))
+		})
+	}
+}
+
+// testTCPVector encodes the request with this package and the response with the bare primitives,
+// standing in for the server.
+func testTCPVector(t *testing.T, v *vector) {
+	client := newClient(t, v)
+	client.SetRandom(vectortest.HexReader(t, v.TCPClientRandom))
+	clientConn := &bufferConn{}
+	conn := client.DialEarlyConn(clientConn, vectorDestination)
+	_, err := conn.Write(append([]byte(nil), vectortest.Request...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectortest.Check(t, "tcp request", v.TCPRequest, clientConn.writer.Bytes())
+	vectortest.Check(t, "tcp response", v.TCPResponse, newSpecCipher(t, v).encode(vectortest.DecodeHex(t, v.TCPServerRandom), vectortest.Response))
+
+	clientConn.reader = bytes.NewReader(vectortest.DecodeHex(t, v.TCPResponse))
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response, vectortest.Response) {
+		t.Fatalf("tcp response: decoded %q", response)
+	}
+}
+
+func testUDPVector(t *testing.T, v *vector) {
+	client := newClient(t, v)
+	client.SetRandom(vectortest.HexReader(t, v.UDPClientRandom))
+	clientConn := &bufferConn{}
+	packetConn := client.DialPacketConn(clientConn)
+	_, err := packetConn.WriteTo(vectortest.Request, vectorDestination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectortest.Check(t, "udp request", v.UDPRequest, clientConn.writer.Bytes())
+	vectortest.Check(t, "udp response", v.UDPResponse, newSpecCipher(t, v).encode(vectortest.DecodeHex(t, v.UDPServerRandom), append(vectorAddress(), vectortest.Response...)))
+
+	clientConn.reader = bytes.NewReader(vectortest.DecodeHex(t, v.UDPResponse))
+	response := make([]byte, 1024)
+	n, addr, err := packetConn.ReadFrom(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if M.SocksaddrFromNet(addr) != vectorDestination || !bytes.Equal(response[:n], vectortest.Response) {
+		t.Fatalf("udp response: decoded %q from %s", response[:n], addr)
+	}
+}
+
+func newClient(t *testing.T, v *vector) *shadowstream.Method {
+	client, err := shadowstream.New(v.Method, nil, v.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.(*shadowstream.Method)
+}
+
+func loadVectors(t *testing.T) []*vector {
+	content, err := os.ReadFile("testdata/vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []*vector
+	err = json.Unmarshal(content, &vectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vectors
+}
+
+// vectorAddress is vectorDestination as ATYP domain name, length, name, port.
+func vectorAddress() []byte {
+	address := append([]byte{3, 11}, "example.com"...)
+	return append(address, 0x01, 0xbb)
+}
+
+// specCipher is a stream cipher built from bare primitives rather than this package.
+type specCipher struct {
+	key       []byte
+	ivLength  int
+	newStream func(iv []byte, decrypt bool) cipher.Stream
+}
+
+func newSpecCipher(t *testing.T, v *vector) *specCipher {
+	c := &specCipher{}
+	var keyLength int
+	switch v.Method {
+	case "aes-128-ctr", "aes-192-ctr", "aes-256-ctr", "aes-128-cfb", "aes-192-cfb", "aes-256-cfb":
+		keyLength = map[string]int{"128": 16, "192": 24, "256": 32}[v.Method[4:7]]
+		c.ivLength = aes.BlockSize
+		c.newStream = func(iv []byte, decrypt bool) cipher.Stream {
+			block := common.Must1(aes.NewCipher(c.key))
+			if strings.HasSuffix(v.Method, "ctr") {
+				return cipher.NewCTR(block, iv)
+			} else if decrypt {
+				return cipher.NewCFBDecrypter(block, iv)
+			}
+			return cipher.NewCFBEncrypter(block, iv)
+		}
+	case "rc4-md5":
+		keyLength, c.ivLength = 16, 16
+		c.newStream = func(iv []byte, decrypt bool) cipher.Stream {
+			rc4Key := md5.Sum(append(append([]byte(nil), c.key...), iv...))
+			return common.Must1(rc4.NewCipher(rc4Key[:]))
+		}
+	case "chacha20-ietf", "xchacha20":
+		keyLength, c.ivLength = chacha20.KeySize, chacha20.NonceSize
+		if v.Method == "xchacha20" {
+			c.ivLength = chacha20.NonceSizeX
+		}
+		c.newStream = func(iv []byte, decrypt bool) cipher.Stream {
+			return common.Must1(chacha20.NewUnauthenticatedCipher(c.key, iv))
+		}
+	default:
+		t.Fatal("unknown method")
+	}
+	var digest []byte
+	for len(c.key) < keyLength {
+		hash := md5.Sum(append(digest, v.Password...))
+		digest = hash[:]
+		c.key = append(c.key, digest...)
+	}
+	c.key = c.key[:keyLength]
+	return c
+}
+
+// encode encrypts payload under the IV read from the start of random.
+func (c *specCipher) encode(random []byte, payload []byte) []byte {
+	data := append(append([]byte(nil), random[:c.ivLength]...), payload...)
+	c.newStream(data[:c.ivLength], false).XORKeyStream(data[c.ivLength:], data[c.ivLength:])
+	return data
+}
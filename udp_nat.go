@@ -0,0 +1,325 @@
+package shadowsocks
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/auth"
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/udpnat"
+)
+
+// UDPNATService is implemented by services that map packet sessions to handler connections.
+// SetUDPSessionLimit must be called before the service starts serving.
+type UDPNATService interface {
+	// SetUDPSessionLimit bounds the number of packet sessions, evicting the least recently used.
+	// Zero means unbounded.
+	SetUDPSessionLimit(limit int)
+	UDPNATStats() UDPNATStats
+}
+
+type UDPNATStats struct {
+	// Sessions is the number of open sessions.
+	Sessions int
+	// Expired counts sessions closed after udpTimeout without packets.
+	Expired uint64
+	// Evicted counts sessions closed to stay within the session limit.
+	Evicted uint64
+	// Dropped counts packets dropped because the handler of their session was not reading.
+	Dropped uint64
+}
+
+const natQueueSize = 64
+
+// UDPNAT is a sharded replacement of udpnat.Service. Each session is served by one handler goroutine,
+// the number of sessions can be bounded, and packets for a session whose queue is full are dropped
+// instead of blocking the caller.
+type UDPNAT[K comparable] struct {
+	dropped uint64
+	closed  int32
+
+	sessions *SessionTable[K, *natConn]
+	hash     func(K) uint64
+	maxAge   int64
+	handler  udpnat.Handler
+	registry *SessionRegistry
+	janitor  sync.Once
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func NewUDPNAT[K comparable](maxAge int64, handler udpnat.Handler, hash func(K) uint64) *UDPNAT[K] {
+	n := &UDPNAT[K]{
+		hash:    hash,
+		maxAge:  maxAge,
+		handler: handler,
+		done:    make(chan struct{}),
+	}
+	n.SetMaxSessions(0)
+	return n
+}
+
+// SetMaxSessions bounds the number of sessions. It must be called before the NAT is used.
+func (n *UDPNAT[K]) SetMaxSessions(maxSessions int) {
+	n.sessions = NewSessionTable[K, *natConn](n.hash, n.maxAge, maxSessions, func(key K, conn *natConn) {
+		conn.Close()
+	})
+}
+
+// SetSessionRegistry registers sessions to registry, with the user in the context returned by init.
+// It must be called before the NAT is used.
+func (n *UDPNAT[K]) SetSessionRegistry(registry *SessionRegistry) {
+	n.registry = registry
+}
+
+func (n *UDPNAT[K]) Stats() UDPNATStats {
+	return UDPNATStats{
+		Sessions: n.sessions.Len(),
+		Expired:  n.sessions.Expired(),
+		Evicted:  n.sessions.Evicted(),
+		Dropped:  atomic.LoadUint64(&n.dropped),
+	}
+}
+
+// Close closes all sessions and drops packets received after, it returns the number of sessions closed.
+func (n *UDPNAT[K]) Close() int {
+	atomic.StoreInt32(&n.closed, 1)
+	n.doneOnce.Do(func() {
+		close(n.done)
+	})
+	return n.sessions.Clear()
+}
+
+// sweep closes sessions that expired without further packets to their shard, until the NAT is closed.
+func (n *UDPNAT[K]) sweep() {
+	ticker := time.NewTicker(time.Duration(n.maxAge) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.sessions.PurgeExpired()
+		case <-n.done:
+			return
+		}
+	}
+}
+
+func (n *UDPNAT[K]) WriteIsThreadUnsafe() {
+}
+
+func (n *UDPNAT[K]) NewPacket(ctx context.Context, key K, buffer *buf.Buffer, metadata M.Metadata, init func(natConn N.PacketConn) N.PacketWriter) {
+	n.NewContextPacket(ctx, key, buffer, metadata, func(natConn N.PacketConn) (context.Context, N.PacketWriter) {
+		return ctx, init(natConn)
+	})
+}
+
+func (n *UDPNAT[K]) NewContextPacket(ctx context.Context, key K, buffer *buf.Buffer, metadata M.Metadata, init func(natConn N.PacketConn) (context.Context, N.PacketWriter)) {
+	if atomic.LoadInt32(&n.closed) != 0 {
+		buffer.Release()
+		return
+	}
+	if n.maxAge > 0 {
+		n.janitor.Do(func() {
+			go n.sweep()
+		})
+	}
+	c, loaded := n.sessions.LoadOrStore(key, func() *natConn {
+		c := &natConn{
+			data:       make(chan natPacket, natQueueSize),
+			remoteAddr: metadata.Destination,
+		}
+		c.localAddr.Store(metadata.Source)
+		c.ctx, c.cancel = common.ContextWithCancelCause(ctx)
+		c.handlerCtx, c.source = init(c)
+		if n.registry != nil {
+			user, _ := auth.UserFromContext[any](c.handlerCtx)
+			keyIndex, _ := KeyIndexFromContext(c.handlerCtx)
+			c.session = n.registry.RegisterKey(N.NetworkUDP, user, keyIndex, metadata, c)
+		}
+		return c
+	})
+	if !loaded {
+		if atomic.LoadInt32(&n.closed) != 0 {
+			n.sessions.CompareAndDelete(key, c)
+			c.Close()
+			if c.session != nil {
+				c.session.Unregister()
+			}
+			buffer.Release()
+			return
+		}
+		go n.serve(key, c, metadata)
+	} else if c.localAddr.Load().(M.Socksaddr) != metadata.Source {
+		c.localAddr.Store(metadata.Source)
+	}
+	if common.Done(c.ctx) {
+		n.sessions.CompareAndDelete(key, c)
+		if !common.Done(ctx) {
+			n.NewContextPacket(ctx, key, buffer, metadata, init)
+		} else {
+			buffer.Release()
+		}
+		return
+	}
+	packetLen := buffer.Len()
+	select {
+	case c.data <- natPacket{buffer, metadata.Destination}:
+		if c.session != nil {
+			c.session.CountRead(int64(packetLen))
+		}
+	default:
+		buffer.Release()
+		atomic.AddUint64(&n.dropped, 1)
+	}
+}
+
+func (n *UDPNAT[K]) serve(key K, c *natConn, metadata M.Metadata) {
+	err := n.handler.NewPacketConnection(c.handlerCtx, c, metadata)
+	if err != nil {
+		n.handler.NewError(c.handlerCtx, err)
+	}
+	c.Close()
+	n.sessions.CompareAndDelete(key, c)
+	if c.session != nil {
+		c.session.Unregister()
+	}
+}
+
+type natPacket struct {
+	data        *buf.Buffer
+	destination M.Socksaddr
+}
+
+type natConn struct {
+	ctx        context.Context
+	cancel     common.ContextCancelCauseFunc
+	handlerCtx context.Context
+	data       chan natPacket
+	localAddr  atomic.Value
+	remoteAddr M.Socksaddr
+	source     N.PacketWriter
+	session    *RegisteredSession
+	newBuffer  func() *buf.Buffer
+}
+
+var (
+	_ N.PacketConn             = (*natConn)(nil)
+	_ N.ThreadSafePacketReader = (*natConn)(nil)
+	_ N.PacketReadWaiter       = (*natConn)(nil)
+)
+
+func (c *natConn) ReadPacketThreadSafe() (buffer *buf.Buffer, addr M.Socksaddr, err error) {
+	select {
+	case p := <-c.data:
+		return p.data, p.destination, nil
+	case <-c.ctx.Done():
+		return nil, M.Socksaddr{}, io.ErrClosedPipe
+	}
+}
+
+func (c *natConn) ReadPacket(buffer *buf.Buffer) (addr M.Socksaddr, err error) {
+	select {
+	case p := <-c.data:
+		_, err = buffer.ReadOnceFrom(p.data)
+		p.data.Release()
+		return p.destination, err
+	case <-c.ctx.Done():
+		return M.Socksaddr{}, io.ErrClosedPipe
+	}
+}
+
+func (c *natConn) InitializeReadWaiter(newBuffer func() *buf.Buffer) {
+	c.newBuffer = newBuffer
+}
+
+func (c *natConn) WaitReadPacket() (destination M.Socksaddr, err error) {
+	buffer := c.newBuffer()
+	destination, err = c.ReadPacket(buffer)
+	if err != nil {
+		buffer.Release()
+	}
+	return
+}
+
+func (c *natConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	if c.session != nil {
+		c.session.CountWrite(int64(buffer.Len()))
+	}
+	return c.source.WritePacket(buffer, destination)
+}
+
+func (c *natConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	select {
+	case pkt := <-c.data:
+		n = copy(p, pkt.data.Bytes())
+		pkt.data.Release()
+		return n, pkt.destination.UDPAddr(), nil
+	case <-c.ctx.Done():
+		return 0, nil, io.ErrClosedPipe
+	}
+}
+
+func (c *natConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if c.session != nil {
+		c.session.CountWrite(int64(len(p)))
+	}
+	return len(p), c.source.WritePacket(buf.As(p).ToOwned(), M.SocksaddrFromNet(addr))
+}
+
+// Close stops the session and releases the packets still queued.
+func (c *natConn) Close() error {
+	select {
+	case <-c.ctx.Done():
+	default:
+		c.cancel(net.ErrClosed)
+	}
+	for {
+		select {
+		case p := <-c.data:
+			p.data.Release()
+			continue
+		default:
+		}
+		break
+	}
+	if sourceCloser, sourceIsCloser := c.source.(io.Closer); sourceIsCloser {
+		return sourceCloser.Close()
+	}
+	return nil
+}
+
+func (c *natConn) LocalAddr() net.Addr {
+	return c.localAddr.Load().(M.Socksaddr)
+}
+
+func (c *natConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *natConn) SetDeadline(t time.Time) error {
+	return os.ErrInvalid
+}
+
+func (c *natConn) SetReadDeadline(t time.Time) error {
+	return os.ErrInvalid
+}
+
+func (c *natConn) SetWriteDeadline(t time.Time) error {
+	return os.ErrInvalid
+}
+
+func (c *natConn) NeedAdditionalReadDeadline() bool {
+	return true
+}
+
+func (c *natConn) Upstream() any {
+	return c.source
+}
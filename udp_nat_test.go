@@ -0,0 +1,153 @@
+package shadowsocks_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-shadowsocks"
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/udpnat"
+)
+
+func TestSessionTableLimit(t *testing.T) {
+	t.Parallel()
+	const limit = 16
+	var evicted int
+	table := shadowsocks.NewSessionTable[uint64, uint64](shadowsocks.HashUint64, 60, limit, func(key uint64, value uint64) {
+		evicted++
+	})
+	for i := uint64(0); i < 1000; i++ {
+		table.LoadOrStore(i, func() uint64 { return i })
+	}
+	if table.Len() > limit {
+		t.Fatal("sessions above limit: ", table.Len())
+	}
+	if table.Evicted() != uint64(evicted) || evicted != 1000-table.Len() {
+		t.Fatal("bad eviction count: ", table.Evicted(), " ", evicted, " ", table.Len())
+	}
+	if table.Expired() != 0 {
+		t.Fatal("unexpected expiry")
+	}
+	if _, loaded := table.Load(999); !loaded {
+		t.Fatal("most recent session evicted")
+	}
+	if table.CompareAndDelete(999, 0) {
+		t.Fatal("deleted a replaced session")
+	}
+	if !table.CompareAndDelete(999, 999) {
+		t.Fatal("session not deleted")
+	}
+}
+
+func TestUDPNATLimit(t *testing.T) {
+	t.Parallel()
+	const limit = 8
+	handler := &closeCountHandler{closed: make(chan struct{}, 100)}
+	nat := shadowsocks.NewUDPNAT[uint64](60, handler, shadowsocks.HashUint64)
+	nat.SetMaxSessions(limit)
+	for i := uint64(0); i < 100; i++ {
+		nat.NewPacket(context.Background(), i, buf.As([]byte("packet")).ToOwned(), M.Metadata{}, func(natConn N.PacketConn) N.PacketWriter {
+			return &discardPacketConn{}
+		})
+	}
+	stats := nat.Stats()
+	if stats.Sessions > limit || stats.Evicted != uint64(100-stats.Sessions) {
+		t.Fatal("bad stats: ", stats)
+	}
+	for i := uint64(0); i < stats.Evicted; i++ {
+		select {
+		case <-handler.closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("evicted sessions not closed")
+		}
+	}
+}
+
+func TestUDPNATIdleExpiry(t *testing.T) {
+	t.Parallel()
+	handler := &closeCountHandler{closed: make(chan struct{}, 1)}
+	nat := shadowsocks.NewUDPNAT[uint64](1, handler, shadowsocks.HashUint64)
+	defer nat.Close()
+	nat.NewPacket(context.Background(), 1, buf.As([]byte("packet")).ToOwned(), M.Metadata{}, func(natConn N.PacketConn) N.PacketWriter {
+		return &discardPacketConn{}
+	})
+	select {
+	case <-handler.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle session not closed")
+	}
+	if stats := nat.Stats(); stats.Sessions != 0 || stats.Expired != 1 {
+		t.Fatal("bad stats: ", stats)
+	}
+}
+
+func TestUDPNATDrop(t *testing.T) {
+	t.Parallel()
+	handler := &closeCountHandler{hold: make(chan struct{}), closed: make(chan struct{}, 1)}
+	nat := shadowsocks.NewUDPNAT[uint64](60, handler, shadowsocks.HashUint64)
+	for i := 0; i < 100; i++ {
+		nat.NewPacket(context.Background(), 1, buf.As([]byte("packet")).ToOwned(), M.Metadata{}, func(natConn N.PacketConn) N.PacketWriter {
+			return &discardPacketConn{}
+		})
+	}
+	close(handler.hold)
+	if stats := nat.Stats(); stats.Sessions != 1 || stats.Dropped != 100-64 {
+		t.Fatal("bad stats: ", stats)
+	}
+}
+
+// closeCountHandler discards packets until the session is closed, then signals closed.
+// If hold is not nil, it starts reading once hold is closed.
+type closeCountHandler struct {
+	discardHandler
+	hold   chan struct{}
+	closed chan struct{}
+}
+
+func (h *closeCountHandler) NewPacketConnection(ctx context.Context, conn N.PacketConn, metadata M.Metadata) error {
+	if h.hold != nil {
+		<-h.hold
+	}
+	err := h.discardHandler.NewPacketConnection(ctx, conn, metadata)
+	h.closed <- struct{}{}
+	return err
+}
+
+type natService[K comparable] interface {
+	NewPacket(ctx context.Context, key K, buffer *buf.Buffer, metadata M.Metadata, init func(natConn N.PacketConn) N.PacketWriter)
+}
+
+// BenchmarkUDPNAT sends packets of many sessions from parallel goroutines. Run with -cpu 1,4,16 to compare
+// how the sharded NAT and the single locked udpnat.Service scale.
+func BenchmarkUDPNAT(b *testing.B) {
+	b.Run("sharded", func(b *testing.B) {
+		benchmarkUDPNAT(b, shadowsocks.NewUDPNAT[uint64](60, &discardHandler{}, shadowsocks.HashUint64))
+	})
+	b.Run("udpnat", func(b *testing.B) {
+		benchmarkUDPNAT(b, udpnat.New[uint64](60, &discardHandler{}))
+	})
+}
+
+func benchmarkUDPNAT(b *testing.B, nat natService[uint64]) {
+	const sessionsPerWorker = 256
+	var workers uint64
+	init := func(natConn N.PacketConn) N.PacketWriter {
+		return &discardPacketConn{}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		base := atomic.AddUint64(&workers, 1) * sessionsPerWorker
+		var i uint64
+		for pb.Next() {
+			buffer := buf.NewPacket()
+			buffer.Extend(64)
+			nat.NewPacket(context.Background(), base+i%sessionsPerWorker, buffer, M.Metadata{}, init)
+			i++
+		}
+	})
+}
@@ -0,0 +1,78 @@
+package shadowsocks
+
+import (
+	"context"
+
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+var _ UDPNATService = (*UDPServer[int])(nil)
+
+// UDPServer is embedded by services to share their UDP NAT settings and the handling common to all packets:
+// packets are dropped after a shutdown started, and rejected ones are counted and wrapped in ServerPacketError.
+type UDPServer[K comparable] struct {
+	name      string
+	handler   E.Handler
+	udpNat    *UDPNAT[K]
+	lifecycle *Lifecycle
+	metrics   *Metrics
+}
+
+// NewUDPServer creates a UDPServer for the service named name. lifecycle and metrics point to the fields
+// of the service, so that later SetMetrics calls apply.
+func NewUDPServer[K comparable](name string, handler E.Handler, udpNat *UDPNAT[K], lifecycle *Lifecycle, metrics *Metrics) *UDPServer[K] {
+	return &UDPServer[K]{
+		name:      name,
+		handler:   handler,
+		udpNat:    udpNat,
+		lifecycle: lifecycle,
+		metrics:   metrics,
+	}
+}
+
+// SetUDPSessionLimit bounds the number of UDP NAT sessions. Zero means unbounded.
+func (s *UDPServer[K]) SetUDPSessionLimit(limit int) {
+	s.udpNat.SetMaxSessions(limit)
+}
+
+func (s *UDPServer[K]) UDPNATStats() UDPNATStats {
+	return s.udpNat.Stats()
+}
+
+// ServePacket calls serve unless a shutdown started, and returns its error as a ServerPacketError.
+func (s *UDPServer[K]) ServePacket(metadata M.Metadata, serve func() error) error {
+	if s.lifecycle.Closed() {
+		return &ServerPacketError{Source: metadata.Source, Cause: ErrServiceClosed}
+	}
+	err := serve()
+	if err != nil {
+		s.rejected(err)
+		err = &ServerPacketError{Source: metadata.Source, Cause: err}
+	}
+	return err
+}
+
+// ServePackets calls serve for each packet of a batch unless a shutdown started. The buffers of rejected
+// packets are released and their errors passed to the handler.
+func (s *UDPServer[K]) ServePackets(ctx context.Context, buffers []*buf.Buffer, metadata []M.Metadata, serve func(buffer *buf.Buffer, metadata M.Metadata) error) {
+	if s.lifecycle.Closed() {
+		buf.ReleaseMulti(buffers)
+		return
+	}
+	for i, buffer := range buffers {
+		err := serve(buffer, metadata[i])
+		if err != nil {
+			buffer.Release()
+			s.rejected(err)
+			s.handler.NewError(ctx, &ServerPacketError{Source: metadata[i].Source, Cause: err})
+		}
+	}
+}
+
+func (s *UDPServer[K]) rejected(err error) {
+	if metrics := *s.metrics; metrics != nil {
+		metrics.HandshakeRejected(s.name, err)
+	}
+}